@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/brutella/webcam"
+)
+
+// adminHandler serves the api of gokwebcamctl on a unix socket, which
+// is only accessible by the user running the daemon.
+type adminHandler struct {
+	sc     *streamControl
+	fe     *frameEncoder
+	frames *broadcaster
+}
+
+// qualityInfo is the json representation of the jpeg quality.
+type qualityInfo struct {
+	Quality int `json:"quality"` // 0 is the default quality
+}
+
+func (h *adminHandler) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/status", &statsHandler{sc: h.sc})
+	mux.HandleFunc("/clients", h.serveClients)
+	mux.HandleFunc("/clients/", h.serveClients)
+	mux.HandleFunc("/snapshot", h.serveSnapshot)
+	mux.HandleFunc("/quality", h.serveQuality)
+	return mux
+}
+
+// serveClients lists the connected clients (GET /clients)
+// or disconnects a client (DELETE /clients/id).
+func (h *adminHandler) serveClients(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats.connected())
+	case http.MethodDelete:
+		id, err := strconv.ParseUint(strings.TrimPrefix(r.URL.Path, "/clients/"), 10, 64)
+		if err != nil {
+			http.Error(w, "invalid client id", http.StatusBadRequest)
+			return
+		}
+		if !stats.kick(id) {
+			http.Error(w, "client not found", http.StatusNotFound)
+			return
+		}
+		logger.Info("client kicked", "id", id)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.Header().Set("Allow", "GET, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveSnapshot returns the next frame as jpeg.
+func (h *adminHandler) serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	img := h.frames.next()
+	defer img.release()
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(img.Bytes())))
+	w.Header().Set("X-Timestamp", formatTimestamp(img.time))
+	w.Write(img.Bytes())
+}
+
+// serveQuality returns the jpeg quality (GET) and sets it (POST with value),
+// where 0 resets the default quality. The quality applies to the encoder of
+// raw and filtered frames, and to the camera if it encodes jpeg frames.
+func (h *adminHandler) serveQuality(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		quality, err := strconv.Atoi(r.FormValue("value"))
+		if err != nil || quality < 0 || quality > 100 {
+			http.Error(w, "invalid quality", http.StatusBadRequest)
+			return
+		}
+		h.fe.quality.Store(int32(quality))
+		logger.Info("jpeg quality set", "quality", quality)
+
+		format, _, _ := h.sc.current()
+		if quality > 0 && (format == V4L2_PIX_FMT_MJPG || format == V4L2_PIX_FMT_PJPG) {
+			id := webcam.ControlID(webcam.V4L2_CID_JPEG_COMPRESSION_QUALITY)
+			if err := h.sc.cam.SetControl(id, int32(quality)); err != nil {
+				logger.Debug("setting jpeg quality of the camera failed", "err", err)
+			}
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(qualityInfo{Quality: int(h.fe.quality.Load())})
+}
+
+// listenAdmin listens on the unix socket at path,
+// which is only accessible by the current user.
+func listenAdmin(path string) (net.Listener, error) {
+	// remove the socket of a previous run
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// serveAdmin serves h on ln.
+func serveAdmin(ln net.Listener, h http.Handler) {
+	srv := &http.Server{
+		Handler:  h,
+		ErrorLog: log.New(logWriter{}, "", 0),
+	}
+	logger.Info("listening", "addr", ln.Addr(), "proto", "admin")
+	logger.Fatal("admin server failed", "err", srv.Serve(ln))
+}
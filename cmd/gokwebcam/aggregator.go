@@ -0,0 +1,503 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Remote cameras are offline if they didn't send a frame for
+// remoteStale. Streams which stall that long are reconnected.
+const (
+	remoteStale       = 10 * time.Second
+	remoteMaxFrame    = 16 << 20
+	remoteMetricsWait = 5 * time.Second
+)
+
+// remoteCamera is a gokwebcam instance consumed by the aggregator. Its
+// stream is received once and distributed to the clients of the
+// aggregator, so that the remote instance has a single client.
+type remoteCamera struct {
+	name   string
+	url    *url.URL // of the instance, may have a token query parameter
+	stream string   // path of the stream, e.g. /video or /video/sub
+	bc     *broadcaster
+
+	frames atomic.Uint64
+
+	mu      sync.Mutex
+	last    []byte // the last frame
+	updated time.Time
+	err     error // why the stream failed
+}
+
+// parseRemoteCamera parses a remote camera like
+// frontdoor=http://10.0.0.5:8080?token=secret.
+func parseRemoteCamera(s string) (*remoteCamera, error) {
+	name, rawURL, ok := strings.Cut(s, "=")
+	if !ok || name == "" || !validCameraName(name) {
+		return nil, fmt.Errorf("invalid remote camera %q, expected name=url", s)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid url %q of remote camera %s, expected http:// or https://", rawURL, name)
+	}
+	return &remoteCamera{name: name, url: u, stream: "/video", bc: newBroadcaster()}, nil
+}
+
+// endpoint returns the url of the endpoint p of the instance.
+func (c *remoteCamera) endpoint(p string) string {
+	u := *c.url
+	u.Path = path.Join("/", u.Path, p)
+	return u.String()
+}
+
+// redacted returns the url of the instance without credentials.
+func (c *remoteCamera) redacted() string {
+	return redactURL(c.url).Redacted()
+}
+
+// frame returns the last frame, or nil if the camera is offline.
+func (c *remoteCamera) frame() ([]byte, time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.updated) > remoteStale {
+		return nil, c.updated
+	}
+	return c.last, c.updated
+}
+
+// run receives the stream of the instance and reconnects when it fails.
+func (c *remoteCamera) run(client *http.Client) {
+	b := &backoff{min: time.Second, max: time.Minute}
+	for {
+		start := time.Now()
+		err := c.receive(client)
+		c.mu.Lock()
+		c.err = err
+		c.mu.Unlock()
+
+		if time.Since(start) > time.Minute {
+			b.reset()
+		}
+		d := b.next()
+		logger.Warn("remote camera stream failed", "camera", c.name, "url", c.redacted(), "err", err, "retry", d)
+		time.Sleep(d)
+	}
+}
+
+// receive reads the multipart stream of the instance until it fails.
+func (c *remoteCamera) receive(client *http.Client) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint(c.stream), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return unwrapURLError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("remote responded with %s", resp.Status)
+	}
+	_, params, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || params["boundary"] == "" {
+		return errors.New("remote didn't respond with a multipart stream")
+	}
+
+	// the stream is reconnected if it stalls
+	watchdog := time.AfterFunc(remoteStale, cancel)
+	defer watchdog.Stop()
+
+	logger.Info("remote camera connected", "camera", c.name, "url", c.redacted())
+	mr := multipart.NewReader(resp.Body, params["boundary"])
+	for {
+		part, err := mr.NextPart()
+		if err != nil {
+			if ctx.Err() != nil {
+				return errors.New("stream stalled")
+			}
+			return err
+		}
+		data, err := io.ReadAll(io.LimitReader(part, remoteMaxFrame))
+		if err != nil {
+			return err
+		}
+		watchdog.Reset(remoteStale)
+
+		now := time.Now()
+		c.mu.Lock()
+		c.last, c.updated, c.err = data, now, nil
+		c.mu.Unlock()
+
+		buf := newFrameBuffer(0)
+		buf.Write(data)
+		buf.seq, buf.time = c.frames.Add(1), now
+		c.bc.publish(buf)
+	}
+}
+
+// aggregator serves several remote gokwebcam instances: an index of the
+// cameras at /cams, their streams and images at /cams/name/video and
+// /cams/name/image, a mosaic of the cameras at /mosaic and their metrics
+// with a camera label at /metrics.
+type aggregator struct {
+	cams     []*remoteCamera
+	byName   map[string]*remoteCamera
+	client   *http.Client
+	boundary string
+
+	mosaic *mosaic
+}
+
+// aggregatorConfig is the configuration of the aggregator mode.
+type aggregatorConfig struct {
+	cameras     []string    // name=url
+	size        image.Point // of the mosaic
+	fps         float64     // of the mosaic
+	boundary    string
+	middlewares []middleware
+
+	mosaicLayout  string
+	mosaicCameras string // comma separated names, empty for all
+
+	readTimeout, writeTimeout, idleTimeout time.Duration
+	maxHeaderBytes                         int
+}
+
+// runAggregator serves the aggregator on lns until the server fails.
+func runAggregator(lns []net.Listener, cfg aggregatorConfig) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = remoteStale
+	a := &aggregator{
+		byName:   map[string]*remoteCamera{},
+		client:   &http.Client{Transport: transport},
+		boundary: cfg.boundary,
+	}
+	for _, s := range cfg.cameras {
+		c, err := parseRemoteCamera(s)
+		if err != nil {
+			logger.Fatal("invalid flag", "aggregate", s, "err", err)
+		}
+		if _, ok := a.byName[c.name]; ok {
+			logger.Fatal("invalid flag", "aggregate", s, "err", "duplicate camera name")
+		}
+		a.cams = append(a.cams, c)
+		a.byName[c.name] = c
+	}
+	for _, c := range a.cams {
+		go c.run(a.client)
+	}
+	m, err := newMosaic(a.cams, cfg.mosaicCameras, cfg.mosaicLayout, cfg.size, cfg.fps)
+	if err != nil {
+		logger.Fatal("invalid flag", "err", err)
+	}
+	a.mosaic = m
+	go m.compose()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", handleHealthz)
+	mux.HandleFunc("/cams", a.serveIndex)
+	mux.HandleFunc("/cams/", a.serveCamera)
+	mux.HandleFunc("/mosaic", a.serveMosaic)
+	// /grid is the former name of /mosaic
+	mux.HandleFunc("/grid", a.serveMosaic)
+	mux.HandleFunc("/metrics", a.serveMetrics)
+
+	srv := &http.Server{
+		Handler:        chain(mux, cfg.middlewares...),
+		ReadTimeout:    cfg.readTimeout,
+		WriteTimeout:   cfg.writeTimeout,
+		IdleTimeout:    cfg.idleTimeout,
+		MaxHeaderBytes: cfg.maxHeaderBytes,
+		ErrorLog:       log.New(logWriter{}, "", 0),
+	}
+	errs := make(chan error, len(lns))
+	for _, ln := range lns {
+		logger.Info("listening", "addr", ln.Addr(), "cameras", len(a.cams))
+		go func(ln net.Listener) {
+			errs <- srv.Serve(ln)
+		}(ln)
+	}
+	if err := sdNotify("READY=1"); err != nil {
+		logger.Error("notifying systemd failed", "err", err)
+	}
+	logger.Fatal("http server failed", "err", <-errs)
+}
+
+// remoteCameraInfo is the json representation of a remote camera.
+type remoteCameraInfo struct {
+	Name    string     `json:"name"`
+	URL     string     `json:"url"`
+	Online  bool       `json:"online"`
+	Updated *time.Time `json:"updated,omitempty"`
+	Frames  uint64     `json:"frames"`
+	Error   string     `json:"error,omitempty"`
+	Video   string     `json:"video"`
+	Image   string     `json:"image"`
+}
+
+func (a *aggregator) serveIndex(w http.ResponseWriter, r *http.Request) {
+	infos := []remoteCameraInfo{}
+	for _, c := range a.cams {
+		info := remoteCameraInfo{
+			Name:   c.name,
+			URL:    c.redacted(),
+			Frames: c.frames.Load(),
+			Video:  "/cams/" + c.name + "/video",
+			Image:  "/cams/" + c.name + "/image",
+		}
+		c.mu.Lock()
+		if !c.updated.IsZero() {
+			updated := c.updated
+			info.Updated = &updated
+		}
+		info.Online = time.Since(c.updated) <= remoteStale
+		if c.err != nil && !info.Online {
+			info.Error = c.err.Error()
+		}
+		c.mu.Unlock()
+		infos = append(infos, info)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// serveCamera serves the last frame of a camera at /cams/name/image
+// and its stream at /cams/name/video.
+func (a *aggregator) serveCamera(w http.ResponseWriter, r *http.Request) {
+	name, endpoint, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/cams/"), "/")
+	c, ok := a.byName[name]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	switch endpoint {
+	case "image":
+		data, updated := c.frame()
+		if data == nil {
+			serviceUnavailable(w, time.Second)
+			return
+		}
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		w.Header().Set("X-Timestamp", formatTimestamp(updated))
+		w.Write(data)
+	case "video":
+		logger.Info("connect", "remote", r.RemoteAddr, "url", redactURL(r.URL))
+		frames := c.bc.subscribe()
+		defer c.bc.unsubscribe(frames)
+		a.serveStream(w, r, frames)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveStream serves frames as multipart stream until the client disconnects.
+func (a *aggregator) serveStream(w http.ResponseWriter, r *http.Request, frames chan *frameBuffer) {
+	stream(w)
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary="+a.boundary)
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(a.boundary)
+	flusher, _ := w.(http.Flusher)
+	for {
+		var img *frameBuffer
+		select {
+		case <-r.Context().Done():
+			return
+		case img = <-frames:
+		}
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":   []string{"image/jpeg"},
+			"Content-Length": []string{strconv.Itoa(len(img.Bytes()))},
+			"X-Timestamp":    []string{formatTimestamp(img.time)},
+			"X-Sequence":     []string{strconv.FormatUint(img.seq, 10)},
+		})
+		if err == nil {
+			_, err = pw.Write(img.Bytes())
+		}
+		img.release()
+		if err != nil {
+			logger.Debug("writing response failed", "remote", r.RemoteAddr, "err", err)
+			return
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+}
+
+// metricFamily is a metric with its samples in the text format of prometheus.
+type metricFamily struct {
+	help, typ string
+	samples   []string
+}
+
+// serveMetrics serves the metrics of all instances, whose samples are
+// labeled with the name of their camera, and whether they are up.
+func (a *aggregator) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), remoteMetricsWait)
+	defer cancel()
+
+	bodies := make([][]byte, len(a.cams))
+	var wg sync.WaitGroup
+	for i, c := range a.cams {
+		wg.Add(1)
+		go func(i int, c *remoteCamera) {
+			defer wg.Done()
+			b, err := c.metrics(ctx, a.client)
+			if err != nil {
+				logger.Debug("fetching metrics failed", "camera", c.name, "err", err)
+				return
+			}
+			bodies[i] = b
+		}(i, c)
+	}
+	wg.Wait()
+
+	families := map[string]*metricFamily{}
+	var names []string
+	family := func(name string) *metricFamily {
+		f, ok := families[name]
+		if !ok {
+			f = &metricFamily{}
+			families[name] = f
+			names = append(names, name)
+		}
+		return f
+	}
+
+	up := family("gokwebcam_aggregate_up")
+	up.help = "# HELP gokwebcam_aggregate_up Whether the metrics of the camera could be fetched."
+	up.typ = "# TYPE gokwebcam_aggregate_up gauge"
+	online := family("gokwebcam_aggregate_online")
+	online.help = "# HELP gokwebcam_aggregate_online Whether the aggregator receives the stream of the camera."
+	online.typ = "# TYPE gokwebcam_aggregate_online gauge"
+	received := family("gokwebcam_aggregate_frames_received_total")
+	received.help = "# HELP gokwebcam_aggregate_frames_received_total Frames received from the camera."
+	received.typ = "# TYPE gokwebcam_aggregate_frames_received_total counter"
+
+	for i, c := range a.cams {
+		data, _ := c.frame()
+		up.samples = append(up.samples, fmt.Sprintf("gokwebcam_aggregate_up{camera=%q} %d", c.name, boolInt(bodies[i] != nil)))
+		online.samples = append(online.samples, fmt.Sprintf("gokwebcam_aggregate_online{camera=%q} %d", c.name, boolInt(data != nil)))
+		received.samples = append(received.samples, fmt.Sprintf("gokwebcam_aggregate_frames_received_total{camera=%q} %d", c.name, c.frames.Load()))
+
+		current := ""
+		s := bufio.NewScanner(bytes.NewReader(bodies[i]))
+		for s.Scan() {
+			line := s.Text()
+			if rest, ok := strings.CutPrefix(line, "# HELP "); ok {
+				current, _, _ = strings.Cut(rest, " ")
+				if f := family(current); f.help == "" {
+					f.help = line
+				}
+				continue
+			}
+			if rest, ok := strings.CutPrefix(line, "# TYPE "); ok {
+				current, _, _ = strings.Cut(rest, " ")
+				if f := family(current); f.typ == "" {
+					f.typ = line
+				}
+				continue
+			}
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			// samples of histograms, e.g. x_bucket, belong to the family x
+			name := line[:strings.IndexAny(line+" ", "{ ")]
+			if current == "" || !strings.HasPrefix(name, current) {
+				current = name
+			}
+			f := family(current)
+			f.samples = append(f.samples, labelSample(line, name, c.name))
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		f := families[name]
+		if f.help != "" {
+			fmt.Fprintln(w, f.help)
+		}
+		if f.typ != "" {
+			fmt.Fprintln(w, f.typ)
+		}
+		for _, s := range f.samples {
+			fmt.Fprintln(w, s)
+		}
+	}
+}
+
+// metrics returns the metrics of the instance.
+func (c *remoteCamera) metrics(ctx context.Context, client *http.Client) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.endpoint("/metrics"), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, unwrapURLError(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("remote responded with %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, remoteMaxFrame))
+}
+
+// labelSample adds the camera label to the sample line of the metric name,
+// unless the instance labels its metrics itself, see -name.
+func labelSample(line, name, camera string) string {
+	rest := line[len(name):]
+	if strings.HasPrefix(rest, "{") {
+		if strings.Contains(rest, `camera="`) {
+			return line
+		}
+		if strings.HasPrefix(rest, "{}") {
+			return fmt.Sprintf("%s{camera=%q}%s", name, camera, rest[2:])
+		}
+		return fmt.Sprintf("%s{camera=%q,%s", name, camera, rest[1:])
+	}
+	return fmt.Sprintf("%s{camera=%q}%s", name, camera, rest)
+}
+
+// unwrapURLError returns the error of a request without the url,
+// which may have a token.
+func unwrapURLError(err error) error {
+	var ue *url.Error
+	if errors.As(err, &ue) {
+		return ue.Err
+	}
+	return err
+}
+
+func boolInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
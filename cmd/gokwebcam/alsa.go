@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/brutella/webcam/ioctl"
+	"golang.org/x/sys/unix"
+)
+
+// ALSA kernel interface as defined in sound/asound.h
+const (
+	sndPCMAccessRWInterleaved = 3
+	sndPCMFormatS16LE         = 2
+	sndPCMSubformatStd        = 0
+
+	sndPCMParamAccess    = 0
+	sndPCMParamFormat    = 1
+	sndPCMParamSubformat = 2
+
+	// intervals are counted from the first interval param
+	sndPCMParamChannels   = 10 - 8
+	sndPCMParamRate       = 11 - 8
+	sndPCMParamPeriodTime = 12 - 8
+
+	sndIntervalInteger = 1 << 2
+)
+
+type sndMask struct {
+	bits [8]uint32
+}
+
+type sndInterval struct {
+	min, max uint32
+	flags    uint32 // openmin, openmax, integer and empty bits
+}
+
+type sndPCMHwParams struct {
+	flags     uint32
+	masks     [3]sndMask
+	mres      [5]sndMask
+	intervals [12]sndInterval
+	ires      [9]sndInterval
+	rmask     uint32
+	cmask     uint32
+	info      uint32
+	msbits    uint32
+	rateNum   uint32
+	rateDen   uint32
+	fifoSize  uint
+	reserved  [64]byte
+}
+
+type sndXferi struct {
+	result int
+	buf    uintptr
+	frames uint
+}
+
+var (
+	SNDRV_PCM_IOCTL_HW_PARAMS     = ioctl.IoRW(uintptr('A'), 0x11, unsafe.Sizeof(sndPCMHwParams{}))
+	SNDRV_PCM_IOCTL_PREPARE       = ioctl.Io(uintptr('A'), 0x40)
+	SNDRV_PCM_IOCTL_DROP          = ioctl.Io(uintptr('A'), 0x43)
+	SNDRV_PCM_IOCTL_WRITEI_FRAMES = ioctl.IoW(uintptr('A'), 0x50, unsafe.Sizeof(sndXferi{}))
+	SNDRV_PCM_IOCTL_READI_FRAMES  = ioctl.IoR(uintptr('A'), 0x51, unsafe.Sizeof(sndXferi{}))
+)
+
+// alsaPCM is an ALSA pcm device which captures or plays
+// interleaved signed 16 bit little endian samples.
+// It talks to the kernel directly, so only hardware devices
+// and no ALSA plugins are supported.
+type alsaPCM struct {
+	fd       int
+	rate     int
+	channels int
+}
+
+// openALSA opens the device, which is either a path like /dev/snd/pcmC1D0c
+// or a hardware device like hw:1,0.
+func openALSA(device string, capture bool, rate, channels int) (*alsaPCM, error) {
+	path, err := alsaPath(device, capture)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Open(path, unix.O_RDWR|unix.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &sndPCMHwParams{rmask: ^uint32(0)}
+	for i := range p.masks {
+		for j := range p.masks[i].bits {
+			p.masks[i].bits[j] = ^uint32(0)
+		}
+	}
+	for i := range p.intervals {
+		p.intervals[i].max = ^uint32(0)
+	}
+	p.masks[sndPCMParamAccess] = sndMaskOf(sndPCMAccessRWInterleaved)
+	p.masks[sndPCMParamFormat] = sndMaskOf(sndPCMFormatS16LE)
+	p.masks[sndPCMParamSubformat] = sndMaskOf(sndPCMSubformatStd)
+	p.intervals[sndPCMParamChannels] = sndInterval{uint32(channels), uint32(channels), sndIntervalInteger}
+	p.intervals[sndPCMParamRate] = sndInterval{uint32(rate), uint32(rate), sndIntervalInteger}
+	// avoid tiny periods which cause a wakeup every few samples
+	p.intervals[sndPCMParamPeriodTime].min = 10000 // µs
+
+	if err := ioctl.Ioctl(uintptr(fd), SNDRV_PCM_IOCTL_HW_PARAMS, uintptr(unsafe.Pointer(p))); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("%s: %d Hz, %d channels not supported: %w", device, rate, channels, err)
+	}
+	if err := ioctl.Ioctl(uintptr(fd), SNDRV_PCM_IOCTL_PREPARE, 0); err != nil {
+		unix.Close(fd)
+		return nil, err
+	}
+
+	return &alsaPCM{fd: fd, rate: rate, channels: channels}, nil
+}
+
+func sndMaskOf(bit uint) sndMask {
+	var m sndMask
+	m.bits[bit/32] = 1 << (bit % 32)
+	return m
+}
+
+func alsaPath(device string, capture bool) (string, error) {
+	if strings.HasPrefix(device, "/") {
+		return device, nil
+	}
+
+	spec, ok := strings.CutPrefix(device, "hw:")
+	if !ok {
+		return "", fmt.Errorf("invalid alsa device %s, expected hw:card,device", device)
+	}
+	cardStr, devStr, _ := strings.Cut(spec, ",")
+	card, err := strconv.Atoi(cardStr)
+	if err != nil {
+		return "", fmt.Errorf("invalid alsa card %s", cardStr)
+	}
+	dev := 0
+	if devStr != "" {
+		if dev, err = strconv.Atoi(devStr); err != nil {
+			return "", fmt.Errorf("invalid alsa device %s", devStr)
+		}
+	}
+
+	dir := "p"
+	if capture {
+		dir = "c"
+	}
+	return fmt.Sprintf("/dev/snd/pcmC%dD%d%s", card, dev, dir), nil
+}
+
+// frameSize returns the number of bytes of a sample of all channels.
+func (a *alsaPCM) frameSize() int {
+	return 2 * a.channels
+}
+
+// read fills b with captured samples and blocks until b is full.
+// It recovers from overruns, which lose some samples.
+func (a *alsaPCM) read(b []byte) error {
+	return a.transfer(SNDRV_PCM_IOCTL_READI_FRAMES, b)
+}
+
+// write plays the samples in b and blocks until they are queued.
+// It recovers from underruns.
+func (a *alsaPCM) write(b []byte) error {
+	return a.transfer(SNDRV_PCM_IOCTL_WRITEI_FRAMES, b)
+}
+
+func (a *alsaPCM) transfer(op uintptr, b []byte) error {
+	for len(b) >= a.frameSize() {
+		x := &sndXferi{
+			buf:    uintptr(unsafe.Pointer(&b[0])),
+			frames: uint(len(b) / a.frameSize()),
+		}
+		err := ioctl.Ioctl(uintptr(a.fd), op, uintptr(unsafe.Pointer(x)))
+		switch err {
+		case nil:
+			b = b[x.result*a.frameSize():]
+		case syscall.EPIPE:
+			// overrun or underrun
+			if err := ioctl.Ioctl(uintptr(a.fd), SNDRV_PCM_IOCTL_PREPARE, 0); err != nil {
+				return err
+			}
+		case syscall.EINTR, syscall.EAGAIN:
+		default:
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *alsaPCM) close() error {
+	ioctl.Ioctl(uintptr(a.fd), SNDRV_PCM_IOCTL_DROP, 0)
+	return unix.Close(a.fd)
+}
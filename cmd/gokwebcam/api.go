@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// apiPrefix is the prefix of the versioned control endpoints.
+const apiPrefix = "/api/v1"
+
+// apiOperation describes a method of a control endpoint.
+type apiOperation struct {
+	method   string
+	summary  string
+	form     []string    // names of form parameters
+	request  interface{} // value of the json request body, optional
+	response interface{} // value of the json response body, nil for no content
+	status   int         // status of a successful response, default 200
+}
+
+// apiRoute is a control endpoint.
+type apiRoute struct {
+	path string
+	ops  []apiOperation
+}
+
+// api registers control endpoints at their path and under apiPrefix,
+// where errors are returned as json, and serves an OpenAPI document
+// of the endpoints at /api.
+type api struct {
+	mux    *http.ServeMux
+	routes []apiRoute
+}
+
+func newAPI(mux *http.ServeMux) *api {
+	a := &api{mux: mux}
+	mux.HandleFunc("/api", a.serveOpenAPI)
+	mux.HandleFunc(apiPrefix+"/openapi.json", a.serveOpenAPI)
+	return a
+}
+
+// handle registers h for path, e.g. /stats, and for /api/v1/stats.
+func (a *api) handle(path string, h http.Handler, ops ...apiOperation) {
+	a.mux.Handle(path, h)
+	a.mux.Handle(apiPrefix+path, jsonErrors(h))
+	a.routes = append(a.routes, apiRoute{path: path, ops: ops})
+}
+
+// apiError is the json envelope of errors.
+type apiError struct {
+	Error struct {
+		Status  int    `json:"status"`
+		Message string `json:"message"`
+	} `json:"error"`
+}
+
+// jsonErrors converts the plain text errors written
+// by http.Error into json apiErrors.
+func jsonErrors(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ew := &errorWriter{ResponseWriter: w}
+		next.ServeHTTP(ew, r)
+		if ew.status == 0 {
+			return
+		}
+
+		var e apiError
+		e.Error.Status = ew.status
+		e.Error.Message = strings.TrimSpace(ew.body.String())
+
+		h := w.Header()
+		h.Del("Content-Length")
+		h.Del("X-Content-Type-Options")
+		h.Set("Content-Type", "application/json")
+		w.WriteHeader(ew.status)
+		json.NewEncoder(w).Encode(e)
+	})
+}
+
+// errorWriter buffers the body of plain text error responses.
+type errorWriter struct {
+	http.ResponseWriter
+	status int // status of a buffered error
+	body   bytes.Buffer
+}
+
+func (w *errorWriter) WriteHeader(status int) {
+	if status >= 400 && strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain") {
+		w.status = status
+		return
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *errorWriter) Write(b []byte) (int, error) {
+	if w.status != 0 {
+		return w.body.Write(b)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+// serveOpenAPI returns the OpenAPI document of the registered endpoints.
+func (a *api) serveOpenAPI(w http.ResponseWriter, r *http.Request) {
+	paths := map[string]interface{}{}
+	for _, route := range a.routes {
+		item := map[string]interface{}{}
+		for _, op := range route.ops {
+			item[strings.ToLower(op.method)] = op.openAPI()
+		}
+		paths[apiPrefix+route.path] = item
+	}
+
+	doc := map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "gokwebcam",
+			"version": "1",
+		},
+		"paths": paths,
+		"components": map[string]interface{}{
+			"schemas": map[string]interface{}{
+				"Error": jsonSchema(reflect.TypeOf(apiError{})),
+			},
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(doc)
+}
+
+// openAPI returns the OpenAPI operation object of op.
+func (op apiOperation) openAPI() map[string]interface{} {
+	status := op.status
+	if status == 0 {
+		status = http.StatusOK
+	}
+
+	success := map[string]interface{}{"description": http.StatusText(status)}
+	if op.response != nil {
+		success["content"] = map[string]interface{}{
+			"application/json": map[string]interface{}{
+				"schema": jsonSchema(reflect.TypeOf(op.response)),
+			},
+		}
+	}
+	o := map[string]interface{}{
+		"summary": op.summary,
+		"responses": map[string]interface{}{
+			strconv.Itoa(status): success,
+			"default": map[string]interface{}{
+				"description": "Error",
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{
+						"schema": map[string]interface{}{"$ref": "#/components/schemas/Error"},
+					},
+				},
+			},
+		},
+	}
+
+	if op.request != nil {
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": jsonSchema(reflect.TypeOf(op.request)),
+				},
+			},
+		}
+	}
+	if len(op.form) > 0 {
+		props := map[string]interface{}{}
+		for _, name := range op.form {
+			props[name] = map[string]interface{}{"type": "string"}
+		}
+		o["requestBody"] = map[string]interface{}{
+			"required": true,
+			"content": map[string]interface{}{
+				"application/x-www-form-urlencoded": map[string]interface{}{
+					"schema": map[string]interface{}{"type": "object", "properties": props},
+				},
+			},
+		}
+	}
+	return o
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema returns the OpenAPI schema of the json encoding of t.
+func jsonSchema(t reflect.Type) map[string]interface{} {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if t == timeType {
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+	case reflect.Struct:
+		props := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			if name == "-" || !f.IsExported() {
+				continue
+			}
+			if name == "" {
+				name = f.Name
+			}
+			props[name] = jsonSchema(f.Type)
+		}
+		return map[string]interface{}{"type": "object", "properties": props}
+	default:
+		return map[string]interface{}{}
+	}
+}
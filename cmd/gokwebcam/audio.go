@@ -0,0 +1,98 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// audioChunkDuration is the duration of the captured audio chunks.
+const audioChunkDuration = 100 * time.Millisecond
+
+// audioChunk is a chunk of captured samples.
+type audioChunk struct {
+	data []byte
+	time time.Time // capture time of the first sample
+}
+
+// audioFormat describes interleaved signed 16 bit little endian samples.
+type audioFormat struct {
+	rate     int
+	channels int
+}
+
+func (f audioFormat) blockAlign() int {
+	return 2 * f.channels
+}
+
+// audioCapture captures audio from an ALSA device and
+// distributes the chunks to subscribers.
+// Subscribers which are too slow lose chunks.
+type audioCapture struct {
+	device string
+	format audioFormat
+
+	mu   sync.Mutex
+	subs map[chan audioChunk]struct{}
+}
+
+func newAudioCapture(device string, rate, channels int) *audioCapture {
+	return &audioCapture{
+		device: device,
+		format: audioFormat{rate: rate, channels: channels},
+		subs:   make(map[chan audioChunk]struct{}),
+	}
+}
+
+func (ac *audioCapture) subscribe() chan audioChunk {
+	ch := make(chan audioChunk, 16)
+	ac.mu.Lock()
+	ac.subs[ch] = struct{}{}
+	ac.mu.Unlock()
+	return ch
+}
+
+func (ac *audioCapture) unsubscribe(ch chan audioChunk) {
+	ac.mu.Lock()
+	delete(ac.subs, ch)
+	ac.mu.Unlock()
+}
+
+// run captures audio until the program exits.
+// The device is reopened if capturing fails.
+func (ac *audioCapture) run() {
+	for {
+		if err := ac.capture(); err != nil {
+			logger.Error("capturing audio failed", "device", ac.device, "err", err)
+		}
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func (ac *audioCapture) capture() error {
+	pcm, err := openALSA(ac.device, true, ac.format.rate, ac.format.channels)
+	if err != nil {
+		return err
+	}
+	defer pcm.close()
+
+	logger.Info("audio capture started", "device", ac.device, "rate", ac.format.rate, "channels", ac.format.channels)
+
+	size := ac.format.rate * int(audioChunkDuration/time.Millisecond) / 1000 * ac.format.blockAlign()
+	for {
+		b := make([]byte, size)
+		if err := pcm.read(b); err != nil {
+			return err
+		}
+		chunk := audioChunk{data: b, time: time.Now().Add(-audioChunkDuration)}
+
+		ac.mu.Lock()
+		for ch := range ac.subs {
+			select {
+			case ch <- chunk:
+			default:
+				// subscriber is busy
+			}
+		}
+		ac.mu.Unlock()
+	}
+}
@@ -0,0 +1,616 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Authentication modes of endpoints.
+const (
+	authNone   = "none"
+	authDigest = "digest" // http digest authentication
+	authCert   = "cert"   // tls client certificate
+	authToken  = "token"  // viewer or admin token
+	authAny    = "any"    // digest, client certificate or token
+)
+
+// Roles of authenticated clients. Viewers can only watch, e.g. the
+// streams and images, and read the state of the camera. Admins can
+// also change it, e.g. the controls and the format.
+const (
+	roleViewer = "viewer"
+	roleAdmin  = "admin"
+)
+
+// adminPaths are endpoints which require the admin role for any method,
+// because they change the camera or its surroundings although they are
+// requested with GET: /still switches the format of the camera, and
+// /talk plays audio on its speaker. All other endpoints require the
+// admin role for methods other than GET, HEAD and OPTIONS.
+var adminPaths = map[string]bool{
+	"/still": true,
+	"/talk":  true,
+}
+
+// authPolicy maps path prefixes to the authentication mode of the
+// endpoints. The longest matching prefix applies, the mode of all
+// other paths is at "". Prefixes match whole path segments, e.g.
+// /video matches /video and /video/low, but not /videos.
+type authPolicy map[string]string
+
+// parseAuthPolicy parses -auth, which is the mode of all endpoints,
+// e.g. digest, or a list of modes per path prefix, e.g.
+// /video=any,/controls=cert,*=digest.
+func parseAuthPolicy(s string) (authPolicy, error) {
+	p := authPolicy{"": authNone}
+	if s == "" {
+		return p, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		prefix, mode, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			prefix, mode = "", prefix
+		} else if prefix == "*" {
+			prefix = ""
+		} else if !strings.HasPrefix(prefix, "/") {
+			return nil, fmt.Errorf("invalid path %q of auth policy", prefix)
+		}
+		switch mode {
+		case authNone, authDigest, authCert, authToken, authAny:
+		default:
+			return nil, fmt.Errorf("invalid auth mode %q, expected none, digest, cert, token or any", mode)
+		}
+		p[prefix] = mode
+	}
+	return p, nil
+}
+
+// mode returns the authentication mode of path.
+func (p authPolicy) mode(path string) string {
+	best := ""
+	for prefix := range p {
+		if len(prefix) > len(best) && hasPathPrefix(path, prefix) {
+			best = prefix
+		}
+	}
+	return p[best]
+}
+
+// hasPathPrefix returns true if path is prefix or a path below it.
+func hasPathPrefix(path, prefix string) bool {
+	return path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/")
+}
+
+// requires returns true if an endpoint requires the mode.
+func (p authPolicy) requires(modes ...string) bool {
+	for _, m := range p {
+		for _, mode := range modes {
+			if m == mode {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// authInfo identifies the client of an authenticated request.
+type authInfo struct {
+	User   string // the digest user or the common name of the certificate
+	Method string // digest, cert or token
+	Role   string // viewer or admin
+
+	Expires time.Time // of share links, zero if access doesn't expire
+}
+
+// authKey is the context key of the authInfo of a request.
+type authKey struct{}
+
+// requestAuth returns the authInfo of r, or nil if r isn't authenticated.
+func requestAuth(r *http.Request) *authInfo {
+	info, _ := r.Context().Value(authKey{}).(*authInfo)
+	return info
+}
+
+// authenticator authenticates requests by the policy of their path.
+type authenticator struct {
+	policy authPolicy
+	prefix string // stripped from paths before matching, e.g. /cam/name
+
+	realm   string
+	users   map[string]string // ha1 of digest users by name
+	viewers map[string]bool   // digest users and certificates with the viewer role
+	tokens  map[string]string // roles by token
+	shares  *shareLinks       // nil if links can't be shared
+	key     []byte            // signs nonces
+}
+
+// nonceLifetime is how long a digest nonce is valid. Clients
+// retry requests with expired nonces without asking the user.
+const nonceLifetime = 5 * time.Minute
+
+func newAuthenticator(policy authPolicy, prefix, realm string) (*authenticator, error) {
+	a := &authenticator{policy: policy, prefix: prefix, realm: realm, users: map[string]string{}, viewers: map[string]bool{}, tokens: map[string]string{}, key: make([]byte, 32)}
+	if _, err := rand.Read(a.key); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// loadUsers reads the digest users from a file in the format of htdigest,
+// which has lines of user:realm:ha1. Users of other realms are ignored.
+func (a *authenticator) loadUsers(file string) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+	for n := 1; s.Scan(); n++ {
+		line := strings.TrimSpace(s.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.Split(line, ":")
+		if len(parts) != 3 || len(parts[2]) != 32 {
+			return fmt.Errorf("%s:%d: expected user:realm:ha1", file, n)
+		}
+		if parts[1] == a.realm {
+			a.users[parts[0]] = strings.ToLower(parts[2])
+		}
+	}
+	if err := s.Err(); err != nil {
+		return err
+	}
+	if len(a.users) == 0 {
+		return fmt.Errorf("%s: no users of realm %q", file, a.realm)
+	}
+	return nil
+}
+
+// addToken adds a token of role.
+func (a *authenticator) addToken(token, role string) error {
+	if len(token) < 16 {
+		return fmt.Errorf("%s token is shorter than 16 characters", role)
+	}
+	if _, ok := a.tokens[token]; ok {
+		return fmt.Errorf("%s token is already used", role)
+	}
+	a.tokens[token] = role
+	return nil
+}
+
+// policyPath returns the path which the policy and the admin role are
+// matched against, without the prefix of the camera and the api, e.g.
+// /video for /cam/name/api/v1/video. The prefixes are trimmed until the
+// path doesn't change, so that repeating them, e.g. in
+// /cam/name/cam/name/video, can't hide the endpoint from the policy.
+func (a *authenticator) policyPath(path string) string {
+	for {
+		p := path
+		if a.prefix != "" && (p == a.prefix || strings.HasPrefix(p, a.prefix+"/")) {
+			p = strings.TrimPrefix(p, a.prefix)
+		}
+		if p == apiPrefix || strings.HasPrefix(p, apiPrefix+"/") {
+			p = strings.TrimPrefix(p, apiPrefix)
+		}
+		if p == path {
+			break
+		}
+		path = p
+	}
+	if path == "" {
+		path = "/"
+	}
+	return path
+}
+
+// requiresAdmin returns true if requests of method to path require the
+// admin role. The path is matched as it is routed, e.g. /still for
+// /cam/name/cam/name/still.
+func (a *authenticator) requiresAdmin(method, path string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return adminPaths[a.policyPath(path)]
+	}
+	return true
+}
+
+func (a *authenticator) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path := a.policyPath(r.URL.Path)
+		mode := a.policy.mode(path)
+		if mode == authNone {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		info, stale := a.authenticate(r, path, mode)
+		if info == nil {
+			switch mode {
+			case authCert:
+				http.Error(w, "client certificate required", http.StatusForbidden)
+				return
+			case authToken:
+				w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, a.realm))
+			case authDigest:
+				w.Header().Set("WWW-Authenticate", a.challenge(stale))
+			case authAny:
+				w.Header().Add("WWW-Authenticate", a.challenge(stale))
+				w.Header().Add("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s"`, a.realm))
+			}
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if info.Role != roleAdmin && a.requiresAdmin(r.Method, r.URL.Path) {
+			logger.Warn("admin role required", "remote", r.RemoteAddr, "method", r.Method, "url", redactURL(r.URL), "user", info.User)
+			http.Error(w, "admin role required", http.StatusForbidden)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), authKey{}, info)
+		if !info.Expires.IsZero() {
+			// streams of share links end when they expire
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithDeadline(ctx, info.Expires)
+			defer cancel()
+		}
+		r = r.WithContext(ctx)
+
+		// handlers don't see the secrets, e.g. in links they build
+		q := r.URL.Query()
+		if q.Has("token") || q.Has("share") {
+			q.Del("token")
+			q.Del("share")
+			u := *r.URL
+			u.RawQuery = q.Encode()
+			r.URL = &u
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// authenticate returns the client of r authenticated by a share link
+// or the methods of mode, or nil and whether digest credentials had an
+// expired nonce.
+func (a *authenticator) authenticate(r *http.Request, path, mode string) (*authInfo, bool) {
+	if share := r.URL.Query().Get("share"); share != "" && a.shares != nil && sharedPath(path) {
+		expires, err := a.shares.verify(path, share)
+		if err == nil {
+			return &authInfo{User: "share", Method: "share", Role: roleViewer, Expires: expires}, false
+		}
+		logger.Warn("authentication failed", "remote", r.RemoteAddr, "url", redactURL(r.URL), "err", err)
+	}
+	if mode == authCert || mode == authAny {
+		if info := clientCertificate(r); info != nil {
+			info.Role = a.userRole(info.User)
+			return info, false
+		}
+	}
+	if mode == authToken || mode == authAny {
+		info, err := a.token(r)
+		if err == nil {
+			return info, false
+		}
+		if err != errNoCredentials {
+			logger.Warn("authentication failed", "remote", r.RemoteAddr, "url", redactURL(r.URL), "err", err)
+		}
+	}
+	if mode == authDigest || mode == authAny {
+		info, err := a.digest(r)
+		if err == nil {
+			info.Role = a.userRole(info.User)
+			return info, false
+		}
+		if err != errNoCredentials {
+			logger.Warn("authentication failed", "remote", r.RemoteAddr, "url", redactURL(r.URL), "err", err)
+		}
+		return nil, err == errStaleNonce
+	}
+	return nil, false
+}
+
+// userRole returns the role of a digest user or certificate.
+func (a *authenticator) userRole(user string) string {
+	if a.viewers[user] {
+		return roleViewer
+	}
+	return roleAdmin
+}
+
+// token returns the client of the token of r, which is sent in the
+// Authorization header as bearer token, or as token query parameter
+// by clients which can't set headers, e.g. img elements and websockets.
+func (a *authenticator) token(r *http.Request) (*authInfo, error) {
+	token := r.URL.Query().Get("token")
+	if scheme, t, ok := strings.Cut(r.Header.Get("Authorization"), " "); ok && strings.EqualFold(scheme, "Bearer") {
+		token = t
+	}
+	if token == "" {
+		return nil, errNoCredentials
+	}
+	// all tokens are compared, so that the time
+	// doesn't tell which part of a token matched
+	role := ""
+	for t, rl := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			role = rl
+		}
+	}
+	if role == "" {
+		return nil, errors.New("invalid token")
+	}
+	return &authInfo{User: role, Method: authToken, Role: role}, nil
+}
+
+// clientCertificate returns the client of r
+// if it sent a verified certificate.
+func clientCertificate(r *http.Request) *authInfo {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 {
+		return nil
+	}
+	return &authInfo{User: r.TLS.VerifiedChains[0][0].Subject.CommonName, Method: authCert}
+}
+
+var (
+	errNoCredentials = errors.New("no credentials")
+	errStaleNonce    = errors.New("stale nonce")
+)
+
+// challenge returns the WWW-Authenticate header of a digest challenge.
+func (a *authenticator) challenge(stale bool) string {
+	h := fmt.Sprintf(`Digest realm="%s", qop="auth", algorithm=MD5, nonce="%s"`, a.realm, a.nonce(time.Now()))
+	if stale {
+		h += ", stale=true"
+	}
+	return h
+}
+
+// nonce returns a nonce of the time t, which is signed so
+// that nonces don't have to be stored to verify them.
+func (a *authenticator) nonce(t time.Time) string {
+	b := binary.BigEndian.AppendUint64(nil, uint64(t.UnixNano()))
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write(b)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(b)[:24])
+}
+
+// verifyNonce returns an error if nonce
+// wasn't issued by a or is expired.
+func (a *authenticator) verifyNonce(nonce string) error {
+	b, err := base64.RawURLEncoding.DecodeString(nonce)
+	if err != nil || len(b) != 24 {
+		return errors.New("invalid nonce")
+	}
+	t := time.Unix(0, int64(binary.BigEndian.Uint64(b)))
+	if !hmac.Equal([]byte(a.nonce(t)), []byte(nonce)) {
+		return errors.New("invalid nonce")
+	}
+	if time.Since(t) > nonceLifetime {
+		return errStaleNonce
+	}
+	return nil
+}
+
+// digest verifies the digest credentials of r (RFC 7616) with MD5,
+// which is the algorithm supported by NVRs. The nonce count isn't
+// checked, replayed requests are accepted until the nonce expires.
+func (a *authenticator) digest(r *http.Request) (*authInfo, error) {
+	scheme, params, _ := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !strings.EqualFold(scheme, "Digest") {
+		return nil, errNoCredentials
+	}
+	p := parseAuthParams(params)
+
+	ha1, ok := a.users[p["username"]]
+	if !ok || p["realm"] != a.realm {
+		return nil, fmt.Errorf("unknown user %q", p["username"])
+	}
+	if p["uri"] != r.RequestURI {
+		return nil, errors.New("uri doesn't match the request")
+	}
+	if alg := p["algorithm"]; alg != "" && !strings.EqualFold(alg, "MD5") {
+		return nil, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+	if err := a.verifyNonce(p["nonce"]); err != nil {
+		return nil, err
+	}
+
+	ha2 := md5Hex(r.Method + ":" + p["uri"])
+	var want string
+	switch p["qop"] {
+	case "auth":
+		want = md5Hex(strings.Join([]string{ha1, p["nonce"], p["nc"], p["cnonce"], "auth", ha2}, ":"))
+	case "":
+		want = md5Hex(ha1 + ":" + p["nonce"] + ":" + ha2)
+	default:
+		return nil, fmt.Errorf("unsupported qop %q", p["qop"])
+	}
+	if subtle.ConstantTimeCompare([]byte(want), []byte(strings.ToLower(p["response"]))) != 1 {
+		return nil, fmt.Errorf("wrong password of user %q", p["username"])
+	}
+	return &authInfo{User: p["username"], Method: authDigest}, nil
+}
+
+// parseAuthParams parses the comma separated
+// key=value or key="value" parameters of a header.
+func parseAuthParams(s string) map[string]string {
+	params := map[string]string{}
+	for s != "" {
+		s = strings.TrimLeft(s, " ,")
+		key, rest, ok := strings.Cut(s, "=")
+		if !ok {
+			break
+		}
+		key = strings.ToLower(strings.TrimSpace(key))
+		var value string
+		if strings.HasPrefix(rest, `"`) {
+			// quoted values may contain commas and escaped quotes
+			var b strings.Builder
+			i := 1
+			for ; i < len(rest) && rest[i] != '"'; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				b.WriteByte(rest[i])
+			}
+			if i < len(rest) {
+				i++ // closing quote
+			}
+			value, s = b.String(), rest[i:]
+		} else {
+			value, s, _ = strings.Cut(rest, ",")
+			value = strings.TrimSpace(value)
+		}
+		params[key] = value
+	}
+	return params
+}
+
+func md5Hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// authFlags are the flags of the tls and the authentication of the http server.
+type authFlags struct {
+	mode, realm, users, viewers  string
+	viewerTokens, adminTokens    []string
+	tlsCert, tlsKey, tlsClientCA string
+	shareMax                     time.Duration
+	shareSecret                  string
+}
+
+// setup wraps the tcp listeners of lns with tls, and returns the policy of
+// -auth and the authenticator, which is nil if no endpoint requires
+// authentication. The prefix is stripped from paths before matching them
+// with the policy. It exits if the flags are invalid.
+func (f authFlags) setup(lns []net.Listener, prefix string) (authPolicy, *authenticator) {
+	policy, err := parseAuthPolicy(f.mode)
+	if err != nil {
+		logger.Fatal("invalid flag", "auth", f.mode, "err", err)
+	}
+	if (f.tlsCert != "") != (f.tlsKey != "") {
+		logger.Fatal("invalid flag", "err", "-tls-cert and -tls-key must be used together")
+	}
+	if policy.requires(authCert) && f.tlsClientCA == "" {
+		logger.Fatal("invalid flag", "err", "-auth cert requires -tls-cert, -tls-key and -tls-client-ca")
+	}
+	if policy.requires(authDigest) && f.users == "" {
+		logger.Fatal("invalid flag", "err", "-auth digest requires -auth-users")
+	}
+	if policy.requires(authToken) && len(f.viewerTokens)+len(f.adminTokens) == 0 {
+		logger.Fatal("invalid flag", "err", "-auth token requires -viewer-token or -admin-token")
+	}
+	if policy.requires(authAny) && f.tlsClientCA == "" && f.users == "" && len(f.viewerTokens)+len(f.adminTokens) == 0 {
+		logger.Fatal("invalid flag", "err", "-auth any requires -tls-client-ca, -auth-users, -viewer-token or -admin-token")
+	}
+	if f.tlsClientCA != "" && f.tlsCert == "" {
+		logger.Fatal("invalid flag", "err", "-tls-client-ca requires -tls-cert and -tls-key")
+	}
+	if f.tlsCert != "" {
+		// certificates are read before the sandbox is applied
+		tlsConfig, err := serverTLS(f.tlsCert, f.tlsKey, f.tlsClientCA)
+		if err != nil {
+			logger.Fatal("loading tls certificate failed", "err", err)
+		}
+		for i, ln := range lns {
+			// unix sockets are only accessible locally and stay plain
+			if ln.Addr().Network() == "tcp" {
+				lns[i] = tls.NewListener(ln, tlsConfig)
+			}
+		}
+	}
+	if !policy.requires(authDigest, authCert, authToken, authAny) {
+		return policy, nil
+	}
+	auth, err := newAuthenticator(policy, prefix, f.realm)
+	if err != nil {
+		logger.Fatal("creating authenticator failed", "err", err)
+	}
+	if f.users != "" {
+		if err := auth.loadUsers(f.users); err != nil {
+			logger.Fatal("loading users failed", "err", err)
+		}
+	}
+	auth.shares = &shareLinks{key: auth.key, max: f.shareMax}
+	if f.shareSecret != "" {
+		auth.shares.key = []byte(f.shareSecret)
+	}
+	for _, user := range strings.Split(f.viewers, ",") {
+		if user = strings.TrimSpace(user); user != "" {
+			auth.viewers[user] = true
+		}
+	}
+	for _, t := range f.viewerTokens {
+		if err := auth.addToken(t, roleViewer); err != nil {
+			logger.Fatal("invalid flag", "err", err)
+		}
+	}
+	for _, t := range f.adminTokens {
+		if err := auth.addToken(t, roleAdmin); err != nil {
+			logger.Fatal("invalid flag", "err", err)
+		}
+	}
+	logger.Info("authentication enabled", "policy", policy)
+	return policy, auth
+}
+
+// serverTLS returns the tls config of the http server with the
+// certificate of certFile and keyFile. If caFile is not empty, clients
+// can authenticate with certificates signed by its certificates.
+func serverTLS(certFile, keyFile, caFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{Certificates: []tls.Certificate{cert}}
+	if caFile == "" {
+		return cfg, nil
+	}
+
+	b, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("%s: no certificates", caFile)
+	}
+	// certificates are optional for the handshake, because
+	// endpoints may not require them, see authPolicy
+	cfg.ClientCAs = pool
+	cfg.ClientAuth = tls.VerifyClientCertIfGiven
+	return cfg, nil
+}
+
+// String returns the modes of p sorted by prefix, e.g. for logging.
+func (p authPolicy) String() string {
+	var parts []string
+	for prefix, mode := range p {
+		if prefix == "" {
+			prefix = "*"
+		}
+		parts = append(parts, prefix+"="+mode)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
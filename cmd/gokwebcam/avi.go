@@ -0,0 +1,269 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"time"
+)
+
+// aviWriter writes jpeg frames as MJPEG video and optionally
+// pcm audio into an AVI file.
+// The header is written with placeholders which are filled in by Close.
+type aviWriter struct {
+	w             io.WriteSeeker
+	width, height uint32
+	fps           float64
+	audio         *audioFormat
+
+	movi       int64 // offset of the movi list
+	offset     int64 // current offset
+	index      []aviIndexEntry
+	frames     uint32
+	max        uint32 // largest frame size
+	audioStrh  int64  // offset of the audio strh data
+	audioBytes uint32
+	audioMax   uint32 // largest audio chunk size
+}
+
+type aviIndexEntry struct {
+	id     string
+	offset uint32 // relative to the movi fourcc
+	size   uint32
+}
+
+const (
+	aviHeaderFlagHasIndex = 0x10
+	aviIndexKeyframe      = 0x10
+)
+
+// newAVIWriter returns a writer of an AVI file with a video stream
+// and an audio stream, if audio is not nil.
+func newAVIWriter(w io.WriteSeeker, width, height uint32, fps float64, audio *audioFormat) (*aviWriter, error) {
+	if fps <= 0 {
+		return nil, errors.New("invalid frame rate")
+	}
+	a := &aviWriter{w: w, width: width, height: height, fps: fps, audio: audio}
+	if err := a.writeHeader(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// WriteFrame appends a jpeg frame.
+func (a *aviWriter) WriteFrame(jpeg []byte) error {
+	a.index = append(a.index, aviIndexEntry{
+		id:     "00dc",
+		offset: uint32(a.offset - a.movi - 8),
+		size:   uint32(len(jpeg)),
+	})
+	a.frames++
+	if uint32(len(jpeg)) > a.max {
+		a.max = uint32(len(jpeg))
+	}
+	return a.chunk("00dc", jpeg)
+}
+
+// WriteAudio appends pcm samples to the audio stream.
+func (a *aviWriter) WriteAudio(pcm []byte) error {
+	if a.audio == nil {
+		return errors.New("avi has no audio stream")
+	}
+	a.index = append(a.index, aviIndexEntry{
+		id:     "01wb",
+		offset: uint32(a.offset - a.movi - 8),
+		size:   uint32(len(pcm)),
+	})
+	a.audioBytes += uint32(len(pcm))
+	if uint32(len(pcm)) > a.audioMax {
+		a.audioMax = uint32(len(pcm))
+	}
+	return a.chunk("01wb", pcm)
+}
+
+// Close writes the index and updates the header.
+// It doesn't close the underlying writer.
+func (a *aviWriter) Close() error {
+	moviEnd := a.offset
+
+	idx := make([]byte, 0, 16*len(a.index))
+	for _, e := range a.index {
+		idx = append(idx, e.id...)
+		idx = binary.LittleEndian.AppendUint32(idx, aviIndexKeyframe)
+		idx = binary.LittleEndian.AppendUint32(idx, e.offset)
+		idx = binary.LittleEndian.AppendUint32(idx, e.size)
+	}
+	if err := a.chunk("idx1", idx); err != nil {
+		return err
+	}
+	end := a.offset
+
+	// update the header
+	frames := a.frames
+	type patch struct {
+		offset int64
+		value  uint32
+	}
+	patches := []patch{
+		{4, uint32(end - 8)},                       // RIFF size
+		{32 + 16, frames},                          // avih total frames
+		{32 + 28, a.max},                           // avih suggested buffer size
+		{aviStrhOffset + 32, frames},               // strh length
+		{aviStrhOffset + 36, a.max},                // strh suggested buffer size
+		{a.movi + 4, uint32(moviEnd - a.movi - 8)}, // movi size
+	}
+	if a.audio != nil {
+		patches = append(patches,
+			patch{a.audioStrh + 32, a.audioBytes / uint32(a.audio.blockAlign())}, // strh length
+			patch{a.audioStrh + 36, a.audioMax},                                  // strh suggested buffer size
+		)
+	}
+	for _, p := range patches {
+		if _, err := a.w.Seek(p.offset, io.SeekStart); err != nil {
+			return err
+		}
+		if err := binary.Write(a.w, binary.LittleEndian, p.value); err != nil {
+			return err
+		}
+	}
+	_, err := a.w.Seek(end, io.SeekStart)
+	return err
+}
+
+// offset of the strh data in the file
+const aviStrhOffset = 12 + 12 + 8 + 56 + 12 + 8
+
+func (a *aviWriter) writeHeader() error {
+	le := binary.LittleEndian
+	usPerFrame := uint32(float64(time.Second/time.Microsecond) / a.fps)
+	streams := 1
+	if a.audio != nil {
+		streams = 2
+	}
+
+	// main header
+	avih := make([]byte, 0, 56)
+	avih = le.AppendUint32(avih, usPerFrame)
+	avih = le.AppendUint32(avih, 0) // max bytes per sec
+	avih = le.AppendUint32(avih, 0) // padding granularity
+	avih = le.AppendUint32(avih, aviHeaderFlagHasIndex)
+	avih = le.AppendUint32(avih, 0) // total frames
+	avih = le.AppendUint32(avih, 0) // initial frames
+	avih = le.AppendUint32(avih, uint32(streams))
+	avih = le.AppendUint32(avih, 0) // suggested buffer size
+	avih = le.AppendUint32(avih, a.width)
+	avih = le.AppendUint32(avih, a.height)
+	avih = append(avih, make([]byte, 16)...)
+
+	// stream header
+	strh := make([]byte, 0, 56)
+	strh = append(strh, "vidsMJPG"...)
+	strh = le.AppendUint32(strh, 0) // flags
+	strh = le.AppendUint32(strh, 0) // priority and language
+	strh = le.AppendUint32(strh, 0) // initial frames
+	strh = le.AppendUint32(strh, 1000)
+	strh = le.AppendUint32(strh, uint32(a.fps*1000))
+	strh = le.AppendUint32(strh, 0)          // start
+	strh = le.AppendUint32(strh, 0)          // length
+	strh = le.AppendUint32(strh, 0)          // suggested buffer size
+	strh = le.AppendUint32(strh, 0xffffffff) // quality
+	strh = le.AppendUint32(strh, 0)          // sample size
+	strh = le.AppendUint16(strh, 0)
+	strh = le.AppendUint16(strh, 0)
+	strh = le.AppendUint16(strh, uint16(a.width))
+	strh = le.AppendUint16(strh, uint16(a.height))
+
+	// stream format
+	strf := make([]byte, 0, 40)
+	strf = le.AppendUint32(strf, 40)
+	strf = le.AppendUint32(strf, a.width)
+	strf = le.AppendUint32(strf, a.height)
+	strf = le.AppendUint16(strf, 1)  // planes
+	strf = le.AppendUint16(strf, 24) // bit count
+	strf = append(strf, "MJPG"...)
+	strf = le.AppendUint32(strf, a.width*a.height*3)
+	strf = append(strf, make([]byte, 16)...)
+
+	strl := list("strl", chunk("strh", strh), chunk("strf", strf))
+	hdrl := []byte("hdrl")
+	hdrl = append(hdrl, chunk("avih", avih)...)
+	hdrl = append(hdrl, strl...)
+
+	if a.audio != nil {
+		blockAlign := uint32(a.audio.blockAlign())
+		rate := uint32(a.audio.rate)
+
+		strh := make([]byte, 0, 56)
+		strh = append(strh, "auds\x00\x00\x00\x00"...)
+		strh = le.AppendUint32(strh, 0) // flags
+		strh = le.AppendUint32(strh, 0) // priority and language
+		strh = le.AppendUint32(strh, 0) // initial frames
+		strh = le.AppendUint32(strh, blockAlign)
+		strh = le.AppendUint32(strh, rate*blockAlign)
+		strh = le.AppendUint32(strh, 0)          // start
+		strh = le.AppendUint32(strh, 0)          // length
+		strh = le.AppendUint32(strh, 0)          // suggested buffer size
+		strh = le.AppendUint32(strh, 0xffffffff) // quality
+		strh = le.AppendUint32(strh, blockAlign) // sample size
+		strh = append(strh, make([]byte, 8)...)
+
+		// WAVEFORMATEX of pcm samples
+		strf := make([]byte, 0, 18)
+		strf = le.AppendUint16(strf, 1) // pcm
+		strf = le.AppendUint16(strf, uint16(a.audio.channels))
+		strf = le.AppendUint32(strf, rate)
+		strf = le.AppendUint32(strf, rate*blockAlign)
+		strf = le.AppendUint16(strf, uint16(blockAlign))
+		strf = le.AppendUint16(strf, 16) // bits per sample
+		strf = le.AppendUint16(strf, 0)
+
+		// offset of the strh data of the audio stream list
+		a.audioStrh = int64(12 + 8 + len(hdrl) + 12 + 8)
+		hdrl = append(hdrl, list("strl", chunk("strh", strh), chunk("strf", strf))...)
+	}
+	hdrl = chunk("LIST", hdrl)
+
+	riff := append([]byte("RIFF\x00\x00\x00\x00AVI "), hdrl...)
+	if _, err := a.w.Write(riff); err != nil {
+		return err
+	}
+	a.offset = int64(len(riff))
+
+	a.movi = a.offset
+	if _, err := a.w.Write([]byte("LIST\x00\x00\x00\x00movi")); err != nil {
+		return err
+	}
+	a.offset += 12
+
+	return nil
+}
+
+// chunk writes a chunk which is padded to an even size.
+func (a *aviWriter) chunk(id string, data []byte) error {
+	b := chunk(id, data)
+	if _, err := a.w.Write(b); err != nil {
+		return err
+	}
+	a.offset += int64(len(b))
+	return nil
+}
+
+func chunk(id string, data []byte) []byte {
+	b := make([]byte, 0, 8+len(data)+1)
+	b = append(b, id...)
+	b = binary.LittleEndian.AppendUint32(b, uint32(len(data)))
+	b = append(b, data...)
+	if len(data)%2 == 1 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+func list(typ string, chunks ...[]byte) []byte {
+	var data []byte
+	data = append(data, typ...)
+	for _, c := range chunks {
+		data = append(data, c...)
+	}
+	return chunk("LIST", data)
+}
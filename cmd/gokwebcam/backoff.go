@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// backoff is an exponential backoff for retrying failed operations.
+type backoff struct {
+	min, max time.Duration
+	current  time.Duration
+}
+
+// next returns the duration to wait before the next attempt,
+// which doubles with every call up to the max.
+func (b *backoff) next() time.Duration {
+	switch {
+	case b.current == 0:
+		b.current = b.min
+	case b.current < b.max:
+		b.current *= 2
+		if b.current > b.max {
+			b.current = b.max
+		}
+	}
+	return b.current
+}
+
+// reset starts over with the min duration after an operation succeeded.
+func (b *backoff) reset() {
+	b.current = 0
+}
+
+// retry calls f until it succeeds, fails with an error which is not
+// recoverable or failed attempts times, and returns the last error.
+// It waits between attempts as set by b.
+func retry(attempts int, b *backoff, msg string, f func() error) error {
+	b.reset()
+	for i := 1; ; i++ {
+		err := f()
+		if err == nil || !recoverable(err) || i >= attempts {
+			return err
+		}
+		d := b.next()
+		logger.Warn(msg, "err", err, "attempt", i, "retry", d)
+		time.Sleep(d)
+	}
+}
+
+// recoverable returns false for errors which won't go away by
+// retrying, e.g. because the camera was unplugged or doesn't
+// support a setting. Other errors, like EIO or EBUSY, are
+// assumed to be transient.
+func recoverable(err error) bool {
+	var errno syscall.Errno
+	if errors.As(err, &errno) {
+		switch errno {
+		case unix.ENODEV, unix.ENXIO, unix.ENOENT, unix.EACCES, unix.EPERM, unix.EINVAL, unix.ENOTTY:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image/jpeg"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseBandwidthCaps parses the caps of -max-kbps, which is a cap for
+// every stream, e.g. 500, or a list of caps per endpoint, e.g.
+// /video=500,/ws=200. The cap of all other endpoints is stored at "".
+func parseBandwidthCaps(s string) (map[string]int, error) {
+	caps := map[string]int{}
+	if s == "" {
+		return caps, nil
+	}
+	for _, part := range strings.Split(s, ",") {
+		endpoint, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok {
+			endpoint, value = "", endpoint
+		} else if endpoint != "/video" && endpoint != "/ws" && !strings.HasPrefix(endpoint, "/video/") {
+			return nil, fmt.Errorf("invalid endpoint %q of bandwidth cap, expected /video, /video/name or /ws", endpoint)
+		}
+		kbps, err := strconv.Atoi(value)
+		if err != nil || kbps <= 0 {
+			return nil, fmt.Errorf("invalid bandwidth cap %q", part)
+		}
+		caps[endpoint] = kbps
+	}
+	return caps, nil
+}
+
+// The quality of re-encoded frames is lowered in steps
+// down to bandwidthMinQuality while frames are dropped.
+const (
+	bandwidthMaxQuality  = 60
+	bandwidthMinQuality  = 30
+	bandwidthQualityStep = 10
+)
+
+// bandwidthLimiter keeps the stream of a subscriber under a byte rate,
+// e.g. for clients connected over LTE. Frames are sent while there is
+// budget left, which can go into debt to send frames larger than a
+// second of the rate, and dropped until the debt is paid off. If frames are dropped frequently, they are re-encoded
+// with a lower quality, which is raised again once they fit the budget.
+// A nil limiter passes all frames.
+type bandwidthLimiter struct {
+	rate    float64 // in bytes per second
+	tokens  float64 // bytes which can be sent, up to a second of the rate, negative in debt
+	last    time.Time
+	dropped float64 // moving average of the fraction of dropped frames
+	quality int     // of re-encoded frames, 0 sends frames unchanged
+
+	buf bytes.Buffer
+}
+
+// newBandwidthLimiter returns a limiter for kbps,
+// or nil if kbps is not positive.
+func newBandwidthLimiter(kbps int) *bandwidthLimiter {
+	if kbps <= 0 {
+		return nil
+	}
+	rate := float64(kbps) * 1000 / 8
+	return &bandwidthLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// frame returns the data of img to send, or nil to drop it.
+// The data is only valid until the next call.
+func (l *bandwidthLimiter) frame(img *frameBuffer) []byte {
+	if l == nil {
+		return img.Bytes()
+	}
+
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.rate {
+		l.tokens = l.rate
+	}
+	l.last = now
+
+	data := img.Bytes()
+	if l.quality > 0 {
+		if b, err := l.reencode(data); err == nil {
+			data = b
+		} else {
+			logger.Debug("re-encoding frame failed", "err", err)
+		}
+	}
+
+	if l.tokens > 0 {
+		l.tokens -= float64(len(data))
+		l.dropped *= 0.9
+		if l.quality > 0 && l.dropped < 0.05 {
+			// frames fit the budget, try a higher quality
+			if l.quality += bandwidthQualityStep; l.quality > bandwidthMaxQuality {
+				l.quality = 0
+			}
+			l.dropped = 0.25
+			logger.Debug("raising quality of bandwidth capped stream", "quality", l.quality)
+		}
+		return data
+	}
+
+	stats.framesThrottled.Add(1)
+	l.dropped = l.dropped*0.9 + 0.1
+	if l.dropped > 0.5 && l.quality != bandwidthMinQuality {
+		if l.quality == 0 {
+			l.quality = bandwidthMaxQuality
+		} else {
+			l.quality -= bandwidthQualityStep
+		}
+		// give the new quality time to take effect
+		l.dropped = 0.25
+		logger.Debug("lowering quality of bandwidth capped stream", "quality", l.quality)
+	}
+	return nil
+}
+
+// reencode encodes the jpeg frame data with the quality of l.
+func (l *bandwidthLimiter) reencode(data []byte) ([]byte, error) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	l.buf.Reset()
+	if err := jpeg.Encode(&l.buf, img, &jpeg.Options{Quality: l.quality}); err != nil {
+		return nil, err
+	}
+	return l.buf.Bytes(), nil
+}
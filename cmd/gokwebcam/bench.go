@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"io"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"runtime"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/brutella/webcam"
+)
+
+// benchResult is a row of the table printed by -bench.
+type benchResult struct {
+	stage, backend string
+	frames         int
+	d              time.Duration
+	bytes          int // total size of the output
+	allocs         uint64
+	allocBytes     uint64
+	err            error
+}
+
+// measure runs f and records its duration and allocations in r.
+func (r *benchResult) measure(f func()) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	f()
+	r.d = time.Since(start)
+	runtime.ReadMemStats(&after)
+	r.allocs = after.Mallocs - before.Mallocs
+	r.allocBytes = after.TotalAlloc - before.TotalAlloc
+}
+
+// benchmark captures n frames and measures how fast they are converted and
+// encoded by every encoder backend, to choose formats and backends for
+// constrained hardware. The results are printed as table to w.
+func benchmark(w io.Writer, cam device, n int, encoderDev string) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var (
+		frames [][]byte
+		format webcam.PixelFormat
+		width  uint32
+		height uint32
+		stride uint32
+		start  time.Time
+	)
+	for frame := range cam.Frames(ctx) {
+		if frame.Err != nil {
+			if _, ok := frame.Err.(*webcam.Timeout); ok {
+				continue
+			}
+			return frame.Err
+		}
+		if start.IsZero() {
+			// the first frame is delayed by the start of the camera
+			start = time.Now()
+		}
+		if !frame.Corrupted() {
+			data := append([]byte(nil), frame.Data...)
+			if frame.Format == V4L2_PIX_FMT_MJPG {
+				data = webcam.AppendMJPEG(nil, frame.Data)
+			}
+			frames = append(frames, data)
+			format, width, height, stride = frame.Format, frame.Width, frame.Height, frame.Stride
+		}
+		frame.Release()
+		if len(frames) == n {
+			break
+		}
+	}
+	cancel()
+	if len(frames) == 0 {
+		return fmt.Errorf("no frames captured")
+	}
+
+	capture := benchResult{stage: "capture", backend: "camera", frames: len(frames) - 1, d: time.Since(start)}
+	for _, f := range frames {
+		capture.bytes += len(f)
+	}
+	results := []benchResult{capture}
+
+	// decoded or converted frames are encoded by all backends
+	var images []image.Image
+	jpegFrames := format == V4L2_PIX_FMT_MJPG || format == V4L2_PIX_FMT_PJPG
+	if jpegFrames {
+		r := benchResult{stage: "decode", backend: "image/jpeg"}
+		r.measure(func() {
+			for _, f := range frames {
+				img, err := jpeg.Decode(bytes.NewReader(f))
+				if err != nil {
+					r.err = err
+					return
+				}
+				images = append(images, img)
+				r.frames++
+			}
+		})
+		results = append(results, r)
+	} else {
+		r := benchResult{stage: "convert", backend: fourccString(format)}
+		if conv, err := webcam.NewConverter(format, int(width), int(height), int(stride)); err != nil {
+			r.err = err
+		} else {
+			r.measure(func() {
+				for _, f := range frames {
+					conv.Convert(f)
+					r.frames++
+				}
+			})
+		}
+		results = append(results, r)
+	}
+
+	// encode encodes the frames with p into buffers from the pool like
+	// the daemon, or into a new buffer per frame if pooled is false,
+	// which shows the allocations saved by the pool
+	encode := func(r *benchResult, p *webcam.Pipeline, pooled bool) {
+		for i, f := range frames {
+			if jpegFrames && i >= len(images) {
+				break
+			}
+			var (
+				out io.Writer
+				buf *frameBuffer
+				b   *bytes.Buffer
+			)
+			if pooled {
+				buf = newFrameBuffer(0)
+				out = buf
+			} else {
+				b = new(bytes.Buffer)
+				out = b
+			}
+
+			var err error
+			if jpegFrames {
+				err = p.EncodeImage(out, images[i], time.Now())
+			} else {
+				err = p.Encode(out, f, format, int(width), int(height), int(stride), time.Now())
+			}
+			if pooled {
+				r.bytes += len(buf.Bytes())
+				buf.release()
+			} else {
+				r.bytes += b.Len()
+			}
+			if err != nil {
+				r.err = err
+				return
+			}
+			r.frames++
+		}
+	}
+
+	var names []string
+	for name := range encoderBackends {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		enc, err := encoderBackends[name](encoderDev, width, height)
+		if err != nil {
+			results = append(results, benchResult{stage: "encode", backend: name, err: err})
+			continue
+		}
+
+		p := webcam.NewPipeline(enc)
+		r := benchResult{stage: "encode", backend: name}
+		r.measure(func() { encode(&r, p, true) })
+		results = append(results, r)
+		if name == "sw" {
+			r := benchResult{stage: "encode", backend: "sw unpooled"}
+			r.measure(func() { encode(&r, p, false) })
+			results = append(results, r)
+		}
+		if c, ok := enc.(io.Closer); ok {
+			c.Close()
+		}
+	}
+
+	fmt.Fprintf(w, "%d frames %s %dx%d\n\n", len(frames), fourccString(format), width, height)
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "STAGE\tBACKEND\tFRAMES\tMS/FRAME\tFPS\tKB/FRAME\tALLOCS/FRAME\tKB ALLOC/FRAME\t")
+	for _, r := range results {
+		if r.err != nil {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t\t\t\t\t\tfailed: %v\n", r.stage, r.backend, r.frames, r.err)
+			continue
+		}
+		if r.frames == 0 {
+			continue
+		}
+		per := r.d / time.Duration(r.frames)
+		kb := "-"
+		if r.bytes > 0 {
+			kb = fmt.Sprintf("%.1f", float64(r.bytes)/float64(r.frames)/1024)
+		}
+		allocs, allocKB := "-", "-"
+		if r.stage != "capture" {
+			allocs = strconv.FormatUint(r.allocs/uint64(r.frames), 10)
+			allocKB = fmt.Sprintf("%.1f", float64(r.allocBytes)/float64(r.frames)/1024)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%.2f\t%.1f\t%s\t%s\t%s\t\n", r.stage, r.backend, r.frames, float64(per)/float64(time.Millisecond), 1/per.Seconds(), kb, allocs, allocKB)
+	}
+	return tw.Flush()
+}
+
+// runBenchmark runs benchmark with the camera and exits.
+func runBenchmark(cam device, n int, encoderDev string) {
+	logger.Info("benchmarking", "frames", n)
+	err := benchmark(os.Stdout, cam, n, encoderDev)
+	cam.StopStreaming()
+	if err != nil {
+		logger.Fatal("benchmark failed", "err", err)
+	}
+	os.Exit(0)
+}
+
+// servePprof serves the profiles of net/http/pprof on ln.
+func servePprof(ln net.Listener) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	logger.Info("listening", "addr", ln.Addr(), "proto", "pprof")
+	logger.Fatal("pprof server failed", "err", http.Serve(ln, mux))
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brutella/webcam"
+)
+
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(frameBuffer)
+	},
+}
+
+// frameBuffer is a reference counted buffer of frame data.
+// The data must not be modified once the buffer is shared,
+// and every retain must be balanced with a release.
+// The buffer is returned to a pool when the last reference is released.
+type frameBuffer struct {
+	refs atomic.Int32
+	data []byte
+
+	seq     uint64    // sequence number of the captured frame
+	time    time.Time // capture time
+	encoded time.Time // time the frame was encoded, zero if it wasn't
+
+	// format and size of raw frames before they are encoded, and
+	// their bytes per row, 0 if rows are not padded
+	format        webcam.PixelFormat
+	width, height uint32
+	stride        uint32
+}
+
+// newFrameBuffer returns a buffer with one reference and
+// a length of size from the pool.
+func newFrameBuffer(size int) *frameBuffer {
+	b := bufferPool.Get().(*frameBuffer)
+	if cap(b.data) < size {
+		b.data = make([]byte, size)
+	}
+	b.data = b.data[:size]
+	b.encoded = time.Time{}
+	b.refs.Store(1)
+	return b
+}
+
+// Bytes returns the frame data.
+func (b *frameBuffer) Bytes() []byte {
+	return b.data
+}
+
+// Write appends p to the data, so that frames are encoded directly into
+// a buffer from the pool. It must only be called before the buffer is shared.
+func (b *frameBuffer) Write(p []byte) (int, error) {
+	b.data = append(b.data, p...)
+	return len(p), nil
+}
+
+// WriteByte and Flush let image/jpeg write to the buffer
+// without allocating a bufio.Writer for every frame.
+func (b *frameBuffer) WriteByte(c byte) error {
+	b.data = append(b.data, c)
+	return nil
+}
+
+func (b *frameBuffer) Flush() error {
+	return nil
+}
+
+func (b *frameBuffer) retain() *frameBuffer {
+	b.refs.Add(1)
+	return b
+}
+
+func (b *frameBuffer) release() {
+	if b.refs.Add(-1) == 0 {
+		bufferPool.Put(b)
+	}
+}
+
+// broadcaster distributes encoded frames to subscribers.
+// Subscribers which are still busy with the previous frame skip a frame.
+type broadcaster struct {
+	mu   sync.Mutex
+	subs map[chan *frameBuffer]*subscriber
+}
+
+// subscriber receives at most one frame per interval.
+type subscriber struct {
+	interval time.Duration
+	last     time.Time
+}
+
+func newBroadcaster() *broadcaster {
+	return &broadcaster{
+		subs: make(map[chan *frameBuffer]*subscriber),
+	}
+}
+
+// subscribe returns a channel which receives new frames.
+// Received frames must be released.
+func (bc *broadcaster) subscribe() chan *frameBuffer {
+	return bc.subscribeInterval(0)
+}
+
+// subscribeInterval returns a channel which receives at most
+// one frame per interval. Received frames must be released.
+func (bc *broadcaster) subscribeInterval(interval time.Duration) chan *frameBuffer {
+	ch := make(chan *frameBuffer, 1)
+
+	bc.mu.Lock()
+	bc.subs[ch] = &subscriber{interval: interval}
+	bc.mu.Unlock()
+
+	return ch
+}
+
+func (bc *broadcaster) unsubscribe(ch chan *frameBuffer) {
+	bc.mu.Lock()
+	delete(bc.subs, ch)
+	bc.mu.Unlock()
+
+	// release a frame which wasn't received
+	select {
+	case b := <-ch:
+		b.release()
+	default:
+	}
+}
+
+// next waits for the next frame. The returned frame must be released.
+func (bc *broadcaster) next() *frameBuffer {
+	ch := bc.subscribe()
+	defer bc.unsubscribe(ch)
+
+	return <-ch
+}
+
+// publish sends b to all subscribers and releases it afterwards.
+func (bc *broadcaster) publish(b *frameBuffer) {
+	now := time.Now()
+
+	bc.mu.Lock()
+	for ch, sub := range bc.subs {
+		// allow some jitter of the capture timing
+		if sub.interval > 0 && now.Sub(sub.last) < sub.interval*9/10 {
+			continue
+		}
+
+		select {
+		case ch <- b.retain():
+			sub.last = now
+		default:
+			// subscriber is busy
+			b.release()
+		}
+	}
+	bc.mu.Unlock()
+
+	b.release()
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestBroadcasterSkipsBusySubscribers(t *testing.T) {
+	bc := newBroadcaster()
+	ch := bc.subscribe()
+	defer bc.unsubscribe(ch)
+
+	first := newFrameBuffer(1)
+	first.seq = 1
+	bc.publish(first)
+	second := newFrameBuffer(1)
+	second.seq = 2
+	bc.publish(second)
+
+	b := <-ch
+	if b.seq != 1 {
+		t.Fatalf("received frame %d, want 1", b.seq)
+	}
+	if refs := b.refs.Load(); refs != 1 {
+		t.Fatalf("frame has %d references, want 1", refs)
+	}
+	b.release()
+
+	select {
+	case b := <-ch:
+		t.Fatalf("received skipped frame %d", b.seq)
+	default:
+	}
+}
+
+func BenchmarkFrameBuffer(b *testing.B) {
+	data := make([]byte, 64<<10)
+	b.SetBytes(int64(len(data)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf := newFrameBuffer(0)
+		buf.Write(data)
+		buf.retain().release()
+		buf.release()
+	}
+}
+
+func BenchmarkBroadcast(b *testing.B) {
+	for _, n := range []int{1, 8, 32} {
+		b.Run(fmt.Sprintf("%d", n), func(b *testing.B) {
+			bc := newBroadcaster()
+			var wg sync.WaitGroup
+			chs := make([]chan *frameBuffer, n)
+			for i := range chs {
+				chs[i] = bc.subscribe()
+				wg.Add(1)
+				go func(ch chan *frameBuffer) {
+					defer wg.Done()
+					for frame := range ch {
+						frame.release()
+					}
+				}(chs[i])
+			}
+
+			data := make([]byte, 64<<10)
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				buf := newFrameBuffer(0)
+				buf.Write(data)
+				bc.publish(buf)
+			}
+			b.StopTimer()
+
+			for _, ch := range chs {
+				bc.unsubscribe(ch)
+				close(ch)
+			}
+			wg.Wait()
+		})
+	}
+}
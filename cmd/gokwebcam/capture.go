@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/brutella/webcam"
+)
+
+// streamControl pauses reading frames from the camera so that
+// handlers can reconfigure it, e.g. to capture a still image.
+type streamControl struct {
+	cam device
+
+	// streaming configuration, only changed while paused
+	format        webcam.PixelFormat
+	width, height uint32
+
+	mu      sync.Mutex // held while reading is paused
+	cancel  context.CancelFunc
+	ch      <-chan webcam.Frame // returned by frames
+	stopped chan struct{}       // closed once reading stopped
+	paused  atomic.Bool
+}
+
+func newStreamControl(cam device, format webcam.PixelFormat, w, h uint32) *streamControl {
+	sc := &streamControl{
+		cam:     cam,
+		format:  format,
+		width:   w,
+		height:  h,
+		cancel:  func() {},
+		stopped: make(chan struct{}),
+	}
+	close(sc.stopped)
+	return sc
+}
+
+// frames returns the frames of the camera until reading is paused.
+// It blocks while reading is paused. The caller must call done once
+// the returned channel is closed or once it stops reading it.
+func (sc *streamControl) frames() <-chan webcam.Frame {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	sc.cancel = cancel
+	sc.stopped = make(chan struct{})
+	sc.paused.Store(false)
+	sc.ch = sc.cam.Frames(ctx)
+	return sc.ch
+}
+
+// current returns the streaming format and frame size.
+// It blocks while the camera is reconfigured.
+func (sc *streamControl) current() (webcam.PixelFormat, uint32, uint32) {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+	return sc.format, sc.width, sc.height
+}
+
+// done reports that reading stopped and returns true if it was paused.
+// Reading may stop before the channel is closed, e.g. after errors, so
+// the remaining frames are drained: the goroutine reading frames uses
+// the buffers of the camera until it closes the channel.
+func (sc *streamControl) done() bool {
+	sc.cancel()
+	for frame := range sc.ch {
+		frame.Release()
+	}
+	close(sc.stopped)
+	return sc.paused.Load()
+}
+
+// pause stops reading frames and waits until all frames are released.
+// The camera can then be used by the caller until resume is called.
+func (sc *streamControl) pause() {
+	sc.mu.Lock()
+	sc.paused.Store(true)
+	sc.cancel()
+	<-sc.stopped
+}
+
+// reconfigure stops streaming, sets the image format and frame rate
+// and restarts streaming. The previous format is restored on failure.
+// A frame rate of 0 keeps the frame rate of the driver.
+// Reading must be paused.
+func (sc *streamControl) reconfigure(format webcam.PixelFormat, w, h uint32, fps float32) error {
+	return sc.configure(nil, format, w, h, fps)
+}
+
+// renegotiate stops streaming, calls setup, e.g. to set the timings of
+// the signal of a capture card, and restarts streaming with frames of the
+// current format and the size returned by setup, or the current size if
+// setup returns 0. Reading must be paused.
+func (sc *streamControl) renegotiate(setup func() (uint32, uint32, error)) error {
+	return sc.configure(setup, sc.format, sc.width, sc.height, 0)
+}
+
+func (sc *streamControl) configure(setup func() (uint32, uint32, error), format webcam.PixelFormat, w, h uint32, fps float32) error {
+	if err := sc.cam.StopStreaming(); err != nil {
+		return fmt.Errorf("stopping stream: %v", err)
+	}
+
+	var (
+		f      webcam.PixelFormat
+		fw, fh uint32
+		err    error
+	)
+	if setup != nil {
+		var sw, sh uint32
+		if sw, sh, err = setup(); sw > 0 && sh > 0 {
+			w, h = sw, sh
+		}
+	}
+	if err == nil {
+		f, fw, fh, err = sc.cam.SetImageFormat(format, w, h)
+	}
+	if err == nil && fps > 0 {
+		if ferr := sc.cam.SetFramerate(fps); ferr != nil {
+			logger.Warn("setting frame rate failed", "fps", fps, "err", ferr)
+		}
+	}
+	if err == nil {
+		if err = sc.cam.StartStreaming(); err == nil {
+			sc.format, sc.width, sc.height = f, fw, fh
+			return nil
+		}
+	}
+
+	if _, _, _, rerr := sc.cam.SetImageFormat(sc.format, sc.width, sc.height); rerr != nil {
+		logger.Error("restoring image format failed", "err", rerr)
+	}
+	if rerr := sc.cam.StartStreaming(); rerr != nil {
+		logger.Error("restarting stream failed", "err", rerr)
+	}
+	return err
+}
+
+// restart stops and starts streaming after reading stopped because
+// of an error. Stopping fails if the driver stopped streaming already,
+// so only the error of starting is returned.
+func (sc *streamControl) restart() error {
+	sc.mu.Lock()
+	defer sc.mu.Unlock()
+
+	if err := sc.cam.StopStreaming(); err != nil {
+		logger.Debug("stopping stream failed", "err", err)
+	}
+	return sc.cam.StartStreaming()
+}
+
+// resume continues reading frames.
+func (sc *streamControl) resume() {
+	sc.mu.Unlock()
+}
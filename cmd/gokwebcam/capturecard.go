@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	"github.com/brutella/webcam"
+	"github.com/brutella/webcam/cmd/gokwebcam/eventbus"
+)
+
+// captureCard watches the signal of an HDMI or analog capture card. Cards
+// have to be configured for the timings or the video standard of their
+// signal, and stream black frames or stop streaming if the signal is lost
+// or changes. The card is renegotiated whenever the signal returns or
+// changes, and frames are dropped while there is no signal.
+//
+// Cheap HDMI to USB sticks are UVC cameras which detect the signal
+// themselves. They don't report signal loss, but stream a blank
+// image, after which they are reinitialized.
+type captureCard struct {
+	cam       *webcam.Webcam
+	sc        *streamControl
+	bus       *eventbus.Bus
+	device    string
+	fixedSize bool // the frame size can't change, e.g. because of privacy masks
+
+	// blank is how long frames can be blank until the stick is
+	// reinitialized, 0 disables the detection
+	blank time.Duration
+
+	dv, std  bool // the input supports timings or video standards
+	timings  webcam.DVTimings
+	standard uint64
+
+	signal     atomic.Bool
+	blankSince atomic.Int64 // unix nano of the first of consecutive blank frames
+}
+
+func newCaptureCard(cam *webcam.Webcam, bus *eventbus.Bus, device string, blank time.Duration) *captureCard {
+	c := &captureCard{cam: cam, bus: bus, device: device, blank: blank}
+	if in, err := cam.QueryInput(); err == nil {
+		c.dv = in.Capabilities&webcam.V4L2_IN_CAP_DV_TIMINGS != 0
+		c.std = in.Capabilities&webcam.V4L2_IN_CAP_STD != 0
+		logger.Info("capture card input", "index", in.Index, "name", in.Name, "dv-timings", c.dv, "std", c.std)
+	}
+	c.signal.Store(true)
+	return c
+}
+
+// negotiate configures the card for the current signal.
+// Streaming must be stopped.
+func (c *captureCard) negotiate() error {
+	switch {
+	case c.dv:
+		t, err := c.cam.QueryDVTimings()
+		if err != nil {
+			return err
+		}
+		if err := c.cam.SetDVTimings(t); err != nil {
+			return fmt.Errorf("setting timings %v: %v", t, err)
+		}
+		c.timings = t
+		logger.Info("signal detected", "timings", t)
+	case c.std:
+		std, err := c.cam.QueryStandard()
+		if err != nil {
+			return err
+		}
+		if err := c.cam.SetStandard(std); err != nil {
+			return fmt.Errorf("setting standard %#x: %v", std, err)
+		}
+		c.standard = std
+		logger.Info("signal detected", "std", fmt.Sprintf("%#x", std))
+	}
+	return nil
+}
+
+// size returns the frame size of the negotiated timings,
+// or false if the size is defined by the format.
+func (c *captureCard) size() (uint32, uint32, bool) {
+	if c.dv && c.timings.Width > 0 {
+		return c.timings.Width, c.timings.Height, true
+	}
+	return 0, 0, false
+}
+
+// run checks the signal at every interval.
+func (c *captureCard) run(interval time.Duration) {
+	b := &backoff{min: interval, max: time.Minute}
+	var next time.Time
+	for range time.Tick(interval) {
+		if time.Now().Before(next) {
+			continue
+		}
+		changed, err := c.check()
+		if err != nil {
+			if c.signal.Swap(false) {
+				logger.Warn("signal lost", "device", c.device, "err", err)
+				c.bus.Publish(eventbus.SignalLost, map[string]interface{}{"device": c.device, "err": err.Error()})
+			}
+			continue
+		}
+		if !changed && c.signal.Load() {
+			if c.blankSince.Load() == 0 {
+				b.reset()
+			}
+			continue
+		}
+
+		// the backoff also applies after renegotiating, because
+		// sticks may still stream blank frames afterwards
+		err = c.renegotiate()
+		d := b.next()
+		next = time.Now().Add(d)
+		if err != nil {
+			logger.Warn("renegotiating signal failed", "device", c.device, "err", err, "retry", d)
+			continue
+		}
+		_, w, h := c.sc.current()
+		logger.Info("signal renegotiated", "device", c.device, "width", w, "height", h)
+		c.bus.Publish(eventbus.SignalChanged, map[string]interface{}{"device": c.device, "width": w, "height": h})
+		c.blankSince.Store(0)
+		c.signal.Store(true)
+	}
+}
+
+// check returns true if the signal changed, and an error
+// if there is no signal.
+func (c *captureCard) check() (bool, error) {
+	switch {
+	case c.dv:
+		t, err := c.cam.QueryDVTimings()
+		if err != nil {
+			return false, err
+		}
+		return !t.Equal(c.timings), nil
+	case c.std:
+		std, err := c.cam.QueryStandard()
+		if err != nil {
+			return false, err
+		}
+		return std != c.standard, nil
+	}
+
+	if in, err := c.cam.QueryInput(); err == nil && !in.HasSignal() {
+		return false, webcam.ErrNoSignal
+	}
+	if since := c.blankSince.Load(); c.blank > 0 && since != 0 && time.Since(time.Unix(0, since)) > c.blank {
+		// reinitialize the stick, which resets the blank time
+		return true, nil
+	}
+	return false, nil
+}
+
+// renegotiate pauses reading frames and restarts streaming
+// with the format negotiated for the current signal.
+func (c *captureCard) renegotiate() error {
+	c.sc.pause()
+	defer c.sc.resume()
+
+	return c.sc.renegotiate(func() (uint32, uint32, error) {
+		if err := c.negotiate(); err != nil {
+			return 0, 0, err
+		}
+		w, h, ok := c.size()
+		if ok && c.fixedSize && (w != c.sc.width || h != c.sc.height) {
+			return 0, 0, fmt.Errorf("frame size %dx%d of the signal differs from %dx%d", w, h, c.sc.width, c.sc.height)
+		}
+		return w, h, nil
+	})
+}
+
+// waiting returns true while frames are dropped because there
+// is no signal or because the stick streams blank frames.
+func (c *captureCard) waiting() bool {
+	if !c.signal.Load() {
+		return true
+	}
+	since := c.blankSince.Load()
+	return c.blank > 0 && since != 0 && time.Since(time.Unix(0, since)) > c.blank
+}
+
+// frame returns false if buf should be dropped because there is
+// no signal. Blank frames are detected by their luma, if it is
+// available without decoding.
+func (c *captureCard) frame(buf *frameBuffer) bool {
+	if !c.signal.Load() {
+		return false
+	}
+	if c.blank == 0 || c.dv || c.std {
+		return true
+	}
+
+	if !blankFrame(buf) {
+		c.blankSince.Store(0)
+		return true
+	}
+	since := c.blankSince.Load()
+	if since == 0 {
+		c.blankSince.Store(time.Now().UnixNano())
+		return true
+	}
+	// short blank periods are part of the video
+	return time.Since(time.Unix(0, since)) <= c.blank
+}
+
+// blankFrame returns true if the luma of the sampled pixels of
+// buf is uniform, like the black or blue image capture sticks
+// stream without signal. Other formats are never blank.
+func blankFrame(buf *frameBuffer) bool {
+	n := int(buf.width * buf.height)
+	step := 1
+	switch buf.format {
+	case V4L2_PIX_FMT_YUYV:
+		step = 2
+	case V4L2_PIX_FMT_NV12, V4L2_PIX_FMT_YUV420, V4L2_PIX_FMT_YVU420, V4L2_PIX_FMT_GREY:
+	default:
+		return false
+	}
+	if n == 0 || len(buf.data) < n*step {
+		return false
+	}
+
+	// sample about 1000 pixels
+	stride := n / 1000
+	if stride == 0 {
+		stride = 1
+	}
+	lo, hi := byte(255), byte(0)
+	for i := 0; i < n; i += stride {
+		y := buf.data[i*step]
+		if y < lo {
+			lo = y
+		}
+		if y > hi {
+			hi = y
+		}
+	}
+	return hi-lo < 8
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/brutella/webcam/cmd/gokwebcam/eventbus"
+)
+
+// defaultChatEvents are the events posted to chats by default.
+const defaultChatEvents = string(eventbus.MotionDetected) + "," + string(eventbus.CameraLost) + "," + string(eventbus.StorageLow)
+
+// chatBackend posts a message and an optional jpeg snapshot to a chat.
+type chatBackend interface {
+	post(text string, snapshot []byte) error
+}
+
+// chatNotifier posts configured events to a chat, together with
+// the current frame for motion events.
+type chatNotifier struct {
+	name    string // name of the backend used in logs
+	backend chatBackend
+	camera  string // camera name used in messages
+	frames  *broadcaster
+	queue   chan eventbus.Event
+}
+
+func newChatNotifier(name string, backend chatBackend, bc *broadcaster) *chatNotifier {
+	return &chatNotifier{
+		name:    name,
+		backend: backend,
+		frames:  bc,
+		queue:   make(chan eventbus.Event, 16),
+	}
+}
+
+// parseEventTypes returns the event types of a comma separated list.
+func parseEventTypes(str string) []eventbus.Type {
+	var types []eventbus.Type
+	for _, typ := range strings.Split(str, ",") {
+		if typ = strings.TrimSpace(typ); typ != "" {
+			types = append(types, eventbus.Type(typ))
+		}
+	}
+	return types
+}
+
+// HandleEvent queues an event for posting.
+func (n *chatNotifier) HandleEvent(e eventbus.Event) {
+	select {
+	case n.queue <- e:
+	default:
+		logger.Warn("chat: queue full, dropping event", "chat", n.name, "type", e.Type)
+	}
+}
+
+// run posts queued events until the program exits.
+func (n *chatNotifier) run() {
+	for e := range n.queue {
+		var snapshot []byte
+		if e.Type == eventbus.MotionDetected || e.Type == eventbus.ObjectDetected {
+			img := n.frames.next()
+			snapshot = append([]byte(nil), img.Bytes()...)
+			img.release()
+		}
+
+		if err := n.backend.post(n.text(e), snapshot); err != nil {
+			logger.Error("chat: posting failed", "chat", n.name, "type", e.Type, "err", err)
+		}
+	}
+}
+
+// text returns the message of an event.
+func (n *chatNotifier) text(e eventbus.Event) string {
+	var b strings.Builder
+	if n.camera != "" {
+		fmt.Fprintf(&b, "%s: ", n.camera)
+	}
+	b.WriteString(string(e.Type))
+	fmt.Fprintf(&b, " at %s", e.Time.Format("2006-01-02 15:04:05"))
+	keys := make([]string, 0, len(e.Data))
+	for k := range e.Data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "\n%s: %v", k, e.Data[k])
+	}
+	return b.String()
+}
+
+// telegram posts to a chat with the Telegram bot api.
+type telegram struct {
+	token  string
+	chatID string
+	client *http.Client
+}
+
+func (t *telegram) post(text string, snapshot []byte) error {
+	method := "sendMessage"
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	mw.WriteField("chat_id", t.chatID)
+	if snapshot != nil {
+		method = "sendPhoto"
+		mw.WriteField("caption", text)
+		w, err := mw.CreateFormFile("photo", "snapshot.jpg")
+		if err != nil {
+			return err
+		}
+		w.Write(snapshot)
+	} else {
+		mw.WriteField("text", text)
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+
+	resp, err := t.client.Post("https://api.telegram.org/bot"+t.token+"/"+method, mw.FormDataContentType(), &b)
+	if err != nil {
+		// the url contains the token
+		return fmt.Errorf("telegram: %s failed", method)
+	}
+	defer resp.Body.Close()
+
+	var result struct {
+		OK          bool   `json:"ok"`
+		Description string `json:"description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("telegram: unexpected status %s", resp.Status)
+	}
+	if !result.OK {
+		return fmt.Errorf("telegram: %s", result.Description)
+	}
+	return nil
+}
+
+// slack posts to a Slack incoming webhook. Incoming webhooks
+// can't upload files, so snapshots are not posted.
+type slack struct {
+	url    string
+	client *http.Client
+}
+
+func (s *slack) post(text string, snapshot []byte) error {
+	payload, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(payload))
+	if err != nil {
+		return fmt.Errorf("slack: posting to webhook failed")
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("slack: unexpected status %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	clipDefaultDuration = 3 * time.Second
+	clipMaxDuration     = 10 * time.Second
+	clipDefaultFPS      = 10
+	clipDefaultWidth    = 320
+)
+
+// clipHandler captures the next frames for ?d=3s and returns them as
+// animated GIF, or as animated WebP for /clip.webp or ?format=webp.
+// The frame rate and size can be set with ?fps=N and ?s=WxH, the
+// default is 10 fps and a width of 320 pixels.
+// For /clip.mp4 or ?format=mp4 the jpeg frames are returned unchanged
+// as motion jpeg video in a fragmented MP4 file.
+// Only one clip is captured at a time.
+type clipHandler struct {
+	frames        *broadcaster
+	width, height uint32
+
+	busy chan struct{}
+}
+
+func newClipHandler(frames *broadcaster, w, h uint32) *clipHandler {
+	return &clipHandler{
+		frames: frames,
+		width:  w,
+		height: h,
+		busy:   make(chan struct{}, 1),
+	}
+}
+
+func (h *clipHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	size, interval, err := streamOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if interval == 0 {
+		interval = time.Second / clipDefaultFPS
+	}
+	if size == (image.Point{}) {
+		size = image.Pt(clipDefaultWidth, int(h.height)*clipDefaultWidth/int(h.width))
+	}
+
+	d := clipDefaultDuration
+	if str := r.FormValue("d"); str != "" {
+		if d, err = parseClipDuration(str); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	format := r.FormValue("format")
+	switch {
+	case strings.HasSuffix(r.URL.Path, ".webp"):
+		format = "webp"
+	case strings.HasSuffix(r.URL.Path, ".mp4"):
+		format = "mp4"
+	}
+
+	select {
+	case h.busy <- struct{}{}:
+		defer func() { <-h.busy }()
+	default:
+		stats.requestsRejected.Add(1)
+		serviceUnavailable(w, d)
+		return
+	}
+
+	if format == "mp4" {
+		h.serveMP4(w, r, d)
+		return
+	}
+
+	frames, delays := h.capture(r, size, interval, d)
+	if len(frames) == 0 {
+		http.Error(w, "no frames captured", http.StatusServiceUnavailable)
+		return
+	}
+
+	var buf bytes.Buffer
+	if format == "webp" {
+		err = encodeAnimatedWebP(&buf, frames, delays)
+		w.Header().Set("Content-Type", "image/webp")
+	} else {
+		err = encodeGIF(&buf, frames, delays)
+		w.Header().Set("Content-Type", "image/gif")
+	}
+	if err != nil {
+		logger.Error("encoding clip failed", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if n, err := w.Write(buf.Bytes()); err == nil {
+		stats.bytesServed.Add(uint64(n))
+	}
+}
+
+// serveMP4 responds with the jpeg frames of the next duration d.
+func (h *clipHandler) serveMP4(w http.ResponseWriter, r *http.Request, d time.Duration) {
+	ch := h.frames.subscribe()
+	defer h.frames.unsubscribe(ch)
+
+	var (
+		samples []mp4Sample
+		last    time.Time
+	)
+	timeout := time.After(d)
+loop:
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-timeout:
+			break loop
+		case frame := <-ch:
+			if n := len(samples); n > 0 {
+				samples[n-1].duration = frame.time.Sub(last)
+			}
+			samples = append(samples, mp4Sample{data: append([]byte(nil), frame.Bytes()...)})
+			last = frame.time
+			frame.release()
+		}
+	}
+	if len(samples) == 0 {
+		http.Error(w, "no frames captured", http.StatusServiceUnavailable)
+		return
+	}
+	if n := len(samples); n > 1 {
+		samples[n-1].duration = samples[n-2].duration
+	} else {
+		samples[0].duration = d
+	}
+
+	var buf bytes.Buffer
+	if err := writeFragmentedMP4(&buf, h.width, h.height, samples); err != nil {
+		logger.Error("encoding clip failed", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if n, err := w.Write(buf.Bytes()); err == nil {
+		stats.bytesServed.Add(uint64(n))
+	}
+}
+
+// capture returns the frames of the next duration d scaled to size
+// and the time each frame is shown.
+func (h *clipHandler) capture(r *http.Request, size image.Point, interval, d time.Duration) ([]*image.RGBA, []time.Duration) {
+	ch := h.frames.subscribeInterval(interval)
+	defer h.frames.unsubscribe(ch)
+
+	var (
+		frames []*image.RGBA
+		times  []time.Time
+	)
+	timeout := time.After(d)
+	for {
+		select {
+		case <-r.Context().Done():
+			return nil, nil
+		case <-timeout:
+			delays := make([]time.Duration, len(frames))
+			for i := range frames {
+				if i+1 < len(frames) {
+					delays[i] = times[i+1].Sub(times[i])
+				} else {
+					delays[i] = interval
+				}
+			}
+			return frames, delays
+		case frame := <-ch:
+			img, err := jpeg.Decode(bytes.NewReader(frame.Bytes()))
+			t := frame.time
+			frame.release()
+			if err != nil {
+				logger.Debug("decoding frame failed", "err", err)
+				continue
+			}
+
+			dst := image.NewRGBA(image.Rectangle{Max: size})
+			draw.ApproxBiLinear.Scale(dst, dst.Rect, img, img.Bounds(), draw.Src, nil)
+			frames = append(frames, dst)
+			times = append(times, t)
+		}
+	}
+}
+
+// parseClipDuration parses a duration like 3s or a number of seconds.
+func parseClipDuration(str string) (time.Duration, error) {
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		secs, ferr := strconv.ParseFloat(str, 64)
+		if ferr != nil {
+			return 0, fmt.Errorf("invalid duration %q", str)
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 || d > clipMaxDuration {
+		return 0, fmt.Errorf("duration must be between 0 and %v", clipMaxDuration)
+	}
+	return d, nil
+}
+
+// encodeGIF writes frames as an animated GIF which loops forever.
+func encodeGIF(w io.Writer, frames []*image.RGBA, delays []time.Duration) error {
+	anim := &gif.GIF{}
+	for i, img := range frames {
+		p := image.NewPaletted(img.Bounds(), palette.Plan9)
+		draw.FloydSteinberg.Draw(p, p.Rect, img, image.Point{})
+		anim.Image = append(anim.Image, p)
+		anim.Delay = append(anim.Delay, int(delays[i]/(10*time.Millisecond)))
+	}
+	return gif.EncodeAll(w, anim)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/brutella/webcam"
+)
+
+// controlsHandler lists the controls of the camera with their
+// current values (GET) and sets a control (POST with id and value).
+// Software controls of the daemon are listed with the controls of the
+// camera.
+type controlsHandler struct {
+	cam  device
+	soft map[webcam.ControlID]*softwareControl
+}
+
+// softwareControl is a control implemented by the daemon
+// instead of the camera, e.g. to toggle a filter.
+type softwareControl struct {
+	info webcam.Control
+	get  func() int32
+	set  func(int32)
+}
+
+// controlInfo is the json representation of a control.
+type controlInfo struct {
+	ID    webcam.ControlID `json:"id"`
+	Name  string           `json:"name"`
+	Type  int32            `json:"type"`
+	Min   int32            `json:"min"`
+	Max   int32            `json:"max"`
+	Step  int32            `json:"step"`
+	Value int32            `json:"value"`
+}
+
+func (h *controlsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(h.list())
+
+	case http.MethodPost:
+		id, err := strconv.ParseUint(r.FormValue("id"), 0, 32)
+		if err != nil {
+			http.Error(w, "invalid control id", http.StatusBadRequest)
+			return
+		}
+		value, err := strconv.ParseInt(r.FormValue("value"), 10, 32)
+		if err != nil {
+			http.Error(w, "invalid control value", http.StatusBadRequest)
+			return
+		}
+
+		if c, ok := h.soft[webcam.ControlID(id)]; ok {
+			if int32(value) < c.info.Min || int32(value) > c.info.Max {
+				http.Error(w, "control value out of range", http.StatusBadRequest)
+				return
+			}
+			c.set(int32(value))
+			logger.Info("control set", "control", c.info.Name, "value", value)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		if err := h.cam.SetControl(webcam.ControlID(id), int32(value)); err != nil {
+			logger.Warn("setting control failed", "id", id, "value", value, "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger.Info("control set", "id", id, "value", value)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// list returns the controls of the camera and
+// the software controls sorted by id.
+func (h *controlsHandler) list() []controlInfo {
+	var list []controlInfo
+	for id, c := range h.soft {
+		list = append(list, controlInfo{
+			ID:    id,
+			Name:  c.info.Name,
+			Type:  c.info.Type,
+			Min:   c.info.Min,
+			Max:   c.info.Max,
+			Step:  c.info.Step,
+			Value: c.get(),
+		})
+	}
+	for id, c := range h.cam.GetControls() {
+		value, err := h.cam.GetControl(id)
+		if err != nil {
+			logger.Debug("reading control failed", "control", c.Name, "err", err)
+		}
+		list = append(list, controlInfo{
+			ID:    id,
+			Name:  c.Name,
+			Type:  c.Type,
+			Min:   c.Min,
+			Max:   c.Max,
+			Step:  c.Step,
+			Value: value,
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
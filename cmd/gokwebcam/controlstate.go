@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/brutella/webcam"
+)
+
+// controlState saves the controls set with the api to a file and
+// restores them at start and after streaming restarted, because many
+// cameras reset their controls to the defaults when they are replugged.
+type controlState struct {
+	file string
+
+	mu     sync.Mutex
+	values map[webcam.ControlID]savedControl
+}
+
+// savedControl is the json representation of a saved control.
+type savedControl struct {
+	ID    webcam.ControlID `json:"id"`
+	Name  string           `json:"name,omitempty"`
+	Value int32            `json:"value"`
+}
+
+func newControlState(file string) *controlState {
+	return &controlState{file: file, values: map[webcam.ControlID]savedControl{}}
+}
+
+// load reads the saved controls from the file, which may not exist yet.
+func (s *controlState) load() error {
+	b, err := os.ReadFile(s.file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var list []savedControl
+	if err := json.Unmarshal(b, &list); err != nil {
+		return fmt.Errorf("%s: %v", s.file, err)
+	}
+	s.mu.Lock()
+	for _, c := range list {
+		s.values[c.ID] = c
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// save writes the controls to a temporary file which replaces the file.
+// s.mu must be held.
+func (s *controlState) save() error {
+	var saved []savedControl
+	for _, c := range s.values {
+		saved = append(saved, c)
+	}
+	sort.Slice(saved, func(i, j int) bool { return saved[i].ID < saved[j].ID })
+
+	b, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(s.file), "."+filepath.Base(s.file)+".tmp")
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.file)
+}
+
+// set records the value of a control and saves the controls.
+func (s *controlState) set(id webcam.ControlID, name string, value int32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if c, ok := s.values[id]; ok && c.Value == value {
+		return
+	}
+	s.values[id] = savedControl{ID: id, Name: name, Value: value}
+	if err := s.save(); err != nil {
+		logger.Warn("saving controls failed", "file", s.file, "err", err)
+	}
+}
+
+// restore sets the saved controls of cam, auto controls first.
+// Controls which can't be set, e.g. because the camera was
+// replaced by another model, are skipped.
+func (s *controlState) restore(cam device) {
+	s.mu.Lock()
+	var list []presetValue
+	for _, c := range s.values {
+		list = append(list, presetValue{id: c.ID, name: c.Name, value: c.Value})
+	}
+	s.mu.Unlock()
+	sortControls(list)
+
+	controls := cam.GetControls()
+	n := 0
+	for _, v := range list {
+		if _, ok := controls[v.id]; !ok {
+			logger.Debug("camera has no saved control", "control", v.name)
+			continue
+		}
+		if err := cam.SetControl(v.id, v.value); err != nil {
+			logger.Warn("restoring control failed", "control", v.name, "value", v.value, "err", err)
+			continue
+		}
+		n++
+	}
+	if n > 0 {
+		logger.Info("controls restored", "controls", n)
+	}
+}
+
+// stateDevice is a device whose controls are recorded in
+// state when they are set, e.g. by the api.
+type stateDevice struct {
+	device
+	state *controlState
+}
+
+func (d stateDevice) SetControl(id webcam.ControlID, value int32) error {
+	if err := d.device.SetControl(id, value); err != nil {
+		return err
+	}
+	// buttons, e.g. to start autofocus, are not listed and not saved
+	if c, ok := d.GetControls()[id]; ok {
+		d.state.set(id, c.Name, value)
+	}
+	return nil
+}
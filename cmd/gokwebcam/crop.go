@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"image"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// parseRect parses a rectangle "x,y,w,h".
+func parseRect(s string) (image.Rectangle, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return image.Rectangle{}, fmt.Errorf("invalid rectangle %q", s)
+	}
+
+	var v [4]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(strings.TrimSpace(p))
+		if err != nil || n < 0 {
+			return image.Rectangle{}, fmt.Errorf("invalid rectangle %q", s)
+		}
+		v[i] = n
+	}
+	if v[2] == 0 || v[3] == 0 {
+		return image.Rectangle{}, fmt.Errorf("empty rectangle %q", s)
+	}
+
+	return image.Rect(v[0], v[1], v[0]+v[2], v[1]+v[3]), nil
+}
+
+// cropFilter crops frames and scales the cropped region back
+// to the frame size, which results in a digital zoom.
+type cropFilter struct {
+	mu   sync.Mutex
+	rect image.Rectangle // empty if frames are not cropped
+
+	dst *image.RGBA
+}
+
+func (c *cropFilter) set(r image.Rectangle) {
+	c.mu.Lock()
+	c.rect = r
+	c.mu.Unlock()
+}
+
+func (c *cropFilter) get() image.Rectangle {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.rect
+}
+
+func (c *cropFilter) Enabled() bool {
+	return !c.get().Empty()
+}
+
+func (c *cropFilter) Apply(img image.Image, t time.Time) image.Image {
+	b := img.Bounds()
+	r := c.get().Add(b.Min).Intersect(b)
+	if r.Empty() || r == b {
+		return img
+	}
+
+	if c.dst == nil || c.dst.Rect != b {
+		c.dst = image.NewRGBA(b)
+	}
+	draw.ApproxBiLinear.Scale(c.dst, b, img, r, draw.Src, nil)
+
+	return c.dst
+}
+
+// cropHandler returns the crop rectangle (GET) and sets it (POST with
+// rect=x,y,w,h, or without rect to reset it). The device crops frames
+// if it supports the selection api, otherwise frames are cropped by sw.
+type cropHandler struct {
+	cam device
+	hw  bool        // device supports cropping
+	sw  *cropFilter // nil if cropping in software is not possible
+}
+
+func (h *cropHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var rect image.Rectangle
+		if str := r.FormValue("rect"); str != "" {
+			var err error
+			if rect, err = parseRect(str); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		if err := h.crop(rect); err != nil {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	rect := h.current()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(cropInfo{
+		X: rect.Min.X,
+		Y: rect.Min.Y,
+		W: rect.Dx(),
+		H: rect.Dy(),
+	})
+}
+
+// cropInfo is the json representation of the crop rectangle.
+type cropInfo struct {
+	X int `json:"x"`
+	Y int `json:"y"`
+	W int `json:"w"`
+	H int `json:"h"`
+}
+
+// crop crops frames to rect. An empty rect resets cropping.
+func (h *cropHandler) crop(rect image.Rectangle) error {
+	if h.hw {
+		if rect.Empty() {
+			def, err := h.cam.GetDefaultCrop()
+			if err != nil {
+				return err
+			}
+			rect = def
+		}
+		res, err := h.cam.SetCrop(rect)
+		if err != nil {
+			return err
+		}
+		logger.Info("camera crops frames", "rect", res)
+		return nil
+	}
+
+	if h.sw == nil {
+		return fmt.Errorf("cropping is not supported")
+	}
+	h.sw.set(rect)
+	logger.Info("cropping frames", "rect", rect)
+	return nil
+}
+
+// current returns the crop rectangle. The rectangle
+// is empty if frames are not cropped.
+func (h *cropHandler) current() image.Rectangle {
+	if h.hw {
+		rect, _ := h.cam.GetCrop()
+		return rect
+	}
+	if h.sw != nil {
+		return h.sw.get()
+	}
+	return image.Rectangle{}
+}
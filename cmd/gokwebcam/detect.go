@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brutella/webcam/cmd/gokwebcam/eventbus"
+)
+
+// detectedObject is an object found by the detector in a frame.
+// The box is in frame coordinates.
+type detectedObject struct {
+	Label      string  `json:"label"`
+	Confidence float64 `json:"confidence"`
+	X          int     `json:"x"`
+	Y          int     `json:"y"`
+	W          int     `json:"w"`
+	H          int     `json:"h"`
+}
+
+func (o detectedObject) String() string {
+	return fmt.Sprintf("%s %.0f%% at %d,%d %dx%d", o.Label, o.Confidence*100, o.X, o.Y, o.W, o.H)
+}
+
+// objectDetector sends sampled frames to an inference server with the
+// DeepStack detection api, which is also implemented by CodeProject.AI,
+// and publishes eventbus.ObjectDetected when an object with a label
+// which wasn't found in the previous frame is detected.
+type objectDetector struct {
+	url           string // e.g. http://localhost:32168/v1/vision/detection
+	interval      time.Duration
+	minConfidence float64
+	labels        map[string]bool // detected labels, all if empty
+	onMotion      bool            // only detect while there is motion
+	client        *http.Client
+	bus           *eventbus.Bus
+	boxes         *detectionBoxes // optional
+
+	motion atomic.Bool
+	prev   map[string]bool // labels of the previous frame
+}
+
+// HandleEvent tracks motion for onMotion.
+func (d *objectDetector) HandleEvent(e eventbus.Event) {
+	d.motion.Store(e.Type == eventbus.MotionDetected)
+}
+
+// run detects objects in frames of bc until the program exits.
+func (d *objectDetector) run(bc *broadcaster) {
+	frames := bc.subscribeInterval(d.interval)
+	defer bc.unsubscribe(frames)
+
+	for frame := range frames {
+		if d.onMotion && !d.motion.Load() {
+			frame.release()
+			d.prev = nil
+			continue
+		}
+
+		objects, err := d.detect(frame.Bytes())
+		t := frame.time
+		frame.release()
+		if err != nil {
+			logger.Warn("detecting objects failed", "url", d.url, "err", err)
+			continue
+		}
+		if d.boxes != nil {
+			d.boxes.set(objects, t.Add(2*d.interval))
+		}
+
+		labels := map[string]bool{}
+		var appeared bool
+		for _, o := range objects {
+			labels[o.Label] = true
+			appeared = appeared || !d.prev[o.Label]
+		}
+		d.prev = labels
+		if appeared {
+			logger.Info("objects detected", "objects", objects)
+			d.bus.Publish(eventbus.ObjectDetected, map[string]interface{}{"objects": objects})
+		}
+	}
+}
+
+// detectionResponse is the response of the detection api.
+type detectionResponse struct {
+	Success     bool   `json:"success"`
+	Error       string `json:"error"`
+	Predictions []struct {
+		Label      string  `json:"label"`
+		Confidence float64 `json:"confidence"`
+		XMin       int     `json:"x_min"`
+		YMin       int     `json:"y_min"`
+		XMax       int     `json:"x_max"`
+		YMax       int     `json:"y_max"`
+	} `json:"predictions"`
+}
+
+// detect posts the jpeg frame and returns the objects with the
+// configured labels and at least the min confidence.
+func (d *objectDetector) detect(frame []byte) ([]detectedObject, error) {
+	var b bytes.Buffer
+	mw := multipart.NewWriter(&b)
+	mw.WriteField("min_confidence", strconv.FormatFloat(d.minConfidence, 'f', -1, 64))
+	w, err := mw.CreateFormFile("image", "frame.jpg")
+	if err != nil {
+		return nil, err
+	}
+	w.Write(frame)
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	res, err := d.client.Post(d.url, mw.FormDataContentType(), &b)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 512))
+		return nil, fmt.Errorf("%s: %s", res.Status, msg)
+	}
+
+	var dr detectionResponse
+	if err := json.NewDecoder(res.Body).Decode(&dr); err != nil {
+		return nil, err
+	}
+	if !dr.Success {
+		return nil, fmt.Errorf("detection failed: %s", dr.Error)
+	}
+
+	var objects []detectedObject
+	for _, p := range dr.Predictions {
+		if p.Confidence < d.minConfidence || (len(d.labels) > 0 && !d.labels[p.Label]) {
+			continue
+		}
+		objects = append(objects, detectedObject{
+			Label:      p.Label,
+			Confidence: p.Confidence,
+			X:          p.XMin,
+			Y:          p.YMin,
+			W:          p.XMax - p.XMin,
+			H:          p.YMax - p.YMin,
+		})
+	}
+	return objects, nil
+}
+
+// detectionBoxes draws the boxes of the last detected objects
+// onto frames until they expire.
+type detectionBoxes struct {
+	mu      sync.Mutex
+	objects []detectedObject
+	until   time.Time
+
+	labels map[string]*image.Alpha // rendered labels
+}
+
+func (db *detectionBoxes) set(objects []detectedObject, until time.Time) {
+	db.mu.Lock()
+	db.objects, db.until = objects, until
+	db.mu.Unlock()
+}
+
+func (db *detectionBoxes) Enabled() bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return len(db.objects) > 0 && time.Now().Before(db.until)
+}
+
+func (db *detectionBoxes) Apply(img image.Image, t time.Time) image.Image {
+	db.mu.Lock()
+	objects := db.objects
+	if t.After(db.until) {
+		objects = nil
+	}
+	db.mu.Unlock()
+
+	white := color.Gray{Y: 235}
+	for _, o := range objects {
+		r := image.Rect(o.X, o.Y, o.X+o.W, o.Y+o.H)
+		fillGray(img, image.Rect(r.Min.X, r.Min.Y, r.Max.X, r.Min.Y+2), white)
+		fillGray(img, image.Rect(r.Min.X, r.Max.Y-2, r.Max.X, r.Max.Y), white)
+		fillGray(img, image.Rect(r.Min.X, r.Min.Y, r.Min.X+2, r.Max.Y), white)
+		fillGray(img, image.Rect(r.Max.X-2, r.Min.Y, r.Max.X, r.Max.Y), white)
+
+		if db.labels == nil {
+			db.labels = map[string]*image.Alpha{}
+		}
+		mask, ok := db.labels[o.Label]
+		if !ok {
+			mask = renderText(o.Label)
+			db.labels[o.Label] = mask
+		}
+		// draw the label inside the top left corner
+		min := r.Min.Add(image.Pt(4, 4))
+		fillGray(img, image.Rectangle{Min: min, Max: min.Add(mask.Rect.Size())}.Inset(-1), color.Gray{Y: 16})
+		for y := 0; y < mask.Rect.Dy(); y++ {
+			for x := 0; x < mask.Rect.Dx(); x++ {
+				if mask.AlphaAt(x, y).A >= 0x80 {
+					p := min.Add(image.Pt(x, y))
+					fillGray(img, image.Rectangle{Min: p, Max: p.Add(image.Pt(1, 1))}, white)
+				}
+			}
+		}
+	}
+	return img
+}
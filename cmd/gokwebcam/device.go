@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"image"
+	"strings"
+
+	"github.com/brutella/webcam"
+)
+
+// device is the video device frames are captured from. It is implemented
+// by *webcam.Webcam and by sources which don't need a camera, which
+// allows to run the whole daemon without one, e.g. for development.
+type device interface {
+	GetName() (string, error)
+	GetSupportedFormats() map[webcam.PixelFormat]string
+	GetSupportedFrameSizes(f webcam.PixelFormat) []webcam.FrameSize
+	GetSupportedFramerates(f webcam.PixelFormat, width, height uint32) []webcam.FrameRate
+	SetImageFormat(f webcam.PixelFormat, width, height uint32) (webcam.PixelFormat, uint32, uint32, error)
+	GetFramerate() (float32, error)
+	SetFramerate(fps float32) error
+	SetBufferCount(count uint32) error
+	GetBufferMode() webcam.BufferMode
+
+	GetControls() map[webcam.ControlID]webcam.Control
+	GetControl(id webcam.ControlID) (int32, error)
+	SetControl(id webcam.ControlID, value int32) error
+	GetCrop() (image.Rectangle, error)
+	GetDefaultCrop() (image.Rectangle, error)
+	SetCrop(r image.Rectangle) (image.Rectangle, error)
+
+	StartStreaming() error
+	StopStreaming() error
+	Frames(ctx context.Context) <-chan webcam.Frame
+	WaitForFrame(timeout uint32) error
+	GetFrame() ([]byte, uint32, error)
+	ReleaseFrame(index uint32) error
+	Close() error
+}
+
+// virtualDevice returns true if path is the
+// path of a device which doesn't need a driver.
+func virtualDevice(path string) bool {
+	return strings.HasPrefix(path, "fake:") || strings.HasPrefix(path, "test:") || strings.HasPrefix(path, "file:")
+}
+
+// openDevice opens the device at path. Paths starting with fake: or
+// test: open a fakeDevice, file: a recording which is replayed, and
+// other paths a v4l2 device.
+func openDevice(path string) (device, error) {
+	if strings.HasPrefix(path, "file:") {
+		d, err := newReplayDevice(path)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	if virtualDevice(path) {
+		d, err := newFakeDevice(path)
+		if err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+	cam, err := webcam.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	return cam, nil
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/brutella/webcam/cmd/gokwebcam/eventbus"
+)
+
+// diskCheckInterval is the interval between checks of the free space.
+const diskCheckInterval = 30 * time.Second
+
+// diskGuard watches the free space of the volume of the recordings, so
+// that continuous recording doesn't fill it up, e.g. the sd card of a
+// Raspberry Pi, which fails to boot once it is full. Below minFree,
+// the oldest recordings are deleted if prune is set. If the free space
+// stays below minFree, storage.low is published, which stops the
+// recorder until storage.recovered is published.
+type diskGuard struct {
+	dir     string
+	minFree diskThreshold
+	prune   bool
+	bus     *eventbus.Bus
+
+	free   atomic.Uint64 // bytes available at the last check
+	min    atomic.Uint64 // minFree in bytes at the last check
+	low    atomic.Bool
+	pruned atomic.Uint64 // number of deleted recordings
+}
+
+// diskThreshold is an amount of free space
+// in bytes or in percent of the volume.
+type diskThreshold struct {
+	bytes   uint64
+	percent float64
+}
+
+// parseDiskThreshold parses a threshold like 5%, 500M or 2G.
+// Sizes are multiples of 1024.
+func parseDiskThreshold(s string) (diskThreshold, error) {
+	if p, ok := strings.CutSuffix(s, "%"); ok {
+		v, err := strconv.ParseFloat(p, 64)
+		if err != nil || v < 0 || v >= 100 {
+			return diskThreshold{}, fmt.Errorf("invalid free space %q", s)
+		}
+		return diskThreshold{percent: v}, nil
+	}
+
+	unit := uint64(1)
+	if n := len(s); n > 0 {
+		if i := strings.IndexByte("KMGT", s[n-1]); i >= 0 {
+			unit = 1 << (10 * (i + 1))
+			s = s[:n-1]
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || v < 0 {
+		return diskThreshold{}, fmt.Errorf("invalid free space %q, expected a percentage like 5%% or a size like 500M", s)
+	}
+	return diskThreshold{bytes: uint64(v * float64(unit))}, nil
+}
+
+// of returns the threshold of a volume of total bytes.
+func (t diskThreshold) of(total uint64) uint64 {
+	if t.percent > 0 {
+		return uint64(float64(total) * t.percent / 100)
+	}
+	return t.bytes
+}
+
+// diskSpace returns the bytes available to the process
+// and the size of the volume of path.
+func diskSpace(path string) (free, total uint64, err error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, 0, err
+	}
+	return st.Bavail * uint64(st.Bsize), st.Blocks * uint64(st.Bsize), nil
+}
+
+// run checks the free space until the program exits.
+func (g *diskGuard) run() {
+	if err := os.MkdirAll(g.dir, 0755); err != nil {
+		logger.Error("creating directory failed", "dir", g.dir, "err", err)
+	}
+	for {
+		if err := g.check(); err != nil {
+			logger.Warn("checking free space failed", "dir", g.dir, "err", err)
+		}
+		time.Sleep(diskCheckInterval)
+	}
+}
+
+// check updates the free space, prunes recordings
+// and publishes changes of the state.
+func (g *diskGuard) check() error {
+	free, total, err := diskSpace(g.dir)
+	if err != nil {
+		return err
+	}
+	min := g.minFree.of(total)
+	if free < min && g.prune {
+		if free, err = g.pruneOldest(free, min); err != nil {
+			logger.Error("deleting recordings failed", "dir", g.dir, "err", err)
+		}
+	}
+	g.free.Store(free)
+	g.min.Store(min)
+
+	low := free < min
+	if low == g.low.Swap(low) {
+		return nil
+	}
+	data := map[string]interface{}{"dir": g.dir, "free": free, "min": min}
+	if low {
+		logger.Warn("recording volume is full, recording stopped", "dir", g.dir, "free", free, "min", min)
+		g.bus.Publish(eventbus.StorageLow, data)
+	} else {
+		logger.Info("recording volume has free space again, recording resumed", "dir", g.dir, "free", free, "min", min)
+		g.bus.Publish(eventbus.StorageRecovered, data)
+	}
+	return nil
+}
+
+// pruneOldest deletes the oldest recordings until at least min bytes
+// are free and returns the free space. The newest recording is kept,
+// it may still be recorded.
+func (g *diskGuard) pruneOldest(free, min uint64) (uint64, error) {
+	entries, err := os.ReadDir(g.dir)
+	if err != nil {
+		return free, err
+	}
+	type file struct {
+		path    string
+		modTime time.Time
+	}
+	var files []file
+	for _, e := range entries {
+		if e.IsDir() || filepath.Ext(e.Name()) != ".avi" {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			continue
+		}
+		files = append(files, file{filepath.Join(g.dir, e.Name()), info.ModTime()})
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].modTime.Before(files[j].modTime) })
+
+	for i := 0; i < len(files)-1 && free < min; i++ {
+		if err := os.Remove(files[i].path); err != nil {
+			return free, err
+		}
+		g.pruned.Add(1)
+		logger.Info("recording deleted to free space", "path", files[i].path)
+		if free, _, err = diskSpace(g.dir); err != nil {
+			return free, err
+		}
+	}
+	return free, nil
+}
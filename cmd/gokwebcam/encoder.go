@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"io"
+
+	"github.com/brutella/webcam"
+)
+
+// encoderBackends creates jpeg encoders by name for the -encoder flag.
+var encoderBackends = map[string]func(dev string, w, h uint32) (webcam.Encoder, error){
+	"sw": func(dev string, w, h uint32) (webcam.Encoder, error) {
+		return webcam.NewJPEGEncoder(0), nil
+	},
+	"hw": func(dev string, w, h uint32) (webcam.Encoder, error) {
+		return newHardwareEncoder(dev, w, h)
+	},
+}
+
+// hardwareFormats are the formats the hardware encoder handles:
+// yuyv frames are encoded and jpeg frames are passed through.
+var hardwareFormats = map[webcam.PixelFormat]bool{
+	V4L2_PIX_FMT_YUYV: true,
+	V4L2_PIX_FMT_MJPG: true,
+	V4L2_PIX_FMT_PJPG: true,
+}
+
+// hardwareEncoder encodes frames with a V4L2 memory-to-memory jpeg encoder.
+type hardwareEncoder struct {
+	m2m *webcam.M2M
+}
+
+func newHardwareEncoder(dev string, w, h uint32) (*hardwareEncoder, error) {
+	m2m, err := webcam.OpenM2M(dev)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := m2m.SetFormat(V4L2_PIX_FMT_YUYV, V4L2_PIX_FMT_JPEG, w, h); err != nil {
+		m2m.Close()
+		return nil, fmt.Errorf("%s: %v", dev, err)
+	}
+
+	if err := m2m.SetControl(webcam.ControlID(webcam.V4L2_CID_JPEG_COMPRESSION_QUALITY), 75); err != nil {
+		logger.Warn("setting jpeg quality failed", "device", dev, "err", err)
+	}
+
+	if err := m2m.StartStreaming(); err != nil {
+		m2m.Close()
+		return nil, fmt.Errorf("%s: %v", dev, err)
+	}
+
+	return &hardwareEncoder{m2m: m2m}, nil
+}
+
+func (e *hardwareEncoder) EncodeYUYV(w io.Writer, frame []byte, width, height int) error {
+	b, err := e.m2m.Process(frame, 5)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(b)
+	return err
+}
+
+func (e *hardwareEncoder) EncodeFrame(w io.Writer, img image.Image) error {
+	return errors.New("hardware encoder only supports yuyv frames")
+}
+
+// SetQuality sets the jpeg quality of the encoder device.
+func (e *hardwareEncoder) SetQuality(quality int) error {
+	return e.m2m.SetControl(webcam.ControlID(webcam.V4L2_CID_JPEG_COMPRESSION_QUALITY), int32(quality))
+}
+
+// Close closes the memory-to-memory device.
+func (e *hardwareEncoder) Close() error {
+	return e.m2m.Close()
+}
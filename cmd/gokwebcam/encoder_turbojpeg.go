@@ -0,0 +1,32 @@
+//go:build turbojpeg
+
+package main
+
+import (
+	"image"
+	"io"
+
+	"github.com/brutella/webcam"
+)
+
+func init() {
+	encoderBackends["turbo"] = func(dev string, w, h uint32) (webcam.Encoder, error) {
+		return webcam.NewTurboJPEGEncoder(75)
+	}
+	imageEncoders["progressive"] = imageEncoder{
+		contentType: "image/jpeg",
+		encode:      encodeProgressive,
+	}
+}
+
+// encodeProgressive encodes img as progressive jpeg, which image/jpeg
+// can't, so that large images are rendered while they are loaded.
+func encodeProgressive(w io.Writer, img image.Image) error {
+	enc, err := webcam.NewTurboJPEGEncoder(90)
+	if err != nil {
+		return err
+	}
+	defer enc.Close()
+	enc.Progressive = true
+	return enc.EncodeFrame(w, img)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/jpeg"
+	"math/bits"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+// frameHasher computes perceptual hashes of frames. The hash of
+// the last frame is cached, because polling clients mostly
+// request the same frame.
+type frameHasher struct {
+	mu   sync.Mutex
+	seq  uint64
+	last uint64
+}
+
+// hash returns the perceptual hash of frame.
+func (fh *frameHasher) hash(frame *frameBuffer) (uint64, error) {
+	fh.mu.Lock()
+	defer fh.mu.Unlock()
+
+	if fh.seq != 0 && fh.seq == frame.seq {
+		return fh.last, nil
+	}
+
+	img, err := jpeg.Decode(bytes.NewReader(frame.Bytes()))
+	if err != nil {
+		return 0, err
+	}
+	fh.seq, fh.last = frame.seq, dHash(img)
+	return fh.last, nil
+}
+
+// dHash returns the difference hash of img. Every bit tells whether
+// a pixel is brighter than its right neighbour in a 9x8 grayscale
+// version of img. Similar images have hashes with few different bits.
+func dHash(img image.Image) uint64 {
+	small := image.NewGray(image.Rect(0, 0, 9, 8))
+	draw.ApproxBiLinear.Scale(small, small.Rect, img, img.Bounds(), draw.Src, nil)
+
+	var h uint64
+	for y := 0; y < 8; y++ {
+		for x := 0; x < 8; x++ {
+			h <<= 1
+			if small.GrayAt(x, y).Y > small.GrayAt(x+1, y).Y {
+				h |= 1
+			}
+		}
+	}
+	return h
+}
+
+// imageETag returns a weak etag for a frame with perceptual hash
+// in the variant, e.g. format and size, requested by the client.
+func imageETag(hash uint64, variant string) string {
+	v := fnv.New32a()
+	v.Write([]byte(variant))
+	return fmt.Sprintf(`W/"%016x-%08x"`, hash, v.Sum32())
+}
+
+// matchETag returns the etag of the If-None-Match header which is of
+// the same variant and differs from hash by at most threshold bits.
+func matchETag(header string, hash uint64, variant string, threshold int) (string, bool) {
+	want := imageETag(hash, variant)
+	for _, etag := range strings.Split(header, ",") {
+		etag = strings.TrimSpace(etag)
+
+		// the hash and variant are encoded with a fixed width
+		if len(etag) != len(want) || etag[len(want)-10:] != want[len(want)-10:] {
+			continue
+		}
+		h, err := strconv.ParseUint(etag[3:19], 16, 64)
+		if err != nil {
+			continue
+		}
+		if bits.OnesCount64(h^hash) <= threshold {
+			return etag, true
+		}
+	}
+	return "", false
+}
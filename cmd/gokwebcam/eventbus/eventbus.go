@@ -0,0 +1,138 @@
+// Package eventbus delivers events between the subsystems of gokwebcam,
+// e.g. from the motion detector to the recorder and to webhooks.
+package eventbus
+
+import (
+	"sync"
+	"time"
+)
+
+// Type is the type of an event.
+type Type string
+
+// Event types
+const (
+	StreamStarted    Type = "stream.started"
+	StreamStopped    Type = "stream.stopped"
+	ClientConnected  Type = "client.connected"
+	ViewersChanged   Type = "viewers.changed"
+	CameraLost       Type = "camera.lost"
+	CameraRecovered  Type = "camera.recovered"
+	CameraError      Type = "camera.error"
+	SignalLost       Type = "signal.lost"
+	SignalChanged    Type = "signal.changed"
+	MotionDetected   Type = "motion.detected"
+	MotionStopped    Type = "motion.stopped"
+	ObjectDetected   Type = "object.detected"
+	RecordingStarted Type = "recording.started"
+	RecordingStopped Type = "recording.stopped"
+	ScheduleArmed    Type = "schedule.armed"
+	ScheduleDisarmed Type = "schedule.disarmed"
+	StorageLow       Type = "storage.low"
+	StorageRecovered Type = "storage.recovered"
+)
+
+// Event describes something that happened while serving the camera.
+type Event struct {
+	Type Type                   `json:"type"`
+	Time time.Time              `json:"time"`
+	Data map[string]interface{} `json:"data,omitempty"`
+}
+
+// Handler handles events. HandleEvent is called by the goroutine
+// which publishes the event and must not block.
+type Handler interface {
+	HandleEvent(e Event)
+}
+
+// HandlerFunc is a function which handles events.
+type HandlerFunc func(e Event)
+
+// HandleEvent calls f(e).
+func (f HandlerFunc) HandleEvent(e Event) {
+	f(e)
+}
+
+// Bus delivers published events to the handlers which subscribed to them.
+// The zero value is an empty bus.
+type Bus struct {
+	mu   sync.RWMutex
+	subs []*Subscription
+}
+
+// New returns an empty bus.
+func New() *Bus {
+	return &Bus{}
+}
+
+// Subscription is a handler subscribed to a bus.
+type Subscription struct {
+	bus     *Bus
+	handler Handler
+	types   map[Type]bool // nil matches all types
+}
+
+// Subscribe calls h for events of the given types, or for all
+// events if no types are given.
+func (b *Bus) Subscribe(h Handler, types ...Type) *Subscription {
+	s := &Subscription{bus: b, handler: h}
+	if len(types) > 0 {
+		s.types = make(map[Type]bool, len(types))
+		for _, t := range types {
+			s.types[t] = true
+		}
+	}
+
+	b.mu.Lock()
+	b.subs = append(b.subs, s)
+	b.mu.Unlock()
+	return s
+}
+
+// SubscribeChan sends events of the given types to a channel
+// with a buffer of size. Events are dropped while the buffer is full.
+func (b *Bus) SubscribeChan(size int, types ...Type) (<-chan Event, *Subscription) {
+	ch := make(chan Event, size)
+	s := b.Subscribe(HandlerFunc(func(e Event) {
+		select {
+		case ch <- e:
+		default:
+		}
+	}), types...)
+	return ch, s
+}
+
+// Unsubscribe stops the delivery of events. Events which are
+// published concurrently may still be delivered.
+func (s *Subscription) Unsubscribe() {
+	b := s.bus
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for i, sub := range b.subs {
+		if sub == s {
+			b.subs = append(b.subs[:i:i], b.subs[i+1:]...)
+			return
+		}
+	}
+}
+
+func (s *Subscription) matches(t Type) bool {
+	return s.types == nil || s.types[t]
+}
+
+// Publish delivers an event of typ with data to the subscribed handlers
+// in the order of their subscription. Data must not be modified afterwards.
+func (b *Bus) Publish(typ Type, data map[string]interface{}) {
+	e := Event{Type: typ, Time: time.Now(), Data: data}
+
+	b.mu.RLock()
+	subs := b.subs
+	b.mu.RUnlock()
+
+	for _, s := range subs {
+		if s.matches(typ) {
+			s.handler.HandleEvent(e)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brutella/webcam"
+	"golang.org/x/sys/unix"
+)
+
+// fakeDevice is a device which renders frames instead of capturing them,
+// to run and test the streaming pipeline and the http endpoints without a
+// camera. It is opened with -d fake: or with -d test: followed by the name
+// of a pattern of testPatterns, e.g. test:smpte, optionally with parameters:
+//
+//	test:ball?format=YUYV&size=640x480&fps=30&fail=1m
+//
+// format and size restrict the device to a format and frame size,
+// otherwise it supports MJPG and YUYV at common sizes. With fail,
+// reading frames fails with EIO after streaming this long, like a
+// camera which was unplugged and reconnected, to exercise the
+// recovery from errors.
+type fakeDevice struct {
+	pattern func(img *image.RGBA, seq uint32, t time.Time)
+	fail    time.Duration
+	formats map[webcam.PixelFormat]string
+	sizes   []webcam.FrameSize
+
+	mu            sync.Mutex
+	format        webcam.PixelFormat
+	width, height uint32
+	fps           float32
+	controls      map[webcam.ControlID]int32
+	streaming     bool
+	started       time.Time
+	seq           uint32
+	next          time.Time // time of the next frame read with GetFrame
+	img           *image.RGBA
+
+	// frames are read from a recording instead of
+	// being rendered if replay is set, see newReplayDevice
+	replay   *replay
+	pending  *replayFrame // the next frame of the recording
+	finished bool         // the recording ended
+}
+
+// fakeFormats are the formats of a fakeDevice.
+var fakeFormats = map[webcam.PixelFormat]string{
+	V4L2_PIX_FMT_MJPG: "Motion-JPEG",
+	V4L2_PIX_FMT_YUYV: "YUYV 4:2:2",
+}
+
+// fakeSizes are the frame sizes of a fakeDevice.
+var fakeSizes = []webcam.FrameSize{
+	{MinWidth: 320, MaxWidth: 320, MinHeight: 240, MaxHeight: 240},
+	{MinWidth: 640, MaxWidth: 640, MinHeight: 480, MaxHeight: 480},
+	{MinWidth: 1280, MaxWidth: 1280, MinHeight: 720, MaxHeight: 720},
+	{MinWidth: 1920, MaxWidth: 1920, MinHeight: 1080, MaxHeight: 1080},
+}
+
+// fakeControls are the controls of a fakeDevice with their defaults.
+var fakeControls = map[webcam.ControlID]webcam.Control{
+	webcam.ControlID(webcam.V4L2_CID_BASE + 0):                  {Name: "Brightness", Min: 0, Max: 255, Step: 1, Type: int32(webcam.V4L2_CTRL_TYPE_INTEGER)},
+	webcam.ControlID(webcam.V4L2_CID_BASE + 1):                  {Name: "Contrast", Min: 0, Max: 255, Step: 1, Type: int32(webcam.V4L2_CTRL_TYPE_INTEGER)},
+	webcam.ControlID(webcam.V4L2_CID_AUTO_WHITE_BALANCE):        {Name: "White Balance, Automatic", Min: 0, Max: 1, Step: 1, Type: int32(webcam.V4L2_CTRL_TYPE_BOOLEAN)},
+	webcam.ControlID(webcam.V4L2_CID_POWER_LINE_FREQUENCY):      {Name: "Power Line Frequency", Min: 0, Max: 2, Step: 1, Type: int32(webcam.V4L2_CTRL_TYPE_MENU)},
+	webcam.ControlID(webcam.V4L2_CID_WHITE_BALANCE_TEMPERATURE): {Name: "White Balance Temperature", Min: 2800, Max: 6500, Step: 10, Type: int32(webcam.V4L2_CTRL_TYPE_INTEGER)},
+	webcam.ControlID(webcam.V4L2_CID_BACKLIGHT_COMPENSATION):    {Name: "Backlight Compensation", Min: 0, Max: 1, Step: 1, Type: int32(webcam.V4L2_CTRL_TYPE_INTEGER)},
+	webcam.ControlID(webcam.V4L2_CID_FOCUS_ABSOLUTE):            {Name: "Focus (absolute)", Min: 0, Max: 250, Step: 5, Type: int32(webcam.V4L2_CTRL_TYPE_INTEGER)},
+	webcam.ControlID(webcam.V4L2_CID_FOCUS_AUTO):                {Name: "Focus, Auto", Min: 0, Max: 1, Step: 1, Type: int32(webcam.V4L2_CTRL_TYPE_BOOLEAN)},
+}
+
+// newFakeDevice returns a fakeDevice configured by the parameters of spec.
+func newFakeDevice(spec string) (*fakeDevice, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	q := u.Query()
+
+	name := u.Opaque
+	if name == "" {
+		name = "gradient"
+		if u.Scheme == "test" {
+			name = "smpte"
+		}
+	}
+	pattern, ok := testPatterns[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown test pattern %q", name)
+	}
+
+	d := &fakeDevice{
+		pattern:  pattern,
+		format:   V4L2_PIX_FMT_MJPG,
+		width:    640,
+		height:   480,
+		fps:      30,
+		controls: map[webcam.ControlID]int32{},
+		formats:  fakeFormats,
+		sizes:    fakeSizes,
+	}
+	for id, c := range fakeControls {
+		d.controls[id] = (c.Min + c.Max + 1) / 2
+	}
+
+	if s := q.Get("format"); s != "" {
+		if d.format, err = fourcc(s); err != nil {
+			return nil, err
+		}
+		desc, ok := fakeFormats[d.format]
+		if !ok {
+			return nil, fmt.Errorf("format %s is not supported by fake devices", s)
+		}
+		d.formats = map[webcam.PixelFormat]string{d.format: desc}
+	}
+	if s := q.Get("size"); s != "" {
+		if d.width, d.height, err = parseSize(s); err != nil {
+			return nil, err
+		}
+		d.sizes = []webcam.FrameSize{{MinWidth: d.width, MaxWidth: d.width, MinHeight: d.height, MaxHeight: d.height}}
+	}
+	if s := q.Get("fps"); s != "" {
+		fps, err := strconv.ParseFloat(s, 32)
+		if err != nil || fps <= 0 {
+			return nil, fmt.Errorf("invalid fps %q", s)
+		}
+		d.fps = float32(fps)
+	}
+	if s := q.Get("fail"); s != "" {
+		if d.fail, err = time.ParseDuration(s); err != nil {
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+func (d *fakeDevice) GetName() (string, error) {
+	return "test-pattern", nil
+}
+
+func (d *fakeDevice) GetSupportedFormats() map[webcam.PixelFormat]string {
+	formats := map[webcam.PixelFormat]string{}
+	for f, s := range d.formats {
+		formats[f] = s
+	}
+	return formats
+}
+
+func (d *fakeDevice) GetSupportedFrameSizes(f webcam.PixelFormat) []webcam.FrameSize {
+	if _, ok := d.formats[f]; !ok {
+		return nil
+	}
+	return append([]webcam.FrameSize(nil), d.sizes...)
+}
+
+func (d *fakeDevice) GetSupportedFramerates(f webcam.PixelFormat, width, height uint32) []webcam.FrameRate {
+	return []webcam.FrameRate{
+		{MinNumerator: 1, MaxNumerator: 1, MinDenominator: 30, MaxDenominator: 30},
+		{MinNumerator: 1, MaxNumerator: 1, MinDenominator: 15, MaxDenominator: 15},
+	}
+}
+
+// SetImageFormat sets the format and any frame size,
+// unlike cameras which choose the nearest supported size.
+func (d *fakeDevice) SetImageFormat(f webcam.PixelFormat, width, height uint32) (webcam.PixelFormat, uint32, uint32, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.streaming {
+		return 0, 0, 0, unix.EBUSY
+	}
+	if _, ok := d.formats[f]; !ok {
+		return 0, 0, 0, unix.EINVAL
+	}
+	if width == 0 || height == 0 {
+		return 0, 0, 0, unix.EINVAL
+	}
+	d.format, d.width, d.height = f, width, height
+	return f, width, height, nil
+}
+
+func (d *fakeDevice) GetFramerate() (float32, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.fps, nil
+}
+
+func (d *fakeDevice) SetFramerate(fps float32) error {
+	if fps <= 0 {
+		return unix.EINVAL
+	}
+	d.mu.Lock()
+	d.fps = fps
+	d.mu.Unlock()
+	return nil
+}
+
+func (d *fakeDevice) SetBufferCount(count uint32) error {
+	return nil
+}
+
+func (d *fakeDevice) GetBufferMode() webcam.BufferMode {
+	return webcam.BufferModeMMAP
+}
+
+func (d *fakeDevice) GetControls() map[webcam.ControlID]webcam.Control {
+	controls := map[webcam.ControlID]webcam.Control{}
+	for id, c := range fakeControls {
+		controls[id] = c
+	}
+	return controls
+}
+
+func (d *fakeDevice) GetControl(id webcam.ControlID) (int32, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	value, ok := d.controls[id]
+	if !ok {
+		return 0, unix.EINVAL
+	}
+	return value, nil
+}
+
+func (d *fakeDevice) SetControl(id webcam.ControlID, value int32) error {
+	c, ok := fakeControls[id]
+	if !ok || value < c.Min || value > c.Max {
+		return unix.EINVAL
+	}
+	d.mu.Lock()
+	d.controls[id] = value
+	d.mu.Unlock()
+	return nil
+}
+
+// Fake devices can't crop, frames are cropped in software.
+
+func (d *fakeDevice) GetCrop() (image.Rectangle, error) {
+	return image.Rectangle{}, unix.ENOTTY
+}
+
+func (d *fakeDevice) GetDefaultCrop() (image.Rectangle, error) {
+	return image.Rectangle{}, unix.ENOTTY
+}
+
+func (d *fakeDevice) SetCrop(r image.Rectangle) (image.Rectangle, error) {
+	return image.Rectangle{}, unix.ENOTTY
+}
+
+func (d *fakeDevice) StartStreaming() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.streaming {
+		return errors.New("Already streaming")
+	}
+	d.streaming = true
+	d.started = time.Now()
+	d.next = d.started
+	d.seq = 0
+	return nil
+}
+
+func (d *fakeDevice) StopStreaming() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !d.streaming {
+		return errors.New("Request to stop streaming when not streaming")
+	}
+	d.streaming = false
+	return nil
+}
+
+// Frames renders frames at the frame rate until ctx is done.
+func (d *fakeDevice) Frames(ctx context.Context) <-chan webcam.Frame {
+	frames := make(chan webcam.Frame)
+	go func() {
+		defer close(frames)
+		for {
+			err := d.WaitForFrame(1)
+			if ctx.Err() != nil {
+				return
+			}
+			switch err.(type) {
+			case nil:
+			case *webcam.Timeout:
+				continue
+			default:
+				select {
+				case frames <- webcam.Frame{Err: err}:
+				case <-ctx.Done():
+				}
+				return
+			}
+
+			f, err := d.frame()
+			if err != nil {
+				f = webcam.Frame{Err: err}
+			}
+			select {
+			case frames <- f:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return frames
+}
+
+// WaitForFrame waits until the next frame is due.
+func (d *fakeDevice) WaitForFrame(timeout uint32) error {
+	d.mu.Lock()
+	streaming, started, next, finished := d.streaming, d.started, d.next, d.finished
+	d.mu.Unlock()
+
+	if !streaming {
+		return errors.New("Not streaming")
+	}
+	if d.fail > 0 && time.Since(started) > d.fail {
+		return unix.EIO
+	}
+	wait := time.Until(next)
+	if finished || wait > time.Duration(timeout)*time.Second {
+		time.Sleep(time.Duration(timeout) * time.Second)
+		return new(webcam.Timeout)
+	}
+	time.Sleep(wait)
+	return nil
+}
+
+// GetFrame renders the next frame. Its index is always 0.
+func (d *fakeDevice) GetFrame() ([]byte, uint32, error) {
+	f, err := d.frame()
+	return f.Data, 0, err
+}
+
+func (d *fakeDevice) ReleaseFrame(index uint32) error {
+	return nil
+}
+
+func (d *fakeDevice) Close() error {
+	if d.replay != nil {
+		return d.replay.file.Close()
+	}
+	return nil
+}
+
+// frame renders the next frame in the current format.
+func (d *fakeDevice) frame() (webcam.Frame, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.replay != nil {
+		return d.replayFrame()
+	}
+
+	now := time.Now()
+	d.next = d.next.Add(time.Duration(float32(time.Second) / d.fps))
+	if d.next.Before(now) {
+		// don't catch up after a slow consumer
+		d.next = now
+	}
+
+	r := image.Rect(0, 0, int(d.width), int(d.height))
+	if d.img == nil || d.img.Rect != r {
+		d.img = image.NewRGBA(r)
+	}
+	d.pattern(d.img, d.seq, now)
+
+	f := webcam.Frame{
+		Timestamp: now,
+		Sequence:  d.seq,
+		Format:    d.format,
+		Width:     d.width,
+		Height:    d.height,
+		FD:        -1,
+	}
+	d.seq++
+
+	switch d.format {
+	case V4L2_PIX_FMT_YUYV:
+		f.Stride = 2 * d.width
+		f.Data = appendYUYV(nil, d.img)
+	default:
+		var b bytes.Buffer
+		if err := jpeg.Encode(&b, d.img, &jpeg.Options{Quality: 80}); err != nil {
+			return f, err
+		}
+		f.Data = b.Bytes()
+	}
+	return f, nil
+}
+
+// appendYUYV appends img as YUYV 4:2:2 to b.
+func appendYUYV(b []byte, img *image.RGBA) []byte {
+	r := img.Rect
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x+1 < r.Max.X; x += 2 {
+			p0 := img.RGBAAt(x, y)
+			p1 := img.RGBAAt(x+1, y)
+			y0, cb, cr := color.RGBToYCbCr(p0.R, p0.G, p0.B)
+			y1, _, _ := color.RGBToYCbCr(p1.R, p1.G, p1.B)
+			b = append(b, y0, cb, y1, cr)
+		}
+	}
+	return b
+}
+
+// gradientPattern draws a diagonal gradient which moves with every frame.
+func gradientPattern(img *image.RGBA, seq uint32, t time.Time) {
+	r := img.Rect
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			v := uint8(x + y + int(seq)*4)
+			img.SetRGBA(x, y, color.RGBA{R: v, G: uint8(y), B: 255 - v, A: 255})
+		}
+	}
+}
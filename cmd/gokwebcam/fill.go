@@ -0,0 +1,43 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+)
+
+// fillGray fills r of img with a gray color.
+// Images in the YCbCr color space are modified in place,
+// other images must implement draw.Image.
+func fillGray(img image.Image, r image.Rectangle, c color.Gray) {
+	r = r.Intersect(img.Bounds())
+	if r.Empty() {
+		return
+	}
+
+	switch img := img.(type) {
+	case *image.YCbCr:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			i := img.YOffset(r.Min.X, y)
+			fill(img.Y[i:i+r.Dx()], c.Y)
+			for x := r.Min.X; x < r.Max.X; x++ {
+				ci := img.COffset(x, y)
+				img.Cb[ci] = 128
+				img.Cr[ci] = 128
+			}
+		}
+	case *image.Gray:
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			i := img.PixOffset(r.Min.X, y)
+			fill(img.Pix[i:i+r.Dx()], c.Y)
+		}
+	case draw.Image:
+		draw.Draw(img, r, image.NewUniform(c), image.Point{}, draw.Src)
+	}
+}
+
+func fill(b []byte, v byte) {
+	for i := range b {
+		b[i] = v
+	}
+}
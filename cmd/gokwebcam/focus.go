@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/brutella/webcam"
+)
+
+var (
+	focusAuto     = webcam.ControlID(webcam.V4L2_CID_FOCUS_AUTO)
+	focusAbsolute = webcam.ControlID(webcam.V4L2_CID_FOCUS_ABSOLUTE)
+	focusStart    = webcam.ControlID(webcam.V4L2_CID_AUTO_FOCUS_START)
+)
+
+var (
+	errNoFocus     = errors.New("camera has no focus controls")
+	errNoAutofocus = errors.New("camera has no autofocus")
+	errFocusing    = errors.New("camera is already focusing")
+)
+
+// focusHandler returns the focus of the camera (GET) and sets it (POST
+// with auto=0|1 and/or absolute). Setting the absolute focus turns off
+// autofocus. The focus controls are also available with /controls.
+type focusHandler struct {
+	cam device
+
+	// settle is how long autofocus is enabled to focus once
+	settle time.Duration
+	mu     sync.Mutex // held while focusing once
+}
+
+// focusInfo is the json representation of the focus of the camera.
+// Auto and Absolute are omitted if the camera doesn't have the control.
+type focusInfo struct {
+	Auto     *bool  `json:"auto,omitempty"`
+	Absolute *int32 `json:"absolute,omitempty"`
+	Min      int32  `json:"min"`
+	Max      int32  `json:"max"`
+	Step     int32  `json:"step"`
+}
+
+func (h *focusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if s := r.FormValue("absolute"); s != "" {
+			v, err := strconv.ParseInt(s, 10, 32)
+			if err != nil {
+				http.Error(w, "invalid absolute focus", http.StatusBadRequest)
+				return
+			}
+			if err := h.setAbsolute(int32(v)); err != nil {
+				logger.Warn("setting focus failed", "absolute", v, "err", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.Info("focus set", "absolute", v)
+		}
+		if s := r.FormValue("auto"); s != "" {
+			auto, err := strconv.ParseBool(s)
+			if err != nil {
+				http.Error(w, "invalid auto focus", http.StatusBadRequest)
+				return
+			}
+			if err := h.setAuto(auto); err != nil {
+				logger.Warn("setting autofocus failed", "auto", auto, "err", err)
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			logger.Info("autofocus set", "auto", auto)
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	info, err := h.current()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
+
+// current returns the focus of the camera.
+func (h *focusHandler) current() (focusInfo, error) {
+	var info focusInfo
+	controls := h.cam.GetControls()
+	if _, ok := controls[focusAuto]; ok {
+		if v, err := h.cam.GetControl(focusAuto); err == nil {
+			auto := v != 0
+			info.Auto = &auto
+		}
+	}
+	if c, ok := controls[focusAbsolute]; ok {
+		if v, err := h.cam.GetControl(focusAbsolute); err == nil {
+			info.Absolute = &v
+		}
+		info.Min, info.Max, info.Step = c.Min, c.Max, c.Step
+	}
+	if info.Auto == nil && info.Absolute == nil {
+		return info, errNoFocus
+	}
+	return info, nil
+}
+
+func (h *focusHandler) setAuto(auto bool) error {
+	var v int32
+	if auto {
+		v = 1
+	}
+	return h.cam.SetControl(focusAuto, v)
+}
+
+// setAbsolute turns off autofocus, because
+// cameras ignore the absolute focus otherwise.
+func (h *focusHandler) setAbsolute(v int32) error {
+	if _, ok := h.cam.GetControls()[focusAuto]; ok {
+		if err := h.setAuto(false); err != nil {
+			return err
+		}
+	}
+	return h.cam.SetControl(focusAbsolute, v)
+}
+
+// trigger focuses the camera once. Cameras with a one-shot autofocus
+// start it, other cameras enable continuous autofocus for the settle
+// duration and keep the focus found after disabling it again, which
+// is how UVC cameras focus once. Cameras with continuous autofocus
+// enabled are already in focus.
+func (h *focusHandler) trigger() error {
+	if !h.mu.TryLock() {
+		return errFocusing
+	}
+	defer h.mu.Unlock()
+
+	if h.cam.SetControl(focusStart, 1) == nil {
+		logger.Info("autofocus started")
+		return nil
+	}
+	if _, ok := h.cam.GetControls()[focusAuto]; !ok {
+		return errNoAutofocus
+	}
+	if v, err := h.cam.GetControl(focusAuto); err == nil && v != 0 {
+		return nil
+	}
+	if err := h.setAuto(true); err != nil {
+		return err
+	}
+	time.Sleep(h.settle)
+	if err := h.setAuto(false); err != nil {
+		return err
+	}
+	// set the focus found, so that it is saved with -controls-state
+	if v, err := h.cam.GetControl(focusAbsolute); err == nil {
+		h.cam.SetControl(focusAbsolute, v)
+	}
+	logger.Info("camera focused", "settle", h.settle)
+	return nil
+}
+
+// focusTriggerHandler focuses the camera once (POST), e.g. after a
+// document was placed under a document camera. It responds with the
+// focus after focusing.
+type focusTriggerHandler struct {
+	*focusHandler
+}
+
+func (h focusTriggerHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if err := h.trigger(); err != nil {
+		logger.Warn("focusing failed", "err", err)
+		status := http.StatusBadRequest
+		switch err {
+		case errFocusing:
+			status = http.StatusConflict
+		case errNoAutofocus:
+			status = http.StatusNotFound
+		}
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	info, err := h.current()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
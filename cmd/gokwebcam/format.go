@@ -0,0 +1,52 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/brutella/webcam"
+)
+
+// defaultFormatPriority lists the formats in the order they are preferred.
+// Compressed formats come first because they don't need to be encoded.
+const defaultFormatPriority = "MJPG,PJPG,YUYV,NV12,YU12,YV12,RGB3,BGR3,RGBP,RGGB,GRBG,GBRG,BA81,RG10,BA10,GB10,BG10,GREY"
+
+// fourcc returns the pixel format for a four character code like "YUYV".
+func fourcc(code string) (webcam.PixelFormat, error) {
+	if len(code) != 4 {
+		return 0, fmt.Errorf("invalid four character code %q", code)
+	}
+
+	return webcam.PixelFormat(uint32(code[0]) | uint32(code[1])<<8 | uint32(code[2])<<16 | uint32(code[3])<<24), nil
+}
+
+// fourccString returns the four character code of a pixel format.
+func fourccString(f webcam.PixelFormat) string {
+	return string([]byte{byte(f), byte(f >> 8), byte(f >> 16), byte(f >> 24)})
+}
+
+// parseFormatPriority parses a comma separated list of four character codes.
+func parseFormatPriority(list string) ([]webcam.PixelFormat, error) {
+	var formats []webcam.PixelFormat
+	for _, code := range strings.Split(list, ",") {
+		f, err := fourcc(strings.TrimSpace(code))
+		if err != nil {
+			return nil, err
+		}
+		formats = append(formats, f)
+	}
+
+	return formats, nil
+}
+
+// selectFormat returns the first format in priority which is
+// available and supported.
+func selectFormat(available map[webcam.PixelFormat]string, priority []webcam.PixelFormat) (webcam.PixelFormat, bool) {
+	for _, f := range priority {
+		if _, ok := available[f]; ok && supportedFormats[f] {
+			return f, true
+		}
+	}
+
+	return 0, false
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+)
+
+// formatHandler returns the format, frame size and frame rate of the
+// camera (GET) and changes them (POST with a json formatConfig).
+// Reading frames is paused while the camera is reconfigured,
+// so that clients stay connected and receive frames of the new
+// format afterwards.
+type formatHandler struct {
+	sc *streamControl
+
+	// privacy masks are defined for the frame size
+	// and the size can't be changed if masks are used
+	fixedSize bool
+
+	// the hardware encoder only supports some formats
+	hwEncoder bool
+}
+
+// formatConfig is the json representation of the streaming configuration.
+type formatConfig struct {
+	Width  uint32  `json:"width"`
+	Height uint32  `json:"height"`
+	Format string  `json:"format"` // four character code
+	FPS    float32 `json:"fps,omitempty"`
+}
+
+func (h *formatHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var cfg formatConfig
+		if err := json.NewDecoder(r.Body).Decode(&cfg); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if err := h.set(cfg); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(h.config())
+}
+
+// config returns the current streaming configuration.
+func (h *formatHandler) config() formatConfig {
+	format, width, height := h.sc.current()
+	cfg := formatConfig{
+		Width:  width,
+		Height: height,
+		Format: fourccString(format),
+	}
+	cfg.FPS, _ = h.sc.cam.GetFramerate()
+	return cfg
+}
+
+// set pauses reading frames and reconfigures the camera.
+func (h *formatHandler) set(cfg formatConfig) error {
+	h.sc.pause()
+	err := h.apply(cfg)
+	h.sc.resume()
+	if err != nil {
+		logger.Warn("changing format failed", "err", err)
+	}
+	return err
+}
+
+// apply validates cfg and reconfigures the camera. Empty fields keep
+// the current value. Reading frames must be paused.
+func (h *formatHandler) apply(cfg formatConfig) error {
+	format := h.sc.format
+	if cfg.Format != "" {
+		f, err := fourcc(cfg.Format)
+		if err != nil {
+			return err
+		}
+		if _, ok := h.sc.cam.GetSupportedFormats()[f]; !ok || !supportedFormats[f] {
+			return fmt.Errorf("format %s is not supported", cfg.Format)
+		}
+		if h.hwEncoder && !hardwareFormats[f] {
+			return fmt.Errorf("format %s is not supported by the hardware encoder", cfg.Format)
+		}
+		format = f
+	}
+
+	width, height := h.sc.width, h.sc.height
+	if cfg.Width != 0 || cfg.Height != 0 {
+		if cfg.Width == 0 || cfg.Height == 0 {
+			return fmt.Errorf("width and height are required")
+		}
+		sizes := h.sc.cam.GetSupportedFrameSizes(format)
+		if len(sizes) == 0 {
+			return fmt.Errorf("no supported frame sizes")
+		}
+
+		var exact bool
+		width, height, exact = fitSize(sizes, cfg.Width, cfg.Height)
+		if !exact {
+			return fmt.Errorf("frame size %dx%d is not supported", cfg.Width, cfg.Height)
+		}
+	}
+	if h.fixedSize && (width != h.sc.width || height != h.sc.height) {
+		return fmt.Errorf("frame size can't be changed with privacy masks")
+	}
+
+	if cfg.FPS < 0 {
+		return fmt.Errorf("invalid fps")
+	}
+
+	logger.Info("changing format", "format", fourccString(format), "width", width, "height", height, "fps", cfg.FPS)
+	if err := h.sc.reconfigure(format, width, height, cfg.FPS); err != nil {
+		return err
+	}
+	logger.Info("resulting image format", "format", fourccString(h.sc.format), "width", h.sc.width, "height", h.sc.height)
+	return nil
+}
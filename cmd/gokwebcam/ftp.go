@@ -0,0 +1,272 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const ftpTimeout = 30 * time.Second
+
+// ftpStorage uploads files to a directory of an FTP server in passive mode.
+// Files are uploaded to a temporary name first and renamed when complete,
+// so that the server never serves a partially uploaded file.
+type ftpStorage struct {
+	addr     string
+	dir      string
+	username string
+	password string
+}
+
+func newFTPStorage(u *url.URL) *ftpStorage {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	username := u.User.Username()
+	if username == "" {
+		username = "anonymous"
+	}
+	password, _ := u.User.Password()
+	return &ftpStorage{
+		addr:     addr,
+		dir:      u.Path,
+		username: username,
+		password: password,
+	}
+}
+
+func (s *ftpStorage) put(name string, r io.Reader, size int64) error {
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer c.quit()
+
+	// create the directories of the file
+	dir := path.Dir(name)
+	if dir != "." {
+		var p string
+		for _, elem := range strings.Split(dir, "/") {
+			p = path.Join(p, elem)
+			// fails if the directory exists
+			c.cmd(257, "MKD %s", p)
+		}
+	}
+
+	tmp := path.Join(dir, "."+path.Base(name)+".part")
+	if err := c.store(tmp, r); err != nil {
+		return err
+	}
+	if _, err := c.cmd(350, "RNFR %s", tmp); err != nil {
+		return err
+	}
+	_, err = c.cmd(250, "RNTO %s", name)
+	return err
+}
+
+func (s *ftpStorage) list() ([]storedObject, error) {
+	c, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer c.quit()
+
+	b, err := c.retrieve("MLSD")
+	if err != nil {
+		return nil, err
+	}
+
+	var objs []storedObject
+	for _, line := range strings.Split(string(b), "\n") {
+		// type=file;size=123;modify=20230101120000; name
+		facts, name, ok := strings.Cut(strings.TrimRight(line, "\r"), " ")
+		if !ok || strings.HasPrefix(name, ".") {
+			continue
+		}
+		obj := storedObject{name: name}
+		file := false
+		for _, fact := range strings.Split(facts, ";") {
+			k, v, _ := strings.Cut(fact, "=")
+			switch strings.ToLower(k) {
+			case "type":
+				file = strings.EqualFold(v, "file")
+			case "size":
+				obj.size, _ = strconv.ParseInt(v, 10, 64)
+			case "modify":
+				// fractions of seconds are optional
+				if len(v) > 14 {
+					v = v[:14]
+				}
+				obj.modTime, _ = time.Parse("20060102150405", v)
+			}
+		}
+		if file {
+			objs = append(objs, obj)
+		}
+	}
+	return objs, nil
+}
+
+func (s *ftpStorage) remove(name string) error {
+	c, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer c.quit()
+
+	_, err = c.cmd(250, "DELE %s", name)
+	return err
+}
+
+// dial connects and logs in to the server and changes to the directory.
+func (s *ftpStorage) dial() (*ftpConn, error) {
+	conn, err := net.DialTimeout("tcp", s.addr, ftpTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Minute))
+
+	c := &ftpConn{conn: conn, text: textproto.NewConn(conn)}
+	if err := c.login(s.username, s.password, s.dir); err != nil {
+		c.text.Close()
+		return nil, fmt.Errorf("ftp: %v", err)
+	}
+	return c, nil
+}
+
+// ftpConn is the control connection to an FTP server.
+type ftpConn struct {
+	conn net.Conn
+	text *textproto.Conn
+}
+
+func (c *ftpConn) login(username, password, dir string) error {
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		return err
+	}
+
+	code, _, err := c.cmdCode("USER %s", username)
+	if err != nil {
+		return err
+	}
+	if code == 331 {
+		if _, err := c.cmd(230, "PASS %s", password); err != nil {
+			return err
+		}
+	} else if code != 230 {
+		return fmt.Errorf("USER: unexpected code %d", code)
+	}
+
+	if _, err := c.cmd(200, "TYPE I"); err != nil {
+		return err
+	}
+	if dir != "" && dir != "/" {
+		if _, err := c.cmd(250, "CWD %s", dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cmd sends a command and expects a response with code.
+func (c *ftpConn) cmd(code int, format string, args ...interface{}) (string, error) {
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+
+	_, msg, err := c.text.ReadResponse(code)
+	return msg, err
+}
+
+// cmdCode sends a command and returns the code of the response.
+func (c *ftpConn) cmdCode(format string, args ...interface{}) (int, string, error) {
+	id, err := c.text.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+	c.text.StartResponse(id)
+	defer c.text.EndResponse(id)
+
+	return c.text.ReadResponse(0)
+}
+
+// passive opens a data connection with EPSV.
+func (c *ftpConn) passive() (net.Conn, error) {
+	// 229 Entering Extended Passive Mode (|||port|)
+	msg, err := c.cmd(229, "EPSV")
+	if err != nil {
+		return nil, err
+	}
+	start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("invalid EPSV response %q", msg)
+	}
+	port := msg[start+4 : end]
+
+	host, _, _ := net.SplitHostPort(c.conn.RemoteAddr().String())
+	return net.DialTimeout("tcp", net.JoinHostPort(host, port), ftpTimeout)
+}
+
+// store uploads r to name.
+func (c *ftpConn) store(name string, r io.Reader) error {
+	data, err := c.passive()
+	if err != nil {
+		return err
+	}
+
+	code, msg, err := c.cmdCode("STOR %s", name)
+	if err == nil && code != 125 && code != 150 {
+		err = fmt.Errorf("STOR: %d %s", code, msg)
+	}
+	if err != nil {
+		data.Close()
+		return err
+	}
+
+	_, err = io.Copy(data, r)
+	if cerr := data.Close(); err == nil {
+		err = cerr
+	}
+	if _, _, rerr := c.text.ReadResponse(2); err == nil {
+		err = rerr
+	}
+	return err
+}
+
+// retrieve returns the data of a command like MLSD.
+func (c *ftpConn) retrieve(command string) ([]byte, error) {
+	data, err := c.passive()
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+
+	code, msg, err := c.cmdCode(command)
+	if err != nil {
+		return nil, err
+	}
+	if code != 125 && code != 150 {
+		return nil, fmt.Errorf("%s: %d %s", command, code, msg)
+	}
+
+	b, err := io.ReadAll(data)
+	if _, _, rerr := c.text.ReadResponse(2); err == nil {
+		err = rerr
+	}
+	return b, err
+}
+
+func (c *ftpConn) quit() {
+	c.cmd(221, "QUIT")
+	c.text.Close()
+}
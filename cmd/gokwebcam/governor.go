@@ -0,0 +1,127 @@
+package main
+
+import (
+	"time"
+
+	"github.com/brutella/webcam"
+)
+
+const (
+	governorMaxQuality = 75 // default quality of the encoders
+	governorMaxSkip    = 9  // encode at least every 10th frame
+	governorInterval   = time.Second
+
+	// fraction of the time between frames used for encoding
+	governorHigh = 0.9
+	governorLow  = 0.5
+)
+
+// qualityEncoder is an encoder whose jpeg quality can be changed.
+type qualityEncoder interface {
+	SetQuality(quality int) error
+}
+
+// governor measures the time to encode frames and lowers the jpeg quality,
+// and then the frame rate, when the encoder can't keep up with the camera.
+// Once the encoder has headroom again, the frame rate and quality are raised.
+// It is only used by the encoding goroutine.
+type governor struct {
+	minQuality int
+	maxQuality int
+
+	quality int
+	skip    int // frames skipped after every encoded frame
+	n       int // frames since the last encoded frame
+
+	encode   float64   // moving average of the encode duration in seconds
+	interval float64   // moving average of the time between frames in seconds
+	last     time.Time // time of the last frame
+	adjusted time.Time
+}
+
+func newGovernor(minQuality int) *governor {
+	return &governor{
+		minQuality: minQuality,
+		maxQuality: governorMaxQuality,
+		quality:    governorMaxQuality,
+	}
+}
+
+// skipFrame returns true if the frame captured at t should be dropped
+// to lower the frame rate.
+func (g *governor) skipFrame(t time.Time) bool {
+	if !g.last.IsZero() {
+		g.interval = average(g.interval, t.Sub(g.last).Seconds())
+	}
+	g.last = t
+
+	if g.n < g.skip {
+		g.n++
+		stats.framesSkipped.Add(1)
+		return true
+	}
+	g.n = 0
+	return false
+}
+
+// observe records the encode duration of a frame and adjusts
+// the quality of enc or the frame rate at most once per interval.
+func (g *governor) observe(enc webcam.Encoder, d time.Duration) {
+	g.encode = average(g.encode, d.Seconds())
+	if g.interval == 0 || time.Since(g.adjusted) < governorInterval {
+		return
+	}
+
+	// the encoder has the time of all skipped frames
+	load := g.encode / (g.interval * float64(g.skip+1))
+	quality, skip := g.quality, g.skip
+	switch {
+	case load > governorHigh && quality > g.minQuality:
+		quality -= 10
+		if quality < g.minQuality {
+			quality = g.minQuality
+		}
+	case load > governorHigh && skip < governorMaxSkip:
+		skip++
+	case load < governorLow && skip > 0:
+		skip--
+	case load < governorLow && quality < g.maxQuality:
+		quality += 5
+		if quality > g.maxQuality {
+			quality = g.maxQuality
+		}
+	default:
+		return
+	}
+	g.adjusted = time.Now()
+
+	if skip != g.skip {
+		logger.Info("adjusting frame rate", "load", load, "skip", skip)
+		g.skip = skip
+	}
+	if quality != g.quality {
+		logger.Info("adjusting jpeg quality", "load", load, "quality", quality)
+		g.quality = quality
+		g.apply(enc)
+	}
+}
+
+// apply sets the quality of enc, e.g. after the encoder was recreated.
+func (g *governor) apply(enc webcam.Encoder) {
+	stats.jpegQuality.Store(int32(g.quality))
+	qe, ok := enc.(qualityEncoder)
+	if !ok {
+		return
+	}
+	if err := qe.SetQuality(g.quality); err != nil {
+		logger.Warn("setting jpeg quality failed", "quality", g.quality, "err", err)
+	}
+}
+
+// average returns the exponential moving average of avg and v.
+func average(avg, v float64) float64 {
+	if avg == 0 {
+		return v
+	}
+	return 0.9*avg + 0.1*v
+}
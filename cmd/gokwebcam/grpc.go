@@ -0,0 +1,295 @@
+package main
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"image"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brutella/webcam/cmd/gokwebcam/eventbus"
+)
+
+// gRPC status codes
+const (
+	grpcOK              = 0
+	grpcCanceled        = 1
+	grpcInvalidArgument = 3
+	grpcUnimplemented   = 12
+	grpcInternal        = 13
+)
+
+// grpcMaxRequest is the max size of request messages.
+const grpcMaxRequest = 1 << 20
+
+// grpcError is returned by grpc methods to respond with a status.
+type grpcError struct {
+	code int
+	msg  string
+}
+
+func (e *grpcError) Error() string {
+	return e.msg
+}
+
+// grpcCall is the server side of a call.
+type grpcCall struct {
+	w http.ResponseWriter
+	r *http.Request
+}
+
+// recv reads the next request message.
+func (c *grpcCall) recv() ([]byte, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(c.r.Body, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0] != 0 {
+		return nil, &grpcError{grpcUnimplemented, "compression is not supported"}
+	}
+	n := binary.BigEndian.Uint32(header[1:])
+	if n > grpcMaxRequest {
+		return nil, &grpcError{grpcInvalidArgument, "message too large"}
+	}
+	msg := make([]byte, n)
+	if _, err := io.ReadFull(c.r.Body, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+// send writes a response message.
+func (c *grpcCall) send(msg protoMessage) error {
+	var header [5]byte
+	binary.BigEndian.PutUint32(header[1:], uint32(len(msg)))
+	if _, err := c.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := c.w.Write(msg); err != nil {
+		return err
+	}
+	return http.NewResponseController(c.w).Flush()
+}
+
+// grpcMethod implements a method of a grpc service.
+type grpcMethod func(c *grpcCall) error
+
+// ServeHTTP calls m and sends its status in the trailers.
+func (m grpcMethod) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost || r.ProtoMajor != 2 ||
+		!strings.HasPrefix(r.Header.Get("Content-Type"), "application/grpc") {
+		http.Error(w, "grpc requires a http/2 post request", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	h := w.Header()
+	h.Set("Content-Type", "application/grpc+proto")
+	h.Set("Trailer", "Grpc-Status, Grpc-Message")
+	w.WriteHeader(http.StatusOK)
+
+	code, msg := grpcOK, ""
+	if err := m(&grpcCall{w: w, r: r}); err != nil {
+		var gerr *grpcError
+		switch {
+		case errors.As(err, &gerr):
+			code, msg = gerr.code, gerr.msg
+		case r.Context().Err() != nil:
+			code, msg = grpcCanceled, "canceled"
+		default:
+			code, msg = grpcInternal, err.Error()
+		}
+		logger.Debug("grpc call failed", "path", r.URL.Path, "remote", r.RemoteAddr, "code", code, "err", err)
+	}
+	h.Set("Grpc-Status", strconv.Itoa(code))
+	if msg != "" {
+		h.Set("Grpc-Message", url.PathEscape(msg))
+	}
+}
+
+// grpcService implements the services of gokwebcam.proto.
+type grpcService struct {
+	streams  *scaledStreams
+	controls *controlsHandler
+	format   *formatHandler
+	bus      *eventbus.Bus
+}
+
+// handler returns the handler of the service methods. Subscribe
+// is wrapped with the optional streamGate.
+func (s *grpcService) handler(streamGate middleware) http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/gokwebcam.Capture/Subscribe", chain(grpcMethod(s.subscribe), streamGate))
+	mux.Handle("/gokwebcam.Device/ListControls", grpcMethod(s.listControls))
+	mux.Handle("/gokwebcam.Device/SetFormat", grpcMethod(s.setFormat))
+	return mux
+}
+
+// grpcEndpoints are the http endpoints which correspond to the service
+// methods. The methods are authenticated and authorized like them.
+var grpcEndpoints = map[string]struct{ method, path string }{
+	"/gokwebcam.Capture/Subscribe":   {http.MethodGet, "/video"},
+	"/gokwebcam.Device/ListControls": {http.MethodGet, "/controls"},
+	"/gokwebcam.Device/SetFormat":    {http.MethodPost, "/format"},
+}
+
+// grpcAuth returns a middleware which authenticates calls with auth
+// as requests of their endpoint, e.g. SetFormat requires the admin role
+// like POST /format. Calls of unknown methods are passed to next.
+func grpcAuth(auth middleware) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			e, ok := grpcEndpoints[r.URL.Path]
+			if !ok {
+				next.ServeHTTP(w, r)
+				return
+			}
+			ar := r.Clone(r.Context())
+			ar.Method, ar.URL.Path = e.method, e.path
+			auth(http.HandlerFunc(func(w http.ResponseWriter, ar *http.Request) {
+				// the call keeps the context of the authenticated client
+				next.ServeHTTP(w, r.WithContext(ar.Context()))
+			})).ServeHTTP(w, ar)
+		})
+	}
+}
+
+// subscribe streams frames until the call is canceled. Frames are sent
+// as fast as http/2 flow control allows, and skipped otherwise.
+func (s *grpcService) subscribe(c *grpcCall) error {
+	req, err := c.recv()
+	if err != nil {
+		return err
+	}
+	var (
+		size image.Point
+		fps  float32
+	)
+	err = decodeProto(req, func(num int, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			size.X = int(v)
+		case 2:
+			size.Y = int(v)
+		case 3:
+			fps = math.Float32frombits(uint32(v))
+		}
+		return nil
+	})
+	if err != nil {
+		return &grpcError{grpcInvalidArgument, err.Error()}
+	}
+	if fps < 0 || math.IsNaN(float64(fps)) {
+		return &grpcError{grpcInvalidArgument, "invalid fps"}
+	}
+	var interval time.Duration
+	if fps > 0 {
+		interval = time.Duration(float64(time.Second) / float64(fps))
+	}
+
+	r, disconnect := stats.connect("/grpc", c.r)
+	defer disconnect()
+	logger.Info("connect", "remote", r.RemoteAddr, "url", r.URL)
+	s.bus.Publish(eventbus.ClientConnected, map[string]interface{}{
+		"remote": r.RemoteAddr,
+		"url":    r.URL.String(),
+	})
+
+	frames, unsubscribe := s.streams.subscribe(size, interval)
+	defer unsubscribe()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return r.Context().Err()
+		case img := <-frames:
+			msg := protoMessage(nil).
+				uint(1, img.seq).
+				int(2, img.time.UnixNano()).
+				bytes(3, img.Bytes())
+			err := c.send(msg)
+			if err == nil {
+				stats.bytesServed.Add(uint64(len(img.Bytes())))
+				stats.sent(r, img)
+			}
+			img.release()
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *grpcService) listControls(c *grpcCall) error {
+	if _, err := c.recv(); err != nil {
+		return err
+	}
+
+	var msg protoMessage
+	for _, ci := range s.controls.list() {
+		control := protoMessage(nil).
+			uint(1, uint64(ci.ID)).
+			string(2, ci.Name).
+			int(3, int64(ci.Type)).
+			int(4, int64(ci.Min)).
+			int(5, int64(ci.Max)).
+			int(6, int64(ci.Step)).
+			int(7, int64(ci.Value))
+		msg = msg.message(1, control)
+	}
+	return c.send(msg)
+}
+
+func (s *grpcService) setFormat(c *grpcCall) error {
+	req, err := c.recv()
+	if err != nil {
+		return err
+	}
+	var cfg formatConfig
+	err = decodeProto(req, func(num int, v uint64, b []byte) error {
+		switch num {
+		case 1:
+			cfg.Width = uint32(v)
+		case 2:
+			cfg.Height = uint32(v)
+		case 3:
+			cfg.Format = string(b)
+		case 4:
+			cfg.FPS = math.Float32frombits(uint32(v))
+		}
+		return nil
+	})
+	if err != nil {
+		return &grpcError{grpcInvalidArgument, err.Error()}
+	}
+
+	if err := s.format.set(cfg); err != nil {
+		return &grpcError{grpcInvalidArgument, err.Error()}
+	}
+
+	cfg = s.format.config()
+	return c.send(protoMessage(nil).
+		uint(1, uint64(cfg.Width)).
+		uint(2, uint64(cfg.Height)).
+		string(3, cfg.Format).
+		float(4, cfg.FPS))
+}
+
+// serveGRPC serves h over http/2 with tls, which grpc requires
+// as the standard library doesn't support unencrypted http/2.
+func serveGRPC(ln net.Listener, h http.Handler, tlsConfig *tls.Config) {
+	srv := &http.Server{
+		Handler:   h,
+		TLSConfig: tlsConfig,
+		ErrorLog:  log.New(logWriter{}, "", 0),
+	}
+	logger.Info("listening", "addr", ln.Addr(), "proto", "grpc")
+	logger.Fatal("grpc server failed", "err", srv.ServeTLS(ln, "", ""))
+}
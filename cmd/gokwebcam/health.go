@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// health tracks the state of the capture loop.
+type health struct {
+	streaming atomic.Bool
+	lastFrame atomic.Int64 // unix nano
+	maxAge    time.Duration
+
+	// waiting returns true while no frames are expected,
+	// e.g. while a capture card has no signal, optional
+	waiting func() bool
+}
+
+// frame records that a frame was captured.
+func (h *health) frame() {
+	h.lastFrame.Store(time.Now().UnixNano())
+}
+
+// ready returns an error if no frame was captured within the max age.
+func (h *health) ready() error {
+	if !h.streaming.Load() {
+		return fmt.Errorf("camera is not streaming")
+	}
+
+	last := h.lastFrame.Load()
+	if last == 0 {
+		return fmt.Errorf("no frame captured yet")
+	}
+
+	if age := time.Since(time.Unix(0, last)); age > h.maxAge {
+		return fmt.Errorf("last frame captured %v ago", age.Round(time.Millisecond))
+	}
+
+	return nil
+}
+
+// alive returns an error if the capture loop is stuck, i.e. if it isn't
+// ready although frames are expected. Waiting for frames is not stuck.
+func (h *health) alive() error {
+	if h.waiting != nil && h.waiting() {
+		return nil
+	}
+	return h.ready()
+}
+
+// handleHealthz responds if the process is alive.
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	fmt.Fprintln(w, "ok")
+}
+
+// ServeHTTP responds with 200 if the camera is ready and 503 otherwise.
+func (h *health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	if err := h.ready(); err != nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, err)
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
@@ -0,0 +1,17 @@
+package main
+
+// homekitConfig configures the HomeKit IP camera accessory.
+type homekitConfig struct {
+	name    string // name of the accessory in the Home app
+	pin     string // setup code, e.g. 00102003
+	dir     string // directory of the pairings and keys
+	addr    string // addr of the hap server, e.g. :0 for a random port
+	ffmpeg  string // ffmpeg binary which encodes the streams
+	encoder string // h.264 encoder of ffmpeg, e.g. libx264
+	bc      *broadcaster
+}
+
+// startHomeKit pairs with the Home app and serves snapshots and
+// streams of the frames of cfg.bc. It is only set when built with
+// the homekit build tag, because it requires github.com/brutella/hap.
+var startHomeKit func(cfg homekitConfig) error
@@ -0,0 +1,274 @@
+//go:build homekit
+
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"sync"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/rtp"
+	"github.com/brutella/hap/service"
+	"github.com/brutella/hap/tlv8"
+)
+
+func init() {
+	startHomeKit = runHomeKit
+}
+
+// runHomeKit starts the hap server of a camera accessory. Snapshots are
+// the latest jpeg frames, streams are encoded to h.264 by ffmpeg, which
+// reads the jpeg frames on stdin and sends them with srtp to the Home app.
+func runHomeKit(cfg homekitConfig) error {
+	if _, err := exec.LookPath(cfg.ffmpeg); err != nil {
+		return err
+	}
+
+	cam := accessory.NewCamera(accessory.Info{
+		Name:         cfg.name,
+		Manufacturer: "gokwebcam",
+		Model:        "v4l2",
+		Firmware:     "1.0",
+	})
+	hs := &homekitStreams{cfg: cfg, sessions: map[string]*homekitSession{}}
+	hs.setup(cam.StreamManagement1)
+	hs.setup(cam.StreamManagement2)
+
+	s, err := hap.NewServer(hap.NewFsStore(cfg.dir), cam.A)
+	if err != nil {
+		return err
+	}
+	s.Pin = cfg.pin
+	s.Addr = cfg.addr
+
+	// snapshots are requested with a post of the resource type and size
+	s.ServeMux().HandleFunc("/resource", func(w http.ResponseWriter, r *http.Request) {
+		if !s.IsAuthorized(r) {
+			hap.JsonError(w, hap.JsonStatusInsufficientPrivileges)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req struct {
+			Type string `json:"resource-type"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Type != "image" {
+			http.Error(w, "unsupported resource", http.StatusBadRequest)
+			return
+		}
+
+		img := cfg.bc.next()
+		defer img.release()
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Content-Length", strconv.Itoa(len(img.Bytes())))
+		w.Write(img.Bytes())
+	})
+
+	go func() {
+		if err := s.ListenAndServe(context.Background()); err != nil {
+			logger.Error("homekit", "err", err)
+		}
+	}()
+	logger.Info("homekit accessory started", "name", cfg.name)
+	return nil
+}
+
+// homekitStreams negotiates the streams of the camera
+// and runs an ffmpeg process per stream.
+type homekitStreams struct {
+	cfg homekitConfig
+
+	mu       sync.Mutex
+	sessions map[string]*homekitSession
+}
+
+// homekitSession is a stream negotiated with the Home app.
+type homekitSession struct {
+	req  rtp.SetupEndpoints
+	resp rtp.SetupEndpointsResponse
+	cmd  *exec.Cmd
+}
+
+// setup advertises the supported stream configurations of m
+// and handles the requests of the Home app.
+func (hs *homekitStreams) setup(m *service.CameraRTPStreamManagement) {
+	setTLV8(m.StreamingStatus.Bytes, rtp.StreamingStatus{Status: rtp.StreamingStatusAvailable})
+	setTLV8(m.SupportedRTPConfiguration.Bytes, rtp.NewConfiguration(rtp.CryptoSuite_AES_CM_128_HMAC_SHA1_80))
+	setTLV8(m.SupportedVideoStreamConfiguration.Bytes, rtp.DefaultVideoStreamConfiguration())
+	setTLV8(m.SupportedAudioStreamConfiguration.Bytes, rtp.DefaultAudioStreamConfiguration())
+
+	m.SetupEndpoints.OnValueRemoteUpdate(func(b []byte) {
+		var req rtp.SetupEndpoints
+		if err := tlv8.Unmarshal(b, &req); err != nil {
+			logger.Error("homekit: invalid endpoints", "err", err)
+			return
+		}
+		// the stream is sent from the address which reaches the controller
+		ip, err := localIP(net.ParseIP(req.ControllerAddr.IPAddr))
+		if err != nil {
+			logger.Error("homekit", "err", err)
+			return
+		}
+		resp := rtp.SetupEndpointsResponse{
+			SessionId: req.SessionId,
+			Status:    rtp.SessionStatusSuccess,
+			AccessoryAddr: rtp.Addr{
+				IPVersion:    req.ControllerAddr.IPVersion,
+				IPAddr:       ip.String(),
+				VideoRtpPort: req.ControllerAddr.VideoRtpPort,
+				AudioRtpPort: req.ControllerAddr.AudioRtpPort,
+			},
+			Video:     req.Video,
+			Audio:     req.Audio,
+			SsrcVideo: rand.Int31(),
+			SsrcAudio: rand.Int31(),
+		}
+
+		hs.mu.Lock()
+		hs.sessions[string(req.SessionId)] = &homekitSession{req: req, resp: resp}
+		hs.mu.Unlock()
+		setTLV8(m.SetupEndpoints.Bytes, resp)
+	})
+
+	m.SelectedRTPStreamConfiguration.OnValueRemoteUpdate(func(b []byte) {
+		var cfg rtp.StreamConfiguration
+		if err := tlv8.Unmarshal(b, &cfg); err != nil {
+			logger.Error("homekit: invalid stream configuration", "err", err)
+			return
+		}
+
+		id := string(cfg.Command.Identifier)
+		switch cfg.Command.Type {
+		case rtp.SessionControlCommandTypeStart:
+			if err := hs.start(id, cfg.Video); err != nil {
+				logger.Error("homekit: starting stream failed", "err", err)
+			}
+		case rtp.SessionControlCommandTypeEnd:
+			hs.stop(id, true)
+		case rtp.SessionControlCommandTypeReconfigure:
+			hs.stop(id, false)
+			if err := hs.start(id, cfg.Video); err != nil {
+				logger.Error("homekit: reconfiguring stream failed", "err", err)
+			}
+		}
+	})
+}
+
+// start runs ffmpeg for the negotiated session id with the video
+// parameters selected by the Home app, and writes the frames to it
+// until the session is stopped.
+func (hs *homekitStreams) start(id string, video rtp.VideoParameters) error {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	sess := hs.sessions[id]
+	if sess == nil {
+		return fmt.Errorf("unknown session %x", id)
+	}
+	if sess.cmd != nil {
+		return nil
+	}
+
+	// the srtp key is the master key followed by the master salt
+	key := base64.StdEncoding.EncodeToString(append(append([]byte{}, sess.req.Video.MasterKey...), sess.req.Video.MasterSalt...))
+	addr := net.JoinHostPort(sess.req.ControllerAddr.IPAddr, strconv.Itoa(int(sess.req.ControllerAddr.VideoRtpPort)))
+	port := strconv.Itoa(int(sess.req.ControllerAddr.VideoRtpPort))
+	mtu := video.RTP.MTU
+	if mtu == 0 {
+		mtu = 1378
+	}
+
+	args := []string{
+		"-hide_banner", "-loglevel", "error",
+		"-f", "mjpeg", "-use_wallclock_as_timestamps", "1", "-i", "-",
+		"-an",
+		"-c:v", hs.cfg.encoder,
+	}
+	if hs.cfg.encoder == "libx264" {
+		args = append(args, "-preset", "ultrafast", "-tune", "zerolatency")
+	}
+	args = append(args,
+		"-pix_fmt", "yuv420p",
+		"-vf", fmt.Sprintf("scale=%d:%d:force_original_aspect_ratio=decrease,pad=ceil(iw/2)*2:ceil(ih/2)*2", video.Attributes.Width, video.Attributes.Height),
+		"-r", strconv.Itoa(int(video.Attributes.Framerate)),
+		"-b:v", fmt.Sprintf("%dk", video.RTP.Bitrate),
+		"-payload_type", strconv.Itoa(int(video.RTP.PayloadType)),
+		"-ssrc", strconv.Itoa(int(sess.resp.SsrcVideo)),
+		"-f", "rtp",
+		"-srtp_out_suite", "AES_CM_128_HMAC_SHA1_80",
+		"-srtp_out_params", key,
+		fmt.Sprintf("srtp://%s?rtcpport=%s&pkt_size=%d", addr, port, mtu),
+	)
+	cmd := exec.Command(hs.cfg.ffmpeg, args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	// errors of ffmpeg are logged as warnings
+	cmd.Stderr = logWriter{}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	sess.cmd = cmd
+	logger.Info("homekit stream started", "addr", addr, "width", video.Attributes.Width, "height", video.Attributes.Height, "fps", video.Attributes.Framerate)
+
+	go func() {
+		ch := hs.cfg.bc.subscribe()
+		defer hs.cfg.bc.unsubscribe(ch)
+		for b := range ch {
+			_, err := stdin.Write(b.Bytes())
+			b.release()
+			if err != nil {
+				// ffmpeg exited
+				return
+			}
+		}
+	}()
+	go func() {
+		err := cmd.Wait()
+		stdin.Close()
+		logger.Info("homekit stream stopped", "addr", addr, "err", err)
+	}()
+	return nil
+}
+
+// stop stops the ffmpeg process of the session id,
+// and forgets the session if it ended.
+func (hs *homekitStreams) stop(id string, end bool) {
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	sess := hs.sessions[id]
+	if sess == nil {
+		return
+	}
+	if sess.cmd != nil {
+		sess.cmd.Process.Kill()
+		sess.cmd = nil
+	}
+	if end {
+		delete(hs.sessions, id)
+	}
+}
+
+// setTLV8 sets the value of c to v encoded as tlv8.
+func setTLV8(c *characteristic.Bytes, v interface{}) {
+	b, err := tlv8.Marshal(v)
+	if err != nil {
+		logger.Error("homekit", "err", err)
+		return
+	}
+	c.SetValue(b)
+}
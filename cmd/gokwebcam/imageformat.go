@@ -0,0 +1,134 @@
+package main
+
+import (
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// imageEncoder encodes a frame in an output format of /image.
+type imageEncoder struct {
+	contentType string
+	encode      func(w io.Writer, img image.Image) error
+}
+
+// imageEncoders are the formats of /image by the value of ?format=.
+// Frames are returned unchanged as jpeg unless they are resized.
+// Progressive jpegs are available when building with the
+// turbojpeg build tag.
+var imageEncoders = map[string]imageEncoder{
+	"jpeg": {
+		contentType: "image/jpeg",
+		encode: func(w io.Writer, img image.Image) error {
+			return jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+		},
+	},
+	"png": {
+		contentType: "image/png",
+		encode:      png.Encode,
+	},
+	"webp": {
+		contentType: "image/webp",
+		encode:      encodeWebP,
+	},
+}
+
+// saveDataEncoder encodes /image for clients which send Save-Data: on
+// with a lower quality.
+var saveDataEncoder = imageEncoder{
+	contentType: "image/jpeg",
+	encode: func(w io.Writer, img image.Image) error {
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 50})
+	},
+}
+
+// negotiateImageFormat returns the format of /image which is acceptable
+// by the Accept header with the highest quality value. Ties are broken
+// by the preferred format, then by jpeg, which is sent without
+// re-encoding. The lossless formats are only chosen for clients which
+// send Save-Data if jpeg isn't acceptable. Formats without an encoder,
+// e.g. avif, are never chosen. The preferred format is returned if no
+// format is acceptable.
+func negotiateImageFormat(accept, preferred string, saveData bool) string {
+	if accept == "" {
+		return preferred
+	}
+	ranges := parseAccept(accept)
+
+	candidates := []string{preferred, "jpeg"}
+	if saveData {
+		candidates = []string{"jpeg", preferred}
+	}
+	var names []string
+	for name := range imageEncoders {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	candidates = append(candidates, names...)
+
+	best, bestQ := preferred, 0.0
+	for _, name := range candidates {
+		enc, ok := imageEncoders[name]
+		if !ok {
+			continue
+		}
+		if q := acceptQuality(ranges, enc.contentType); q > bestQ {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+// acceptRange is a media range of an Accept header with its quality value.
+type acceptRange struct {
+	typ, subtype string
+	q            float64
+}
+
+// parseAccept returns the media ranges of an Accept header.
+func parseAccept(accept string) []acceptRange {
+	var ranges []acceptRange
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		typ, subtype, ok := strings.Cut(strings.ToLower(strings.TrimSpace(params[0])), "/")
+		if !ok {
+			continue
+		}
+		r := acceptRange{typ: typ, subtype: subtype, q: 1}
+		for _, p := range params[1:] {
+			if k, v, ok := strings.Cut(strings.TrimSpace(p), "="); ok && strings.EqualFold(k, "q") {
+				if q, err := strconv.ParseFloat(v, 64); err == nil && q >= 0 && q <= 1 {
+					r.q = q
+				}
+			}
+		}
+		ranges = append(ranges, r)
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality value of the most specific
+// range of ranges which matches the content type, 0 if none.
+func acceptQuality(ranges []acceptRange, contentType string) float64 {
+	typ, subtype, _ := strings.Cut(contentType, "/")
+	q, specificity := 0.0, -1
+	for _, r := range ranges {
+		s := -1
+		switch {
+		case r.typ == typ && r.subtype == subtype:
+			s = 2
+		case r.typ == typ && r.subtype == "*":
+			s = 1
+		case r.typ == "*" && r.subtype == "*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
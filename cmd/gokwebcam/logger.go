@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels
+const (
+	LevelDebug = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"DEBUG", "INFO", "WARN", "ERROR"}
+
+// logger is the logger used by the program.
+var logger = &leveledLogger{out: os.Stderr, level: LevelInfo}
+
+// leveledLogger writes log messages with a level and
+// optional key-value pairs as text or json.
+type leveledLogger struct {
+	mu    sync.Mutex
+	out   io.Writer
+	level int
+	json  bool
+}
+
+// parseLevel returns the log level for a name like "debug" or "warn".
+func parseLevel(name string) (int, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(n, name) {
+			return i, nil
+		}
+	}
+	if strings.EqualFold(name, "warning") {
+		return LevelWarn, nil
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// parseFormat reports whether the log format name is "json", or an error
+// if it is neither "text" nor "json".
+func parseFormat(name string) (bool, error) {
+	switch strings.ToLower(name) {
+	case "text":
+		return false, nil
+	case "json":
+		return true, nil
+	}
+	return false, fmt.Errorf("unknown log format %q", name)
+}
+
+func (l *leveledLogger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *leveledLogger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *leveledLogger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *leveledLogger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+// Fatal logs an error and exits the program.
+func (l *leveledLogger) Fatal(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+	os.Exit(1)
+}
+
+func (l *leveledLogger) log(level int, msg string, kv []interface{}) {
+	if level < l.level {
+		return
+	}
+
+	now := time.Now()
+	var line []byte
+	if l.json {
+		m := map[string]interface{}{
+			"time":  now.Format(time.RFC3339Nano),
+			"level": strings.ToLower(levelNames[level]),
+			"msg":   msg,
+		}
+		for i := 0; i < len(kv); i += 2 {
+			m[key(kv, i)] = jsonValue(value(kv, i))
+		}
+		line, _ = json.Marshal(m)
+	} else {
+		var b strings.Builder
+		b.WriteString(now.Format("2006/01/02 15:04:05 "))
+		b.WriteString(levelNames[level])
+		b.WriteByte(' ')
+		b.WriteString(msg)
+		for i := 0; i < len(kv); i += 2 {
+			fmt.Fprintf(&b, " %s=%s", key(kv, i), textValue(value(kv, i)))
+		}
+		line = []byte(b.String())
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.out.Write(append(line, '\n'))
+}
+
+func key(kv []interface{}, i int) string {
+	if s, ok := kv[i].(string); ok {
+		return s
+	}
+	return fmt.Sprint(kv[i])
+}
+
+func value(kv []interface{}, i int) interface{} {
+	if i+1 < len(kv) {
+		return kv[i+1]
+	}
+	return "!MISSING"
+}
+
+func jsonValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case fmt.Stringer:
+		return v.String()
+	}
+	return v
+}
+
+func textValue(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return fmt.Sprintf("%q", s)
+	}
+	return s
+}
+
+// logRequests logs every request with its duration and number
+// of bytes written once the request is done.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		lw := &loggingResponseWriter{ResponseWriter: w, status: http.StatusOK}
+
+		logger.Debug("request started", "remote", r.RemoteAddr, "method", r.Method, "url", redactURL(r.URL))
+		next.ServeHTTP(lw, r)
+		logger.Info("request",
+			"remote", r.RemoteAddr,
+			"method", r.Method,
+			"url", redactURL(r.URL),
+			"status", lw.status,
+			"bytes", lw.written,
+			"duration", time.Since(start))
+	})
+}
+
+// secretParams are query parameters which grant access, see authenticator.
+var secretParams = []string{"token", "share"}
+
+// redactURL returns u without the values of secretParams,
+// so that they are not logged.
+func redactURL(u *url.URL) *url.URL {
+	q := u.Query()
+	redacted := false
+	for _, p := range secretParams {
+		if q.Has(p) {
+			q.Set(p, "redacted")
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u
+	}
+	v := *u
+	v.RawQuery = q.Encode()
+	return &v
+}
+
+// loggingResponseWriter records the status code and
+// the number of bytes written to a response.
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status  int
+	written int64
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(b)
+	w.written += int64(n)
+	return n, err
+}
+
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap returns the wrapped writer for http.ResponseController.
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *loggingResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := w.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, fmt.Errorf("hijacking not supported")
+}
+
+// logWriter writes log messages of the standard library,
+// e.g. errors of the http server, as warnings.
+type logWriter struct{}
+
+func (logWriter) Write(b []byte) (int, error) {
+	logger.Warn(strings.TrimSpace(string(b)))
+	return len(b), nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// privacyMask blacks out regions of every frame.
+// The regions are stored as rectangles; polygons are
+// broken up into one rectangle per row.
+type privacyMask struct {
+	rects []image.Rectangle
+}
+
+// parseMask parses a rectangle "x,y,w,h" or a polygon
+// "x1,y1;x2,y2;x3,y3;..." and adds it to the mask.
+func (m *privacyMask) parseMask(s string) error {
+	var pts []image.Point
+	for _, p := range strings.Split(s, ";") {
+		var nums []int
+		for _, v := range strings.Split(p, ",") {
+			n, err := strconv.Atoi(strings.TrimSpace(v))
+			if err != nil {
+				return fmt.Errorf("invalid mask %q", s)
+			}
+			nums = append(nums, n)
+		}
+
+		switch {
+		case len(nums) == 4 && !strings.Contains(s, ";"):
+			m.rects = append(m.rects, image.Rect(nums[0], nums[1], nums[0]+nums[2], nums[1]+nums[3]))
+			return nil
+		case len(nums) == 2:
+			pts = append(pts, image.Pt(nums[0], nums[1]))
+		default:
+			return fmt.Errorf("invalid mask %q", s)
+		}
+	}
+
+	if len(pts) < 3 {
+		return fmt.Errorf("mask %q needs at least 3 points", s)
+	}
+	m.rects = append(m.rects, polygonRects(pts)...)
+	return nil
+}
+
+func (m *privacyMask) Enabled() bool {
+	return len(m.rects) > 0
+}
+
+func (m *privacyMask) Apply(img image.Image, t time.Time) image.Image {
+	for _, r := range m.rects {
+		fillGray(img, r, color.Gray{Y: 16})
+	}
+	return img
+}
+
+// polygonRects returns rectangles of one row each which cover
+// the inside of the polygon pts (even-odd rule).
+func polygonRects(pts []image.Point) []image.Rectangle {
+	minY, maxY := pts[0].Y, pts[0].Y
+	for _, p := range pts {
+		if p.Y < minY {
+			minY = p.Y
+		}
+		if p.Y > maxY {
+			maxY = p.Y
+		}
+	}
+
+	var rects []image.Rectangle
+	for y := minY; y < maxY; y++ {
+		// sample at the center of the row
+		cy := float64(y) + 0.5
+
+		var xs []float64
+		for i := range pts {
+			a, b := pts[i], pts[(i+1)%len(pts)]
+			if (float64(a.Y) <= cy) == (float64(b.Y) <= cy) {
+				continue
+			}
+			xs = append(xs, float64(a.X)+(cy-float64(a.Y))*float64(b.X-a.X)/float64(b.Y-a.Y))
+		}
+		sort.Float64s(xs)
+
+		for i := 0; i+1 < len(xs); i += 2 {
+			x0, x1 := int(xs[i]+0.5), int(xs[i+1]+0.5)
+			if x1 > x0 {
+				rects = append(rects, image.Rect(x0, y, x1, y+1))
+			}
+		}
+	}
+
+	return rects
+}
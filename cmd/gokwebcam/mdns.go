@@ -0,0 +1,291 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"strings"
+	"time"
+)
+
+// DNS record types
+const (
+	dnsTypeA   = 1
+	dnsTypePTR = 12
+	dnsTypeTXT = 16
+	dnsTypeSRV = 33
+	dnsTypeANY = 255
+
+	dnsClassIN         = 1
+	dnsClassCacheFlush = 0x8000
+	dnsTTL             = 120
+)
+
+var mdnsGroup = &net.UDPAddr{IP: net.IPv4(224, 0, 0, 251), Port: 5353}
+
+// mdnsService is a service advertised via multicast dns.
+type mdnsService struct {
+	typ string // e.g. "_http._tcp"
+	txt []string
+}
+
+// mdns advertises services of the host via multicast dns
+// as described in RFC 6762 and RFC 6763.
+type mdns struct {
+	instance string // name of the service instances
+	host     string // host name without .local
+	port     uint16
+	services []mdnsService
+}
+
+// run announces the services and answers queries until the program exits.
+func (m *mdns) run() {
+	conn, err := net.ListenMulticastUDP("udp4", nil, mdnsGroup)
+	if err != nil {
+		logger.Warn("mdns: advertisement disabled", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	go m.announce(conn)
+
+	buf := make([]byte, 9000)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			logger.Error("mdns", "err", err)
+			continue
+		}
+
+		id, questions, err := parseDNSQuery(buf[:n])
+		if err != nil || len(questions) == 0 {
+			continue
+		}
+
+		ip, err := localIP(from.IP)
+		if err != nil {
+			logger.Error("mdns", "err", err)
+			continue
+		}
+
+		answers, extra := m.answer(questions, ip)
+		if len(answers) == 0 {
+			continue
+		}
+
+		// legacy unicast queries are answered directly
+		to := mdnsGroup
+		if from.Port != mdnsGroup.Port {
+			to = from
+		} else {
+			id = 0
+		}
+		if _, err := conn.WriteToUDP(dnsResponse(id, answers, extra), to); err != nil {
+			logger.Error("mdns", "err", err)
+		}
+	}
+}
+
+// announce sends unsolicited responses with all records.
+func (m *mdns) announce(conn *net.UDPConn) {
+	ip, err := localIP(mdnsGroup.IP)
+	if err != nil {
+		logger.Warn("mdns: announcement failed", "err", err)
+		return
+	}
+
+	var questions []dnsQuestion
+	for _, s := range m.services {
+		questions = append(questions, dnsQuestion{name: s.typ + ".local.", typ: dnsTypePTR})
+	}
+	answers, extra := m.answer(questions, ip)
+	msg := dnsResponse(0, append(answers, extra...), nil)
+
+	for i := 0; i < 2; i++ {
+		if _, err := conn.WriteToUDP(msg, mdnsGroup); err != nil {
+			logger.Warn("mdns: announcement failed", "err", err)
+			return
+		}
+		time.Sleep(time.Second)
+	}
+	logger.Info("mdns: services announced", "instance", m.instance, "host", m.host+".local")
+}
+
+// answer returns the answers and additional records for questions.
+func (m *mdns) answer(questions []dnsQuestion, ip net.IP) (answers, extra [][]byte) {
+	host := m.host + ".local."
+	a := dnsRecord(host, dnsTypeA, true, ip.To4())
+
+	for _, q := range questions {
+		name := strings.ToLower(q.name)
+		if name == "_services._dns-sd._udp.local." && (q.typ == dnsTypePTR || q.typ == dnsTypeANY) {
+			for _, s := range m.services {
+				answers = append(answers, dnsRecord(q.name, dnsTypePTR, false, dnsName(s.typ+".local.")))
+			}
+			continue
+		}
+
+		if name == strings.ToLower(host) && (q.typ == dnsTypeA || q.typ == dnsTypeANY) {
+			answers = append(answers, a)
+			continue
+		}
+
+		for _, s := range m.services {
+			typ := s.typ + ".local."
+			inst := m.instance + "." + typ
+
+			srvData := binary.BigEndian.AppendUint16(nil, 0) // priority
+			srvData = binary.BigEndian.AppendUint16(srvData, 0)
+			srvData = binary.BigEndian.AppendUint16(srvData, m.port)
+			srvData = append(srvData, dnsName(host)...)
+			srv := dnsRecord(inst, dnsTypeSRV, true, srvData)
+			txt := dnsRecord(inst, dnsTypeTXT, true, dnsTXT(s.txt))
+
+			switch {
+			case name == strings.ToLower(typ) && (q.typ == dnsTypePTR || q.typ == dnsTypeANY):
+				answers = append(answers, dnsRecord(typ, dnsTypePTR, false, dnsName(inst)))
+				extra = append(extra, srv, txt, a)
+			case name == strings.ToLower(inst):
+				if q.typ == dnsTypeSRV || q.typ == dnsTypeANY {
+					answers = append(answers, srv)
+					extra = append(extra, a)
+				}
+				if q.typ == dnsTypeTXT || q.typ == dnsTypeANY {
+					answers = append(answers, txt)
+				}
+			}
+		}
+	}
+
+	return answers, extra
+}
+
+type dnsQuestion struct {
+	name string
+	typ  uint16
+}
+
+// parseDNSQuery returns the id and questions of a dns query.
+func parseDNSQuery(b []byte) (uint16, []dnsQuestion, error) {
+	if len(b) < 12 {
+		return 0, nil, errors.New("message too short")
+	}
+	id := binary.BigEndian.Uint16(b)
+	flags := binary.BigEndian.Uint16(b[2:])
+	if flags&0x8000 != 0 {
+		return 0, nil, errors.New("not a query")
+	}
+
+	count := int(binary.BigEndian.Uint16(b[4:]))
+	off := 12
+	var questions []dnsQuestion
+	for i := 0; i < count; i++ {
+		name, n, err := readDNSName(b, off)
+		if err != nil {
+			return 0, nil, err
+		}
+		off = n
+		if off+4 > len(b) {
+			return 0, nil, errors.New("message too short")
+		}
+		questions = append(questions, dnsQuestion{name: name, typ: binary.BigEndian.Uint16(b[off:])})
+		off += 4
+	}
+
+	return id, questions, nil
+}
+
+// readDNSName reads a possibly compressed name at off and
+// returns it with the offset after the name.
+func readDNSName(b []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; jumps < 16; {
+		if off >= len(b) {
+			return "", 0, errors.New("invalid name")
+		}
+		n := int(b[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(b) {
+				return "", 0, errors.New("invalid name")
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(b[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+n > len(b) {
+				return "", 0, errors.New("invalid name")
+			}
+			labels = append(labels, string(b[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+	return "", 0, errors.New("too many compression pointers")
+}
+
+// dnsName encodes a name like "host.local." without compression.
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) > 63 {
+			label = label[:63]
+		}
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// dnsTXT encodes the strings of a TXT record.
+func dnsTXT(txt []string) []byte {
+	var b []byte
+	for _, s := range txt {
+		if len(s) > 255 {
+			s = s[:255]
+		}
+		b = append(b, byte(len(s)))
+		b = append(b, s...)
+	}
+	if len(b) == 0 {
+		b = []byte{0}
+	}
+	return b
+}
+
+func dnsRecord(name string, typ uint16, unique bool, data []byte) []byte {
+	class := uint16(dnsClassIN)
+	if unique {
+		class |= dnsClassCacheFlush
+	}
+
+	b := dnsName(name)
+	b = binary.BigEndian.AppendUint16(b, typ)
+	b = binary.BigEndian.AppendUint16(b, class)
+	b = binary.BigEndian.AppendUint32(b, dnsTTL)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(data)))
+	return append(b, data...)
+}
+
+func dnsResponse(id uint16, answers, extra [][]byte) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = binary.BigEndian.AppendUint16(b, 0x8400) // response, authoritative
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(answers)))
+	b = binary.BigEndian.AppendUint16(b, 0)
+	b = binary.BigEndian.AppendUint16(b, uint16(len(extra)))
+	for _, r := range answers {
+		b = append(b, r...)
+	}
+	for _, r := range extra {
+		b = append(b, r...)
+	}
+	return b
+}
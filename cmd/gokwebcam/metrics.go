@@ -0,0 +1,385 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// stats holds the metrics of the running process.
+var stats = &metrics{
+	start:         time.Now(),
+	encodeLatency: newHistogram(0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1),
+	clients:       map[*clientInfo]struct{}{},
+}
+
+type metrics struct {
+	start  time.Time
+	camera string // name of the camera used as label
+
+	framesCaptured      atomic.Uint64
+	framesDropped       atomic.Uint64 // by the encoder
+	framesDroppedDriver atomic.Uint64
+	framesCorrupted     atomic.Uint64
+	framesSkipped       atomic.Uint64 // by the governor
+	framesThrottled     atomic.Uint64 // by the bandwidth caps of clients
+	cameraErrors        atomic.Uint64
+	bytesServed         atomic.Uint64
+	requestsRejected    atomic.Uint64
+	fps                 atomic.Uint64 // float64 bits
+	lastFrame           atomic.Int64  // unix time of the last captured frame in ns
+	jpegQuality         atomic.Int32  // set by the governor
+
+	imageClients atomic.Int32
+	videoClients atomic.Int32
+	wsClients    atomic.Int32
+
+	encodeLatency *histogram
+	encodeAverage atomic.Int64 // moving average of the encode duration in ns
+
+	// measured with the metadata of the camera, optional
+	transferDuration *histogram
+	frameLatency     *histogram
+
+	// limiter of /image requests, optional
+	imageLimiter *rateLimiter
+
+	// guard of the recording volume, optional
+	diskGuard *diskGuard
+
+	// latency tracks the latency of the frames sent to every client
+	latency bool
+
+	mu       sync.Mutex
+	clients  map[*clientInfo]struct{}
+	clientID atomic.Uint64 // id of the last connected client
+}
+
+// clientInfo is a client connected to an endpoint.
+type clientInfo struct {
+	ID        uint64    `json:"id"`
+	Endpoint  string    `json:"endpoint"`
+	Remote    string    `json:"remote"`
+	Connected time.Time `json:"connected"`
+
+	// estimated with -latency
+	Latency *latencyEstimate `json:"latency,omitempty"`
+
+	cancel  context.CancelFunc
+	latency *clientLatency
+}
+
+// clientKey is the context key of the clientInfo of a request.
+type clientKey struct{}
+
+// connect tracks the client of r until disconnect is called.
+// The context of the returned request is canceled when the client
+// is kicked.
+func (m *metrics) connect(endpoint string, r *http.Request) (*http.Request, func()) {
+	ctx, cancel := context.WithCancel(r.Context())
+	c := &clientInfo{
+		ID:        m.clientID.Add(1),
+		Endpoint:  endpoint,
+		Remote:    r.RemoteAddr,
+		Connected: time.Now(),
+		cancel:    cancel,
+	}
+	if m.latency {
+		c.latency = &clientLatency{}
+	}
+	ctx = context.WithValue(ctx, clientKey{}, c)
+
+	m.mu.Lock()
+	m.clients[c] = struct{}{}
+	m.mu.Unlock()
+
+	return r.WithContext(ctx), func() {
+		m.mu.Lock()
+		delete(m.clients, c)
+		m.mu.Unlock()
+		cancel()
+	}
+}
+
+// kick disconnects the client with id and returns
+// false if no such client is connected.
+func (m *metrics) kick(id uint64) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for c := range m.clients {
+		if c.ID == id {
+			c.cancel()
+			return true
+		}
+	}
+	return false
+}
+
+// connected returns the connected clients ordered by connect time.
+func (m *metrics) connected() []clientInfo {
+	m.mu.Lock()
+	list := make([]clientInfo, 0, len(m.clients))
+	for c := range m.clients {
+		info := *c
+		if c.latency != nil {
+			info.Latency = c.latency.estimate()
+		}
+		list = append(list, info)
+	}
+	m.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Connected.Before(list[j].Connected) })
+	return list
+}
+
+// sent records that frame was sent to the client of r.
+func (m *metrics) sent(r *http.Request, frame *frameBuffer) {
+	if c, ok := r.Context().Value(clientKey{}).(*clientInfo); ok && c.latency != nil {
+		c.latency.observe(frame, time.Now())
+	}
+}
+
+// clientLatency estimates the latency of the frames sent to a client
+// with moving averages of the durations in nanoseconds. The frames are
+// only observed by the goroutine serving the client.
+type clientLatency struct {
+	frames atomic.Uint64
+	encode atomic.Int64 // from the capture until the frame was encoded
+	send   atomic.Int64 // from encoding until the frame was sent
+	total  atomic.Int64 // from the capture until the frame was sent
+}
+
+// latencyEstimate is the json representation of clientLatency.
+type latencyEstimate struct {
+	Frames uint64  `json:"frames"`
+	Encode float64 `json:"capture_to_encode"` // seconds
+	Send   float64 `json:"encode_to_send"`
+	Total  float64 `json:"capture_to_send"`
+}
+
+func (l *clientLatency) observe(frame *frameBuffer, sent time.Time) {
+	n := l.frames.Add(1)
+	avg := func(v *atomic.Int64, d time.Duration) {
+		if n == 1 {
+			v.Store(int64(d))
+			return
+		}
+		// weights the last frame with 1/8
+		v.Store(v.Load() + (int64(d)-v.Load())/8)
+	}
+	// raw frames and frames passed through are not encoded
+	if !frame.encoded.IsZero() {
+		avg(&l.encode, frame.encoded.Sub(frame.time))
+		avg(&l.send, sent.Sub(frame.encoded))
+	}
+	avg(&l.total, sent.Sub(frame.time))
+}
+
+func (l *clientLatency) estimate() *latencyEstimate {
+	return &latencyEstimate{
+		Frames: l.frames.Load(),
+		Encode: time.Duration(l.encode.Load()).Seconds(),
+		Send:   time.Duration(l.send.Load()).Seconds(),
+		Total:  time.Duration(l.total.Load()).Seconds(),
+	}
+}
+
+// observeEncode records the duration to encode a frame.
+func (m *metrics) observeEncode(d time.Duration) {
+	m.encodeLatency.observe(d)
+	// about the average of the last 10 frames
+	avg := m.encodeAverage.Load()
+	if avg == 0 {
+		avg = int64(d)
+	}
+	m.encodeAverage.Store(avg + (int64(d)-avg)/10)
+}
+
+// frameCaptured counts a captured frame and returns its sequence number.
+func (m *metrics) frameCaptured() uint64 {
+	m.lastFrame.Store(time.Now().UnixNano())
+	return m.framesCaptured.Add(1)
+}
+
+// measureFPS sets the capture frame rate from the frames captured every
+// interval, so that it drops to 0 when the camera stalls, and calls fn
+// with it. It never returns.
+func (m *metrics) measureFPS(interval time.Duration, fn func(fps float64)) {
+	start := time.Now()
+	captured := m.framesCaptured.Load()
+	for now := range time.Tick(interval) {
+		n := m.framesCaptured.Load()
+		fps := float64(n-captured) / now.Sub(start).Seconds()
+		m.setFPS(fps)
+		fn(fps)
+		start, captured = now, n
+	}
+}
+
+func (m *metrics) setFPS(fps float64) {
+	m.fps.Store(math.Float64bits(fps))
+}
+
+func (m *metrics) getFPS() float64 {
+	return math.Float64frombits(m.fps.Load())
+}
+
+// ServeHTTP writes the metrics in the prometheus text format.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	m.writeMetric(w, "gokwebcam_capture_fps", "gauge", "Frames per second captured from the camera.", m.getFPS())
+	m.writeMetric(w, "gokwebcam_last_frame_timestamp_seconds", "gauge", "Unix time of the last frame captured from the camera, 0 if none was captured.", float64(m.lastFrame.Load())/1e9)
+	m.writeMetric(w, "gokwebcam_frames_captured_total", "counter", "Frames captured from the camera.", m.framesCaptured.Load())
+	m.writeMetric(w, "gokwebcam_frames_dropped_total", "counter", "Frames dropped because the encoder was busy.", m.framesDropped.Load())
+	m.writeMetric(w, "gokwebcam_frames_dropped_driver_total", "counter", "Frames dropped by the driver, detected by gaps in buffer sequence numbers.", m.framesDroppedDriver.Load())
+	m.writeMetric(w, "gokwebcam_frames_skipped_total", "counter", "Frames skipped by -adaptive-quality to lower the frame rate.", m.framesSkipped.Load())
+	m.writeMetric(w, "gokwebcam_frames_throttled_total", "counter", "Frames not sent to clients to stay under -max-kbps.", m.framesThrottled.Load())
+	if q := m.jpegQuality.Load(); q > 0 {
+		m.writeMetric(w, "gokwebcam_jpeg_quality", "gauge", "Jpeg quality set by -adaptive-quality.", q)
+	}
+	m.writeMetric(w, "gokwebcam_frames_corrupted_total", "counter", "Frames skipped because they were corrupted or truncated.", m.framesCorrupted.Load())
+	m.writeMetric(w, "gokwebcam_camera_errors_total", "counter", "Errors and timeouts reading from the camera.", m.cameraErrors.Load())
+	m.writeMetric(w, "gokwebcam_bytes_served_total", "counter", "Bytes of image data written to clients.", m.bytesServed.Load())
+	m.writeMetric(w, "gokwebcam_requests_rejected_total", "counter", "Requests rejected because of client or rate limits.", m.requestsRejected.Load())
+	if m.imageLimiter != nil {
+		m.writeMetric(w, "gokwebcam_rate_limited_clients", "gauge", "Clients tracked by the /image rate limiter.", m.imageLimiter.clients())
+	}
+	if g := m.diskGuard; g != nil {
+		m.writeMetric(w, "gokwebcam_record_free_bytes", "gauge", "Bytes available on the volume of -record-dir.", g.free.Load())
+		m.writeMetric(w, "gokwebcam_record_min_free_bytes", "gauge", "Bytes below which recording stops, see -record-min-free.", g.min.Load())
+		m.writeMetric(w, "gokwebcam_record_volume_full", "gauge", "Whether recording is stopped because the volume of -record-dir is full.", boolInt(g.low.Load()))
+		m.writeMetric(w, "gokwebcam_recordings_pruned_total", "counter", "Recordings deleted to free space, see -record-prune.", g.pruned.Load())
+	}
+
+	fmt.Fprintln(w, "# HELP gokwebcam_clients Connected clients per endpoint.")
+	fmt.Fprintln(w, "# TYPE gokwebcam_clients gauge")
+	fmt.Fprintf(w, "gokwebcam_clients%s %d\n", m.labels("endpoint", "/image"), m.imageClients.Load())
+	fmt.Fprintf(w, "gokwebcam_clients%s %d\n", m.labels("endpoint", "/video"), m.videoClients.Load())
+	fmt.Fprintf(w, "gokwebcam_clients%s %d\n", m.labels("endpoint", "/ws"), m.wsClients.Load())
+
+	m.encodeLatency.write(w, "gokwebcam_encode_duration_seconds", "Time to encode a frame as jpeg.", m.labels)
+	if m.transferDuration != nil {
+		m.transferDuration.write(w, "gokwebcam_transfer_duration_seconds", "Time from the first to the last usb packet of a frame.", m.labels)
+		m.frameLatency.write(w, "gokwebcam_frame_latency_seconds", "Time from the capture of a frame until it was read.", m.labels)
+	}
+
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	writeMetric(w, "go_goroutines", "gauge", "Number of goroutines that currently exist.", runtime.NumGoroutine())
+	writeMetric(w, "go_memstats_alloc_bytes", "gauge", "Number of bytes allocated and still in use.", mem.Alloc)
+	writeMetric(w, "go_memstats_sys_bytes", "gauge", "Number of bytes obtained from system.", mem.Sys)
+	writeMetric(w, "go_memstats_mallocs_total", "counter", "Total number of mallocs.", mem.Mallocs)
+	writeMetric(w, "go_gc_cycles_total", "counter", "Number of completed GC cycles.", mem.NumGC)
+}
+
+func writeMetric(w io.Writer, name, typ, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %v\n", name, help, name, typ, name, value)
+}
+
+// writeMetric writes a metric labeled with the camera name.
+func (m *metrics) writeMetric(w io.Writer, name, typ, help string, value interface{}) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s%s %v\n", name, help, name, typ, name, m.labels(), value)
+}
+
+// labels returns the label set of a sample with the camera label
+// and pairs of label names and values, or "" if there are no labels.
+func (m *metrics) labels(pairs ...string) string {
+	if m.camera != "" {
+		pairs = append([]string{"camera", m.camera}, pairs...)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i := 0; i+1 < len(pairs); i += 2 {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", pairs[i], pairs[i+1])
+	}
+	b.WriteByte('}')
+	return b.String()
+}
+
+// histogram counts observations in cumulative buckets.
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64
+	counts  []uint64
+	count   uint64
+	sum     float64
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	v := d.Seconds()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// quantile estimates the q-quantile of the observations by linear
+// interpolation within the bucket it falls into, like the
+// histogram_quantile function of prometheus. It returns 0 if there
+// are no observations and the largest bucket if q falls beyond it.
+func (h *histogram) quantile(q float64) float64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.count == 0 {
+		return 0
+	}
+
+	rank := q * float64(h.count)
+	lower, prev := 0.0, uint64(0)
+	for i, b := range h.buckets {
+		if float64(h.counts[i]) >= rank {
+			n := h.counts[i] - prev
+			if n == 0 {
+				return b
+			}
+			return lower + (b-lower)*(rank-float64(prev))/float64(n)
+		}
+		lower, prev = b, h.counts[i]
+	}
+	return h.buckets[len(h.buckets)-1]
+}
+
+// write writes the histogram with the label sets returned by labels.
+func (h *histogram) write(w io.Writer, name, help string, labels func(pairs ...string) string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels("le", fmt.Sprintf("%g", b)), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket%s %d\n", name, labels("le", "+Inf"), h.count)
+	fmt.Fprintf(w, "%s_sum%s %g\n", name, labels(), h.sum)
+	fmt.Fprintf(w, "%s_count%s %d\n", name, labels(), h.count)
+}
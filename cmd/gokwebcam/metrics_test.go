@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeasureFPS(t *testing.T) {
+	m := &metrics{}
+	rates := make(chan float64)
+	go m.measureFPS(50*time.Millisecond, func(fps float64) {
+		rates <- fps
+	})
+
+	if fps := <-rates; fps != 0 {
+		t.Fatalf("fps is %f before the first frame, want 0", fps)
+	}
+	for i := 0; i < 5; i++ {
+		m.frameCaptured()
+	}
+	if fps := <-rates; fps <= 0 {
+		t.Fatalf("fps is %f with captured frames", fps)
+	}
+	// the camera stalls
+	if fps := <-rates; fps != 0 {
+		t.Fatalf("fps is %f without frames, want 0", fps)
+	}
+	if m.getFPS() != 0 {
+		t.Fatalf("fps gauge is %f, want 0", m.getFPS())
+	}
+	if m.lastFrame.Load() == 0 {
+		t.Fatal("no last frame time")
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// middleware wraps a handler.
+type middleware func(http.Handler) http.Handler
+
+// chain wraps h with mws. The first middleware is the outermost one.
+func chain(h http.Handler, mws ...middleware) http.Handler {
+	for i := len(mws) - 1; i >= 0; i-- {
+		if mws[i] != nil {
+			h = mws[i](h)
+		}
+	}
+	return h
+}
+
+// cors returns a middleware which allows cross-origin requests
+// from a comma separated list of origins, or from any origin with "*".
+// It returns nil if origins is empty.
+func cors(origins string) middleware {
+	if origins == "" {
+		return nil
+	}
+
+	allowed := map[string]bool{}
+	for _, o := range strings.Split(origins, ",") {
+		allowed[strings.TrimSpace(o)] = true
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			origin := r.Header.Get("Origin")
+			if origin != "" && (allowed["*"] || allowed[origin]) {
+				h := w.Header()
+				if allowed["*"] {
+					h.Set("Access-Control-Allow-Origin", "*")
+				} else {
+					h.Set("Access-Control-Allow-Origin", origin)
+					h.Add("Vary", "Origin")
+				}
+				h.Set("Access-Control-Expose-Headers", "Content-Length, ETag, X-Timestamp, X-Sequence")
+
+				// preflight request
+				if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+					h.Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
+					h.Set("Access-Control-Allow-Headers", "Content-Type, Authorization")
+					h.Set("Access-Control-Max-Age", "600")
+					w.WriteHeader(http.StatusNoContent)
+					return
+				}
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -1,14 +1,34 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
 
 	"golang.org/x/sys/unix"
 )
 
+// defaultModules are the kernel modules loaded at startup.
+// Their dependencies are resolved with modules.dep.
+const defaultModules = moduleAuto
+
+// moduleAuto loads the video drivers of the connected usb devices,
+// which are resolved by their modalias with modules.alias.
+const moduleAuto = "auto"
+
+// usbModaliases matches the modaliases of usb devices and their interfaces.
+const usbModaliases = "/sys/bus/usb/devices/*/modalias"
+
+// moduleInitCompressedFile lets the kernel decompress a module
+// (MODULE_INIT_COMPRESSED_FILE, since linux 5.17).
+const moduleInitCompressedFile = 4
+
 var release = func() string {
 	var uts unix.Utsname
 	if err := unix.Uname(&uts); err != nil {
@@ -18,13 +38,204 @@ var release = func() string {
 	return string(uts.Release[:bytes.IndexByte(uts.Release[:], 0)])
 }()
 
+// moduleDir is the directory of the modules of the running kernel.
+var moduleDir = filepath.Join("/lib/modules", release)
+
+// loadModules loads kernel modules by name, e.g. uvcvideo, or by path
+// relative to the module directory, together with their dependencies.
+// The name auto loads the drivers of the connected usb video devices.
+// Modules which don't exist are skipped, because drivers
+// can also be built into the kernel.
+func loadModules(mods []string) error {
+	deps, err := readModulesDep(filepath.Join(moduleDir, "modules.dep"))
+	if err != nil {
+		if !os.IsNotExist(err) {
+			return err
+		}
+		logger.Debug("modules.dep not found, loading modules without dependencies", "dir", moduleDir)
+	}
+
+	loaded := map[string]bool{}
+	load := func(path string) error {
+		if loaded[path] {
+			return nil
+		}
+		loaded[path] = true
+
+		err := loadModule(path)
+		if os.IsNotExist(err) {
+			logger.Debug("kernel module not found", "module", path)
+			return nil
+		}
+		return err
+	}
+
+	var names []string
+	for _, mod := range mods {
+		switch mod = strings.TrimSpace(mod); mod {
+		case "":
+		case moduleAuto:
+			drivers, err := usbVideoDrivers(deps)
+			if err != nil {
+				return err
+			}
+			logger.Debug("resolved drivers of usb devices", "modules", drivers)
+			names = append(names, drivers...)
+		default:
+			names = append(names, mod)
+		}
+	}
+
+	for _, mod := range names {
+		path := mod
+		if dep, ok := deps[moduleName(mod)]; ok {
+			// dependencies are listed before the modules they depend on
+			for i := len(dep) - 1; i > 0; i-- {
+				if err := load(dep[i]); err != nil {
+					return err
+				}
+			}
+			path = dep[0]
+		}
+		if err := load(path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// usbVideoDrivers returns the names of the video drivers for the
+// connected usb devices. Only modules in drivers/media are returned,
+// other drivers are left to udev.
+func usbVideoDrivers(deps map[string][]string) ([]string, error) {
+	aliases, err := readModulesAlias(filepath.Join(moduleDir, "modules.alias"))
+	if err != nil {
+		if os.IsNotExist(err) {
+			logger.Warn("modules.alias not found, can't resolve drivers", "dir", moduleDir)
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	files, err := filepath.Glob(usbModaliases)
+	if err != nil {
+		return nil, err
+	}
+
+	var drivers []string
+	found := map[string]bool{}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			continue
+		}
+		modalias := strings.TrimSpace(string(b))
+
+		for _, a := range aliases {
+			if found[a.module] {
+				continue
+			}
+			if ok, _ := path.Match(a.pattern, modalias); !ok {
+				continue
+			}
+			if dep, ok := deps[a.module]; !ok || !strings.Contains(dep[0], "/drivers/media/") {
+				continue
+			}
+			found[a.module] = true
+			drivers = append(drivers, a.module)
+		}
+	}
+	return drivers, nil
+}
+
+// moduleAlias is a line of modules.alias.
+type moduleAlias struct {
+	pattern string // shell pattern of modaliases
+	module  string
+}
+
+// readModulesAlias returns the usb aliases of modules.alias.
+func readModulesAlias(path string) ([]moduleAlias, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var aliases []moduleAlias
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+		if len(fields) != 3 || fields[0] != "alias" || !strings.HasPrefix(fields[1], "usb:") {
+			continue
+		}
+		aliases = append(aliases, moduleAlias{pattern: fields[1], module: moduleName(fields[2])})
+	}
+	return aliases, s.Err()
+}
+
+// readModulesDep returns the paths of modules and their
+// dependencies by module name. The first path is the module.
+func readModulesDep(path string) (map[string][]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	deps := map[string][]string{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		mod, list, ok := strings.Cut(s.Text(), ":")
+		if !ok {
+			continue
+		}
+		deps[moduleName(mod)] = append([]string{mod}, strings.Fields(list)...)
+	}
+	return deps, s.Err()
+}
+
+// moduleName returns the name of a module file like
+// kernel/drivers/media/usb/uvc/uvcvideo.ko.xz.
+// Dashes and underscores are equivalent in module names.
+func moduleName(path string) string {
+	name := filepath.Base(path)
+	for _, ext := range []string{".gz", ".xz", ".zst"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	name = strings.TrimSuffix(name, ".ko")
+	return strings.ReplaceAll(name, "-", "_")
+}
+
+// loadModule loads the module at path, which is relative
+// to the module directory unless it is absolute.
+// Compressed modules are decompressed by the kernel, or gzip compressed
+// modules in process if the kernel doesn't support it.
 func loadModule(mod string) error {
-	f, err := os.Open(filepath.Join("/lib/modules", release, mod))
+	path := mod
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(moduleDir, mod)
+	}
+	f, err := os.Open(path)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-	if err := unix.FinitModule(int(f.Fd()), "", 0); err != nil {
+
+	var flags int
+	compressed := filepath.Ext(mod) != ".ko"
+	if compressed {
+		flags = moduleInitCompressedFile
+	}
+
+	err = unix.FinitModule(int(f.Fd()), "", flags)
+	if compressed && (err == unix.EINVAL || err == unix.EOPNOTSUPP) {
+		if filepath.Ext(mod) != ".gz" {
+			return fmt.Errorf("%v: kernel can't decompress module: %v", mod, err)
+		}
+		err = initGzipModule(f)
+	}
+	if err != nil {
 		if err != unix.EEXIST &&
 			err != unix.EBUSY &&
 			err != unix.ENODEV &&
@@ -34,3 +245,19 @@ func loadModule(mod string) error {
 	}
 	return nil
 }
+
+// initGzipModule decompresses the module of f and loads it.
+func initGzipModule(f *os.File) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	zr, err := gzip.NewReader(f)
+	if err != nil {
+		return err
+	}
+	image, err := io.ReadAll(zr)
+	if err != nil {
+		return err
+	}
+	return unix.InitModule(image, "")
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// mosaicLayout arranges the cameras of a mosaic in tiles:
+//
+//	auto   a grid with about as many columns as rows
+//	3x2    a grid with 3 columns and 2 rows
+//	1+5    a large tile of the first camera with 5 small tiles on its
+//	       right and bottom edge, also 1+7, 1+9, ...
+type mosaicLayout struct {
+	cols, rows int // of the grid, 0 for auto
+	focus      int // size of the large tile in cells, 0 for none
+}
+
+func parseMosaicLayout(s string) (mosaicLayout, error) {
+	if s == "auto" {
+		return mosaicLayout{}, nil
+	}
+	if small, ok := strings.CutPrefix(s, "1+"); ok {
+		n, err := strconv.Atoi(small)
+		if err != nil || n < 3 || n%2 == 0 {
+			return mosaicLayout{}, fmt.Errorf("invalid mosaic layout %q, expected 1+N with an odd N of at least 3", s)
+		}
+		// the large tile has k x k cells of a (k+1) x (k+1) grid,
+		// whose last column and row have 2k+1 cells
+		k := (n - 1) / 2
+		return mosaicLayout{cols: k + 1, rows: k + 1, focus: k}, nil
+	}
+	cs, rs, ok := strings.Cut(s, "x")
+	cols, err1 := strconv.Atoi(cs)
+	rows, err2 := strconv.Atoi(rs)
+	if !ok || err1 != nil || err2 != nil || cols <= 0 || rows <= 0 {
+		return mosaicLayout{}, fmt.Errorf("invalid mosaic layout %q, expected auto, CxR, e.g. 3x2, or 1+N, e.g. 1+5", s)
+	}
+	return mosaicLayout{cols: cols, rows: rows}, nil
+}
+
+// tiles returns the tiles of n cameras in a mosaic of size. Layouts
+// with fewer tiles than cameras return fewer tiles.
+func (l mosaicLayout) tiles(n int, size image.Point) []image.Rectangle {
+	if n == 0 {
+		return nil
+	}
+	cols, rows := l.cols, l.rows
+	if cols == 0 {
+		cols = int(math.Ceil(math.Sqrt(float64(n))))
+		rows = (n + cols - 1) / cols
+	}
+	cell := func(col, row int) image.Rectangle {
+		return image.Rect(col*size.X/cols, row*size.Y/rows, (col+1)*size.X/cols, (row+1)*size.Y/rows)
+	}
+
+	var tiles []image.Rectangle
+	if l.focus > 0 {
+		k := l.focus
+		tiles = append(tiles, cell(0, 0).Union(cell(k-1, k-1)))
+		for row := 0; row <= k; row++ {
+			tiles = append(tiles, cell(k, row))
+		}
+		for col := 0; col < k; col++ {
+			tiles = append(tiles, cell(col, k))
+		}
+	} else {
+		for i := 0; i < cols*rows; i++ {
+			tiles = append(tiles, cell(i%cols, i/cols))
+		}
+	}
+	if len(tiles) > n {
+		tiles = tiles[:n]
+	}
+	return tiles
+}
+
+// mosaic composes the frames of several cameras into one stream, e.g.
+// for monitors which can only show one stream. Frames are composed
+// while the stream has clients.
+type mosaic struct {
+	cams  []*remoteCamera
+	tiles []image.Rectangle
+	size  image.Point
+	fps   float64
+
+	bc   *broadcaster
+	subs atomic.Int32
+}
+
+// newMosaic returns a mosaic of the cameras with the comma separated
+// names, or of all cams if names is empty.
+func newMosaic(cams []*remoteCamera, names, layout string, size image.Point, fps float64) (*mosaic, error) {
+	l, err := parseMosaicLayout(layout)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &mosaic{cams: cams, size: size, fps: fps, bc: newBroadcaster()}
+	if names != "" {
+		m.cams = nil
+		for _, name := range strings.Split(names, ",") {
+			name = strings.TrimSpace(name)
+			var cam *remoteCamera
+			for _, c := range cams {
+				if c.name == name {
+					cam = c
+				}
+			}
+			if cam == nil {
+				return nil, fmt.Errorf("unknown camera %q of the mosaic", name)
+			}
+			m.cams = append(m.cams, cam)
+		}
+	}
+
+	m.tiles = l.tiles(len(m.cams), size)
+	if len(m.tiles) < len(m.cams) {
+		logger.Warn("cameras don't fit the mosaic layout", "layout", layout, "cameras", len(m.cams), "tiles", len(m.tiles))
+		m.cams = m.cams[:len(m.tiles)]
+	}
+	return m, nil
+}
+
+func (a *aggregator) serveMosaic(w http.ResponseWriter, r *http.Request) {
+	logger.Info("connect", "remote", r.RemoteAddr, "url", redactURL(r.URL))
+	m := a.mosaic
+	m.subs.Add(1)
+	defer m.subs.Add(-1)
+	frames := m.bc.subscribe()
+	defer m.bc.unsubscribe(frames)
+	a.serveStream(w, r, frames)
+}
+
+// compose composes the frames of the cameras while the mosaic
+// has clients. Cameras without frames are shown as grey tiles.
+func (m *mosaic) compose() {
+	ticker := time.NewTicker(time.Duration(float64(time.Second) / m.fps))
+	defer ticker.Stop()
+
+	dst := image.NewRGBA(image.Rectangle{Max: m.size})
+	labels := make([]*image.Alpha, len(m.cams))
+	for i, c := range m.cams {
+		labels[i] = renderText(c.name)
+	}
+	// frames are only decoded when they changed
+	decoded := make([]image.Image, len(m.cams))
+	seqs := make([]uint64, len(m.cams))
+
+	var seq uint64
+	for range ticker.C {
+		if m.subs.Load() == 0 {
+			continue
+		}
+		for i, c := range m.cams {
+			tile := dst.SubImage(m.tiles[i]).(*image.RGBA)
+			fillGray(tile, tile.Rect, color.Gray{Y: 32})
+			data, _ := c.frame()
+			if data == nil {
+				decoded[i] = nil
+				drawText(tile, labels[i], "top-left", 2, true)
+				continue
+			}
+			if n := c.frames.Load(); decoded[i] == nil || n != seqs[i] {
+				img, err := jpeg.Decode(bytes.NewReader(data))
+				if err != nil {
+					logger.Debug("decoding frame failed", "camera", c.name, "err", err)
+					continue
+				}
+				decoded[i], seqs[i] = img, n
+			}
+			draw.ApproxBiLinear.Scale(dst, fitRect(decoded[i].Bounds().Size(), m.tiles[i]), decoded[i], decoded[i].Bounds(), draw.Src, nil)
+			drawText(tile, labels[i], "top-left", 2, true)
+		}
+		// separate the tiles
+		for _, t := range m.tiles {
+			fillGray(dst, image.Rect(t.Max.X-1, t.Min.Y, t.Max.X, t.Max.Y), color.Gray{})
+			fillGray(dst, image.Rect(t.Min.X, t.Max.Y-1, t.Max.X, t.Max.Y), color.Gray{})
+		}
+
+		buf := newFrameBuffer(0)
+		if err := jpeg.Encode(buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+			buf.release()
+			logger.Warn("encoding mosaic failed", "err", err)
+			continue
+		}
+		seq++
+		buf.seq, buf.time = seq, time.Now()
+		m.bc.publish(buf)
+	}
+}
+
+// fitRect returns the largest rectangle with the aspect ratio
+// of size which fits centered into r.
+func fitRect(size image.Point, r image.Rectangle) image.Rectangle {
+	if size.X == 0 || size.Y == 0 {
+		return r
+	}
+	w, h := r.Dx(), r.Dx()*size.Y/size.X
+	if h > r.Dy() {
+		w, h = r.Dy()*size.X/size.Y, r.Dy()
+	}
+	min := r.Min.Add(image.Pt((r.Dx()-w)/2, (r.Dy()-h)/2))
+	return image.Rectangle{Min: min, Max: min.Add(image.Pt(w, h))}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"sync/atomic"
+	"time"
+
+	"github.com/brutella/webcam/cmd/gokwebcam/eventbus"
+)
+
+const (
+	motionWidth     = 64                     // width of the compared images
+	motionHeight    = 48                     // height of the compared images
+	motionInterval  = 200 * time.Millisecond // interval between compared frames
+	motionPixelDiff = 25                     // min luma difference of a changed pixel
+	motionQuiet     = 10 * time.Second       // time without motion until motion stopped
+)
+
+// motionAlgorithm returns the fraction of changed
+// pixels of downscaled luma images.
+type motionAlgorithm interface {
+	// changed returns the fraction of changed pixels of luma within
+	// mask, or of all pixels if mask is nil. It returns 0 until the
+	// algorithm has learned enough frames.
+	changed(luma []byte, mask []bool) float64
+
+	// reset forgets the learned frames.
+	reset()
+}
+
+// motionAlgorithms creates motion algorithms by name for -motion-algorithm.
+var motionAlgorithms = map[string]func() motionAlgorithm{
+	"diff":     func() motionAlgorithm { return &frameDiff{} },
+	"gaussian": func() motionAlgorithm { return &gaussianBackground{} },
+}
+
+// motionDetector compares downscaled frames and publishes
+// eventbus.MotionDetected when the fraction of changed pixels exceeds
+// the threshold, and eventbus.MotionStopped when there was no motion
+// for some time.
+type motionDetector struct {
+	threshold float64
+	algo      motionAlgorithm
+	bus       *eventbus.Bus
+	disarmed  atomic.Bool            // set by the schedule
+	zones     atomic.Pointer[[]bool] // mask of the motion zones
+
+	motion bool
+	last   time.Time // time of the last motion
+}
+
+// run detects motion in the frames of bc until the program exits.
+func (md *motionDetector) run(bc *broadcaster) {
+	frames := bc.subscribeInterval(motionInterval)
+	defer bc.unsubscribe(frames)
+
+	for frame := range frames {
+		if md.disarmed.Load() {
+			frame.release()
+			md.reset()
+			continue
+		}
+
+		img, err := jpeg.Decode(bytes.NewReader(frame.Bytes()))
+		t := frame.time
+		frame.release()
+		if err != nil {
+			logger.Debug("decoding frame failed", "err", err)
+			continue
+		}
+
+		md.detect(lumaThumbnail(img), t)
+	}
+}
+
+// HandleEvent disarms detection while the schedule is disarmed.
+func (md *motionDetector) HandleEvent(e eventbus.Event) {
+	md.disarmed.Store(e.Type == eventbus.ScheduleDisarmed)
+}
+
+// setZones restricts detection to zones,
+// or detects motion in the whole frame if zones is empty.
+func (md *motionDetector) setZones(zones []motionZone) {
+	mask := zoneMask(zones)
+	md.zones.Store(&mask)
+}
+
+// reset forgets the learned frames and stops motion.
+func (md *motionDetector) reset() {
+	md.algo.reset()
+	if md.motion {
+		md.motion = false
+		logger.Info("motion stopped")
+		md.bus.Publish(eventbus.MotionStopped, nil)
+	}
+}
+
+func (md *motionDetector) detect(luma []byte, t time.Time) {
+	var mask []bool
+	if p := md.zones.Load(); p != nil {
+		mask = *p
+	}
+	ratio := md.algo.changed(luma, mask)
+
+	switch {
+	case ratio >= md.threshold:
+		md.last = t
+		if !md.motion {
+			md.motion = true
+			logger.Info("motion detected", "ratio", ratio)
+			md.bus.Publish(eventbus.MotionDetected, map[string]interface{}{"ratio": ratio})
+		}
+	case md.motion && t.Sub(md.last) > motionQuiet:
+		md.motion = false
+		logger.Info("motion stopped")
+		md.bus.Publish(eventbus.MotionStopped, nil)
+	}
+}
+
+// frameDiff counts the pixels which changed since the previous frame.
+// Slow changes of the light are ignored, but every change of the
+// exposure or sudden change of the light is detected as motion.
+type frameDiff struct {
+	prev []byte
+}
+
+func (fd *frameDiff) changed(luma []byte, mask []bool) float64 {
+	prev := fd.prev
+	fd.prev = luma
+	if prev == nil {
+		return 0
+	}
+
+	var changed, n int
+	for i := range luma {
+		if mask != nil && !mask[i] {
+			continue
+		}
+		n++
+		d := int(luma[i]) - int(prev[i])
+		if d > motionPixelDiff || d < -motionPixelDiff {
+			changed++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return float64(changed) / float64(n)
+}
+
+func (fd *frameDiff) reset() {
+	fd.prev = nil
+}
+
+const (
+	gaussianLearningRate   = 0.02  // of background pixels, about 10s at motionInterval
+	gaussianForegroundRate = 0.002 // of foreground pixels, which fade into the background
+	gaussianDeviations     = 3     // deviations from the mean of a changed pixel
+	gaussianMinVariance    = 8 * 8
+	gaussianWarmup         = 10 // frames learned before motion is detected
+)
+
+// gaussianBackground models the luma of every pixel of the background
+// as a running gaussian average. Pixels which deviate from the mean by
+// more than some standard deviations are foreground. The model adapts
+// to gradual changes of the light, and objects which stop moving fade
+// into the background. Changes of the brightness of the whole image,
+// e.g. by clouds or the exposure, are compensated.
+type gaussianBackground struct {
+	mean     []float32
+	variance []float32
+	frames   int
+}
+
+func (gb *gaussianBackground) changed(luma []byte, mask []bool) float64 {
+	if len(gb.mean) != len(luma) {
+		gb.mean = make([]float32, len(luma))
+		gb.variance = make([]float32, len(luma))
+		for i, v := range luma {
+			gb.mean[i] = float32(v)
+			gb.variance[i] = 2 * gaussianMinVariance
+		}
+		gb.frames = 1
+		return 0
+	}
+
+	// offset of the brightness of the image from the background
+	var offset float32
+	for i, v := range luma {
+		offset += float32(v) - gb.mean[i]
+	}
+	offset /= float32(len(luma))
+
+	// the model of all pixels is updated, but only
+	// the pixels within mask are counted
+	var changed, n int
+	for i, v := range luma {
+		d := float32(v) - gb.mean[i] - offset
+		d2 := d * d
+		rate := float32(gaussianLearningRate)
+		inMask := mask == nil || mask[i]
+		if inMask {
+			n++
+		}
+		if d2 > gaussianDeviations*gaussianDeviations*gb.variance[i] {
+			if inMask {
+				changed++
+			}
+			rate = gaussianForegroundRate
+		}
+		gb.mean[i] += rate * (d + offset)
+		gb.variance[i] += rate * (d2 - gb.variance[i])
+		if gb.variance[i] < gaussianMinVariance {
+			gb.variance[i] = gaussianMinVariance
+		}
+	}
+
+	if gb.frames < gaussianWarmup {
+		gb.frames++
+		return 0
+	}
+	if n == 0 {
+		return 0
+	}
+	return float64(changed) / float64(n)
+}
+
+func (gb *gaussianBackground) reset() {
+	gb.mean, gb.variance = nil, nil
+}
+
+// lumaThumbnail returns the luma of img sampled at motionWidth x motionHeight.
+func lumaThumbnail(img image.Image) []byte {
+	b := img.Bounds()
+	luma := make([]byte, motionWidth*motionHeight)
+	for y := 0; y < motionHeight; y++ {
+		sy := b.Min.Y + y*b.Dy()/motionHeight
+		for x := 0; x < motionWidth; x++ {
+			sx := b.Min.X + x*b.Dx()/motionWidth
+
+			var v byte
+			switch img := img.(type) {
+			case *image.YCbCr:
+				v = img.Y[img.YOffset(sx, sy)]
+			case *image.Gray:
+				v = img.Pix[img.PixOffset(sx, sy)]
+			default:
+				r, g, b, _ := img.At(sx, sy).RGBA()
+				v = byte((19595*r + 38470*g + 7471*b + 1<<15) >> 24)
+			}
+			luma[y*motionWidth+x] = v
+		}
+	}
+	return luma
+}
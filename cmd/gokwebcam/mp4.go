@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+// mp4Timescale is the number of time units per second of the video track.
+const mp4Timescale = 1000
+
+// mp4Sample is a jpeg frame and the time it is shown. Frames of files
+// are read when they are written, so that long videos, e.g. timelapses,
+// are not held in memory.
+type mp4Sample struct {
+	data     []byte
+	path     string // file of the frame, instead of data
+	size     int    // of the file
+	duration time.Duration
+}
+
+// len returns the size of the frame.
+func (s mp4Sample) len() int {
+	if s.path != "" {
+		return s.size
+	}
+	return len(s.data)
+}
+
+// writeFragmentedMP4 writes jpeg frames as motion jpeg video track
+// into a fragmented MP4 file with a single fragment.
+func writeFragmentedMP4(w io.Writer, width, height uint32, samples []mp4Sample) error {
+	if len(samples) == 0 {
+		return errors.New("no samples")
+	}
+
+	be := binary.BigEndian
+	matrix := make([]byte, 0, 36)
+	for _, v := range []uint32{0x00010000, 0, 0, 0, 0x00010000, 0, 0, 0, 0x40000000} {
+		matrix = be.AppendUint32(matrix, v)
+	}
+
+	ftyp := mp4Box("ftyp", []byte("isom\x00\x00\x02\x00isomiso6mp41"))
+
+	mvhd := make([]byte, 0, 96)
+	mvhd = be.AppendUint32(mvhd, 0) // creation time
+	mvhd = be.AppendUint32(mvhd, 0) // modification time
+	mvhd = be.AppendUint32(mvhd, mp4Timescale)
+	mvhd = be.AppendUint32(mvhd, 0)          // duration
+	mvhd = be.AppendUint32(mvhd, 0x00010000) // rate
+	mvhd = be.AppendUint16(mvhd, 0x0100)     // volume
+	mvhd = append(mvhd, make([]byte, 10)...)
+	mvhd = append(mvhd, matrix...)
+	mvhd = append(mvhd, make([]byte, 24)...)
+	mvhd = be.AppendUint32(mvhd, 2) // next track id
+
+	tkhd := make([]byte, 0, 80)
+	tkhd = be.AppendUint32(tkhd, 0) // creation time
+	tkhd = be.AppendUint32(tkhd, 0) // modification time
+	tkhd = be.AppendUint32(tkhd, 1) // track id
+	tkhd = be.AppendUint32(tkhd, 0)
+	tkhd = be.AppendUint32(tkhd, 0) // duration
+	tkhd = append(tkhd, make([]byte, 16)...)
+	tkhd = append(tkhd, matrix...)
+	tkhd = be.AppendUint32(tkhd, width<<16)
+	tkhd = be.AppendUint32(tkhd, height<<16)
+
+	mdhd := make([]byte, 0, 20)
+	mdhd = be.AppendUint32(mdhd, 0) // creation time
+	mdhd = be.AppendUint32(mdhd, 0) // modification time
+	mdhd = be.AppendUint32(mdhd, mp4Timescale)
+	mdhd = be.AppendUint32(mdhd, 0)      // duration
+	mdhd = be.AppendUint16(mdhd, 0x55c4) // language und
+	mdhd = be.AppendUint16(mdhd, 0)
+
+	hdlr := make([]byte, 0, 37)
+	hdlr = be.AppendUint32(hdlr, 0)
+	hdlr = append(hdlr, "vide"...)
+	hdlr = append(hdlr, make([]byte, 12)...)
+	hdlr = append(hdlr, "VideoHandler\x00"...)
+
+	// visual sample entry of motion jpeg
+	jpeg := make([]byte, 0, 78)
+	jpeg = append(jpeg, make([]byte, 6)...)
+	jpeg = be.AppendUint16(jpeg, 1) // data reference index
+	jpeg = append(jpeg, make([]byte, 16)...)
+	jpeg = be.AppendUint16(jpeg, uint16(width))
+	jpeg = be.AppendUint16(jpeg, uint16(height))
+	jpeg = be.AppendUint32(jpeg, 0x00480000) // 72 dpi
+	jpeg = be.AppendUint32(jpeg, 0x00480000)
+	jpeg = be.AppendUint32(jpeg, 0)
+	jpeg = be.AppendUint16(jpeg, 1) // frame count
+	name := make([]byte, 32)
+	name[0] = byte(copy(name[1:], "Photo - JPEG"))
+	jpeg = append(jpeg, name...)
+	jpeg = be.AppendUint16(jpeg, 0x0018) // depth
+	jpeg = be.AppendUint16(jpeg, 0xffff)
+
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, be.AppendUint32(nil, 1), mp4Box("jpeg", jpeg)),
+		mp4FullBox("stts", 0, 0, be.AppendUint32(nil, 0)),
+		mp4FullBox("stsc", 0, 0, be.AppendUint32(nil, 0)),
+		mp4FullBox("stsz", 0, 0, be.AppendUint32(nil, 0), be.AppendUint32(nil, 0)),
+		mp4FullBox("stco", 0, 0, be.AppendUint32(nil, 0)),
+	)
+	minf := mp4Box("minf",
+		mp4FullBox("vmhd", 0, 1, make([]byte, 8)),
+		mp4Box("dinf", mp4FullBox("dref", 0, 0, be.AppendUint32(nil, 1), mp4FullBox("url ", 0, 1))),
+		stbl,
+	)
+
+	trex := make([]byte, 0, 20)
+	trex = be.AppendUint32(trex, 1) // track id
+	trex = be.AppendUint32(trex, 1) // sample description index
+	trex = be.AppendUint32(trex, 0) // duration
+	trex = be.AppendUint32(trex, 0) // size
+	trex = be.AppendUint32(trex, 0) // flags, every jpeg is a sync sample
+
+	moov := mp4Box("moov",
+		mp4FullBox("mvhd", 0, 0, mvhd),
+		mp4Box("trak",
+			mp4FullBox("tkhd", 0, 3, tkhd),
+			mp4Box("mdia", mp4FullBox("mdhd", 0, 0, mdhd), mp4FullBox("hdlr", 0, 0, hdlr), minf),
+		),
+		mp4Box("mvex", mp4FullBox("trex", 0, 0, trex)),
+	)
+
+	// the fragment with all samples
+	const (
+		tfhdDefaultBaseIsMoof = 0x020000
+		trunDataOffset        = 0x000001
+		trunSampleDuration    = 0x000100
+		trunSampleSize        = 0x000200
+	)
+	var size int
+	trun := be.AppendUint32(nil, uint32(len(samples)))
+	trun = be.AppendUint32(trun, 0) // data offset, set below
+	for _, s := range samples {
+		trun = be.AppendUint32(trun, uint32(s.duration*mp4Timescale/time.Second))
+		trun = be.AppendUint32(trun, uint32(s.len()))
+		size += s.len()
+	}
+	if uint64(8+size) > math.MaxUint32 {
+		return errors.New("samples exceed 4 GiB")
+	}
+
+	moof := mp4Box("moof",
+		mp4FullBox("mfhd", 0, 0, be.AppendUint32(nil, 1)),
+		mp4Box("traf",
+			mp4FullBox("tfhd", 0, tfhdDefaultBaseIsMoof, be.AppendUint32(nil, 1)),
+			mp4FullBox("tfdt", 1, 0, be.AppendUint64(nil, 0)),
+			mp4FullBox("trun", 0, trunDataOffset|trunSampleDuration|trunSampleSize, trun),
+		),
+	)
+	// the data of the first sample follows the mdat header
+	be.PutUint32(moof[len(moof)-len(trun)+4:], uint32(len(moof)+8))
+
+	mdat := be.AppendUint32(nil, uint32(8+size))
+	mdat = append(mdat, "mdat"...)
+
+	for _, b := range [][]byte{ftyp, moov, moof, mdat} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	for _, s := range samples {
+		data := s.data
+		if s.path != "" {
+			var err error
+			if data, err = os.ReadFile(s.path); err != nil {
+				return err
+			}
+			if len(data) != s.size {
+				return fmt.Errorf("%s changed while writing", s.path)
+			}
+		}
+		if _, err := w.Write(data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mp4Box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make([]byte, 0, size)
+	b = binary.BigEndian.AppendUint32(b, uint32(size))
+	b = append(b, typ...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func mp4FullBox(typ string, version byte, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(typ, append([][]byte{header}, payload...)...)
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/brutella/webcam/cmd/gokwebcam/eventbus"
+)
+
+// MQTT control packet types
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPingreq    = 0xC0
+	mqttDisconnect = 0xE0
+)
+
+const mqttKeepAlive = 60 // seconds
+
+// mqttClient is a minimal MQTT 3.1.1 client which publishes messages
+// with QoS 0. It registers a will message on `<prefix>/availability`,
+// which the broker publishes when the connection is lost.
+type mqttClient struct {
+	addr     string
+	prefix   string
+	clientID string
+	username string
+	password string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func newMQTTClient(addr, prefix, username, password string) *mqttClient {
+	return &mqttClient{
+		addr:     addr,
+		prefix:   prefix,
+		clientID: fmt.Sprintf("gokwebcam-%d", time.Now().UnixNano()%1e6),
+		username: username,
+		password: password,
+	}
+}
+
+// run keeps the connection to the broker alive and reconnects
+// if the connection is lost. It never returns.
+func (c *mqttClient) run() {
+	backoff := time.Second
+	for {
+		conn, err := c.dial()
+		if err != nil {
+			logger.Warn("mqtt: connecting failed", "addr", c.addr, "err", err, "retry", backoff)
+			time.Sleep(backoff)
+			if backoff < time.Minute {
+				backoff *= 2
+			}
+			continue
+		}
+		backoff = time.Second
+		logger.Info("mqtt: connected", "addr", c.addr)
+
+		c.mu.Lock()
+		c.conn = conn
+		c.mu.Unlock()
+
+		c.publishRetained("availability", []byte("online"))
+
+		done := make(chan struct{})
+		go c.ping(done)
+
+		// read and discard incoming packets until the connection fails
+		_, err = io.Copy(io.Discard, conn)
+		close(done)
+		logger.Warn("mqtt: connection lost", "addr", c.addr, "err", err)
+
+		c.mu.Lock()
+		c.conn.Close()
+		c.conn = nil
+		c.mu.Unlock()
+	}
+}
+
+func (c *mqttClient) dial() (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", c.addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := conn.Write(c.connectPacket()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	ack := make([]byte, 4)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	if ack[0] != mqttConnack {
+		conn.Close()
+		return nil, errors.New("unexpected response to connect")
+	}
+	if ack[3] != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("connection refused (code %d)", ack[3])
+	}
+
+	return conn, nil
+}
+
+func (c *mqttClient) ping(done chan struct{}) {
+	t := time.NewTicker(mqttKeepAlive / 2 * time.Second)
+	defer t.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-t.C:
+			c.write([]byte{mqttPingreq, 0})
+		}
+	}
+}
+
+// close publishes that the camera is offline and disconnects from the broker.
+func (c *mqttClient) close() {
+	c.publishRetained("availability", []byte("offline"))
+	c.write([]byte{mqttDisconnect, 0})
+}
+
+// publish sends a message to `<prefix>/<topic>`.
+// The message is dropped if the client is not connected.
+func (c *mqttClient) publish(topic string, payload []byte) {
+	c.write(c.publishPacket(topic, payload, false))
+}
+
+func (c *mqttClient) publishRetained(topic string, payload []byte) {
+	c.write(c.publishPacket(topic, payload, true))
+}
+
+// HandleEvent publishes events to `<prefix>/events` and
+// the motion state to `<prefix>/motion`.
+func (c *mqttClient) HandleEvent(e eventbus.Event) {
+	switch e.Type {
+	case eventbus.MotionDetected:
+		c.publish("motion", []byte("ON"))
+	case eventbus.MotionStopped:
+		c.publish("motion", []byte("OFF"))
+	}
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		logger.Error("mqtt", "err", err)
+		return
+	}
+	c.publish("events", b)
+}
+
+func (c *mqttClient) write(b []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	if _, err := c.conn.Write(b); err != nil {
+		logger.Error("mqtt", "err", err)
+		// unblock the reader in run
+		c.conn.Close()
+	}
+}
+
+func (c *mqttClient) connectPacket() []byte {
+	flags := byte(0x02) // clean session
+	// will message
+	flags |= 0x04 | 0x20 // will flag, will retain
+
+	var body []byte
+	body = appendString(body, "MQTT")
+	body = append(body, 4) // protocol level 3.1.1
+	if c.username != "" {
+		flags |= 0x80
+	}
+	if c.password != "" {
+		flags |= 0x40
+	}
+	body = append(body, flags)
+	body = binary.BigEndian.AppendUint16(body, mqttKeepAlive)
+
+	body = appendString(body, c.clientID)
+	body = appendString(body, c.prefix+"/availability")
+	body = appendString(body, "offline")
+	if c.username != "" {
+		body = appendString(body, c.username)
+	}
+	if c.password != "" {
+		body = appendString(body, c.password)
+	}
+
+	return packet(mqttConnect, body)
+}
+
+func (c *mqttClient) publishPacket(topic string, payload []byte, retain bool) []byte {
+	typ := byte(mqttPublish)
+	if retain {
+		typ |= 0x01
+	}
+
+	body := appendString(nil, c.prefix+"/"+topic)
+	body = append(body, payload...)
+
+	return packet(typ, body)
+}
+
+// packet returns a control packet with a fixed header.
+func packet(typ byte, body []byte) []byte {
+	b := []byte{typ}
+
+	// remaining length is encoded with 7 bits per byte
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		b = append(b, digit)
+		if n == 0 {
+			break
+		}
+	}
+
+	return append(b, body...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.BigEndian.AppendUint16(b, uint16(len(s)))
+	return append(b, s...)
+}
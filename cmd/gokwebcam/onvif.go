@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// onvif implements a minimal ONVIF Profile S device and media service,
+// which is sufficient for NVRs to find the mjpeg stream and snapshot uri.
+type onvif struct {
+	Name   string
+	Width  uint32
+	Height uint32
+	UUID   string
+}
+
+func newONVIF(name string, width, height uint32) *onvif {
+	return &onvif{
+		Name:   name,
+		Width:  width,
+		Height: height,
+		UUID:   fmt.Sprintf("urn:uuid:6b2be3f0-6c0c-4a7e-9b1a-%012x", time.Now().UnixNano()&0xffffffffffff),
+	}
+}
+
+func (o *onvif) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	action, err := soapAction(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tmpl := onvifTemplates.Lookup(action)
+	if tmpl == nil {
+		logger.Warn("onvif: unsupported action", "action", action)
+		w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+		w.WriteHeader(http.StatusBadRequest)
+		onvifTemplates.ExecuteTemplate(w, "Fault", action)
+		return
+	}
+
+	data := struct {
+		*onvif
+		Host string
+		Time time.Time
+	}{o, serviceHost(r), time.Now().UTC()}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		logger.Error("onvif", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/soap+xml; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// serviceHost returns the host of the service urls, the local address
+// of the connection of r. The Host header is set by clients and only
+// used for other listeners, e.g. unix sockets.
+func serviceHost(r *http.Request) string {
+	if addr, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok {
+		return addr.String()
+	}
+	return r.Host
+}
+
+// soapAction returns the name of the first element in the soap body.
+func soapAction(r io.Reader) (string, error) {
+	dec := xml.NewDecoder(r)
+	inBody := false
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return "", err
+		}
+
+		if se, ok := t.(xml.StartElement); ok {
+			if inBody {
+				return se.Name.Local, nil
+			}
+			inBody = se.Name.Local == "Body"
+		}
+	}
+}
+
+// discover answers WS-Discovery probes on the local network. It never returns.
+func (o *onvif) discover(port string) {
+	group := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 3702}
+	conn, err := net.ListenMulticastUDP("udp4", nil, group)
+	if err != nil {
+		logger.Warn("onvif: discovery disabled", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 8192)
+	for {
+		n, from, err := conn.ReadFromUDP(buf)
+		if err != nil {
+			logger.Error("onvif", "err", err)
+			continue
+		}
+
+		msg := string(buf[:n])
+		if !strings.Contains(msg, "Probe") || strings.Contains(msg, "ProbeMatches") {
+			continue
+		}
+
+		var msgID string
+		if i := strings.Index(msg, "MessageID"); i >= 0 {
+			if j := strings.Index(msg[i:], ">"); j >= 0 {
+				if k := strings.Index(msg[i+j:], "<"); k >= 0 {
+					msgID = msg[i+j+1 : i+j+k]
+				}
+			}
+		}
+
+		ip, err := localIP(from.IP)
+		if err != nil {
+			logger.Error("onvif", "err", err)
+			continue
+		}
+
+		data := struct {
+			*onvif
+			MessageID string
+			RelatesTo string
+			Addr      string
+		}{o, newMessageID(), msgID, net.JoinHostPort(ip.String(), port)}
+
+		var resp bytes.Buffer
+		if err := onvifTemplates.ExecuteTemplate(&resp, "ProbeMatches", data); err != nil {
+			logger.Error("onvif", "err", err)
+			continue
+		}
+
+		if _, err := conn.WriteToUDP(resp.Bytes(), from); err != nil {
+			logger.Error("onvif", "err", err)
+		}
+	}
+}
+
+// newMessageID returns a random uuid as WS-Addressing message id,
+// which must be unique for every message.
+func newMessageID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // variant
+	return fmt.Sprintf("urn:uuid:%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// localIP returns the local address used to reach ip.
+func localIP(ip net.IP) (net.IP, error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(ip.String(), "3702"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+const onvifEnvelope = `{{define "header"}}<?xml version="1.0" encoding="UTF-8"?>
+<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:tds="http://www.onvif.org/ver10/device/wsdl" xmlns:trt="http://www.onvif.org/ver10/media/wsdl" xmlns:tt="http://www.onvif.org/ver10/schema" xmlns:ter="http://www.onvif.org/ver10/error"><s:Body>{{end}}
+{{define "footer"}}</s:Body></s:Envelope>{{end}}`
+
+var onvifTemplates = template.Must(template.New("onvif").Parse(onvifEnvelope + `
+{{define "Fault"}}{{template "header"}}<s:Fault><s:Code><s:Value>s:Sender</s:Value><s:Subcode><s:Value>ter:ActionNotSupported</s:Value></s:Subcode></s:Code><s:Reason><s:Text xml:lang="en">{{html .}} is not supported</s:Text></s:Reason></s:Fault>{{template "footer"}}{{end}}
+
+{{define "GetSystemDateAndTime"}}{{template "header"}}<tds:GetSystemDateAndTimeResponse><tds:SystemDateAndTime><tt:DateTimeType>NTP</tt:DateTimeType><tt:DaylightSavings>false</tt:DaylightSavings><tt:UTCDateTime><tt:Time><tt:Hour>{{.Time.Hour}}</tt:Hour><tt:Minute>{{.Time.Minute}}</tt:Minute><tt:Second>{{.Time.Second}}</tt:Second></tt:Time><tt:Date><tt:Year>{{.Time.Year}}</tt:Year><tt:Month>{{printf "%d" .Time.Month}}</tt:Month><tt:Day>{{.Time.Day}}</tt:Day></tt:Date></tt:UTCDateTime></tds:SystemDateAndTime></tds:GetSystemDateAndTimeResponse>{{template "footer"}}{{end}}
+
+{{define "GetDeviceInformation"}}{{template "header"}}<tds:GetDeviceInformationResponse><tds:Manufacturer>gokwebcam</tds:Manufacturer><tds:Model>{{html .Name}}</tds:Model><tds:FirmwareVersion>1.0</tds:FirmwareVersion><tds:SerialNumber>{{.UUID}}</tds:SerialNumber><tds:HardwareId>v4l2</tds:HardwareId></tds:GetDeviceInformationResponse>{{template "footer"}}{{end}}
+
+{{define "GetCapabilities"}}{{template "header"}}<tds:GetCapabilitiesResponse><tds:Capabilities><tt:Device><tt:XAddr>http://{{html .Host}}/onvif/device_service</tt:XAddr></tt:Device><tt:Media><tt:XAddr>http://{{html .Host}}/onvif/media_service</tt:XAddr><tt:StreamingCapabilities><tt:RTPMulticast>false</tt:RTPMulticast><tt:RTP_TCP>false</tt:RTP_TCP><tt:RTP_RTSP_TCP>false</tt:RTP_RTSP_TCP></tt:StreamingCapabilities></tt:Media></tds:Capabilities></tds:GetCapabilitiesResponse>{{template "footer"}}{{end}}
+
+{{define "GetServices"}}{{template "header"}}<tds:GetServicesResponse><tds:Service><tds:Namespace>http://www.onvif.org/ver10/device/wsdl</tds:Namespace><tds:XAddr>http://{{html .Host}}/onvif/device_service</tds:XAddr><tds:Version><tt:Major>2</tt:Major><tt:Minor>0</tt:Minor></tds:Version></tds:Service><tds:Service><tds:Namespace>http://www.onvif.org/ver10/media/wsdl</tds:Namespace><tds:XAddr>http://{{html .Host}}/onvif/media_service</tds:XAddr><tds:Version><tt:Major>2</tt:Major><tt:Minor>0</tt:Minor></tds:Version></tds:Service></tds:GetServicesResponse>{{template "footer"}}{{end}}
+
+{{define "profile"}}<trt:Profiles token="profile0" fixed="true"><tt:Name>{{html .Name}}</tt:Name><tt:VideoSourceConfiguration token="source0"><tt:Name>source0</tt:Name><tt:UseCount>1</tt:UseCount><tt:SourceToken>source0</tt:SourceToken><tt:Bounds x="0" y="0" width="{{.Width}}" height="{{.Height}}"/></tt:VideoSourceConfiguration><tt:VideoEncoderConfiguration token="encoder0"><tt:Name>encoder0</tt:Name><tt:UseCount>1</tt:UseCount><tt:Encoding>JPEG</tt:Encoding><tt:Resolution><tt:Width>{{.Width}}</tt:Width><tt:Height>{{.Height}}</tt:Height></tt:Resolution><tt:Quality>75</tt:Quality></tt:VideoEncoderConfiguration></trt:Profiles>{{end}}
+
+{{define "GetProfiles"}}{{template "header"}}<trt:GetProfilesResponse>{{template "profile" .}}</trt:GetProfilesResponse>{{template "footer"}}{{end}}
+
+{{define "GetProfile"}}{{template "header"}}<trt:GetProfileResponse>{{template "profile" .}}</trt:GetProfileResponse>{{template "footer"}}{{end}}
+
+{{define "GetStreamUri"}}{{template "header"}}<trt:GetStreamUriResponse><trt:MediaUri><tt:Uri>http://{{html .Host}}/video</tt:Uri><tt:InvalidAfterConnect>false</tt:InvalidAfterConnect><tt:InvalidAfterReboot>false</tt:InvalidAfterReboot><tt:Timeout>PT0S</tt:Timeout></trt:MediaUri></trt:GetStreamUriResponse>{{template "footer"}}{{end}}
+
+{{define "GetSnapshotUri"}}{{template "header"}}<trt:GetSnapshotUriResponse><trt:MediaUri><tt:Uri>http://{{html .Host}}/image</tt:Uri><tt:InvalidAfterConnect>false</tt:InvalidAfterConnect><tt:InvalidAfterReboot>false</tt:InvalidAfterReboot><tt:Timeout>PT0S</tt:Timeout></trt:MediaUri></trt:GetSnapshotUriResponse>{{template "footer"}}{{end}}
+
+{{define "ProbeMatches"}}<?xml version="1.0" encoding="UTF-8"?>
+<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope" xmlns:a="http://schemas.xmlsoap.org/ws/2004/08/addressing" xmlns:d="http://schemas.xmlsoap.org/ws/2005/04/discovery" xmlns:dn="http://www.onvif.org/ver10/network/wsdl"><s:Header><a:MessageID>{{.MessageID}}</a:MessageID><a:RelatesTo>{{html .RelatesTo}}</a:RelatesTo><a:To>http://schemas.xmlsoap.org/ws/2004/08/addressing/role/anonymous</a:To><a:Action>http://schemas.xmlsoap.org/ws/2005/04/discovery/ProbeMatches</a:Action></s:Header><s:Body><d:ProbeMatches><d:ProbeMatch><a:EndpointReference><a:Address>{{.UUID}}</a:Address></a:EndpointReference><d:Types>dn:NetworkVideoTransmitter</d:Types><d:Scopes>onvif://www.onvif.org/Profile/Streaming onvif://www.onvif.org/type/video_encoder onvif://www.onvif.org/name/{{html .Name}}</d:Scopes><d:XAddrs>http://{{.Addr}}/onvif/device_service</d:XAddrs><d:MetadataVersion>1</d:MetadataVersion></d:ProbeMatch></d:ProbeMatches></s:Body></s:Envelope>{{end}}
+`))
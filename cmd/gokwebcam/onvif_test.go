@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestONVIFServiceHost(t *testing.T) {
+	srv := httptest.NewServer(newONVIF("cam", 640, 480))
+	defer srv.Close()
+
+	body := `<s:Envelope xmlns:s="http://www.w3.org/2003/05/soap-envelope"><s:Body><GetCapabilities/></s:Body></s:Envelope>`
+	req, err := http.NewRequest(http.MethodPost, srv.URL+"/onvif/device_service", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Host = `evil"><x>`
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(b, []byte("evil")) {
+		t.Errorf("response contains the host header: %s", b)
+	}
+	want := "http://" + srv.Listener.Addr().String() + "/onvif/media_service"
+	if !bytes.Contains(b, []byte(want)) {
+		t.Errorf("response doesn't contain %s: %s", want, b)
+	}
+}
+
+func TestONVIFMessageID(t *testing.T) {
+	a, b := newMessageID(), newMessageID()
+	if a == b {
+		t.Errorf("message ids are equal: %s", a)
+	}
+	if !strings.HasPrefix(a, "urn:uuid:") || len(a) != len("urn:uuid:")+36 {
+		t.Errorf("invalid message id %s", a)
+	}
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"time"
+)
+
+// orientation flips and rotates frames.
+// Frames are flipped first and then rotated by 90 degrees clockwise;
+// rotations by 180 and 270 degrees are expressed by flipping both axes.
+type orientation struct {
+	hflip, vflip bool
+	rot90        bool
+
+	dst image.Image
+}
+
+// newOrientation returns the orientation for a clockwise rotation
+// in degrees and an optional flip "h", "v" or "hv".
+func newOrientation(rotate int, flip string) (*orientation, error) {
+	o := &orientation{}
+	switch rotate {
+	case 0:
+	case 90:
+		o.rot90 = true
+	case 180:
+		o.hflip, o.vflip = true, true
+	case 270:
+		o.hflip, o.vflip, o.rot90 = true, true, true
+	default:
+		return nil, fmt.Errorf("invalid rotation %d", rotate)
+	}
+
+	for _, c := range flip {
+		switch c {
+		case 'h':
+			o.hflip = !o.hflip
+		case 'v':
+			o.vflip = !o.vflip
+		default:
+			return nil, fmt.Errorf("invalid flip %q", flip)
+		}
+	}
+
+	return o, nil
+}
+
+// identity returns true if the orientation doesn't change frames.
+func (o *orientation) identity() bool {
+	return !o.hflip && !o.vflip && !o.rot90
+}
+
+func (o *orientation) Enabled() bool {
+	return !o.identity()
+}
+
+// size returns the size of an oriented frame of size w x h.
+func (o *orientation) size(w, h uint32) (uint32, uint32) {
+	if o.rot90 {
+		return h, w
+	}
+	return w, h
+}
+
+// apply returns the oriented frame. The returned image is
+// reused and only valid until the next call to apply.
+func (o *orientation) Apply(img image.Image, t time.Time) image.Image {
+	if o.identity() {
+		return img
+	}
+
+	b := img.Bounds()
+	size := b.Size()
+	if o.rot90 {
+		size.X, size.Y = size.Y, size.X
+	}
+	rect := image.Rectangle{Max: size}
+
+	switch src := img.(type) {
+	case *image.YCbCr:
+		ratio := src.SubsampleRatio
+		if o.rot90 {
+			switch ratio {
+			case image.YCbCrSubsampleRatio422:
+				ratio = image.YCbCrSubsampleRatio440
+			case image.YCbCrSubsampleRatio440:
+				ratio = image.YCbCrSubsampleRatio422
+			case image.YCbCrSubsampleRatio411, image.YCbCrSubsampleRatio410:
+				logger.Warn("rotation is not supported for subsample ratio", "ratio", ratio)
+				return img
+			}
+		}
+		dst, ok := o.dst.(*image.YCbCr)
+		if !ok || dst.Rect != rect || dst.SubsampleRatio != ratio {
+			dst = image.NewYCbCr(rect, ratio)
+			o.dst = dst
+		}
+
+		o.plane(dst.Y, dst.YStride, src.Y[src.YOffset(b.Min.X, b.Min.Y):], src.YStride, b.Dx(), b.Dy(), 1)
+		cw, ch := chromaSize(src)
+		co := src.COffset(b.Min.X, b.Min.Y)
+		o.plane(dst.Cb, dst.CStride, src.Cb[co:], src.CStride, cw, ch, 1)
+		o.plane(dst.Cr, dst.CStride, src.Cr[co:], src.CStride, cw, ch, 1)
+		return dst
+
+	case *image.Gray:
+		dst, ok := o.dst.(*image.Gray)
+		if !ok || dst.Rect != rect {
+			dst = image.NewGray(rect)
+			o.dst = dst
+		}
+		o.plane(dst.Pix, dst.Stride, src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], src.Stride, b.Dx(), b.Dy(), 1)
+		return dst
+
+	case *image.RGBA:
+		dst, ok := o.dst.(*image.RGBA)
+		if !ok || dst.Rect != rect {
+			dst = image.NewRGBA(rect)
+			o.dst = dst
+		}
+		o.plane(dst.Pix, dst.Stride, src.Pix[src.PixOffset(b.Min.X, b.Min.Y):], src.Stride, b.Dx(), b.Dy(), 4)
+		return dst
+	}
+
+	logger.Warn("orientation is not supported for image type", "type", fmt.Sprintf("%T", img))
+	return img
+}
+
+// plane flips and rotates a plane of w x h pixels with bpp bytes per pixel.
+func (o *orientation) plane(dst []byte, dstStride int, src []byte, srcStride, w, h, bpp int) {
+	for y := 0; y < h; y++ {
+		fy := y
+		if o.vflip {
+			fy = h - 1 - y
+		}
+		row := src[y*srcStride:]
+		for x := 0; x < w; x++ {
+			fx := x
+			if o.hflip {
+				fx = w - 1 - x
+			}
+
+			dx, dy := fx, fy
+			if o.rot90 {
+				dx, dy = h-1-fy, fx
+			}
+			i := dy*dstStride + dx*bpp
+			if bpp == 1 {
+				dst[i] = row[x]
+			} else {
+				copy(dst[i:i+bpp], row[x*bpp:x*bpp+bpp])
+			}
+		}
+	}
+}
+
+// chromaSize returns the size of the chroma planes of img.
+func chromaSize(img *image.YCbCr) (int, int) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	switch img.SubsampleRatio {
+	case image.YCbCrSubsampleRatio422:
+		return (w + 1) / 2, h
+	case image.YCbCrSubsampleRatio420:
+		return (w + 1) / 2, (h + 1) / 2
+	case image.YCbCrSubsampleRatio440:
+		return w, (h + 1) / 2
+	case image.YCbCrSubsampleRatio411:
+		return (w + 3) / 4, h
+	case image.YCbCrSubsampleRatio410:
+		return (w + 3) / 4, (h + 1) / 2
+	}
+	return w, h
+}
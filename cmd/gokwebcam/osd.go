@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"sync/atomic"
+	"time"
+
+	"github.com/brutella/webcam"
+)
+
+// osdControl is the id of the software control which toggles the debug
+// OSD, in the range of driver specific controls, which cameras don't
+// use anymore.
+const osdControl = webcam.ControlID(0x08000000)
+
+// debugOSD draws statistics of the image pipeline onto frames, to debug
+// the stream without another client. It is toggled at runtime with the
+// "Debug OSD" control. Jpeg frames are only decoded while it is enabled.
+type debugOSD struct {
+	position string
+	scale    int
+
+	enabled atomic.Bool
+
+	// the last rendered text
+	text string
+	mask *image.Alpha
+}
+
+func newDebugOSD(position string, scale int, enabled bool) (*debugOSD, error) {
+	switch position {
+	case "top-left", "top-right", "bottom-left", "bottom-right":
+	default:
+		return nil, fmt.Errorf("invalid osd position %q", position)
+	}
+	if scale < 1 {
+		scale = 1
+	}
+	o := &debugOSD{position: position, scale: scale}
+	o.enabled.Store(enabled)
+	return o, nil
+}
+
+func (o *debugOSD) Enabled() bool {
+	return o.enabled.Load()
+}
+
+func (o *debugOSD) Apply(img image.Image, t time.Time) image.Image {
+	text := fmt.Sprintf("%.1f fps  %d clients\nencode %.1f ms\ndropped %d encoder  %d driver  %d skipped",
+		stats.getFPS(),
+		len(stats.connected()),
+		float64(stats.encodeAverage.Load())/float64(time.Millisecond),
+		stats.framesDropped.Load(),
+		stats.framesDroppedDriver.Load(),
+		stats.framesSkipped.Load(),
+	)
+	if text != o.text || o.mask == nil {
+		o.text = text
+		o.mask = renderText(text)
+	}
+	drawText(img, o.mask, o.position, o.scale, true)
+	return img
+}
+
+// control returns the software control to toggle the osd.
+func (o *debugOSD) control() *softwareControl {
+	return &softwareControl{
+		info: webcam.Control{Name: "Debug OSD", Type: int32(webcam.V4L2_CTRL_TYPE_BOOLEAN), Min: 0, Max: 1, Step: 1},
+		get: func() int32 {
+			if o.enabled.Load() {
+				return 1
+			}
+			return 0
+		},
+		set: func(v int32) {
+			o.enabled.Store(v != 0)
+		},
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+	"text/template"
+	"time"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// overlay draws a line of text onto frames.
+// The text is a template which is executed with overlayData for every frame.
+type overlay struct {
+	tmpl     *template.Template
+	name     string
+	position string
+	scale    int
+	box      bool
+
+	// the last rendered text
+	text string
+	mask *image.Alpha
+}
+
+// overlayData is passed to the overlay template.
+type overlayData struct {
+	Time time.Time
+	Name string
+	FPS  float64
+}
+
+func newOverlay(text, name, position string, scale int, box bool) (*overlay, error) {
+	tmpl, err := template.New("overlay").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+
+	switch position {
+	case "top-left", "top-right", "bottom-left", "bottom-right":
+	default:
+		return nil, fmt.Errorf("invalid overlay position %q", position)
+	}
+
+	if scale < 1 {
+		scale = 1
+	}
+
+	return &overlay{
+		tmpl:     tmpl,
+		name:     name,
+		position: position,
+		scale:    scale,
+		box:      box,
+	}, nil
+}
+
+func (o *overlay) Enabled() bool {
+	return true
+}
+
+// apply draws the text for a frame captured at t onto img.
+func (o *overlay) Apply(img image.Image, t time.Time) image.Image {
+	var b bytes.Buffer
+	if err := o.tmpl.Execute(&b, overlayData{Time: t, Name: o.name, FPS: stats.getFPS()}); err != nil {
+		logger.Warn("executing overlay template failed", "err", err)
+		return img
+	}
+	if text := b.String(); text != o.text || o.mask == nil {
+		o.text = text
+		o.mask = renderText(text)
+	}
+	drawText(img, o.mask, o.position, o.scale, o.box)
+	return img
+}
+
+// drawText draws the text of mask, scaled by scale, at position onto img.
+func drawText(img image.Image, mask *image.Alpha, position string, scale int, box bool) {
+	// position the text with a margin
+	pad := 2 * scale
+	size := mask.Rect.Size().Mul(scale)
+	bounds := img.Bounds().Inset(2 * pad)
+	var min image.Point
+	switch position {
+	case "top-left":
+		min = bounds.Min
+	case "top-right":
+		min = image.Pt(bounds.Max.X-size.X, bounds.Min.Y)
+	case "bottom-left":
+		min = image.Pt(bounds.Min.X, bounds.Max.Y-size.Y)
+	case "bottom-right":
+		min = bounds.Max.Sub(size)
+	}
+
+	if box {
+		r := image.Rectangle{Min: min, Max: min.Add(size)}
+		fillGray(img, r.Inset(-pad), color.Gray{Y: 16})
+	}
+
+	for y := 0; y < mask.Rect.Dy(); y++ {
+		for x := 0; x < mask.Rect.Dx(); x++ {
+			if mask.AlphaAt(x, y).A < 0x80 {
+				continue
+			}
+			p := min.Add(image.Pt(x, y).Mul(scale))
+			fillGray(img, image.Rectangle{Min: p, Max: p.Add(image.Pt(scale, scale))}, color.Gray{Y: 235})
+		}
+	}
+}
+
+// renderText returns a mask of text rendered with a fixed 7x13 font.
+// Lines are separated by newlines.
+func renderText(text string) *image.Alpha {
+	face := basicfont.Face7x13
+	d := &font.Drawer{Face: face}
+	lines := strings.Split(text, "\n")
+	w := 0
+	for _, line := range lines {
+		if lw := d.MeasureString(line).Ceil(); lw > w {
+			w = lw
+		}
+	}
+
+	mask := image.NewAlpha(image.Rect(0, 0, w, face.Height*len(lines)))
+	d.Dst = mask
+	d.Src = image.Opaque
+	for i, line := range lines {
+		d.Dot = fixed.P(0, face.Ascent+i*face.Height)
+		d.DrawString(line)
+	}
+
+	return mask
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/webcam"
+	"golang.org/x/image/draw"
+)
+
+// pictureInPicture draws the frames of a second camera as inset into a
+// corner of the frames, e.g. an overview camera into the stream of a door
+// camera. The second camera is a device like /dev/video2 or test:ball, or
+// the stream of a gokwebcam instance like http://10.0.0.6:8080/video/sub.
+// Its frames are scaled when they are received, so that drawing the
+// inset only copies it. The inset is not drawn while the second camera
+// is offline.
+type pictureInPicture struct {
+	source   string
+	position string
+	percent  int         // width of the inset in percent of the frame width
+	hint     image.Point // frame size requested from devices
+
+	mu      sync.Mutex
+	inset   *image.YCbCr // 4:4:4, so that it can be copied into any frame
+	updated time.Time
+	width   int // of the frames the inset is drawn onto
+}
+
+// The inset is updated at most every pipInterval, and has a border of
+// pipBorder pixels.
+const (
+	pipInterval = 100 * time.Millisecond
+	pipBorder   = 2
+)
+
+// newPictureInPicture returns an inset of source with a width of percent
+// of the w x h frames. Devices are opened before returning.
+func newPictureInPicture(source, position string, percent int, w, h uint32) (*pictureInPicture, error) {
+	switch position {
+	case "top-left", "top-right", "bottom-left", "bottom-right":
+	default:
+		return nil, fmt.Errorf("invalid picture-in-picture position %q", position)
+	}
+	if percent < 5 || percent > 90 {
+		return nil, fmt.Errorf("invalid picture-in-picture size %d%%, expected 5 to 90", percent)
+	}
+
+	p := &pictureInPicture{
+		source:   source,
+		position: position,
+		percent:  percent,
+		hint:     image.Pt(int(w)*percent/100, int(h)*percent/100),
+		width:    int(w),
+	}
+
+	if !p.device() {
+		c, err := parseRemoteCamera("pip=" + source)
+		if err != nil {
+			return nil, err
+		}
+		// the url may end with the stream, e.g. /video/sub
+		if base, stream, ok := strings.Cut(c.url.Path, "/video"); ok && (stream == "" || stream[0] == '/') {
+			c.url.Path, c.stream = base, "/video"+stream
+		}
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.ResponseHeaderTimeout = remoteStale
+		go c.run(&http.Client{Transport: transport})
+		go p.receive(c)
+		return p, nil
+	}
+
+	cam, err := p.open()
+	if err != nil {
+		return nil, err
+	}
+	go p.capture(cam)
+	return p, nil
+}
+
+// device returns true if the second camera is a device.
+func (p *pictureInPicture) device() bool {
+	return !strings.HasPrefix(p.source, "http://") && !strings.HasPrefix(p.source, "https://")
+}
+
+func (p *pictureInPicture) Enabled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.inset != nil && time.Since(p.updated) < remoteStale
+}
+
+// Apply draws the inset into a corner of img.
+func (p *pictureInPicture) Apply(img image.Image, t time.Time) image.Image {
+	b := img.Bounds()
+	p.mu.Lock()
+	p.width = b.Dx()
+	inset := p.inset
+	if time.Since(p.updated) > remoteStale {
+		inset = nil
+	}
+	p.mu.Unlock()
+	if inset == nil {
+		return img
+	}
+
+	// position the inset with a margin
+	size := inset.Rect.Size()
+	bounds := b.Inset(4 * pipBorder)
+	var min image.Point
+	switch p.position {
+	case "top-left":
+		min = bounds.Min
+	case "top-right":
+		min = image.Pt(bounds.Max.X-size.X, bounds.Min.Y)
+	case "bottom-left":
+		min = image.Pt(bounds.Min.X, bounds.Max.Y-size.Y)
+	case "bottom-right":
+		min = bounds.Max.Sub(size)
+	}
+	r := image.Rectangle{Min: min, Max: min.Add(size)}
+
+	fillGray(img, r.Inset(-pipBorder), color.Gray{Y: 235})
+	copyYCbCr(img, r, inset)
+	return img
+}
+
+// update scales img to the size of the inset and replaces the inset.
+func (p *pictureInPicture) update(img image.Image) {
+	p.mu.Lock()
+	width := p.width
+	p.mu.Unlock()
+
+	b := img.Bounds()
+	w := width * p.percent / 100
+	h := w * b.Dy() / b.Dx()
+	if w == 0 || h == 0 {
+		return
+	}
+	scaled := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.ApproxBiLinear.Scale(scaled, scaled.Rect, img, b, draw.Src, nil)
+
+	inset := image.NewYCbCr(scaled.Rect, image.YCbCrSubsampleRatio444)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			i := scaled.PixOffset(x, y)
+			yy, cb, cr := color.RGBToYCbCr(scaled.Pix[i], scaled.Pix[i+1], scaled.Pix[i+2])
+			inset.Y[inset.YOffset(x, y)] = yy
+			ci := inset.COffset(x, y)
+			inset.Cb[ci], inset.Cr[ci] = cb, cr
+		}
+	}
+
+	p.mu.Lock()
+	p.inset, p.updated = inset, time.Now()
+	p.mu.Unlock()
+}
+
+// receive updates the inset with the frames of a gokwebcam instance.
+func (p *pictureInPicture) receive(c *remoteCamera) {
+	frames := c.bc.subscribeInterval(pipInterval)
+	for buf := range frames {
+		img, err := jpeg.Decode(bytes.NewReader(buf.Bytes()))
+		buf.release()
+		if err != nil {
+			logger.Debug("decoding picture-in-picture frame failed", "source", c.redacted(), "err", err)
+			continue
+		}
+		p.update(img)
+	}
+}
+
+// open opens the device of the inset with the preferred
+// format and the frame size closest to the inset.
+func (p *pictureInPicture) open() (device, error) {
+	cam, err := openDevice(p.source)
+	if err != nil {
+		return nil, err
+	}
+	priority, _ := parseFormatPriority(defaultFormatPriority)
+	f, ok := selectFormat(cam.GetSupportedFormats(), priority)
+	if !ok {
+		cam.Close()
+		return nil, errors.New("device has no supported format")
+	}
+	w, h, _ := fitSize(cam.GetSupportedFrameSizes(f), uint32(p.hint.X), uint32(p.hint.Y))
+	if _, _, _, err := cam.SetImageFormat(f, w, h); err != nil {
+		cam.Close()
+		return nil, err
+	}
+	if err := cam.StartStreaming(); err != nil {
+		cam.Close()
+		return nil, err
+	}
+	return cam, nil
+}
+
+// capture updates the inset with the frames of cam,
+// which is reopened when reading frames fails.
+func (p *pictureInPicture) capture(cam device) {
+	b := &backoff{min: time.Second, max: time.Minute}
+	for {
+		start := time.Now()
+		err := p.read(cam)
+		cam.StopStreaming()
+		cam.Close()
+		if time.Since(start) > time.Minute {
+			b.reset()
+		}
+		for {
+			d := b.next()
+			logger.Warn("picture-in-picture device failed", "device", p.source, "err", err, "retry", d)
+			time.Sleep(d)
+			if cam, err = p.open(); err == nil {
+				break
+			}
+		}
+	}
+}
+
+// read updates the inset with the frames of cam until reading fails.
+func (p *pictureInPicture) read(cam device) error {
+	ctx, cancel := context.WithCancel(context.Background())
+	frames := cam.Frames(ctx)
+	defer func() {
+		// streaming is stopped once the frames are drained
+		cancel()
+		for frame := range frames {
+			frame.Release()
+		}
+	}()
+
+	var (
+		conv *webcam.Converter
+		last time.Time
+	)
+	for frame := range frames {
+		if frame.Err != nil {
+			if _, ok := frame.Err.(*webcam.Timeout); ok {
+				continue
+			}
+			return frame.Err
+		}
+		if frame.Corrupted() || time.Since(last) < pipInterval {
+			frame.Release()
+			continue
+		}
+		last = time.Now()
+
+		var (
+			img image.Image
+			err error
+		)
+		switch frame.Format {
+		case V4L2_PIX_FMT_MJPG, V4L2_PIX_FMT_PJPG:
+			img, err = jpeg.Decode(bytes.NewReader(webcam.AppendMJPEG(nil, frame.Data)))
+			if err != nil {
+				frame.Release()
+				logger.Debug("decoding picture-in-picture frame failed", "device", p.source, "err", err)
+				continue
+			}
+		default:
+			size := image.Pt(int(frame.Width), int(frame.Height))
+			if conv == nil || conv.Format() != frame.Format || conv.Size() != size || conv.Stride() != int(frame.Stride) {
+				if conv, err = webcam.NewConverter(frame.Format, size.X, size.Y, int(frame.Stride)); err != nil {
+					frame.Release()
+					return err
+				}
+			}
+			img = conv.Convert(frame.Data)
+		}
+		frame.Release()
+		p.update(img)
+	}
+	return errors.New("device stopped streaming")
+}
+
+// copyYCbCr copies src into r of dst. Images in the YCbCr color
+// space are modified in place, other images must implement draw.Image.
+func copyYCbCr(dst image.Image, r image.Rectangle, src *image.YCbCr) {
+	clipped := r.Intersect(dst.Bounds())
+	if clipped.Empty() {
+		return
+	}
+	sp := src.Rect.Min.Add(clipped.Min.Sub(r.Min))
+
+	switch dst := dst.(type) {
+	case *image.YCbCr:
+		for y := 0; y < clipped.Dy(); y++ {
+			di := dst.YOffset(clipped.Min.X, clipped.Min.Y+y)
+			si := src.YOffset(sp.X, sp.Y+y)
+			copy(dst.Y[di:di+clipped.Dx()], src.Y[si:])
+			for x := 0; x < clipped.Dx(); x++ {
+				dci := dst.COffset(clipped.Min.X+x, clipped.Min.Y+y)
+				sci := src.COffset(sp.X+x, sp.Y+y)
+				dst.Cb[dci], dst.Cr[dci] = src.Cb[sci], src.Cr[sci]
+			}
+		}
+	case *image.Gray:
+		for y := 0; y < clipped.Dy(); y++ {
+			di := dst.PixOffset(clipped.Min.X, clipped.Min.Y+y)
+			si := src.YOffset(sp.X, sp.Y+y)
+			copy(dst.Pix[di:di+clipped.Dx()], src.Y[si:])
+		}
+	case draw.Image:
+		draw.Draw(dst, clipped, src, sp, draw.Src)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/brutella/webcam"
+)
+
+// controlPreset is a named bundle of controls with their values. The
+// controls are named like by v4l2-ctl, or by their id, e.g. 0x00980918.
+type controlPreset map[string]int32
+
+// controlNames are the names of the controls which can be used in presets.
+var controlNames = map[string]uint32{
+	"brightness":                 webcam.V4L2_CID_BRIGHTNESS,
+	"contrast":                   webcam.V4L2_CID_CONTRAST,
+	"saturation":                 webcam.V4L2_CID_SATURATION,
+	"hue":                        webcam.V4L2_CID_HUE,
+	"white_balance_automatic":    webcam.V4L2_CID_AUTO_WHITE_BALANCE,
+	"gain":                       webcam.V4L2_CID_GAIN,
+	"power_line_frequency":       webcam.V4L2_CID_POWER_LINE_FREQUENCY,
+	"white_balance_temperature":  webcam.V4L2_CID_WHITE_BALANCE_TEMPERATURE,
+	"sharpness":                  webcam.V4L2_CID_SHARPNESS,
+	"backlight_compensation":     webcam.V4L2_CID_BACKLIGHT_COMPENSATION,
+	"auto_exposure":              webcam.V4L2_CID_EXPOSURE_AUTO,
+	"exposure_time_absolute":     webcam.V4L2_CID_EXPOSURE_ABSOLUTE,
+	"exposure_dynamic_framerate": webcam.V4L2_CID_EXPOSURE_AUTO_PRIORITY,
+	"focus_absolute":             webcam.V4L2_CID_FOCUS_ABSOLUTE,
+	"focus_automatic_continuous": webcam.V4L2_CID_FOCUS_AUTO,
+}
+
+// autoControls switch the automatic adjustment of other controls, which
+// cameras ignore while it is enabled. They are set before other controls.
+var autoControls = map[uint32]bool{
+	webcam.V4L2_CID_AUTO_WHITE_BALANCE: true,
+	webcam.V4L2_CID_EXPOSURE_AUTO:      true,
+	webcam.V4L2_CID_FOCUS_AUTO:         true,
+}
+
+// builtinPresets are available without configuration. The power line
+// frequency is 1 for 50 Hz, 2 for 60 Hz, and auto_exposure 1 for manual
+// and 3 for aperture priority exposure.
+var builtinPresets = map[string]controlPreset{
+	"indoor-50hz": {
+		"power_line_frequency":      1,
+		"white_balance_automatic":   0,
+		"white_balance_temperature": 3200,
+		"backlight_compensation":    0,
+	},
+	"indoor-60hz": {
+		"power_line_frequency":      2,
+		"white_balance_automatic":   0,
+		"white_balance_temperature": 3200,
+		"backlight_compensation":    0,
+	},
+	"outdoor": {
+		"power_line_frequency":    0,
+		"white_balance_automatic": 1,
+		"backlight_compensation":  1,
+	},
+	"lowlight": {
+		"white_balance_automatic":    1,
+		"auto_exposure":              3,
+		"exposure_dynamic_framerate": 1,
+		"backlight_compensation":     0,
+	},
+}
+
+// presetValue is the value of a control of a preset.
+type presetValue struct {
+	id    webcam.ControlID
+	name  string
+	value int32
+}
+
+// values returns the controls of p in the order they are set.
+func (p controlPreset) values() ([]presetValue, error) {
+	var values []presetValue
+	for name, v := range p {
+		id, ok := controlNames[name]
+		if !ok {
+			n, err := strconv.ParseUint(name, 0, 32)
+			if err != nil {
+				return nil, fmt.Errorf("unknown control %q", name)
+			}
+			id = uint32(n)
+		}
+		values = append(values, presetValue{id: webcam.ControlID(id), name: name, value: v})
+	}
+	sortControls(values)
+	return values, nil
+}
+
+// sortControls sorts values by id with the auto controls first.
+func sortControls(values []presetValue) {
+	sort.Slice(values, func(i, j int) bool {
+		ai, aj := autoControls[uint32(values[i].id)], autoControls[uint32(values[j].id)]
+		if ai != aj {
+			return ai
+		}
+		return values[i].id < values[j].id
+	})
+}
+
+// presetsHandler returns the control presets (GET) and applies a
+// preset (POST with name). The controls of a preset are set together:
+// if a control can't be set, the controls set before are restored.
+// Controls the camera doesn't have are skipped.
+type presetsHandler struct {
+	cam device
+
+	mu      sync.Mutex
+	presets map[string]controlPreset
+	active  string // the last applied preset
+}
+
+// presetsInfo is the json representation of the presets.
+type presetsInfo struct {
+	Active  string                   `json:"active,omitempty"`
+	Presets map[string]controlPreset `json:"presets"`
+}
+
+// newPresetsHandler returns a handler of the builtin presets and
+// presets, which replace the builtin presets of the same name.
+func newPresetsHandler(cam device, presets map[string]controlPreset) *presetsHandler {
+	h := &presetsHandler{cam: cam, presets: map[string]controlPreset{}}
+	for name, p := range builtinPresets {
+		h.presets[name] = p
+	}
+	for name, p := range presets {
+		h.presets[name] = p
+	}
+	return h
+}
+
+// readPresets reads presets from a json file.
+func readPresets(file string) (map[string]controlPreset, error) {
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var presets map[string]controlPreset
+	if err := json.Unmarshal(b, &presets); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for name, p := range presets {
+		if name == "" {
+			return nil, fmt.Errorf("%s: preset without name", file)
+		}
+		if _, err := p.values(); err != nil {
+			return nil, fmt.Errorf("%s: preset %q: %v", file, name, err)
+		}
+	}
+	return presets, nil
+}
+
+// apply sets the controls of the preset name.
+func (h *presetsHandler) apply(name string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	p, ok := h.presets[name]
+	if !ok {
+		return fmt.Errorf("unknown preset %q", name)
+	}
+	values, err := p.values()
+	if err != nil {
+		return err
+	}
+
+	controls := h.cam.GetControls()
+	var restore []presetValue
+	for _, v := range values {
+		if _, ok := controls[v.id]; !ok {
+			logger.Debug("camera has no control of preset", "preset", name, "control", v.name)
+			continue
+		}
+		prev, err := h.cam.GetControl(v.id)
+		if err == nil {
+			err = h.cam.SetControl(v.id, v.value)
+		}
+		if err != nil {
+			for i := len(restore) - 1; i >= 0; i-- {
+				if err := h.cam.SetControl(restore[i].id, restore[i].value); err != nil {
+					logger.Warn("restoring control failed", "control", restore[i].name, "err", err)
+				}
+			}
+			return fmt.Errorf("setting %s to %d: %v", v.name, v.value, err)
+		}
+		restore = append(restore, presetValue{id: v.id, name: v.name, value: prev})
+	}
+	if len(restore) == 0 {
+		return errors.New("camera has none of the controls of the preset")
+	}
+
+	h.active = name
+	logger.Info("preset applied", "preset", name, "controls", len(restore))
+	return nil
+}
+
+func (h *presetsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		if err := h.apply(r.FormValue("name")); err != nil {
+			logger.Warn("applying preset failed", "preset", r.FormValue("name"), "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	h.mu.Lock()
+	info := presetsInfo{Active: h.active, Presets: h.presets}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+	h.mu.Unlock()
+}
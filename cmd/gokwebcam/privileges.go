@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"os/user"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// capSysModule is the capability to load kernel modules.
+const capSysModule = 16
+
+// canLoadModules returns true if the process has CAP_SYS_MODULE.
+func canLoadModules() bool {
+	hdr := unix.CapUserHeader{Version: unix.LINUX_CAPABILITY_VERSION_3}
+	var data [2]unix.CapUserData
+	if err := unix.Capget(&hdr, &data[0]); err != nil {
+		return false
+	}
+	return data[capSysModule/32].Effective&(1<<(capSysModule%32)) != 0
+}
+
+// dropPrivileges switches to the user and group once the device and
+// the listeners are opened, so that gokwebcam can be started as root
+// to load kernel modules and serve from privileged ports.
+// If group is empty, the primary group of the user is used.
+// The supplementary groups of the user, e.g. video and audio,
+// are kept to open devices later on.
+//
+// To run without root at all, start gokwebcam as a user of the video group
+// with -no-modprobe or with the driver already loaded, e.g. with
+// User=gokwebcam and SupplementaryGroups=video in a systemd unit.
+func dropPrivileges(username, group string) error {
+	u, err := user.Lookup(username)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return fmt.Errorf("invalid uid %q", u.Uid)
+	}
+
+	gid, err := strconv.Atoi(u.Gid)
+	if err != nil {
+		return fmt.Errorf("invalid gid %q", u.Gid)
+	}
+	if group != "" {
+		g, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(g.Gid); err != nil {
+			return fmt.Errorf("invalid gid %q", g.Gid)
+		}
+	}
+
+	groups := []int{gid}
+	ids, err := u.GroupIds()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if n, err := strconv.Atoi(id); err == nil && n != gid {
+			groups = append(groups, n)
+		}
+	}
+
+	// the go runtime applies these to all threads
+	if err := unix.Setgroups(groups); err != nil {
+		return fmt.Errorf("setgroups: %v", err)
+	}
+	if err := unix.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %v", err)
+	}
+	if err := unix.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %v", err)
+	}
+
+	// make sure that root can't be regained
+	if unix.Setuid(0) == nil {
+		return fmt.Errorf("privileges could not be dropped")
+	}
+	return nil
+}
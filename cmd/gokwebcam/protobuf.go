@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+)
+
+// protobuf wire types
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+	protoFixed32 = 5
+)
+
+// protoMessage is an encoded protobuf message. Fields with
+// the default value are omitted like in proto3.
+type protoMessage []byte
+
+func (m protoMessage) tag(num, typ int) protoMessage {
+	return binary.AppendUvarint(m, uint64(num)<<3|uint64(typ))
+}
+
+// uint appends a uint32 or uint64 field.
+func (m protoMessage) uint(num int, v uint64) protoMessage {
+	if v == 0 {
+		return m
+	}
+	return binary.AppendUvarint(m.tag(num, protoVarint), v)
+}
+
+// int appends an int32 or int64 field. Negative values
+// are sign extended to 10 bytes.
+func (m protoMessage) int(num int, v int64) protoMessage {
+	return m.uint(num, uint64(v))
+}
+
+func (m protoMessage) float(num int, v float32) protoMessage {
+	if v == 0 {
+		return m
+	}
+	return binary.LittleEndian.AppendUint32(m.tag(num, protoFixed32), math.Float32bits(v))
+}
+
+// bytes appends a bytes, string or embedded message field.
+func (m protoMessage) bytes(num int, b []byte) protoMessage {
+	if len(b) == 0 {
+		return m
+	}
+	m = binary.AppendUvarint(m.tag(num, protoBytes), uint64(len(b)))
+	return append(m, b...)
+}
+
+func (m protoMessage) string(num int, s string) protoMessage {
+	return m.bytes(num, []byte(s))
+}
+
+// message appends an embedded message, which is
+// encoded even if empty as elements of repeated fields.
+func (m protoMessage) message(num int, msg protoMessage) protoMessage {
+	m = binary.AppendUvarint(m.tag(num, protoBytes), uint64(len(msg)))
+	return append(m, msg...)
+}
+
+var errProtoTruncated = errors.New("protobuf: truncated message")
+
+// decodeProto calls field for every field of msg. The value of varint
+// and fixed fields is v, the value of length delimited fields is b.
+func decodeProto(msg []byte, field func(num int, v uint64, b []byte) error) error {
+	for len(msg) > 0 {
+		key, n := binary.Uvarint(msg)
+		if n <= 0 {
+			return errProtoTruncated
+		}
+		msg = msg[n:]
+
+		var (
+			v uint64
+			b []byte
+		)
+		switch typ := key & 7; typ {
+		case protoVarint:
+			if v, n = binary.Uvarint(msg); n <= 0 {
+				return errProtoTruncated
+			}
+			msg = msg[n:]
+		case protoFixed64:
+			if len(msg) < 8 {
+				return errProtoTruncated
+			}
+			v, msg = binary.LittleEndian.Uint64(msg), msg[8:]
+		case protoFixed32:
+			if len(msg) < 4 {
+				return errProtoTruncated
+			}
+			v, msg = uint64(binary.LittleEndian.Uint32(msg)), msg[4:]
+		case protoBytes:
+			l, n := binary.Uvarint(msg)
+			if n <= 0 || l > uint64(len(msg)-n) {
+				return errProtoTruncated
+			}
+			b, msg = msg[n:n+int(l)], msg[n+int(l):]
+		default:
+			return errors.New("protobuf: unsupported wire type")
+		}
+
+		if err := field(int(key>>3), v, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
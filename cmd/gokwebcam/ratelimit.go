@@ -0,0 +1,114 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a leaky bucket rate limiter per client ip.
+// Every request adds one to the bucket of the client, which leaks
+// with rate requests per second. Requests which would overflow
+// the bucket of size burst are rejected.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	cleaned time.Time
+}
+
+type bucket struct {
+	level float64
+	last  time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// allow returns true if a request of ip is allowed, or
+// the duration after which the next request is allowed.
+func (l *rateLimiter) allow(ip string) (bool, time.Duration) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// forget clients with empty buckets once a minute
+	if now.Sub(l.cleaned) > time.Minute {
+		for k, b := range l.buckets {
+			if l.leak(b, now) == 0 {
+				delete(l.buckets, k)
+			}
+		}
+		l.cleaned = now
+	}
+
+	b, ok := l.buckets[ip]
+	if !ok {
+		b = &bucket{last: now}
+		l.buckets[ip] = b
+	}
+
+	level := l.leak(b, now)
+	if level+1 > l.burst {
+		wait := (level + 1 - l.burst) / l.rate
+		return false, time.Duration(wait * float64(time.Second))
+	}
+	b.level = level + 1
+	b.last = now
+	return true, 0
+}
+
+// leak returns the level of b at now.
+func (l *rateLimiter) leak(b *bucket, now time.Time) float64 {
+	return math.Max(0, b.level-now.Sub(b.last).Seconds()*l.rate)
+}
+
+// clients returns the number of tracked clients.
+func (l *rateLimiter) clients() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return len(l.buckets)
+}
+
+// middleware rejects requests over the limit with 503 Service Unavailable.
+func (l *rateLimiter) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			ip = r.RemoteAddr
+		}
+
+		if ok, wait := l.allow(ip); !ok {
+			stats.requestsRejected.Add(1)
+			logger.Debug("rate limit exceeded", "remote", r.RemoteAddr, "url", r.URL)
+			serviceUnavailable(w, wait)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// serviceUnavailable responds with 503 Service Unavailable
+// and the number of seconds to wait in the Retry-After header.
+func serviceUnavailable(w http.ResponseWriter, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	if secs < 1 {
+		secs = 1
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(secs))
+	http.Error(w, "too many requests", http.StatusServiceUnavailable)
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/binary"
+	"io"
+	"net/http"
+
+	"github.com/brutella/webcam"
+	"github.com/brutella/webcam/cmd/gokwebcam/eventbus"
+)
+
+// rawHeaderSize is the size of the header preceding every raw frame.
+const rawHeaderSize = 40
+
+// rawHandler streams the captured frames before they are filtered and
+// encoded, for consumers which process pixels and would otherwise decode
+// every jpeg frame. The frames are sent in a chunked response, or as
+// binary messages if the request is a WebSocket handshake. Every frame
+// is preceded by a header of big endian fields:
+//
+//	magic     [4]byte  "RAWF"
+//	format    uint32   fourcc of the pixel format, e.g. YUYV or NV12
+//	width     uint32
+//	height    uint32
+//	stride    uint32   bytes per row of the first plane, 0 for jpeg frames
+//	seq       uint64   sequence number of the frame
+//	time      int64    capture time in nanoseconds since the unix epoch
+//	length    uint32   number of bytes following the header
+//
+// With ?fps the frame rate is limited. A client which is slow to
+// receive skips frames.
+type rawHandler struct {
+	frames *broadcaster
+	bus    *eventbus.Bus
+}
+
+func (h *rawHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	_, interval, err := streamOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var ws *websocketConn
+	if r.Header.Get("Upgrade") != "" {
+		if !isWebsocketUpgrade(w, r) {
+			return
+		}
+		if ws, err = upgradeWebsocket(w, r); err != nil {
+			return
+		}
+		defer ws.conn.Close()
+	}
+
+	logger.Info("connect", "remote", r.RemoteAddr, "url", r.URL)
+	h.bus.Publish(eventbus.ClientConnected, map[string]interface{}{
+		"remote": r.RemoteAddr,
+		"url":    r.URL.String(),
+	})
+	r, disconnect := stats.connect("/raw", r)
+	defer disconnect()
+
+	frames := h.frames.subscribeInterval(interval)
+	defer h.frames.unsubscribe(frames)
+
+	done := make(chan struct{})
+	if ws != nil {
+		go func() {
+			defer close(done)
+			if err := ws.read(nil); err != nil && err != io.EOF {
+				logger.Debug("reading websocket failed", "remote", r.RemoteAddr, "err", err)
+			}
+		}()
+	} else {
+		stream(w)
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+	}
+	flusher, _ := w.(http.Flusher)
+
+	var msg []byte
+	for {
+		var frame *frameBuffer
+		select {
+		case <-done:
+			return
+		case <-r.Context().Done():
+			return
+		case frame = <-frames:
+		}
+
+		msg = appendRawHeader(msg[:0], frame)
+		if ws != nil {
+			msg = append(msg, frame.Bytes()...)
+			err = ws.write(wsOpBinary, msg)
+		} else {
+			if _, err = w.Write(msg); err == nil {
+				_, err = w.Write(frame.Bytes())
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		}
+		if err == nil {
+			stats.bytesServed.Add(uint64(rawHeaderSize + len(frame.Bytes())))
+			stats.sent(r, frame)
+		}
+		frame.release()
+		if err != nil {
+			logger.Debug("writing raw frame failed", "remote", r.RemoteAddr, "err", err)
+			return
+		}
+	}
+}
+
+// appendRawHeader appends the header of frame to b.
+func appendRawHeader(b []byte, frame *frameBuffer) []byte {
+	b = append(b, "RAWF"...)
+	b = binary.BigEndian.AppendUint32(b, uint32(frame.format))
+	b = binary.BigEndian.AppendUint32(b, frame.width)
+	b = binary.BigEndian.AppendUint32(b, frame.height)
+	stride := frame.stride
+	if stride == 0 {
+		stride = rawStride(frame.format, frame.width)
+	}
+	b = binary.BigEndian.AppendUint32(b, stride)
+	b = binary.BigEndian.AppendUint64(b, frame.seq)
+	b = binary.BigEndian.AppendUint64(b, uint64(frame.time.UnixNano()))
+	return binary.BigEndian.AppendUint32(b, uint32(len(frame.Bytes())))
+}
+
+// rawStride returns the bytes per row of the first plane of frames of
+// format and width without padding, or 0 for jpeg and unknown formats.
+func rawStride(format webcam.PixelFormat, width uint32) uint32 {
+	switch format {
+	case V4L2_PIX_FMT_YUYV, V4L2_PIX_FMT_RGB565,
+		V4L2_PIX_FMT_SBGGR10, V4L2_PIX_FMT_SGBRG10, V4L2_PIX_FMT_SGRBG10, V4L2_PIX_FMT_SRGGB10:
+		return 2 * width
+	case V4L2_PIX_FMT_RGB24, V4L2_PIX_FMT_BGR24:
+		return 3 * width
+	case V4L2_PIX_FMT_NV12, V4L2_PIX_FMT_YUV420, V4L2_PIX_FMT_YVU420, V4L2_PIX_FMT_GREY,
+		V4L2_PIX_FMT_SBGGR8, V4L2_PIX_FMT_SGBRG8, V4L2_PIX_FMT_SGRBG8, V4L2_PIX_FMT_SRGGB8:
+		return width
+	}
+	return 0
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/brutella/webcam/cmd/gokwebcam/eventbus"
+)
+
+// recorder keeps the frames of the last pre duration in memory and
+// records them together with the following frames and the captured
+// audio into an MJPEG avi file when it is triggered by motion or by
+// POST /record/trigger.
+// Recording continues until post after motion stopped or the last trigger.
+// It stops while the volume of dir is full, see diskGuard.
+type recorder struct {
+	dir           string
+	name          string // camera name prefixed to file names, optional
+	pre, post     time.Duration
+	width, height uint32
+	audio         *audioCapture // optional
+	bus           *eventbus.Bus
+
+	mu       sync.Mutex
+	motion   bool
+	until    time.Time
+	disarmed bool // by the schedule
+	full     bool // the volume, by the disk guard
+}
+
+// HandleEvent starts recording on motion and stops post after motion stopped.
+// Recording stops and triggers are ignored while the schedule is disarmed
+// or the volume is full.
+func (r *recorder) HandleEvent(e eventbus.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	switch e.Type {
+	case eventbus.MotionDetected:
+		r.motion = !r.disarmed && !r.full
+	case eventbus.MotionStopped:
+		r.motion = false
+		if !r.disarmed && !r.full {
+			r.extend(time.Now().Add(r.post))
+		}
+	case eventbus.ScheduleArmed:
+		r.disarmed = false
+	case eventbus.ScheduleDisarmed:
+		r.disarmed = true
+		r.motion = false
+		r.until = time.Time{}
+	case eventbus.StorageLow:
+		r.full = true
+		r.motion = false
+		r.until = time.Time{}
+	case eventbus.StorageRecovered:
+		r.full = false
+	}
+}
+
+// trigger starts or extends a recording and returns an error
+// if recording is disarmed or the volume is full.
+func (r *recorder) trigger() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.disarmed {
+		return errors.New("disarmed by schedule")
+	}
+	if r.full {
+		return errors.New("recording volume is full")
+	}
+	r.extend(time.Now().Add(r.post))
+	return nil
+}
+
+func (r *recorder) extend(t time.Time) {
+	if t.After(r.until) {
+		r.until = t
+	}
+}
+
+func (r *recorder) active(t time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.motion || t.Before(r.until)
+}
+
+// ServeHTTP triggers a recording.
+func (r *recorder) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := r.trigger(); err != nil {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// run buffers and records the frames of bc and the audio
+// until the program exits.
+func (r *recorder) run(bc *broadcaster) {
+	frames := bc.subscribe()
+	defer bc.unsubscribe(frames)
+
+	var audio chan audioChunk
+	if r.audio != nil {
+		audio = r.audio.subscribe()
+		defer r.audio.unsubscribe(audio)
+	}
+
+	var (
+		ring      []*frameBuffer
+		audioRing []audioChunk
+		rec       *recording
+	)
+	for {
+		select {
+		case chunk := <-audio:
+			if rec == nil {
+				audioRing = append(audioRing, chunk)
+				for len(audioRing) > 0 && chunk.time.Sub(audioRing[0].time) > r.pre {
+					audioRing = audioRing[1:]
+				}
+				continue
+			}
+
+			if err := rec.avi.WriteAudio(chunk.data); err != nil {
+				logger.Error("writing recording failed", "path", rec.path, "err", err)
+				r.stop(rec)
+				rec = nil
+			}
+
+		case frame := <-frames:
+			if rec == nil {
+				ring = append(ring, frame)
+				for len(ring) > 0 && frame.time.Sub(ring[0].time) > r.pre {
+					ring[0].release()
+					ring = ring[1:]
+				}
+				if !r.active(frame.time) {
+					continue
+				}
+
+				var err error
+				if rec, err = r.start(ring, audioRing); err != nil {
+					logger.Error("starting recording failed", "err", err)
+					r.mu.Lock()
+					r.until = time.Time{}
+					r.mu.Unlock()
+				}
+				for _, f := range ring {
+					f.release()
+				}
+				ring = nil
+				audioRing = nil
+				continue
+			}
+
+			err := rec.avi.WriteFrame(frame.Bytes())
+			frame.release()
+			rec.frames++
+			if err != nil {
+				logger.Error("writing recording failed", "path", rec.path, "err", err)
+			}
+			if err != nil || !r.active(time.Now()) {
+				r.stop(rec)
+				rec = nil
+			}
+		}
+	}
+}
+
+// recording is an avi file which is being recorded.
+type recording struct {
+	path   string
+	file   *os.File
+	avi    *aviWriter
+	frames int
+}
+
+// start creates a new recording which starts with the frames of ring
+// and the audio chunks of audioRing captured since the first frame.
+func (r *recorder) start(ring []*frameBuffer, audioRing []audioChunk) (*recording, error) {
+	// estimate the frame rate from the buffered frames
+	fps := stats.getFPS()
+	if n := len(ring); n > 1 {
+		if d := ring[n-1].time.Sub(ring[0].time); d > 0 {
+			fps = float64(n-1) / d.Seconds()
+		}
+	}
+	if fps <= 0 {
+		fps = 25
+	}
+
+	if err := os.MkdirAll(r.dir, 0755); err != nil {
+		return nil, err
+	}
+	pattern := "%Y-%m-%d_%H%M%S.avi"
+	if r.name != "" {
+		pattern = r.name + "_" + pattern
+	}
+	path := filepath.Join(r.dir, strftime(pattern, ring[0].time))
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	var format *audioFormat
+	if r.audio != nil {
+		format = &r.audio.format
+	}
+	avi, err := newAVIWriter(f, r.width, r.height, fps, format)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	rec := &recording{path: path, file: f, avi: avi}
+	for _, frame := range ring {
+		if err := avi.WriteFrame(frame.Bytes()); err != nil {
+			f.Close()
+			return nil, err
+		}
+		rec.frames++
+	}
+	for _, chunk := range audioRing {
+		if chunk.time.Before(ring[0].time) {
+			continue
+		}
+		if err := avi.WriteAudio(chunk.data); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	logger.Info("recording started", "path", path, "fps", fps)
+	r.bus.Publish(eventbus.RecordingStarted, map[string]interface{}{"path": path})
+	return rec, nil
+}
+
+func (r *recorder) stop(rec *recording) {
+	err := rec.avi.Close()
+	if cerr := rec.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		logger.Error("closing recording failed", "path", rec.path, "err", err)
+	}
+
+	logger.Info("recording stopped", "path", rec.path, "frames", rec.frames)
+	r.bus.Publish(eventbus.RecordingStopped, map[string]interface{}{"path": rec.path, "frames": rec.frames})
+}
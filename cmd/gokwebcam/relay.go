@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// relayListener is a listener which dials out to a relay server, so that
+// cameras behind carrier-grade nat or firewalls can be viewed without
+// port forwarding. It keeps idle tunnels, WebSocket connections to the
+// relay url, open. The relay forwards the connection of a viewer through
+// an idle tunnel as binary messages of at most 64 KiB, and closes the
+// tunnel when the viewer disconnects. Once a viewer is connected, the
+// next idle tunnel is opened. The connections are served like those of
+// the other listeners, including -auth.
+type relayListener struct {
+	url   *url.URL
+	token string // sent as bearer token to the relay
+
+	conns     chan net.Conn
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// The tunnels ping the relay, so that idle tunnels are
+// not closed by nat gateways and proxies in between.
+const (
+	relayPingInterval = 30 * time.Second
+	relayDialTimeout  = 10 * time.Second
+)
+
+// newRelayListener returns a listener of the relay at rawURL,
+// e.g. wss://relay.example.com/cameras/frontdoor, with idle tunnels.
+func newRelayListener(rawURL, token string, idle int) (*relayListener, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ws" && u.Scheme != "wss" {
+		return nil, fmt.Errorf("invalid relay url %q, expected ws:// or wss://", rawURL)
+	}
+	if idle <= 0 {
+		return nil, fmt.Errorf("invalid number of relay tunnels %d", idle)
+	}
+
+	l := &relayListener{url: u, token: token, conns: make(chan net.Conn), done: make(chan struct{})}
+	for i := 0; i < idle; i++ {
+		go l.run()
+	}
+	return l, nil
+}
+
+func (l *relayListener) Accept() (net.Conn, error) {
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *relayListener) Close() error {
+	l.closeOnce.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *relayListener) Addr() net.Addr {
+	return relayAddr(l.url.Redacted())
+}
+
+// relayAddr is the address of a relayListener.
+type relayAddr string
+
+func (a relayAddr) Network() string { return "relay" }
+func (a relayAddr) String() string  { return string(a) }
+
+// run keeps an idle tunnel open until the listener is closed.
+func (l *relayListener) run() {
+	b := &backoff{min: time.Second, max: time.Minute}
+	for {
+		t, err := l.dial()
+		if err == nil {
+			start := time.Now()
+			select {
+			case <-t.ready:
+				b.reset()
+				select {
+				case l.conns <- t.viewer:
+				case <-l.done:
+					t.viewer.Close()
+					return
+				}
+				logger.Debug("viewer connected through relay", "relay", l.url.Redacted())
+				continue
+			case <-t.closed:
+				err = t.err
+				if time.Since(start) > time.Minute {
+					// the relay or a proxy closed the idle tunnel
+					logger.Debug("idle relay tunnel closed", "relay", l.url.Redacted(), "err", err)
+					b.reset()
+					continue
+				}
+			case <-l.done:
+				t.viewer.Close()
+				return
+			}
+		}
+
+		d := b.next()
+		logger.Warn("relay tunnel failed", "relay", l.url.Redacted(), "err", err, "retry", d)
+		select {
+		case <-time.After(d):
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// relayTunnel is a WebSocket connection to the relay. The messages are
+// copied to and from the viewer end of a pipe, which is served like a
+// connection from the viewer.
+type relayTunnel struct {
+	ws     *websocketConn
+	viewer net.Conn
+
+	ready  chan struct{} // closed when the relay forwards a viewer
+	closed chan struct{} // closed when the tunnel is closed
+	err    error         // why the tunnel was closed
+}
+
+// dial opens a tunnel to the relay.
+func (l *relayListener) dial() (*relayTunnel, error) {
+	ws, err := l.handshake()
+	if err != nil {
+		return nil, err
+	}
+
+	local, remote := net.Pipe()
+	t := &relayTunnel{
+		ws:     ws,
+		viewer: relayConn{Conn: remote, addr: ws.conn.RemoteAddr()},
+		ready:  make(chan struct{}),
+		closed: make(chan struct{}),
+	}
+
+	// relay to viewer
+	go func() {
+		var once sync.Once
+		err := ws.read(func(op byte, payload []byte) error {
+			if op != wsOpBinary {
+				return nil
+			}
+			once.Do(func() { close(t.ready) })
+			_, err := local.Write(payload)
+			return err
+		})
+		t.err = err
+		close(t.closed)
+		local.Close()
+		ws.conn.Close()
+	}()
+
+	// viewer to relay
+	go func() {
+		buf := make([]byte, 32*1024)
+		for {
+			n, err := local.Read(buf)
+			if n > 0 {
+				if err := ws.write(wsOpBinary, buf[:n]); err != nil {
+					break
+				}
+			}
+			if err != nil {
+				ws.write(wsOpClose, nil)
+				break
+			}
+		}
+		ws.conn.Close()
+	}()
+
+	go func() {
+		ticker := time.NewTicker(relayPingInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ws.write(wsOpPing, nil)
+			case <-t.closed:
+				return
+			}
+		}
+	}()
+
+	return t, nil
+}
+
+// handshake connects to the relay and opens a WebSocket connection.
+func (l *relayListener) handshake() (*websocketConn, error) {
+	host := l.url.Host
+	if l.url.Port() == "" {
+		port := "80"
+		if l.url.Scheme == "wss" {
+			port = "443"
+		}
+		host = net.JoinHostPort(l.url.Hostname(), port)
+	}
+
+	d := &net.Dialer{Timeout: relayDialTimeout}
+	var (
+		conn net.Conn
+		err  error
+	)
+	if l.url.Scheme == "wss" {
+		conn, err = tls.DialWithDialer(d, "tcp", host, &tls.Config{ServerName: l.url.Hostname()})
+	} else {
+		conn, err = d.Dial("tcp", host)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, 16)
+	rand.Read(key)
+	u := *l.url
+	u.Scheme = "http"
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Key", base64.StdEncoding.EncodeToString(key))
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if l.token != "" {
+		req.Header.Set("Authorization", "Bearer "+l.token)
+	}
+
+	conn.SetDeadline(time.Now().Add(relayDialTimeout))
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("relay responded with %s", resp.Status)
+	}
+	if resp.Header.Get("Sec-WebSocket-Accept") != websocketAccept(req.Header.Get("Sec-WebSocket-Key")) {
+		conn.Close()
+		return nil, errors.New("relay responded with an invalid websocket accept key")
+	}
+	conn.SetDeadline(time.Time{})
+
+	return &websocketConn{conn: conn, rw: bufio.NewReadWriter(br, bufio.NewWriter(conn)), client: true}, nil
+}
+
+// relayConn is the connection of a viewer through a tunnel,
+// whose remote address is the address of the relay.
+type relayConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c relayConn) RemoteAddr() net.Addr { return c.addr }
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"mime/multipart"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/brutella/webcam"
+)
+
+// replay reads the frames of a recording to stream them again, e.g. to
+// reproduce a bug with the output of a specific camera. It reads
+//
+//   - streams of raw frames saved from /raw, in any pixel format
+//   - multipart streams saved from /video, e.g. with curl
+//   - concatenated jpeg frames, e.g. written by ffmpeg -f mjpeg
+//
+// The frames of the first two are replayed at their original rate by
+// their timestamps, concatenated jpeg frames at a fixed frame rate.
+type replay struct {
+	file *os.File
+	r    *bufio.Reader
+	mr   *multipart.Reader // of multipart streams
+
+	kind     string // raw, multipart or jpeg
+	boundary string // of multipart streams
+	loop     bool
+	interval time.Duration // between frames without timestamps
+
+	format        webcam.PixelFormat // of the first frame
+	width, height uint32
+
+	last time.Time // timestamp of the previous frame
+}
+
+// replayFrame is a frame read from a recording.
+type replayFrame struct {
+	data          []byte
+	format        webcam.PixelFormat
+	width, height uint32
+	stride        uint32
+	time          time.Time // zero if the recording has no timestamps
+}
+
+// openReplay opens the recording at path and reads the format of its
+// first frame. Frames without timestamps are replayed at fps.
+func openReplay(path string, loop bool, fps float32) (*replay, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := &replay{
+		file:     f,
+		r:        bufio.NewReaderSize(f, 1<<16),
+		loop:     loop,
+		interval: time.Duration(float32(time.Second) / fps),
+	}
+
+	magic, err := r.r.Peek(4)
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading %s: %v", path, err)
+	}
+	switch {
+	case string(magic) == "RAWF":
+		r.kind = "raw"
+	case magic[0] == 0xff && magic[1] == 0xd8:
+		r.kind = "jpeg"
+	case string(magic[:2]) == "--":
+		line, err := r.r.ReadString('\n')
+		if err != nil {
+			f.Close()
+			return nil, fmt.Errorf("reading %s: %v", path, err)
+		}
+		r.kind = "multipart"
+		r.boundary = strings.TrimSpace(strings.TrimPrefix(line, "--"))
+	default:
+		f.Close()
+		return nil, fmt.Errorf("%s is not a recording of raw, multipart or jpeg frames", path)
+	}
+
+	if err := r.rewind(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	first, err := r.next()
+	if err != nil {
+		f.Close()
+		return nil, fmt.Errorf("reading the first frame of %s: %v", path, err)
+	}
+	r.format, r.width, r.height = first.format, first.width, first.height
+	if err := r.rewind(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// rewind starts reading from the start of the file.
+func (r *replay) rewind() error {
+	if _, err := r.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	r.r.Reset(r.file)
+	if r.kind == "multipart" {
+		r.mr = multipart.NewReader(r.r, r.boundary)
+	}
+	r.last = time.Time{}
+	return nil
+}
+
+// frame returns the next frame and how long to wait since the previous
+// frame. At the end of the file, it starts over if looping, otherwise
+// it returns io.EOF.
+func (r *replay) frame() (replayFrame, time.Duration, error) {
+	f, err := r.next()
+	if err == io.EOF && r.loop {
+		if err := r.rewind(); err != nil {
+			return f, 0, err
+		}
+		f, err = r.next()
+	}
+	if err != nil {
+		return f, 0, err
+	}
+
+	d := r.interval
+	if !f.time.IsZero() && !r.last.IsZero() {
+		// gaps, e.g. where the recording was paused, are skipped
+		if gap := f.time.Sub(r.last); gap >= 0 && gap < time.Second {
+			d = gap
+		}
+	}
+	r.last = f.time
+	return f, d, nil
+}
+
+// next reads the next frame of the file.
+func (r *replay) next() (replayFrame, error) {
+	switch r.kind {
+	case "raw":
+		return r.nextRaw()
+	case "multipart":
+		return r.nextPart()
+	}
+	return r.nextJPEG()
+}
+
+// nextRaw reads a frame preceded by the header written by rawHandler.
+func (r *replay) nextRaw() (replayFrame, error) {
+	var h [rawHeaderSize]byte
+	if _, err := io.ReadFull(r.r, h[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		return replayFrame{}, err
+	}
+	if string(h[:4]) != "RAWF" {
+		return replayFrame{}, errors.New("invalid raw frame header")
+	}
+	f := replayFrame{
+		format: webcam.PixelFormat(binary.BigEndian.Uint32(h[4:])),
+		width:  binary.BigEndian.Uint32(h[8:]),
+		height: binary.BigEndian.Uint32(h[12:]),
+		stride: binary.BigEndian.Uint32(h[16:]),
+		time:   time.Unix(0, int64(binary.BigEndian.Uint64(h[28:]))),
+	}
+	f.data = make([]byte, binary.BigEndian.Uint32(h[36:]))
+	if _, err := io.ReadFull(r.r, f.data); err != nil {
+		return replayFrame{}, io.EOF
+	}
+	return f, nil
+}
+
+// nextPart reads a jpeg frame of a multipart stream.
+func (r *replay) nextPart() (replayFrame, error) {
+	p, err := r.mr.NextPart()
+	if err != nil {
+		if err != io.EOF {
+			// streams saved from /video end in the middle of a part
+			err = io.EOF
+		}
+		return replayFrame{}, err
+	}
+	data, err := io.ReadAll(p)
+	if err != nil {
+		return replayFrame{}, io.EOF
+	}
+
+	f, err := jpegFrame(data)
+	if err != nil {
+		return f, err
+	}
+	if ts, err := strconv.ParseFloat(p.Header.Get("X-Timestamp"), 64); err == nil {
+		f.time = time.UnixMicro(int64(ts * 1e6))
+	}
+	return f, nil
+}
+
+// nextJPEG reads a jpeg frame up to its end of image marker.
+func (r *replay) nextJPEG() (replayFrame, error) {
+	var b bytes.Buffer
+	for {
+		chunk, err := r.r.ReadSlice(0xd9)
+		b.Write(chunk)
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			return replayFrame{}, io.EOF
+		}
+		// the marker is 0xff 0xd9, 0xd9 alone may be part of the data
+		if n := b.Len(); n >= 2 && b.Bytes()[n-2] == 0xff {
+			break
+		}
+	}
+	return jpegFrame(b.Bytes())
+}
+
+// jpegFrame returns the jpeg frame data with its size.
+func jpegFrame(data []byte) (replayFrame, error) {
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return replayFrame{}, fmt.Errorf("invalid jpeg frame: %v", err)
+	}
+	return replayFrame{
+		data:   data,
+		format: V4L2_PIX_FMT_MJPG,
+		width:  uint32(cfg.Width),
+		height: uint32(cfg.Height),
+	}, nil
+}
+
+// newReplayDevice returns a fakeDevice which replays the recording of
+// spec, which is the path of the file after file:, optionally with
+// parameters:
+//
+//	file:capture.mjpeg?loop=1&fps=30
+//
+// With loop, the recording starts over at its end, otherwise the
+// device stops delivering frames. fps is the frame rate of recordings
+// without timestamps.
+func newReplayDevice(spec string) (*fakeDevice, error) {
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, err
+	}
+	path := u.Opaque
+	if path == "" {
+		path = u.Path
+	}
+	q := u.Query()
+
+	loop, _ := strconv.ParseBool(q.Get("loop"))
+	fps := 30.0
+	if s := q.Get("fps"); s != "" {
+		if fps, err = strconv.ParseFloat(s, 32); err != nil || fps <= 0 {
+			return nil, fmt.Errorf("invalid fps %q", s)
+		}
+	}
+
+	r, err := openReplay(path, loop, float32(fps))
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("replaying recording", "path", path, "frames", r.kind, "format", fourccString(r.format), "width", r.width, "height", r.height, "loop", loop)
+
+	return &fakeDevice{
+		format:   r.format,
+		width:    r.width,
+		height:   r.height,
+		fps:      float32(fps),
+		controls: map[webcam.ControlID]int32{},
+		formats:  map[webcam.PixelFormat]string{r.format: fourccString(r.format)},
+		sizes:    []webcam.FrameSize{{MinWidth: r.width, MaxWidth: r.width, MinHeight: r.height, MaxHeight: r.height}},
+		replay:   r,
+	}, nil
+}
+
+// replayFrame returns the next frame of the recording and
+// schedules the following frame at its original delay.
+// d.mu must be held.
+func (d *fakeDevice) replayFrame() (webcam.Frame, error) {
+	now := time.Now()
+	if d.pending == nil {
+		f, _, err := d.replay.frame()
+		if err != nil {
+			return d.replayEnded(err)
+		}
+		d.pending = &f
+	}
+	f := d.pending
+	d.pending = nil
+
+	if next, delay, err := d.replay.frame(); err == nil {
+		d.pending = &next
+		d.next = d.next.Add(delay)
+		if d.next.Before(now) {
+			d.next = now
+		}
+	} else if err != io.EOF {
+		return d.replayEnded(err)
+	} else {
+		d.finished = true
+		logger.Info("recording ended")
+	}
+
+	frame := webcam.Frame{
+		Data:      f.data,
+		Timestamp: now,
+		Sequence:  d.seq,
+		Format:    f.format,
+		Width:     f.width,
+		Height:    f.height,
+		Stride:    f.stride,
+		FD:        -1,
+	}
+	d.seq++
+	return frame, nil
+}
+
+// replayEnded stops delivering frames because the recording ended or
+// can't be read.
+func (d *fakeDevice) replayEnded(err error) (webcam.Frame, error) {
+	d.finished = true
+	if err == io.EOF {
+		logger.Info("recording ended")
+		return webcam.Frame{}, new(webcam.Timeout)
+	}
+	return webcam.Frame{}, err
+}
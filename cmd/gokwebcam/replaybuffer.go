@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replayBuffer keeps the encoded frames of the last max duration in
+// memory, at most maxBytes of them, to answer what just happened without
+// recording to disk. GET /replay?d=10s responds with the frames of the
+// last 10s, or all buffered frames without d, as multipart stream which
+// is sent at once, and /replay.mp4 or ?format=mp4 as motion jpeg video
+// in a fragmented MP4 file.
+type replayBuffer struct {
+	max           time.Duration
+	maxBytes      int
+	boundary      string
+	width, height uint32
+
+	mu     sync.Mutex
+	frames []*frameBuffer // oldest first
+	size   int            // of frames
+}
+
+// run buffers the frames of bc until the program exits.
+func (rb *replayBuffer) run(bc *broadcaster) {
+	frames := bc.subscribe()
+	defer bc.unsubscribe(frames)
+
+	for frame := range frames {
+		rb.mu.Lock()
+		rb.frames = append(rb.frames, frame)
+		rb.size += len(frame.Bytes())
+		for len(rb.frames) > 1 && (frame.time.Sub(rb.frames[0].time) > rb.max || rb.size > rb.maxBytes) {
+			rb.size -= len(rb.frames[0].Bytes())
+			rb.frames[0].release()
+			rb.frames[0] = nil
+			rb.frames = rb.frames[1:]
+		}
+		rb.mu.Unlock()
+	}
+}
+
+// last returns the frames of the last duration d, or all frames if d is
+// 0. The frames are retained and must be released.
+func (rb *replayBuffer) last(d time.Duration) []*frameBuffer {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	if len(rb.frames) == 0 {
+		return nil
+	}
+
+	i := 0
+	if d > 0 {
+		since := rb.frames[len(rb.frames)-1].time.Add(-d)
+		for i < len(rb.frames)-1 && rb.frames[i].time.Before(since) {
+			i++
+		}
+	}
+	frames := make([]*frameBuffer, 0, len(rb.frames)-i)
+	for _, f := range rb.frames[i:] {
+		frames = append(frames, f.retain())
+	}
+	return frames
+}
+
+func (rb *replayBuffer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var d time.Duration
+	if str := r.FormValue("d"); str != "" {
+		var err error
+		if d, err = parseReplayDuration(str); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	frames := rb.last(d)
+	defer func() {
+		for _, f := range frames {
+			f.release()
+		}
+	}()
+	if len(frames) == 0 {
+		http.Error(w, "no frames buffered", http.StatusServiceUnavailable)
+		return
+	}
+
+	if strings.HasSuffix(r.URL.Path, ".mp4") || r.FormValue("format") == "mp4" {
+		rb.serveMP4(w, frames)
+		return
+	}
+
+	w.Header().Set("Content-Type", "multipart/x-mixed-replace;boundary="+rb.boundary)
+	mw := multipart.NewWriter(w)
+	mw.SetBoundary(rb.boundary)
+	for _, f := range frames {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":   []string{"image/jpeg"},
+			"Content-Length": []string{strconv.Itoa(len(f.Bytes()))},
+			"X-Timestamp":    []string{formatTimestamp(f.time)},
+			"X-Sequence":     []string{strconv.FormatUint(f.seq, 10)},
+		})
+		if err == nil {
+			_, err = pw.Write(f.Bytes())
+		}
+		if err != nil {
+			logger.Debug("writing response failed", "remote", r.RemoteAddr, "err", err)
+			return
+		}
+		stats.bytesServed.Add(uint64(len(f.Bytes())))
+	}
+	mw.Close()
+}
+
+// serveMP4 responds with frames as motion jpeg video,
+// which is shown at the rate the frames were captured.
+func (rb *replayBuffer) serveMP4(w http.ResponseWriter, frames []*frameBuffer) {
+	samples := make([]mp4Sample, len(frames))
+	for i, f := range frames {
+		samples[i].data = f.Bytes()
+		if i+1 < len(frames) {
+			samples[i].duration = frames[i+1].time.Sub(f.time)
+		} else if i > 0 {
+			samples[i].duration = samples[i-1].duration
+		} else {
+			samples[i].duration = time.Second
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := writeFragmentedMP4(&buf, rb.width, rb.height, samples); err != nil {
+		logger.Error("encoding replay failed", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "video/mp4")
+	w.Header().Set("Content-Length", strconv.Itoa(buf.Len()))
+	if n, err := w.Write(buf.Bytes()); err == nil {
+		stats.bytesServed.Add(uint64(n))
+	}
+}
+
+// parseReplayDuration parses a positive duration
+// like 10s or a number of seconds.
+func parseReplayDuration(str string) (time.Duration, error) {
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		secs, ferr := strconv.ParseFloat(str, 64)
+		if ferr != nil {
+			return 0, fmt.Errorf("invalid duration %q", str)
+		}
+		d = time.Duration(secs * float64(time.Second))
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("invalid duration %q", str)
+	}
+	return d, nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// s3UnsignedPayload is sent as payload hash to stream uploads
+// without hashing them first.
+const s3UnsignedPayload = "UNSIGNED-PAYLOAD"
+
+// s3Storage saves files in an S3 compatible bucket. Requests use
+// path-style urls and are signed with AWS signature version 4.
+type s3Storage struct {
+	endpoint  *url.URL
+	bucket    string
+	prefix    string
+	region    string
+	accessKey string
+	secretKey string
+	client    *http.Client
+}
+
+func newS3Storage(u *url.URL) (*s3Storage, error) {
+	q := u.Query()
+	region := q.Get("region")
+	if region == "" {
+		region = "us-east-1"
+	}
+
+	endpoint := q.Get("endpoint")
+	if endpoint == "" {
+		endpoint = "https://s3." + region + ".amazonaws.com"
+	}
+	ep, err := url.Parse(endpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &s3Storage{
+		endpoint:  ep,
+		bucket:    u.Host,
+		prefix:    strings.Trim(u.Path, "/"),
+		region:    region,
+		accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		client:    &http.Client{Timeout: 5 * time.Minute},
+	}
+	if s.bucket == "" {
+		return nil, errors.New("s3: missing bucket")
+	}
+	if s.accessKey == "" || s.secretKey == "" {
+		return nil, errors.New("s3: AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY are required")
+	}
+	if s.prefix != "" {
+		s.prefix += "/"
+	}
+	return s, nil
+}
+
+func (s *s3Storage) put(name string, r io.Reader, size int64) error {
+	req, err := s.request(http.MethodPut, s.prefix+name, nil, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if typ := mime.TypeByExtension(path.Ext(name)); typ != "" {
+		req.Header.Set("Content-Type", typ)
+	}
+	return s.do(req, nil)
+}
+
+func (s *s3Storage) list() ([]storedObject, error) {
+	var (
+		objs  []storedObject
+		token string
+	)
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {s.prefix}, "delimiter": {"/"}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		req, err := s.request(http.MethodGet, "", q, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		var result struct {
+			Contents []struct {
+				Key          string
+				Size         int64
+				LastModified time.Time
+			}
+			IsTruncated           bool
+			NextContinuationToken string
+		}
+		if err := s.do(req, &result); err != nil {
+			return nil, err
+		}
+
+		for _, c := range result.Contents {
+			objs = append(objs, storedObject{
+				name:    strings.TrimPrefix(c.Key, s.prefix),
+				size:    c.Size,
+				modTime: c.LastModified,
+			})
+		}
+		if !result.IsTruncated {
+			return objs, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+func (s *s3Storage) remove(name string) error {
+	req, err := s.request(http.MethodDelete, s.prefix+name, nil, nil)
+	if err != nil {
+		return err
+	}
+	return s.do(req, nil)
+}
+
+// request returns a request for the key in the bucket.
+func (s *s3Storage) request(method, key string, q url.Values, body io.Reader) (*http.Request, error) {
+	u := *s.endpoint
+	u.Path = path.Join("/", u.Path, s.bucket, key)
+	if key == "" {
+		u.Path += "/"
+	}
+	u.RawQuery = strings.ReplaceAll(q.Encode(), "+", "%20")
+
+	return http.NewRequest(method, u.String(), body)
+}
+
+// sign adds the headers of AWS signature version 4 to req.
+func (s *s3Storage) sign(req *http.Request, t time.Time) {
+	date := t.Format("20060102T150405Z")
+	day := t.Format("20060102")
+	req.Header.Set("Host", req.URL.Host)
+	req.Header.Set("X-Amz-Date", date)
+	req.Header.Set("X-Amz-Content-Sha256", s3UnsignedPayload)
+
+	var names []string
+	for name := range req.Header {
+		names = append(names, strings.ToLower(name))
+	}
+	sort.Strings(names)
+
+	var headers strings.Builder
+	for _, name := range names {
+		fmt.Fprintf(&headers, "%s:%s\n", name, strings.TrimSpace(req.Header.Get(name)))
+	}
+	signed := strings.Join(names, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		headers.String(),
+		signed,
+		s3UnsignedPayload,
+	}, "\n")
+
+	scope := day + "/" + s.region + "/s3/aws4_request"
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + sha256Hex([]byte(canonical))
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), day)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, toSign))
+
+	req.Header.Del("Host")
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signed, signature))
+}
+
+// do signs and sends req and decodes the xml response into v, if v is not nil.
+func (s *s3Storage) do(req *http.Request, v interface{}) error {
+	s.sign(req, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var e struct {
+			Code    string
+			Message string
+		}
+		if xml.NewDecoder(resp.Body).Decode(&e) == nil && e.Code != "" {
+			return fmt.Errorf("s3: %s: %s", e.Code, e.Message)
+		}
+		return fmt.Errorf("s3: unexpected status %s", resp.Status)
+	}
+
+	if v == nil {
+		return nil
+	}
+	return xml.NewDecoder(resp.Body).Decode(v)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// seccomp constants which are missing in x/sys
+const (
+	seccompSetModeFilter   = 1
+	seccompFilterFlagTSync = 1
+	seccompRetAllow        = 0x7fff0000
+	seccompRetErrno        = 0x00050000
+)
+
+// auditArch are the seccomp architectures by GOARCH.
+// The filter assumes a little endian architecture.
+var auditArch = map[string]uint32{
+	"386":     unix.AUDIT_ARCH_I386,
+	"amd64":   unix.AUDIT_ARCH_X86_64,
+	"arm":     unix.AUDIT_ARCH_ARM,
+	"arm64":   unix.AUDIT_ARCH_AARCH64,
+	"riscv64": unix.AUDIT_ARCH_RISCV64,
+}
+
+// deniedSyscalls are never needed to capture and serve frames,
+// but are useful to an attacker who took over the process.
+var deniedSyscalls = []uint32{
+	unix.SYS_EXECVE,
+	unix.SYS_EXECVEAT,
+	unix.SYS_PTRACE,
+	unix.SYS_PROCESS_VM_READV,
+	unix.SYS_PROCESS_VM_WRITEV,
+	unix.SYS_MOUNT,
+	unix.SYS_UMOUNT2,
+	unix.SYS_PIVOT_ROOT,
+	unix.SYS_CHROOT,
+	unix.SYS_UNSHARE,
+	unix.SYS_SETNS,
+	unix.SYS_INIT_MODULE,
+	unix.SYS_FINIT_MODULE,
+	unix.SYS_DELETE_MODULE,
+	unix.SYS_KEXEC_LOAD,
+	unix.SYS_REBOOT,
+	unix.SYS_SWAPON,
+	unix.SYS_SWAPOFF,
+	unix.SYS_BPF,
+	unix.SYS_PERF_EVENT_OPEN,
+	unix.SYS_USERFAULTFD,
+	unix.SYS_KEYCTL,
+	unix.SYS_ADD_KEY,
+	unix.SYS_REQUEST_KEY,
+}
+
+// allowedIoctlTypes are the types of the ioctl requests which are
+// allowed: video4linux ('V'), alsa pcm ('A') and terminals ('T').
+var allowedIoctlTypes = []uint32{'V', 'A', 'T'}
+
+// sandbox restricts the process once the device and the listeners are
+// opened. Landlock limits file access to the given paths and seccomp
+// denies system calls like execve and ioctls of other subsystems.
+// Network access is not restricted.
+type sandbox struct {
+	readOnly  []string
+	readWrite []string
+	devices   []string // device nodes which are reopened, e.g. the encoder after failures
+}
+
+// apply restricts all threads of the process. Restrictions which are not
+// supported by the kernel are skipped with a warning.
+// Requires a binary without cgo, because the threads of cgo
+// can't be restricted.
+func (s *sandbox) apply() error {
+	// required for unprivileged processes
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_PRCTL, unix.PR_SET_NO_NEW_PRIVS, 1, 0); errno != 0 {
+		if errno == syscall.ENOTSUP {
+			return fmt.Errorf("sandbox requires a binary built with CGO_ENABLED=0")
+		}
+		return fmt.Errorf("setting no_new_privs: %v", errno)
+	}
+
+	switch err := s.landlock(); {
+	case err == nil:
+		logger.Info("landlock applied")
+	case errors.Is(err, unix.ENOSYS) || errors.Is(err, unix.EOPNOTSUPP):
+		logger.Warn("landlock is not supported by the kernel", "err", err)
+	default:
+		return fmt.Errorf("landlock: %v", err)
+	}
+
+	if err := seccomp(); err != nil {
+		return fmt.Errorf("seccomp: %v", err)
+	}
+	logger.Info("seccomp filter applied")
+	return nil
+}
+
+func (s *sandbox) landlock() error {
+	abi, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, 0, 0, unix.LANDLOCK_CREATE_RULESET_VERSION)
+	if errno != 0 {
+		return errno
+	}
+
+	handled := uint64(unix.LANDLOCK_ACCESS_FS_EXECUTE |
+		unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_FILE |
+		unix.LANDLOCK_ACCESS_FS_READ_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_CHAR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_FIFO |
+		unix.LANDLOCK_ACCESS_FS_MAKE_BLOCK |
+		unix.LANDLOCK_ACCESS_FS_MAKE_SYM)
+	if abi >= 2 {
+		handled |= unix.LANDLOCK_ACCESS_FS_REFER
+	}
+	if abi >= 3 {
+		handled |= unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+
+	attr := unix.LandlockRulesetAttr{Access_fs: handled}
+	fd, _, errno := unix.Syscall(unix.SYS_LANDLOCK_CREATE_RULESET, uintptr(unsafe.Pointer(&attr)), unsafe.Sizeof(attr), 0)
+	if errno != 0 {
+		return errno
+	}
+	defer unix.Close(int(fd))
+
+	read := uint64(unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_READ_DIR)
+	write := read | unix.LANDLOCK_ACCESS_FS_WRITE_FILE |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_DIR |
+		unix.LANDLOCK_ACCESS_FS_REMOVE_FILE |
+		unix.LANDLOCK_ACCESS_FS_MAKE_DIR |
+		unix.LANDLOCK_ACCESS_FS_MAKE_REG |
+		unix.LANDLOCK_ACCESS_FS_REFER |
+		unix.LANDLOCK_ACCESS_FS_TRUNCATE
+
+	for _, p := range s.readOnly {
+		if err := addLandlockRule(int(fd), p, read&handled); err != nil {
+			return err
+		}
+	}
+	for _, p := range s.readWrite {
+		if err := addLandlockRule(int(fd), p, write&handled); err != nil {
+			return err
+		}
+	}
+	for _, p := range s.devices {
+		// rules are bound to the inode of the node, symlinks like
+		// /dev/v4l/by-id/… are resolved. A reconnected device gets
+		// a new node, which can't be opened anymore.
+		dev := uint64(unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE)
+		if err := addLandlockRule(int(fd), p, dev&handled); err != nil {
+			return err
+		}
+	}
+
+	if _, _, errno := syscall.AllThreadsSyscall(unix.SYS_LANDLOCK_RESTRICT_SELF, fd, 0, 0); errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// addLandlockRule allows access beneath path. Paths which
+// don't exist are skipped.
+func addLandlockRule(ruleset int, path string, access uint64) error {
+	fd, err := unix.Open(path, unix.O_PATH|unix.O_CLOEXEC, 0)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	defer unix.Close(fd)
+
+	var st unix.Stat_t
+	if err := unix.Fstat(fd, &st); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if st.Mode&unix.S_IFMT != unix.S_IFDIR {
+		// only file rights apply to files
+		access &= unix.LANDLOCK_ACCESS_FS_READ_FILE | unix.LANDLOCK_ACCESS_FS_WRITE_FILE | unix.LANDLOCK_ACCESS_FS_TRUNCATE
+	}
+
+	rule := unix.LandlockPathBeneathAttr{Allowed_access: access, Parent_fd: int32(fd)}
+	_, _, errno := unix.Syscall6(unix.SYS_LANDLOCK_ADD_RULE, uintptr(ruleset), unix.LANDLOCK_RULE_PATH_BENEATH, uintptr(unsafe.Pointer(&rule)), 0, 0, 0)
+	if errno != 0 {
+		return fmt.Errorf("%s: %v", path, errno)
+	}
+	return nil
+}
+
+// seccomp installs a filter on all threads which denies deniedSyscalls
+// and ioctls whose type is not in allowedIoctlTypes with EPERM.
+func seccomp() error {
+	arch, ok := auditArch[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("architecture %s is not supported", runtime.GOARCH)
+	}
+
+	const (
+		ld  = unix.BPF_LD | unix.BPF_W | unix.BPF_ABS
+		jeq = unix.BPF_JMP | unix.BPF_JEQ | unix.BPF_K
+		jge = unix.BPF_JMP | unix.BPF_JGE | unix.BPF_K
+		and = unix.BPF_ALU | unix.BPF_AND | unix.BPF_K
+		ret = unix.BPF_RET | unix.BPF_K
+
+		// offsets in struct seccomp_data
+		offNr    = 0
+		offArch  = 4
+		offIoctl = 24 // lower half of the second argument
+	)
+	deny := unix.SockFilter{Code: ret, K: seccompRetErrno | uint32(unix.EPERM)}
+	allow := unix.SockFilter{Code: ret, K: seccompRetAllow}
+
+	// jumps are relative, Jf: 1 skips the return of a match
+	var prog []unix.SockFilter
+	prog = append(prog,
+		unix.SockFilter{Code: ld, K: offArch},
+		unix.SockFilter{Code: jeq, K: arch, Jt: 1},
+		deny,
+		unix.SockFilter{Code: ld, K: offNr},
+		// x32 system calls on amd64
+		unix.SockFilter{Code: jge, K: 0x40000000, Jt: 0, Jf: 1},
+		deny,
+	)
+	for _, nr := range deniedSyscalls {
+		prog = append(prog,
+			unix.SockFilter{Code: jeq, K: nr, Jf: 1},
+			deny,
+		)
+	}
+	prog = append(prog,
+		unix.SockFilter{Code: jeq, K: unix.SYS_IOCTL, Jt: 1},
+		allow,
+		unix.SockFilter{Code: ld, K: offIoctl},
+		unix.SockFilter{Code: and, K: 0xff00},
+	)
+	for _, typ := range allowedIoctlTypes {
+		prog = append(prog,
+			unix.SockFilter{Code: jeq, K: typ << 8, Jf: 1},
+			allow,
+		)
+	}
+	prog = append(prog, deny)
+
+	fprog := unix.SockFprog{Len: uint16(len(prog)), Filter: &prog[0]}
+	_, _, errno := unix.Syscall(unix.SYS_SECCOMP, seccompSetModeFilter, seccompFilterFlagTSync, uintptr(unsafe.Pointer(&fprog)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// scaledStreams provides downscaled copies of the video stream.
+// Clients which request the same size share one scaler,
+// which runs as long as there are clients.
+type scaledStreams struct {
+	mu      sync.Mutex
+	src     *broadcaster
+	max     image.Point
+	streams map[scaledKey]*scaledStream
+}
+
+// scaledKey identifies a scaler. Scalers of profiles only
+// scale frames at the interval of the profile.
+type scaledKey struct {
+	size     image.Point
+	interval time.Duration
+}
+
+type scaledStream struct {
+	bc      *broadcaster
+	clients int
+	done    chan struct{}
+}
+
+func newScaledStreams(src *broadcaster, w, h uint32) *scaledStreams {
+	return &scaledStreams{
+		src:     src,
+		max:     image.Pt(int(w), int(h)),
+		streams: make(map[scaledKey]*scaledStream),
+	}
+}
+
+// subscribe returns a channel which receives frames scaled to size,
+// at most one frame per interval. A zero size or sizes larger than the frame size are clamped to the
+// frame size. The returned function must be called to unsubscribe.
+func (s *scaledStreams) subscribe(size image.Point, interval time.Duration) (chan *frameBuffer, func()) {
+	return s.subscribeKey(scaledKey{size: size}, interval)
+}
+
+// subscribeProfile returns a channel which receives the frames of p.
+// Frames are scaled once for all clients of p, and only at the frame
+// rate of p. The returned function must be called to unsubscribe.
+func (s *scaledStreams) subscribeProfile(p profile) (chan *frameBuffer, func()) {
+	return s.subscribeKey(scaledKey{size: p.size, interval: p.interval}, p.interval)
+}
+
+func (s *scaledStreams) subscribeKey(key scaledKey, interval time.Duration) (chan *frameBuffer, func()) {
+	if key.size.X == 0 || key.size.X > s.max.X {
+		key.size.X = s.max.X
+	}
+	if key.size.Y == 0 || key.size.Y > s.max.Y {
+		key.size.Y = s.max.Y
+	}
+
+	// no need to scale
+	if key.size == s.max {
+		ch := s.src.subscribeInterval(interval)
+		return ch, func() { s.src.unsubscribe(ch) }
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.streams[key]
+	if !ok {
+		st = &scaledStream{
+			bc:   newBroadcaster(),
+			done: make(chan struct{}),
+		}
+		s.streams[key] = st
+		go st.run(s.src, key)
+		logger.Debug("scaler started", "size", key.size, "interval", key.interval)
+	}
+	st.clients++
+
+	ch := st.bc.subscribeInterval(interval)
+	return ch, func() {
+		st.bc.unsubscribe(ch)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		st.clients--
+		if st.clients == 0 {
+			delete(s.streams, key)
+			close(st.done)
+			logger.Debug("scaler stopped", "size", key.size, "interval", key.interval)
+		}
+	}
+}
+
+// run scales the frames of src until the stream is done.
+func (st *scaledStream) run(src *broadcaster, key scaledKey) {
+	frames := src.subscribeInterval(key.interval)
+	defer src.unsubscribe(frames)
+
+	dst := image.NewRGBA(image.Rectangle{Max: key.size})
+	for {
+		select {
+		case <-st.done:
+			return
+		case frame := <-frames:
+			img, err := jpeg.Decode(bytes.NewReader(frame.Bytes()))
+			seq, t := frame.seq, frame.time
+			frame.release()
+			if err != nil {
+				logger.Warn("decoding frame failed", "err", err)
+				continue
+			}
+
+			draw.ApproxBiLinear.Scale(dst, dst.Rect, img, img.Bounds(), draw.Src, nil)
+
+			buf := newFrameBuffer(0)
+			if err := jpeg.Encode(buf, dst, &jpeg.Options{Quality: 90}); err != nil {
+				buf.release()
+				logger.Warn("encoding frame failed", "err", err)
+				continue
+			}
+			buf.seq, buf.time, buf.encoded = seq, t, time.Now()
+			st.bc.publish(buf)
+		}
+	}
+}
+
+// profile is a pre-configured rendition of the video stream,
+// like the sub stream of ip cameras.
+type profile struct {
+	name     string
+	size     image.Point
+	interval time.Duration
+}
+
+// parseProfile parses a profile like sub=320x240@5,
+// which is served at /video/sub with 320x240 pixels at 5 fps.
+// The frame rate is optional.
+func parseProfile(s string) (profile, error) {
+	name, spec, ok := strings.Cut(s, "=")
+	if !ok || name == "" || strings.Contains(name, "/") {
+		return profile{}, fmt.Errorf("invalid profile %q, expected name=WxH@fps", s)
+	}
+
+	p := profile{name: name}
+	size, fps, hasFPS := strings.Cut(spec, "@")
+	w, h, err := parseSize(size)
+	if err != nil {
+		return profile{}, err
+	}
+	p.size = image.Pt(int(w), int(h))
+
+	if hasFPS {
+		rate, err := strconv.ParseFloat(fps, 64)
+		if err != nil || rate <= 0 {
+			return profile{}, fmt.Errorf("invalid frame rate %q", fps)
+		}
+		p.interval = time.Duration(float64(time.Second) / rate)
+	}
+	return p, nil
+}
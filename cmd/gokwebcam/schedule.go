@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/brutella/webcam/cmd/gokwebcam/eventbus"
+)
+
+// scheduleInterval is the interval in which the schedule is checked.
+const scheduleInterval = 10 * time.Second
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// scheduleWindow is a time window on some days of the week,
+// e.g. mon-fri 09:00-17:00. Windows which end before they start
+// end on the next day, e.g. 22:00-06:00.
+type scheduleWindow struct {
+	str        string
+	days       [7]bool
+	start, end time.Duration // since midnight
+}
+
+// parseScheduleWindow parses a window like "mon-fri 09:00-17:00",
+// "sat,sun 10:00-12:00" or "22:00-06:00" for every day.
+func parseScheduleWindow(str string) (scheduleWindow, error) {
+	w := scheduleWindow{str: str}
+
+	fields := strings.Fields(str)
+	switch len(fields) {
+	case 1:
+		for i := range w.days {
+			w.days[i] = true
+		}
+	case 2:
+		for _, r := range strings.Split(fields[0], ",") {
+			from, to, isRange := strings.Cut(strings.ToLower(r), "-")
+			first, ok := weekdays[from]
+			if !ok {
+				return w, fmt.Errorf("invalid day %q", from)
+			}
+			last := first
+			if isRange {
+				if last, ok = weekdays[to]; !ok {
+					return w, fmt.Errorf("invalid day %q", to)
+				}
+			}
+			for d := first; ; d = (d + 1) % 7 {
+				w.days[d] = true
+				if d == last {
+					break
+				}
+			}
+		}
+	default:
+		return w, fmt.Errorf("invalid schedule %q", str)
+	}
+
+	start, end, ok := strings.Cut(fields[len(fields)-1], "-")
+	if !ok {
+		return w, fmt.Errorf("invalid time range %q", fields[len(fields)-1])
+	}
+	var err error
+	if w.start, err = parseTimeOfDay(start); err != nil {
+		return w, err
+	}
+	if w.end, err = parseTimeOfDay(end); err != nil {
+		return w, err
+	}
+	return w, nil
+}
+
+// parseTimeOfDay parses hh:mm and returns the duration since midnight.
+// 24:00 is the end of the day.
+func parseTimeOfDay(str string) (time.Duration, error) {
+	var h, m int
+	if n, err := fmt.Sscanf(str, "%d:%d", &h, &m); err != nil || n != 2 ||
+		h < 0 || m < 0 || m > 59 || h > 24 || (h == 24 && m > 0) {
+		return 0, fmt.Errorf("invalid time %q", str)
+	}
+	return time.Duration(h)*time.Hour + time.Duration(m)*time.Minute, nil
+}
+
+// contains returns true if t is within the window.
+func (w scheduleWindow) contains(t time.Time) bool {
+	midnight := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+	tod := t.Sub(midnight)
+	day := t.Weekday()
+
+	if w.start <= w.end {
+		return w.days[day] && tod >= w.start && tod < w.end
+	}
+	// the window started the day before
+	return (w.days[day] && tod >= w.start) || (w.days[(day+6)%7] && tod < w.end)
+}
+
+// scheduleOverride arms or disarms until a time,
+// or until it is removed if until is zero.
+type scheduleOverride struct {
+	Armed bool      `json:"armed"`
+	Until time.Time `json:"until,omitempty"`
+}
+
+// scheduler arms and disarms subsystems during the configured windows,
+// or always if no windows are configured, and publishes
+// eventbus.ScheduleArmed and eventbus.ScheduleDisarmed on changes.
+// The schedule can be overridden with /schedule.
+type scheduler struct {
+	windows []scheduleWindow
+	bus     *eventbus.Bus
+
+	mu       sync.Mutex
+	override *scheduleOverride
+	armed    bool
+}
+
+func newScheduler(windows []scheduleWindow, bus *eventbus.Bus) *scheduler {
+	return &scheduler{windows: windows, bus: bus, armed: true}
+}
+
+// armedAt returns true if the schedule is armed at t.
+// s.mu must be held.
+func (s *scheduler) armedAt(t time.Time) bool {
+	if o := s.override; o != nil && (o.Until.IsZero() || t.Before(o.Until)) {
+		return o.Armed
+	}
+	if len(s.windows) == 0 {
+		return true
+	}
+	for _, w := range s.windows {
+		if w.contains(t) {
+			return true
+		}
+	}
+	return false
+}
+
+// run checks the schedule until the program exits.
+func (s *scheduler) run() {
+	s.update()
+	for range time.Tick(scheduleInterval) {
+		s.update()
+	}
+}
+
+// update publishes an event if the state changed.
+func (s *scheduler) update() {
+	s.mu.Lock()
+	now := time.Now()
+	if o := s.override; o != nil && !o.Until.IsZero() && !now.Before(o.Until) {
+		s.override = nil
+	}
+	armed := s.armedAt(now)
+	changed := armed != s.armed
+	s.armed = armed
+	s.mu.Unlock()
+
+	if !changed {
+		return
+	}
+	if armed {
+		logger.Info("schedule armed")
+		s.bus.Publish(eventbus.ScheduleArmed, nil)
+	} else {
+		logger.Info("schedule disarmed")
+		s.bus.Publish(eventbus.ScheduleDisarmed, nil)
+	}
+}
+
+// scheduleStatus is the json representation of a scheduler.
+type scheduleStatus struct {
+	Armed    bool              `json:"armed"`
+	Windows  []string          `json:"windows"`
+	Override *scheduleOverride `json:"override,omitempty"`
+}
+
+// scheduleRequest overrides the schedule for a duration, e.g. 1h,
+// or until the override is deleted if the duration is empty.
+type scheduleRequest struct {
+	Armed    bool   `json:"armed"`
+	Duration string `json:"duration"`
+}
+
+// ServeHTTP returns the state of the schedule (GET), overrides it
+// (POST with a json scheduleRequest) or removes the override (DELETE).
+func (s *scheduler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		var req scheduleRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		o := &scheduleOverride{Armed: req.Armed}
+		if req.Duration != "" {
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+			o.Until = time.Now().Add(d)
+		}
+		logger.Info("overriding schedule", "armed", o.Armed, "until", o.Until)
+
+		s.mu.Lock()
+		s.override = o
+		s.mu.Unlock()
+		s.update()
+	case http.MethodDelete:
+		s.mu.Lock()
+		s.override = nil
+		s.mu.Unlock()
+		s.update()
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	s.mu.Lock()
+	status := scheduleStatus{Armed: s.armed, Windows: []string{}, Override: s.override}
+	s.mu.Unlock()
+	for _, win := range s.windows {
+		status.Windows = append(status.Windows, win.str)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// scheduleGate is a middleware which rejects requests while the schedule
+// is disarmed and cancels the requests in progress once it is disarmed.
+func scheduleGate(bus *eventbus.Bus) middleware {
+	var disarmed atomic.Bool
+	bus.Subscribe(eventbus.HandlerFunc(func(e eventbus.Event) {
+		disarmed.Store(e.Type == eventbus.ScheduleDisarmed)
+	}), eventbus.ScheduleArmed, eventbus.ScheduleDisarmed)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if disarmed.Load() {
+				http.Error(w, "disarmed by schedule", http.StatusServiceUnavailable)
+				return
+			}
+
+			ctx, cancel := context.WithCancel(r.Context())
+			defer cancel()
+			sub := bus.Subscribe(eventbus.HandlerFunc(func(e eventbus.Event) {
+				cancel()
+			}), eventbus.ScheduleDisarmed)
+			defer sub.Unsubscribe()
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
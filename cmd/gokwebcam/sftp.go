@@ -0,0 +1,204 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// sftpStorage uploads files to a directory of an SSH server with SFTP.
+// Files are uploaded to a temporary name first and renamed when complete,
+// like with ftpStorage. The host key of the server must be pinned by its
+// fingerprint, e.g.
+//
+//	sftp://user@host/path?hostkey=SHA256:...&key=/etc/gokwebcam/id_ed25519
+//
+// The fingerprint is printed by ssh-keyscan host | ssh-keygen -lf -.
+// Clients authenticate with the private key of key, or with the
+// password of the url.
+type sftpStorage struct {
+	addr string
+	dir  string
+	cfg  *ssh.ClientConfig
+
+	// dial connects to the server and starts SFTP, done
+	// closes the client and the connection
+	dial func() (c *sftp.Client, done func(), err error)
+}
+
+// newSFTPStorage returns the storage of u. The private
+// key is read before the sandbox is applied.
+func newSFTPStorage(u *url.URL) (*sftpStorage, error) {
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	q := u.Query()
+	// base64 fingerprints contain + which is decoded as space
+	hostKey := strings.ReplaceAll(q.Get("hostkey"), " ", "+")
+	user := u.User.Username()
+
+	if user == "" {
+		return nil, errors.New("sftp requires a user, e.g. sftp://user@host/path")
+	}
+	if !strings.HasPrefix(hostKey, "SHA256:") {
+		return nil, errors.New("sftp requires the fingerprint of the host key, e.g. ?hostkey=SHA256:..., see ssh-keygen -l")
+	}
+
+	// the key is tried before the password
+	var auth []ssh.AuthMethod
+	if file := q.Get("key"); file != "" {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if password, ok := u.User.Password(); ok && password != "" {
+		auth = append(auth, ssh.Password(password))
+	}
+	if len(auth) == 0 {
+		return nil, errors.New("sftp requires a private key, e.g. ?key=/path/to/id_ed25519, or a password")
+	}
+
+	s := &sftpStorage{
+		addr: addr,
+		dir:  u.Path,
+		cfg: &ssh.ClientConfig{
+			User: user,
+			Auth: auth,
+			HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				if fp := ssh.FingerprintSHA256(key); fp != hostKey {
+					return fmt.Errorf("host key %s doesn't match %s", fp, hostKey)
+				}
+				return nil
+			},
+			Timeout: ftpTimeout,
+		},
+	}
+	s.dial = s.dialSSH
+	return s, nil
+}
+
+func (s *sftpStorage) put(name string, r io.Reader, size int64) error {
+	c, done, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	dir := path.Dir(name)
+	if dir != "." {
+		if err := c.MkdirAll(s.path(dir)); err != nil {
+			return err
+		}
+	}
+
+	tmp := s.path(path.Join(dir, "."+path.Base(name)+".part"))
+	f, err := c.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.ReadFrom(r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		c.Remove(tmp)
+		return err
+	}
+	return s.rename(c, tmp, s.path(name))
+}
+
+// rename renames from to to, replacing to if it exists.
+func (s *sftpStorage) rename(c *sftp.Client, from, to string) error {
+	if _, ok := c.HasExtension("posix-rename@openssh.com"); ok {
+		return c.PosixRename(from, to)
+	}
+	// renaming fails if the file exists with version 3
+	c.Remove(to)
+	return c.Rename(from, to)
+}
+
+func (s *sftpStorage) list() ([]storedObject, error) {
+	c, done, err := s.dial()
+	if err != nil {
+		return nil, err
+	}
+	defer done()
+
+	dir := s.dir
+	if dir == "" {
+		dir = "."
+	}
+	infos, err := c.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var objs []storedObject
+	for _, fi := range infos {
+		// hidden files are partial uploads
+		if !fi.Mode().IsRegular() || strings.HasPrefix(fi.Name(), ".") {
+			continue
+		}
+		objs = append(objs, storedObject{name: fi.Name(), size: fi.Size(), modTime: fi.ModTime()})
+	}
+	return objs, nil
+}
+
+func (s *sftpStorage) remove(name string) error {
+	c, done, err := s.dial()
+	if err != nil {
+		return err
+	}
+	defer done()
+
+	return c.Remove(s.path(name))
+}
+
+// path returns the path of name on the server. Paths
+// without a directory are relative to the home directory.
+func (s *sftpStorage) path(name string) string {
+	if s.dir == "" {
+		return name
+	}
+	return path.Join(s.dir, name)
+}
+
+// dialSSH connects and logs in to the server and starts SFTP.
+func (s *sftpStorage) dialSSH() (*sftp.Client, func(), error) {
+	conn, err := net.DialTimeout("tcp", s.addr, ftpTimeout)
+	if err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Minute))
+
+	sc, chans, reqs, err := ssh.NewClientConn(conn, s.addr, s.cfg)
+	if err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("sftp: %v", err)
+	}
+	client := ssh.NewClient(sc, chans, reqs)
+	c, err := sftp.NewClient(client)
+	if err != nil {
+		client.Close()
+		return nil, nil, fmt.Errorf("sftp: %v", err)
+	}
+	return c, func() {
+		c.Close()
+		client.Close()
+	}, nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// shareLinks signs links which grant access to a stream until they
+// expire, e.g. for a contractor who has no credentials. The links are
+// not stored, they are valid until they expire or the key changes.
+type shareLinks struct {
+	key []byte
+	max time.Duration // max lifetime of links
+}
+
+// shareInfo is the json representation of a share link.
+type shareInfo struct {
+	URL     string    `json:"url"`
+	Expires time.Time `json:"expires"`
+}
+
+// mint returns a token which grants access to path until expires.
+func (s *shareLinks) mint(path string, expires time.Time) string {
+	b := binary.BigEndian.AppendUint64(nil, uint64(expires.Unix()))
+	return base64.RawURLEncoding.EncodeToString(append(b, s.sign(path, b)...))
+}
+
+// sign returns the signature of path and the expiry time b.
+func (s *shareLinks) sign(path string, b []byte) []byte {
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write(b)
+	mac.Write([]byte(path))
+	return mac.Sum(nil)[:16]
+}
+
+// verify returns the expiry time of token if it grants access to path.
+func (s *shareLinks) verify(path, token string) (time.Time, error) {
+	b, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || len(b) != 24 {
+		return time.Time{}, errors.New("invalid share link")
+	}
+	if !hmac.Equal(s.sign(path, b[:8]), b[8:]) {
+		return time.Time{}, errors.New("invalid share link")
+	}
+	expires := time.Unix(int64(binary.BigEndian.Uint64(b)), 0)
+	if time.Now().After(expires) {
+		return time.Time{}, errors.New("share link expired")
+	}
+	return expires, nil
+}
+
+// sharedPath returns true if links can be shared to path.
+func sharedPath(path string) bool {
+	return path == "/video" || strings.HasPrefix(path, "/video/")
+}
+
+// shareHandler mints share links (POST with minutes and path, /video by
+// default). It requires the admin role, like all POST requests.
+type shareHandler struct {
+	links *shareLinks
+}
+
+func (h shareHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	minutes := 60
+	if s := r.FormValue("minutes"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n <= 0 {
+			http.Error(w, "invalid minutes", http.StatusBadRequest)
+			return
+		}
+		minutes = n
+	}
+	d := time.Duration(minutes) * time.Minute
+	if d > h.links.max {
+		http.Error(w, fmt.Sprintf("share links expire after at most %v", h.links.max), http.StatusBadRequest)
+		return
+	}
+	path := r.FormValue("path")
+	if path == "" {
+		path = "/video"
+	}
+	if !sharedPath(path) {
+		http.Error(w, "only /video streams can be shared", http.StatusBadRequest)
+		return
+	}
+
+	// links are relative to the url /share was requested at,
+	// e.g. /cam/name/share shares /cam/name/video, and streams
+	// are not served under apiPrefix
+	base := strings.TrimSuffix(strings.SplitN(r.RequestURI, "?", 2)[0], "/share")
+	base = strings.TrimSuffix(base, apiPrefix)
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	expires := time.Now().Add(d).Truncate(time.Second)
+	u := url.URL{
+		Scheme:   scheme,
+		Host:     r.Host,
+		Path:     base + path,
+		RawQuery: url.Values{"share": {h.links.mint(path, expires)}}.Encode(),
+	}
+
+	user := ""
+	if info := requestAuth(r); info != nil {
+		user = info.User
+	}
+	logger.Info("share link created", "path", path, "expires", expires, "user", user)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(shareInfo{URL: u.String(), Expires: expires})
+}
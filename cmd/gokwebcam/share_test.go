@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestShareLinkPath(t *testing.T) {
+	links := &shareLinks{key: []byte("0123456789abcdef0123456789abcdef"), max: time.Hour}
+	tests := []struct {
+		target string
+		path   string
+	}{
+		{"/share", "/video"},
+		{apiPrefix + "/share", "/video"},
+		{"/share?path=/video/low", "/video/low"},
+		{apiPrefix + "/share?path=/video/low", "/video/low"},
+		{"/cam/front/share", "/cam/front/video"},
+		{"/cam/front" + apiPrefix + "/share", "/cam/front/video"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, test.target, nil)
+		rec := httptest.NewRecorder()
+		shareHandler{links}.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", test.target, rec.Code)
+		}
+
+		var info shareInfo
+		if err := json.NewDecoder(rec.Body).Decode(&info); err != nil {
+			t.Fatalf("%s: %v", test.target, err)
+		}
+		u, err := url.Parse(info.URL)
+		if err != nil {
+			t.Fatalf("%s: %v", test.target, err)
+		}
+		if u.Path != test.path {
+			t.Errorf("%s: link to %s, want %s", test.target, u.Path, test.path)
+		}
+
+		// the token is valid for the path the policy is matched against
+		a := &authenticator{prefix: "/cam/front"}
+		if _, err := links.verify(a.policyPath(u.Path), u.Query().Get("share")); err != nil {
+			t.Errorf("%s: %v", test.target, err)
+		}
+	}
+}
+
+func TestShareLinkExpired(t *testing.T) {
+	links := &shareLinks{key: []byte("0123456789abcdef0123456789abcdef"), max: time.Hour}
+	token := links.mint("/video", time.Now().Add(-time.Minute))
+	if _, err := links.verify("/video", token); err == nil {
+		t.Fatal("expired link is valid")
+	}
+	token = links.mint("/video", time.Now().Add(time.Minute))
+	if _, err := links.verify("/video/low", token); err == nil {
+		t.Fatal("link is valid for another path")
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/brutella/webcam"
+)
+
+// parseSize parses a frame size like "1280x720".
+func parseSize(s string) (w, h uint32, err error) {
+	ws, hs, ok := strings.Cut(strings.ToLower(s), "x")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid frame size %q", s)
+	}
+
+	width, err := strconv.ParseUint(strings.TrimSpace(ws), 10, 32)
+	if err != nil || width == 0 {
+		return 0, 0, fmt.Errorf("invalid frame width %q", ws)
+	}
+	height, err := strconv.ParseUint(strings.TrimSpace(hs), 10, 32)
+	if err != nil || height == 0 {
+		return 0, 0, fmt.Errorf("invalid frame height %q", hs)
+	}
+
+	return uint32(width), uint32(height), nil
+}
+
+// fitSize returns the supported frame size which is closest to w x h.
+// Stepwise sizes are clamped to their range and rounded to their step.
+// If w x h is not supported, the size with the nearest area is used.
+// exact is true if w x h is supported.
+func fitSize(sizes []webcam.FrameSize, w, h uint32) (width, height uint32, exact bool) {
+	var bestArea, bestDist int64 = -1, -1
+	for _, s := range sizes {
+		cw := fitDimension(w, s.MinWidth, s.MaxWidth, s.StepWidth)
+		ch := fitDimension(h, s.MinHeight, s.MaxHeight, s.StepHeight)
+
+		area := distance(uint64(cw)*uint64(ch), uint64(w)*uint64(h))
+		dist := distance(uint64(cw), uint64(w)) + distance(uint64(ch), uint64(h))
+		if bestArea == -1 || area < bestArea || (area == bestArea && dist < bestDist) {
+			bestArea, bestDist, width, height = area, dist, cw, ch
+		}
+	}
+
+	return width, height, bestDist == 0
+}
+
+// fitDimension clamps v to [min, max] and rounds it to the nearest step.
+func fitDimension(v, min, max, step uint32) uint32 {
+	if v <= min {
+		return min
+	}
+	if v >= max {
+		return max
+	}
+	if step == 0 {
+		// discrete size
+		return max
+	}
+
+	n := (v - min + step/2) / step
+	if r := min + n*step; r <= max {
+		return r
+	}
+	return min + (n-1)*step
+}
+
+func distance(a, b uint64) int64 {
+	if a > b {
+		return int64(a - b)
+	}
+	return int64(b - a)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/brutella/webcam/cmd/gokwebcam/eventbus"
+)
+
+// eventStream sends events and the metadata of new frames to clients
+// as server-sent events. Events are dropped for clients which are too slow.
+// Frame metadata can be disabled with ?frames=0 and throttled with ?fps=N.
+type eventStream struct {
+	bus           *eventbus.Bus
+	frames        *broadcaster
+	width, height uint32
+}
+
+// frameInfo is the metadata of a frame.
+type frameInfo struct {
+	Seq    uint64    `json:"seq"`
+	Time   time.Time `json:"time"`
+	Width  uint32    `json:"width"`
+	Height uint32    `json:"height"`
+	Size   int       `json:"size"`
+}
+
+func newEventStream(bus *eventbus.Bus, frames *broadcaster, w, h uint32) *eventStream {
+	return &eventStream{
+		bus:    bus,
+		frames: frames,
+		width:  w,
+		height: h,
+	}
+}
+
+func (es *eventStream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	_, interval, err := streamOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, sub := es.bus.SubscribeChan(16)
+	defer sub.Unsubscribe()
+	r, disconnect := stats.connect("/events", r)
+	defer disconnect()
+
+	var frames chan *frameBuffer
+	if r.FormValue("frames") != "0" {
+		frames = es.frames.subscribeInterval(interval)
+		defer es.frames.unsubscribe(frames)
+	}
+
+	stream(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		var (
+			typ string
+			v   interface{}
+		)
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-events:
+			typ, v = string(e.Type), e
+		case img := <-frames:
+			typ = "frame"
+			v = frameInfo{
+				Seq:    img.seq,
+				Time:   img.time,
+				Width:  es.width,
+				Height: es.height,
+				Size:   len(img.Bytes()),
+			}
+			img.release()
+		}
+
+		b, err := json.Marshal(v)
+		if err != nil {
+			logger.Error("encoding event failed", "err", err)
+			continue
+		}
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", typ, b); err != nil {
+			return
+		}
+		flusher.Flush()
+	}
+}
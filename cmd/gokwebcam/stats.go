@@ -0,0 +1,58 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// statsHandler returns the state of the process as json.
+type statsHandler struct {
+	sc *streamControl
+}
+
+// statsInfo is the json representation of the stats.
+type statsInfo struct {
+	Uptime              float64            `json:"uptime"` // seconds
+	Format              string             `json:"format"`
+	Width               uint32             `json:"width"`
+	Height              uint32             `json:"height"`
+	FPS                 float64            `json:"fps"` // measured
+	FramesCaptured      uint64             `json:"frames_captured"`
+	FramesDropped       uint64             `json:"frames_dropped"` // by the encoder
+	FramesDroppedDriver uint64             `json:"frames_dropped_driver"`
+	FramesCorrupted     uint64             `json:"frames_corrupted"`
+	BytesServed         uint64             `json:"bytes_served"`
+	Clients             []clientInfo       `json:"clients"`
+	ClientCounts        map[string]int     `json:"client_counts"`   // by endpoint
+	EncodeDuration      map[string]float64 `json:"encode_duration"` // percentiles in seconds
+}
+
+func (h *statsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	format, width, height := h.sc.current()
+	info := statsInfo{
+		Uptime:              time.Since(stats.start).Seconds(),
+		Format:              fourccString(format),
+		Width:               width,
+		Height:              height,
+		FPS:                 stats.getFPS(),
+		FramesCaptured:      stats.framesCaptured.Load(),
+		FramesDropped:       stats.framesDropped.Load(),
+		FramesDroppedDriver: stats.framesDroppedDriver.Load(),
+		FramesCorrupted:     stats.framesCorrupted.Load(),
+		BytesServed:         stats.bytesServed.Load(),
+		Clients:             stats.connected(),
+		ClientCounts:        map[string]int{},
+		EncodeDuration: map[string]float64{
+			"p50": stats.encodeLatency.quantile(0.5),
+			"p90": stats.encodeLatency.quantile(0.9),
+			"p99": stats.encodeLatency.quantile(0.99),
+		},
+	}
+	for _, c := range info.Clients {
+		info.ClientCounts[c.Endpoint]++
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(info)
+}
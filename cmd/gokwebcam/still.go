@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/brutella/webcam"
+)
+
+// stillSkipFrames is the number of frames skipped after switching
+// the format to give the auto exposure of the camera time to settle.
+const stillSkipFrames = 3
+
+// stillHandler captures a single jpeg frame at the largest frame size
+// of the camera, which is often larger than the size used for streaming.
+// Streaming is paused meanwhile and restored afterwards.
+type stillHandler struct {
+	sc     *streamControl
+	orient *orientation
+}
+
+func (h *stillHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+
+	start := time.Now()
+	h.sc.pause()
+	b, err := h.capture()
+	h.sc.resume()
+	if err != nil {
+		logger.Error("capturing still failed", "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger.Info("still captured", "remote", r.RemoteAddr, "duration", time.Since(start))
+
+	w.Header().Set("Content-Type", "image/jpeg")
+	w.Header().Set("Content-Length", strconv.Itoa(len(b)))
+	if n, err := w.Write(b); err == nil {
+		stats.bytesServed.Add(uint64(n))
+	}
+}
+
+// capture switches to the largest frame size, preferably as mjpeg,
+// and returns a jpeg encoded frame. Streaming must be paused.
+func (h *stillHandler) capture() ([]byte, error) {
+	cam := h.sc.cam
+
+	format := h.sc.format
+	if _, ok := cam.GetSupportedFormats()[V4L2_PIX_FMT_MJPG]; ok {
+		format = V4L2_PIX_FMT_MJPG
+	}
+	sizes := FrameSizes(cam.GetSupportedFrameSizes(format))
+	if len(sizes) == 0 {
+		return nil, errors.New("no supported frame sizes")
+	}
+	sort.Sort(sizes)
+	largest := sizes[len(sizes)-1]
+
+	if err := cam.StopStreaming(); err != nil {
+		return nil, fmt.Errorf("stopping stream: %v", err)
+	}
+	defer func() {
+		if _, _, _, err := cam.SetImageFormat(h.sc.format, h.sc.width, h.sc.height); err != nil {
+			logger.Error("restoring image format failed", "err", err)
+		}
+		if err := cam.StartStreaming(); err != nil {
+			logger.Error("restarting stream failed", "err", err)
+		}
+	}()
+
+	f, width, height, err := cam.SetImageFormat(format, largest.MaxWidth, largest.MaxHeight)
+	if err != nil {
+		return nil, fmt.Errorf("setting image format: %v", err)
+	}
+	if err := cam.StartStreaming(); err != nil {
+		return nil, fmt.Errorf("starting stream: %v", err)
+	}
+	defer cam.StopStreaming()
+
+	frame, stride, err := readStill(cam)
+	if err != nil {
+		return nil, err
+	}
+
+	passthrough := f == V4L2_PIX_FMT_MJPG || f == V4L2_PIX_FMT_PJPG
+	if passthrough && h.orient.identity() {
+		return webcam.AppendMJPEG(nil, frame), nil
+	}
+
+	var img image.Image
+	if passthrough {
+		if img, err = jpeg.Decode(bytes.NewReader(webcam.AppendMJPEG(nil, frame))); err != nil {
+			return nil, err
+		}
+	} else {
+		conv, err := webcam.NewConverter(f, int(width), int(height), int(stride))
+		if err != nil {
+			return nil, err
+		}
+		img = conv.Convert(frame)
+	}
+	img = h.orient.Apply(img, time.Now())
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readStill returns a copy of the frame after stillSkipFrames
+// and its bytes per row.
+func readStill(cam device) ([]byte, uint32, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	frames := cam.Frames(ctx)
+	defer func() {
+		// streaming is stopped once the frames are drained
+		cancel()
+		for frame := range frames {
+			frame.Release()
+		}
+	}()
+
+	skipped := 0
+	for frame := range frames {
+		if frame.Err != nil {
+			return nil, 0, frame.Err
+		}
+		if skipped < stillSkipFrames {
+			skipped++
+			frame.Release()
+			continue
+		}
+		data := append([]byte(nil), frame.Data...)
+		frame.Release()
+		return data, frame.Stride, nil
+	}
+	return nil, 0, errors.New("device stopped streaming")
+}
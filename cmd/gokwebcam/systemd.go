@@ -0,0 +1,128 @@
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listen returns the sockets passed by systemd socket activation
+// or listens on a comma separated list of addresses if the program
+// wasn't socket activated. Addresses are tcp addresses like ":8080"
+// or "[::1]:8080", or unix socket paths like "unix:/run/gokwebcam.sock".
+func listen(addrs string) ([]net.Listener, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err == nil && pid == os.Getpid() {
+		if n, err := strconv.Atoi(os.Getenv("LISTEN_FDS")); err == nil && n > 0 {
+			os.Unsetenv("LISTEN_PID")
+			os.Unsetenv("LISTEN_FDS")
+
+			// passed file descriptors start at 3
+			var lns []net.Listener
+			for fd := 3; fd < 3+n; fd++ {
+				f := os.NewFile(uintptr(fd), "systemd-socket")
+				ln, err := net.FileListener(f)
+				f.Close()
+				if err != nil {
+					return nil, err
+				}
+				lns = append(lns, ln)
+			}
+			logger.Info("using sockets passed by systemd", "count", n)
+			return lns, nil
+		}
+	}
+
+	var lns []net.Listener
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr == "" {
+			continue
+		}
+
+		var (
+			ln  net.Listener
+			err error
+		)
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			// remove the socket of a previous run
+			if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+				os.Remove(path)
+			}
+			ln, err = net.Listen("unix", path)
+		} else {
+			ln, err = net.Listen("tcp", addr)
+		}
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return nil, err
+		}
+		lns = append(lns, ln)
+	}
+
+	return lns, nil
+}
+
+// tcpPort returns the port of the first tcp listener of lns, or 0.
+func tcpPort(lns []net.Listener) int {
+	for _, ln := range lns {
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			return addr.Port
+		}
+	}
+	return 0
+}
+
+// sdNotify sends a state notification like "READY=1" to systemd.
+// It does nothing if the program isn't run by systemd.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+
+	// abstract namespace sockets start with a null byte
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+// watchdog pings the systemd watchdog as long as the capture loop
+// is alive. If frames stop arriving, the pings stop and systemd
+// restarts the service, unless no frames are expected, e.g. while a
+// capture card waits for its signal. It returns immediately if the
+// watchdog is disabled.
+func watchdog(hc *health) {
+	usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+	if err != nil || usec <= 0 {
+		return
+	}
+	if pid, err := strconv.Atoi(os.Getenv("WATCHDOG_PID")); err == nil && pid != os.Getpid() {
+		return
+	}
+
+	interval := time.Duration(usec) * time.Microsecond / 2
+	logger.Info("systemd watchdog enabled", "interval", interval)
+	for range time.Tick(interval) {
+		if err := hc.alive(); err != nil {
+			logger.Warn("skipping watchdog ping", "err", err)
+			continue
+		}
+
+		if err := sdNotify("WATCHDOG=1"); err != nil {
+			logger.Error("watchdog ping failed", "err", err)
+		}
+	}
+}
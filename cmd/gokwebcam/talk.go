@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// talkHandler plays audio which is sent over a WebSocket on an alsa device,
+// e.g. to talk to a person in front of a doorbell camera.
+// Clients send binary messages of interleaved signed 16 bit little endian
+// samples with the rate and number of channels given by ?rate=N&channels=N.
+// Only one client can talk at a time.
+type talkHandler struct {
+	device string
+
+	mu sync.Mutex // held while a client is talking
+}
+
+func (h *talkHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isWebsocketUpgrade(w, r) {
+		return
+	}
+
+	switch r.FormValue("codec") {
+	case "", "pcm":
+	default:
+		// decoding compressed audio like opus requires cgo libraries
+		http.Error(w, "unsupported codec, only pcm (s16le) is supported", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	rate, err := formInt(r, "rate", 48000)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	channels, err := formInt(r, "channels", 1)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !h.mu.TryLock() {
+		http.Error(w, "another client is talking", http.StatusConflict)
+		return
+	}
+	defer h.mu.Unlock()
+
+	pcm, err := openALSA(h.device, false, rate, channels)
+	if err != nil {
+		logger.Error("opening audio output failed", "device", h.device, "err", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer pcm.close()
+
+	ws, err := upgradeWebsocket(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.conn.Close()
+
+	logger.Info("talk started", "remote", r.RemoteAddr, "rate", rate, "channels", channels)
+	defer logger.Info("talk stopped", "remote", r.RemoteAddr)
+
+	err = ws.read(func(op byte, payload []byte) error {
+		if op != wsOpBinary {
+			return errors.New("expected binary message")
+		}
+		return pcm.write(payload)
+	})
+	if err != nil && err != io.EOF {
+		logger.Debug("reading websocket failed", "remote", r.RemoteAddr, "err", err)
+	}
+}
+
+// formInt returns the positive integer form value key, or def if it is empty.
+func formInt(r *http.Request, key string, def int) (int, error) {
+	s := r.FormValue(key)
+	if s == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, errors.New("invalid " + key)
+	}
+	return n, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"time"
+)
+
+// testPatterns are the patterns rendered by fake devices, e.g. with -d test:smpte.
+var testPatterns = map[string]func(img *image.RGBA, seq uint32, t time.Time){
+	"gradient": gradientPattern,
+	"smpte":    smptePattern,
+	"ball":     ballPattern,
+}
+
+// smpteBars are the colors of the bars of the SMPTE color bars, the
+// colors of the reverse bars below them and of the bottom row.
+var (
+	smpteBars = []color.RGBA{
+		{191, 191, 191, 255}, // grey
+		{191, 191, 0, 255},   // yellow
+		{0, 191, 191, 255},   // cyan
+		{0, 191, 0, 255},     // green
+		{191, 0, 191, 255},   // magenta
+		{191, 0, 0, 255},     // red
+		{0, 0, 191, 255},     // blue
+	}
+	smpteReverse = []color.RGBA{
+		{0, 0, 191, 255},
+		{19, 19, 19, 255},
+		{191, 0, 191, 255},
+		{19, 19, 19, 255},
+		{0, 191, 191, 255},
+		{19, 19, 19, 255},
+		{191, 191, 191, 255},
+	}
+	smpteBottom = []struct {
+		c     color.RGBA
+		width int // in 1/84 of the image width
+	}{
+		{color.RGBA{0, 33, 76, 255}, 15},     // -I
+		{color.RGBA{255, 255, 255, 255}, 15}, // white
+		{color.RGBA{50, 0, 106, 255}, 15},    // +Q
+		{color.RGBA{19, 19, 19, 255}, 15},    // black
+		{color.RGBA{9, 9, 9, 255}, 4},        // pluge
+		{color.RGBA{19, 19, 19, 255}, 4},
+		{color.RGBA{29, 29, 29, 255}, 4},
+		{color.RGBA{19, 19, 19, 255}, 12},
+	}
+)
+
+// smptePattern draws the SMPTE color bars with a ball moving across them,
+// so that frames differ from each other.
+func smptePattern(img *image.RGBA, seq uint32, t time.Time) {
+	r := img.Rect
+	w, h := r.Dx(), r.Dy()
+	top := r.Min.Y + h*2/3
+	middle := r.Min.Y + h*3/4
+
+	for i := range smpteBars {
+		x0, x1 := r.Min.X+w*i/7, r.Min.X+w*(i+1)/7
+		fillRGBA(img, image.Rect(x0, r.Min.Y, x1, top), smpteBars[i])
+		fillRGBA(img, image.Rect(x0, top, x1, middle), smpteReverse[i])
+	}
+	x := 0
+	for _, b := range smpteBottom {
+		x0, x1 := r.Min.X+w*x/84, r.Min.X+w*(x+b.width)/84
+		fillRGBA(img, image.Rect(x0, middle, x1, r.Max.Y), b.c)
+		x += b.width
+	}
+
+	drawBall(img, seq, color.RGBA{255, 255, 255, 255})
+}
+
+// ballPattern draws a ball bouncing on a dark background.
+func ballPattern(img *image.RGBA, seq uint32, t time.Time) {
+	fillRGBA(img, img.Rect, color.RGBA{16, 16, 32, 255})
+	drawBall(img, seq, color.RGBA{255, 128, 0, 255})
+}
+
+// drawBall draws a ball whose position bounces
+// off the borders of img with every frame.
+func drawBall(img *image.RGBA, seq uint32, c color.RGBA) {
+	r := img.Rect
+	radius := r.Dy() / 12
+	if radius < 4 {
+		radius = 4
+	}
+	cx := r.Min.X + radius + bounce(int(seq)*7, r.Dx()-2*radius)
+	cy := r.Min.Y + radius + bounce(int(seq)*5, r.Dy()-2*radius)
+
+	for y := cy - radius; y <= cy+radius; y++ {
+		for x := cx - radius; x <= cx+radius; x++ {
+			dx, dy := x-cx, y-cy
+			if dx*dx+dy*dy <= radius*radius && image.Pt(x, y).In(r) {
+				img.SetRGBA(x, y, c)
+			}
+		}
+	}
+}
+
+// bounce returns the position of an object moving by pos between 0 and
+// n and reversing its direction at the borders.
+func bounce(pos, n int) int {
+	if n <= 0 {
+		return 0
+	}
+	pos %= 2 * n
+	if pos > n {
+		return 2*n - pos
+	}
+	return pos
+}
+
+// fillRGBA fills r of img with c.
+func fillRGBA(img *image.RGBA, r image.Rectangle, c color.RGBA) {
+	draw.Draw(img, r, &image.Uniform{C: c}, image.Point{}, draw.Src)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"image/jpeg"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// timelapseFPS is the frame rate of assembled timelapse videos.
+const timelapseFPS = 25
+
+// timelapse saves a frame every interval to a directory.
+// File names are created from a strftime pattern.
+// If assemble is set, the frames of a day are assembled
+// into an MJPEG video after midnight. If mp4 is set, the
+// frames of past days are assembled into mp4 files by runMP4.
+type timelapse struct {
+	dir           string
+	pattern       string
+	interval      time.Duration
+	assemble      bool
+	mp4           bool
+	speedup       float64 // of the mp4 files
+	width, height uint32
+
+	day   string   // day of the saved files, YYYY-MM-DD
+	files []string // saved files of the day
+}
+
+// run saves frames of bc until the program exits.
+func (tl *timelapse) run(bc *broadcaster) {
+	ticker := time.NewTicker(tl.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		img := bc.next()
+		err := tl.save(img.Bytes(), img.time)
+		img.release()
+		if err != nil {
+			logger.Error("saving timelapse frame failed", "err", err)
+		}
+	}
+}
+
+func (tl *timelapse) save(b []byte, t time.Time) error {
+	if day := t.Format("2006-01-02"); day != tl.day {
+		if tl.assemble && len(tl.files) > 0 {
+			files, day := tl.files, tl.day
+			go func() {
+				path := filepath.Join(tl.dir, day+".avi")
+				if err := assembleAVI(path, files, tl.width, tl.height, timelapseFPS); err != nil {
+					logger.Error("assembling timelapse failed", "path", path, "err", err)
+					return
+				}
+				logger.Info("timelapse assembled", "path", path, "frames", len(files))
+			}()
+		}
+		tl.day = day
+		tl.files = nil
+	}
+
+	path := filepath.Join(tl.dir, strftime(tl.pattern, t))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, b, 0644); err != nil {
+		return err
+	}
+	logger.Debug("timelapse frame saved", "path", path)
+
+	if tl.assemble {
+		tl.files = append(tl.files, path)
+	}
+	return nil
+}
+
+// runMP4 assembles the frames of every past day without an mp4 file
+// into dir/YYYY-MM-DD.mp4, at start and after every midnight. The day
+// of a frame is the day its file was modified, so that frames are found
+// with any pattern, and also after restarts.
+func (tl *timelapse) runMP4() {
+	for {
+		tl.assembleMP4s(time.Now())
+		// wait for the last frame of the day to be saved
+		now := time.Now()
+		next := time.Date(now.Year(), now.Month(), now.Day()+1, 0, 0, 0, 0, now.Location())
+		time.Sleep(time.Until(next) + tl.interval)
+	}
+}
+
+// assembleMP4s assembles the days before now which have no mp4 file.
+func (tl *timelapse) assembleMP4s(now time.Time) {
+	today := now.Format("2006-01-02")
+	days := map[string][]mp4Sample{}
+	modified := map[string]time.Time{}
+	filepath.WalkDir(tl.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return nil
+		}
+		if ext := strings.ToLower(filepath.Ext(path)); ext != ".jpg" && ext != ".jpeg" {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		day := info.ModTime().Format("2006-01-02")
+		if day >= today {
+			return nil
+		}
+		days[day] = append(days[day], mp4Sample{path: path, size: int(info.Size())})
+		modified[path] = info.ModTime()
+		return nil
+	})
+
+	duration := time.Duration(float64(tl.interval) / tl.speedup)
+	for day, samples := range days {
+		path := filepath.Join(tl.dir, day+".mp4")
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+		sort.Slice(samples, func(i, j int) bool {
+			return modified[samples[i].path].Before(modified[samples[j].path])
+		})
+		for i := range samples {
+			samples[i].duration = duration
+		}
+		if err := assembleMP4(path, samples); err != nil {
+			logger.Error("assembling timelapse failed", "path", path, "err", err)
+			continue
+		}
+		logger.Info("timelapse assembled", "path", path, "frames", len(samples))
+	}
+}
+
+// assembleMP4 writes the jpeg files of samples into an mp4 file. The
+// file is written under a temporary name, so that incomplete files are
+// neither served nor taken for assembled days.
+func assembleMP4(path string, samples []mp4Sample) error {
+	// the size of the video is the size of the first frame
+	first, err := os.Open(samples[0].path)
+	if err != nil {
+		return err
+	}
+	cfg, err := jpeg.DecodeConfig(first)
+	first.Close()
+	if err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	w := bufio.NewWriterSize(f, 1<<20)
+	if err := writeFragmentedMP4(w, uint32(cfg.Width), uint32(cfg.Height), samples); err != nil {
+		return err
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// timelapseHandler serves the mp4 files of the timelapse
+// at /timelapse/YYYY-MM-DD.mp4.
+type timelapseHandler struct {
+	dir string
+}
+
+func (h timelapseHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.Header().Set("Allow", "GET, HEAD")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/timelapse/")
+	day, ok := strings.CutSuffix(name, ".mp4")
+	if _, err := time.Parse("2006-01-02", day); !ok || err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	f, err := os.Open(filepath.Join(h.dir, name))
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// ranges let players seek
+	w.Header().Set("Content-Type", "video/mp4")
+	http.ServeContent(w, r, name, info.ModTime(), f)
+}
+
+// assembleAVI writes the jpeg files into an MJPEG video.
+func assembleAVI(path string, files []string, width, height uint32, fps float64) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	a, err := newAVIWriter(f, width, height, fps, nil)
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		b, err := os.ReadFile(file)
+		if err != nil {
+			logger.Warn("reading timelapse frame failed", "path", file, "err", err)
+			continue
+		}
+		if err := a.WriteFrame(b); err != nil {
+			return err
+		}
+	}
+	if err := a.Close(); err != nil {
+		return err
+	}
+
+	return f.Close()
+}
+
+// strftime formats t with a subset of the strftime conversions:
+// %Y %m %d %H %M %S %j %s and %%.
+func strftime(pattern string, t time.Time) string {
+	var b strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if c != '%' || i+1 == len(pattern) {
+			b.WriteByte(c)
+			continue
+		}
+
+		i++
+		switch pattern[i] {
+		case 'Y':
+			fmt.Fprintf(&b, "%04d", t.Year())
+		case 'm':
+			fmt.Fprintf(&b, "%02d", int(t.Month()))
+		case 'd':
+			fmt.Fprintf(&b, "%02d", t.Day())
+		case 'H':
+			fmt.Fprintf(&b, "%02d", t.Hour())
+		case 'M':
+			fmt.Fprintf(&b, "%02d", t.Minute())
+		case 'S':
+			fmt.Fprintf(&b, "%02d", t.Second())
+		case 'j':
+			fmt.Fprintf(&b, "%03d", t.YearDay())
+		case 's':
+			fmt.Fprintf(&b, "%d", t.Unix())
+		case '%':
+			b.WriteByte('%')
+		default:
+			b.WriteByte('%')
+			b.WriteByte(pattern[i])
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"bytes"
+	"time"
+)
+
+// snapshotUploader uploads a frame every interval to a storage, e.g. to
+// the FTP server of a CCTV portal. File names are created from a strftime
+// pattern; a pattern without conversions like webcam.jpg replaces the
+// same file on every upload.
+type snapshotUploader struct {
+	store     storage
+	pattern   string
+	interval  time.Duration
+	retention retention
+}
+
+// run uploads frames of bc until the program exits. Uploads which are
+// slower than the interval delay the next upload.
+func (u *snapshotUploader) run(bc *broadcaster) {
+	ticker := time.NewTicker(u.interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		img := bc.next()
+		name := strftime(u.pattern, img.time)
+		err := u.store.put(name, bytes.NewReader(img.Bytes()), int64(len(img.Bytes())))
+		img.release()
+		if err != nil {
+			logger.Error("uploading snapshot failed", "name", name, "err", err)
+			continue
+		}
+		logger.Debug("snapshot uploaded", "name", name)
+
+		if err := u.retention.apply(u.store); err != nil {
+			logger.Error("storage: applying retention failed", "err", err)
+		}
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"time"
+
+	"github.com/brutella/webcam"
+)
+
+// frameMetadata correlates the metadata of a UVC camera
+// with the captured frames by their sequence numbers.
+type frameMetadata struct {
+	dev            *webcam.MetadataDevice
+	clockFrequency uint32 // of the camera in Hz, 0 if unknown
+
+	last *webcam.UVCMetadata
+}
+
+// lookup returns the metadata of the frame with sequence seq, or nil if
+// it isn't available. The driver completes the metadata together with
+// the frame, so only the metadata available without waiting is read.
+func (fm *frameMetadata) lookup(seq uint32) *webcam.UVCMetadata {
+	for fm.last == nil || fm.last.Sequence != seq {
+		md, err := fm.dev.ReadMetadata(0)
+		if err != nil {
+			if _, ok := err.(*webcam.Timeout); !ok {
+				logger.Debug("reading metadata failed", "err", err)
+			}
+			return nil
+		}
+		fm.last = md
+	}
+	return fm.last
+}
+
+// captured returns the time the capture of the frame with sequence seq
+// started, and observes the latency of the frame which was read at t.
+// It returns false if there is no metadata of the frame.
+func (fm *frameMetadata) captured(seq uint32, t time.Time) (time.Time, bool) {
+	md := fm.lookup(seq)
+	if md == nil {
+		return time.Time{}, false
+	}
+	first, last := md.Received()
+	if first.IsZero() {
+		return time.Time{}, false
+	}
+	stats.transferDuration.observe(last.Sub(first))
+
+	// the capture started before the first packet was received
+	start, ok := md.CaptureTime(fm.clockFrequency)
+	if !ok {
+		start = first
+	}
+	stats.frameLatency.observe(t.Sub(start))
+	return start, ok
+}
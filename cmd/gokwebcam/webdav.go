@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/xml"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// webdavStorage saves files in a collection of a WebDAV server,
+// e.g. Nextcloud or nginx with the dav module.
+type webdavStorage struct {
+	base     *url.URL // collection with a trailing slash
+	username string
+	password string
+	client   *http.Client
+	created  map[string]bool // collections which were created
+}
+
+func newWebDAVStorage(u *url.URL) *webdavStorage {
+	base := *u
+	base.Scheme = "http"
+	if u.Scheme == "webdavs" {
+		base.Scheme = "https"
+	}
+	base.User = nil
+	if !strings.HasSuffix(base.Path, "/") {
+		base.Path += "/"
+	}
+
+	password, _ := u.User.Password()
+	return &webdavStorage{
+		base:     &base,
+		username: u.User.Username(),
+		password: password,
+		client:   &http.Client{Timeout: 5 * time.Minute},
+		created:  map[string]bool{},
+	}
+}
+
+func (s *webdavStorage) put(name string, r io.Reader, size int64) error {
+	// create the collection and the directories of the file
+	var dir string
+	for _, elem := range append([]string{""}, strings.Split(path.Dir(name), "/")...) {
+		if elem == "." {
+			break
+		}
+		dir = path.Join(dir, elem)
+		if s.created[dir] {
+			continue
+		}
+		if err := s.mkcol(dir); err != nil {
+			return err
+		}
+		s.created[dir] = true
+	}
+
+	req, err := s.request(http.MethodPut, name, r)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	if typ := mime.TypeByExtension(path.Ext(name)); typ != "" {
+		req.Header.Set("Content-Type", typ)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// mkcol creates a collection unless it exists.
+func (s *webdavStorage) mkcol(name string) error {
+	req, err := s.request("MKCOL", name, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err, ok := err.(*webdavError); ok && err.status == http.StatusMethodNotAllowed {
+		// the collection exists
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (s *webdavStorage) list() ([]storedObject, error) {
+	const body = `<?xml version="1.0"?><propfind xmlns="DAV:"><prop><resourcetype/><getcontentlength/><getlastmodified/></prop></propfind>`
+	req, err := s.request("PROPFIND", "", strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Depth", "1")
+	req.Header.Set("Content-Type", "application/xml")
+
+	resp, err := s.do(req)
+	if err != nil {
+		if err, ok := err.(*webdavError); ok && err.status == http.StatusNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ms struct {
+		Responses []struct {
+			Href string `xml:"href"`
+			Prop struct {
+				Collection    *struct{} `xml:"resourcetype>collection"`
+				ContentLength int64     `xml:"getcontentlength"`
+				LastModified  string    `xml:"getlastmodified"`
+			} `xml:"propstat>prop"`
+		} `xml:"response"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&ms); err != nil {
+		return nil, err
+	}
+
+	var objs []storedObject
+	for _, r := range ms.Responses {
+		if r.Prop.Collection != nil {
+			continue
+		}
+		href, err := url.PathUnescape(r.Href)
+		if err != nil {
+			continue
+		}
+		t, _ := http.ParseTime(r.Prop.LastModified)
+		objs = append(objs, storedObject{
+			name:    path.Base(href),
+			size:    r.Prop.ContentLength,
+			modTime: t,
+		})
+	}
+	return objs, nil
+}
+
+func (s *webdavStorage) remove(name string) error {
+	req, err := s.request(http.MethodDelete, name, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// request returns a request for a file in the collection,
+// or for the collection if name is empty.
+func (s *webdavStorage) request(method, name string, body io.Reader) (*http.Request, error) {
+	u := s.base.JoinPath(name)
+	if name == "" {
+		u = s.base
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if s.username != "" {
+		req.SetBasicAuth(s.username, s.password)
+	}
+	return req, nil
+}
+
+// webdavError is returned for responses with an error status.
+type webdavError struct {
+	status int
+	text   string
+}
+
+func (e *webdavError) Error() string {
+	return "webdav: unexpected status " + e.text
+}
+
+// do sends req and returns the response if the status is successful.
+// The body of the response must be closed.
+func (s *webdavStorage) do(req *http.Request) (*http.Response, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		resp.Body.Close()
+		return nil, &webdavError{status: resp.StatusCode, text: resp.Status}
+	}
+	return resp, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/brutella/webcam/cmd/gokwebcam/eventbus"
+)
+
+// webhooks posts events as json to a list of urls.
+// If a secret is set, the payload is signed with HMAC-SHA256 and the
+// signature is sent in the `X-Webhook-Signature` header.
+type webhooks struct {
+	urls    []string
+	secret  string
+	retries int
+	client  *http.Client
+	queue   chan eventbus.Event
+}
+
+func newWebhooks(urls []string, secret string) *webhooks {
+	return &webhooks{
+		urls:    urls,
+		secret:  secret,
+		retries: 5,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queue:   make(chan eventbus.Event, 64),
+	}
+}
+
+// run sends queued events to all urls. It never returns.
+func (wh *webhooks) run() {
+	for e := range wh.queue {
+		payload, err := json.Marshal(e)
+		if err != nil {
+			logger.Error("webhook", "err", err)
+			continue
+		}
+
+		for _, url := range wh.urls {
+			go wh.deliver(url, payload)
+		}
+	}
+}
+
+// HandleEvent queues an event for delivery.
+// The event is dropped if the queue is full.
+func (wh *webhooks) HandleEvent(e eventbus.Event) {
+	select {
+	case wh.queue <- e:
+	default:
+		logger.Warn("webhook: queue full, dropping event", "type", e.Type)
+	}
+}
+
+// deliver posts the payload to url and retries with an exponential
+// backoff if the request fails or the server responds with an error.
+func (wh *webhooks) deliver(url string, payload []byte) {
+	backoff := time.Second
+	for i := 0; ; i++ {
+		err := wh.post(url, payload)
+		if err == nil {
+			return
+		}
+
+		if i == wh.retries {
+			logger.Error("webhook: giving up", "url", url, "err", err)
+			return
+		}
+
+		logger.Warn("webhook: delivery failed", "url", url, "err", err, "retry", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (wh *webhooks) post(url string, payload []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if wh.secret != "" {
+		req.Header.Set("X-Webhook-Signature", "sha256="+sign(payload, wh.secret))
+	}
+
+	resp, err := wh.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of payload.
+func sign(payload []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,381 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"sort"
+	"time"
+)
+
+// encodeAnimatedWebP writes frames as an animated WebP image which
+// loops forever. Each frame is shown for the corresponding delay.
+// The frames are encoded losslessly (VP8L) without backward references,
+// so the result is larger than the output of libwebp.
+func encodeAnimatedWebP(w io.Writer, frames []*image.RGBA, delays []time.Duration) error {
+	if len(frames) == 0 || len(frames) != len(delays) {
+		return errors.New("invalid number of frames")
+	}
+
+	le := binary.LittleEndian
+	b := frames[0].Bounds()
+
+	vp8x := make([]byte, 0, 10)
+	vp8x = append(vp8x, 0x02, 0, 0, 0) // animation flag
+	vp8x = appendUint24(vp8x, uint32(b.Dx()-1))
+	vp8x = appendUint24(vp8x, uint32(b.Dy()-1))
+
+	anim := make([]byte, 0, 6)
+	anim = le.AppendUint32(anim, 0xff000000) // background color
+	anim = le.AppendUint16(anim, 0)          // loop forever
+
+	data := []byte("WEBP")
+	data = append(data, chunk("VP8X", vp8x)...)
+	data = append(data, chunk("ANIM", anim)...)
+	for i, img := range frames {
+		fb := img.Bounds()
+		d := delays[i] / time.Millisecond
+		if d > 0xffffff {
+			d = 0xffffff
+		}
+
+		anmf := make([]byte, 0, 16)
+		anmf = appendUint24(anmf, 0) // x offset
+		anmf = appendUint24(anmf, 0) // y offset
+		anmf = appendUint24(anmf, uint32(fb.Dx()-1))
+		anmf = appendUint24(anmf, uint32(fb.Dy()-1))
+		anmf = appendUint24(anmf, uint32(d))
+		anmf = append(anmf, 0x02) // don't blend, don't dispose
+		anmf = append(anmf, chunk("VP8L", encodeVP8L(img))...)
+		data = append(data, chunk("ANMF", anmf)...)
+	}
+
+	_, err := w.Write(chunk("RIFF", data))
+	return err
+}
+
+// encodeWebP writes img as lossless WebP image.
+func encodeWebP(w io.Writer, img image.Image) error {
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		b := img.Bounds()
+		rgba = image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+		draw.Draw(rgba, rgba.Rect, img, b.Min, draw.Src)
+	}
+
+	data := []byte("WEBP")
+	data = append(data, chunk("VP8L", encodeVP8L(rgba))...)
+	_, err := w.Write(chunk("RIFF", data))
+	return err
+}
+
+func appendUint24(b []byte, v uint32) []byte {
+	return append(b, byte(v), byte(v>>8), byte(v>>16))
+}
+
+// vp8lCodeLengthOrder is the order in which the
+// lengths of the code length code are stored.
+var vp8lCodeLengthOrder = [19]int{17, 18, 0, 1, 2, 3, 4, 5, 16, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// encodeVP8L encodes an opaque image as lossless VP8L bitstream using
+// the subtract green and predictor transforms and a prefix code per channel.
+func encodeVP8L(img *image.RGBA) []byte {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+
+	// subtract green from red and blue
+	pix := make([][3]byte, 0, w*h)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := img.Pix[img.PixOffset(b.Min.X, y):]
+		for x := 0; x < w; x++ {
+			r, g, b := row[4*x], row[4*x+1], row[4*x+2]
+			pix = append(pix, [3]byte{g, r - g, b - g})
+		}
+	}
+
+	// predict every pixel by the average of its left and top neighbour,
+	// the first row by the left and the first column by the top neighbour
+	res := make([][3]byte, len(pix))
+	var green, red, blue [256]int
+	for i, p := range pix {
+		x, y := i%w, i/w
+
+		var pred [3]byte
+		switch {
+		case x == 0 && y == 0:
+		case y == 0:
+			pred = pix[i-1]
+		case x == 0:
+			pred = pix[i-w]
+		default:
+			l, t := pix[i-1], pix[i-w]
+			for c := range pred {
+				pred[c] = byte((int(l[c]) + int(t[c])) / 2)
+			}
+		}
+
+		for c := range p {
+			res[i][c] = p[c] - pred[c]
+		}
+		green[res[i][0]]++
+		red[res[i][1]]++
+		blue[res[i][2]]++
+	}
+
+	bw := &bitWriter{}
+	bw.write(0x2f, 8) // signature
+	bw.write(uint32(w-1), 14)
+	bw.write(uint32(h-1), 14)
+	bw.write(0, 1) // alpha is not used
+	bw.write(0, 3) // version
+
+	bw.write(1, 1) // transform
+	bw.write(2, 2) // subtract green
+	bw.write(1, 1) // transform
+	bw.write(0, 2) // predictor
+	bw.write(vp8lPredictorBits-2, 3)
+
+	// all blocks use the same predictor mode, which is stored
+	// in the green channel of the predictor image
+	var mode, zero, opaque [256]int
+	mode[vp8lPredictorAverageLT] = 1
+	zero[0] = 1
+	opaque[0xff] = 1
+	bw.write(0, 1) // no color cache
+	bw.writePrefixCode(mode[:])
+	bw.writePrefixCode(zero[:])
+	bw.writePrefixCode(zero[:])
+	bw.writePrefixCode(opaque[:])
+	bw.writePrefixCode(make([]int, 40))
+
+	bw.write(0, 1) // no more transforms
+	bw.write(0, 1) // no color cache
+	bw.write(0, 1) // no meta prefix codes
+
+	// green has 24 additional length prefix symbols
+	gc := bw.writePrefixCode(append(green[:], make([]int, 24)...))
+	rc := bw.writePrefixCode(red[:])
+	bc := bw.writePrefixCode(blue[:])
+	bw.writePrefixCode(zero[:])         // alpha
+	bw.writePrefixCode(make([]int, 40)) // distance
+
+	for _, p := range res {
+		gc.write(bw, int(p[0]))
+		rc.write(bw, int(p[1]))
+		bc.write(bw, int(p[2]))
+	}
+
+	return bw.bytes()
+}
+
+const (
+	vp8lPredictorBits      = 9 // log2 of the block size of the predictor image
+	vp8lPredictorAverageLT = 7
+)
+
+// bitWriter writes bits starting with the least significant bit.
+type bitWriter struct {
+	buf  []byte
+	acc  uint64
+	nacc uint
+}
+
+func (bw *bitWriter) write(v uint32, n uint) {
+	bw.acc |= uint64(v) << bw.nacc
+	bw.nacc += n
+	for bw.nacc >= 8 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc >>= 8
+		bw.nacc -= 8
+	}
+}
+
+func (bw *bitWriter) bytes() []byte {
+	if bw.nacc > 0 {
+		bw.buf = append(bw.buf, byte(bw.acc))
+		bw.acc, bw.nacc = 0, 0
+	}
+	return bw.buf
+}
+
+// prefixCode holds the bit reversed codes of the symbols of an alphabet.
+type prefixCode struct {
+	codes   []uint32
+	lengths []uint8 // number of bits written per symbol
+}
+
+func (c *prefixCode) write(bw *bitWriter, symbol int) {
+	bw.write(c.codes[symbol], uint(c.lengths[symbol]))
+}
+
+// writePrefixCode writes the prefix code for the symbol
+// frequencies of hist and returns it.
+func (bw *bitWriter) writePrefixCode(hist []int) *prefixCode {
+	var used []int
+	for s, n := range hist {
+		if n > 0 {
+			used = append(used, s)
+		}
+	}
+
+	// a simple code of up to two 8 bit symbols
+	if len(used) <= 2 && (len(used) == 0 || used[len(used)-1] < 256) {
+		c := &prefixCode{codes: make([]uint32, len(hist)), lengths: make([]uint8, len(hist))}
+		bw.write(1, 1) // simple
+		switch len(used) {
+		case 0:
+			bw.write(0, 1) // one symbol
+			bw.write(0, 1) // of one bit
+			bw.write(0, 1)
+		case 1:
+			bw.write(0, 1)
+			bw.write(1, 1) // of eight bits
+			bw.write(uint32(used[0]), 8)
+		case 2:
+			bw.write(1, 1) // two symbols
+			bw.write(1, 1)
+			bw.write(uint32(used[0]), 8)
+			bw.write(uint32(used[1]), 8)
+			c.lengths[used[0]], c.codes[used[0]] = 1, 0
+			c.lengths[used[1]], c.codes[used[1]] = 1, 1
+		}
+		return c
+	}
+
+	lengths := huffmanLengths(hist, 15)
+
+	// the code lengths are encoded with another prefix code
+	var clHist [19]int
+	for _, l := range lengths {
+		clHist[l]++
+	}
+	clLengths := huffmanLengths(clHist[:], 7)
+	clCode := canonicalCode(clLengths)
+
+	n := len(vp8lCodeLengthOrder)
+	for n > 4 && clLengths[vp8lCodeLengthOrder[n-1]] == 0 {
+		n--
+	}
+	bw.write(0, 1) // normal
+	bw.write(uint32(n-4), 4)
+	for _, s := range vp8lCodeLengthOrder[:n] {
+		bw.write(uint32(clLengths[s]), 3)
+	}
+	bw.write(0, 1) // all symbols have a code length
+	for _, l := range lengths {
+		clCode.write(bw, int(l))
+	}
+
+	return canonicalCode(lengths)
+}
+
+// canonicalCode returns the canonical prefix code for the code lengths.
+// A code with a single symbol uses no bits.
+func canonicalCode(lengths []uint8) *prefixCode {
+	c := &prefixCode{codes: make([]uint32, len(lengths)), lengths: make([]uint8, len(lengths))}
+
+	var count [16]uint32
+	used := 0
+	for _, l := range lengths {
+		if l > 0 {
+			count[l]++
+			used++
+		}
+	}
+	if used == 1 {
+		return c
+	}
+
+	var next [16]uint32
+	code := uint32(0)
+	for l := 1; l < 16; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	for s, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		code := next[l]
+		next[l]++
+
+		// the most significant bit of the code is written first
+		var rev uint32
+		for i := uint8(0); i < l; i++ {
+			rev = rev<<1 | (code>>i)&1
+		}
+		c.codes[s] = rev
+		c.lengths[s] = l
+	}
+	return c
+}
+
+// huffmanLengths returns the code lengths of a huffman code for the
+// symbol frequencies of hist limited to limit bits.
+func huffmanLengths(hist []int, limit uint8) []uint8 {
+	lengths := make([]uint8, len(hist))
+
+	freq := append([]int(nil), hist...)
+	for {
+		type node struct {
+			freq        int
+			symbol      int // -1 for inner nodes
+			left, right int
+		}
+		var nodes []node
+		for s, f := range freq {
+			if f > 0 {
+				nodes = append(nodes, node{freq: f, symbol: s})
+			}
+		}
+		if len(nodes) == 1 {
+			lengths[nodes[0].symbol] = 1
+			return lengths
+		}
+
+		// merge the two least frequent nodes until one is left
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].freq < nodes[j].freq })
+		queue := make([]int, len(nodes))
+		for i := range queue {
+			queue[i] = i
+		}
+		for len(queue) > 1 {
+			a, b := queue[0], queue[1]
+			nodes = append(nodes, node{freq: nodes[a].freq + nodes[b].freq, symbol: -1, left: a, right: b})
+			n := len(nodes) - 1
+			queue = queue[2:]
+			i := sort.Search(len(queue), func(i int) bool { return nodes[queue[i]].freq > nodes[n].freq })
+			queue = append(queue, 0)
+			copy(queue[i+1:], queue[i:])
+			queue[i] = n
+		}
+
+		// assign the depths of the leaves
+		depths := make([]uint8, len(nodes))
+		max := uint8(0)
+		for i := len(nodes) - 1; i >= 0; i-- {
+			if nodes[i].symbol >= 0 {
+				lengths[nodes[i].symbol] = depths[i]
+				if depths[i] > max {
+					max = depths[i]
+				}
+				continue
+			}
+			depths[nodes[i].left] = depths[i] + 1
+			depths[nodes[i].right] = depths[i] + 1
+		}
+		if max <= limit {
+			return lengths
+		}
+
+		// flatten the distribution and try again
+		for s, f := range freq {
+			if f > 0 {
+				freq[s] = f/2 + 1
+			}
+		}
+	}
+}
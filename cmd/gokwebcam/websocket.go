@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/brutella/webcam/cmd/gokwebcam/eventbus"
+)
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// WebSocket opcodes
+const (
+	wsOpText   = 0x1
+	wsOpBinary = 0x2
+	wsOpClose  = 0x8
+	wsOpPing   = 0x9
+	wsOpPong   = 0xa
+)
+
+// websocketHandler streams frames over a WebSocket connection.
+// Frames are sent as binary messages, or with ?format=json as text
+// messages containing the base64 encoded frame and its timestamp.
+// A client which is slow to receive skips frames.
+type websocketHandler struct {
+	streams *scaledStreams
+	bus     *eventbus.Bus
+	kbps    int // bandwidth cap of every client, 0 is unlimited
+}
+
+// websocketFrame is the json representation of a frame.
+type websocketFrame struct {
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+	Data []byte    `json:"data"`
+}
+
+func (h *websocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isWebsocketUpgrade(w, r) {
+		return
+	}
+
+	size, interval, err := streamOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	asJSON := r.FormValue("format") == "json"
+
+	ws, err := upgradeWebsocket(w, r)
+	if err != nil {
+		return
+	}
+	defer ws.conn.Close()
+
+	logger.Info("connect", "remote", r.RemoteAddr, "url", r.URL)
+	h.bus.Publish(eventbus.ClientConnected, map[string]interface{}{
+		"remote": r.RemoteAddr,
+		"url":    r.URL.String(),
+	})
+
+	stats.wsClients.Add(1)
+	publishViewers(h.bus)
+	defer publishViewers(h.bus)
+	defer stats.wsClients.Add(-1)
+	r, disconnect := stats.connect("/ws", r)
+	defer disconnect()
+
+	frames, unsubscribe := h.streams.subscribe(size, interval)
+	defer unsubscribe()
+	limit := newBandwidthLimiter(h.kbps)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := ws.read(nil); err != nil && err != io.EOF {
+			logger.Debug("reading websocket failed", "remote", r.RemoteAddr, "err", err)
+		}
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-r.Context().Done():
+			return
+		case img := <-frames:
+			data := limit.frame(img)
+			if data == nil {
+				img.release()
+				continue
+			}
+			if asJSON {
+				var b []byte
+				b, err = json.Marshal(websocketFrame{Seq: img.seq, Time: img.time, Data: data})
+				if err == nil {
+					err = ws.write(wsOpText, b)
+				}
+			} else {
+				err = ws.write(wsOpBinary, data)
+			}
+			if err == nil {
+				stats.bytesServed.Add(uint64(len(data)))
+				stats.sent(r, img)
+			}
+			img.release()
+			if err != nil {
+				logger.Error("writing websocket failed", "remote", r.RemoteAddr, "err", err)
+				return
+			}
+		}
+	}
+}
+
+// isWebsocketUpgrade returns true if r is a WebSocket handshake.
+// Otherwise it responds with an error.
+func isWebsocketUpgrade(w http.ResponseWriter, r *http.Request) bool {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") ||
+		!strings.Contains(strings.ToLower(r.Header.Get("Connection")), "upgrade") {
+		http.Error(w, "websocket upgrade required", http.StatusUpgradeRequired)
+		return false
+	}
+
+	if r.Header.Get("Sec-WebSocket-Key") == "" {
+		http.Error(w, "missing websocket key", http.StatusBadRequest)
+		return false
+	}
+
+	return true
+}
+
+// upgradeWebsocket completes the handshake of r and returns the connection,
+// which must be closed by the caller.
+func upgradeWebsocket(w http.ResponseWriter, r *http.Request) (*websocketConn, error) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "websocket not supported", http.StatusInternalServerError)
+		return nil, errors.New("hijacking not supported")
+	}
+	conn, rw, err := hj.Hijack()
+	if err != nil {
+		logger.Error("hijacking connection failed", "err", err)
+		return nil, err
+	}
+
+	// the connection lives longer than the timeouts of the server
+	conn.SetDeadline(time.Time{})
+
+	rw.WriteString("HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(r.Header.Get("Sec-WebSocket-Key")) + "\r\n\r\n")
+	if err := rw.Flush(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &websocketConn{conn: conn, rw: rw}, nil
+}
+
+// websocketAccept returns the Sec-WebSocket-Accept value for a key.
+func websocketAccept(key string) string {
+	h := sha1.New()
+	io.WriteString(h, key+websocketGUID)
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+// websocketConn is the server side of a WebSocket connection,
+// or the client side, e.g. of the tunnels of relayListener.
+type websocketConn struct {
+	conn   net.Conn
+	rw     *bufio.ReadWriter
+	client bool       // messages of clients are masked
+	mu     sync.Mutex // serializes writes
+}
+
+// write sends an unfragmented message.
+func (c *websocketConn) write(op byte, payload []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	header := []byte{0x80 | op}
+	var masked byte
+	if c.client {
+		masked = 0x80
+	}
+	switch n := len(payload); {
+	case n < 126:
+		header = append(header, masked|byte(n))
+	case n <= 0xffff:
+		header = append(header, masked|126)
+		header = binary.BigEndian.AppendUint16(header, uint16(n))
+	default:
+		header = append(header, masked|127)
+		header = binary.BigEndian.AppendUint64(header, uint64(n))
+	}
+	if c.client {
+		var mask [4]byte
+		rand.Read(mask[:])
+		header = append(header, mask[:]...)
+		p := make([]byte, len(payload))
+		for i := range payload {
+			p[i] = payload[i] ^ mask[i%4]
+		}
+		payload = p
+	}
+
+	c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+	c.rw.Write(header)
+	c.rw.Write(payload)
+	return c.rw.Flush()
+}
+
+// read handles control messages from the client until the connection
+// is closed. Text and binary messages are passed to handle, or are
+// ignored if handle is nil.
+func (c *websocketConn) read(handle func(op byte, payload []byte) error) error {
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(c.rw, header[:2]); err != nil {
+			return err
+		}
+		op := header[0] & 0x0f
+		masked := header[1]&0x80 != 0
+
+		n := uint64(header[1] & 0x7f)
+		switch n {
+		case 126:
+			if _, err := io.ReadFull(c.rw, header[:2]); err != nil {
+				return err
+			}
+			n = uint64(binary.BigEndian.Uint16(header[:2]))
+		case 127:
+			if _, err := io.ReadFull(c.rw, header[:8]); err != nil {
+				return err
+			}
+			n = binary.BigEndian.Uint64(header[:8])
+		}
+		if n > 1<<16 {
+			return errors.New("websocket message too large")
+		}
+
+		var mask [4]byte
+		if masked {
+			if _, err := io.ReadFull(c.rw, mask[:]); err != nil {
+				return err
+			}
+		}
+
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(c.rw, payload); err != nil {
+			return err
+		}
+		if masked {
+			for i := range payload {
+				payload[i] ^= mask[i%4]
+			}
+		}
+
+		switch op {
+		case wsOpClose:
+			c.write(wsOpClose, payload)
+			return io.EOF
+		case wsOpPing:
+			if err := c.write(wsOpPong, payload); err != nil {
+				return err
+			}
+		case wsOpText, wsOpBinary:
+			if handle != nil {
+				if err := handle(op, payload); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// motionZone is a polygon in which motion is detected. The points are
+// normalized to the frame size, 0,0 is the top left and 1,1 the bottom
+// right corner.
+type motionZone struct {
+	Name   string       `json:"name,omitempty"`
+	Points [][2]float64 `json:"points"`
+}
+
+func (z motionZone) validate() error {
+	if len(z.Points) < 3 {
+		return fmt.Errorf("zone %q needs at least 3 points", z.Name)
+	}
+	for _, p := range z.Points {
+		if p[0] < 0 || p[0] > 1 || p[1] < 0 || p[1] > 1 {
+			return fmt.Errorf("point %v of zone %q is not normalized", p, z.Name)
+		}
+	}
+	return nil
+}
+
+// zoneMask returns which pixels of the motionWidth x motionHeight
+// luma images are within zones, or nil for all pixels if there
+// are no zones.
+func zoneMask(zones []motionZone) []bool {
+	if len(zones) == 0 {
+		return nil
+	}
+
+	mask := make([]bool, motionWidth*motionHeight)
+	for _, z := range zones {
+		pts := make([]image.Point, len(z.Points))
+		for i, p := range z.Points {
+			pts[i] = image.Pt(int(p[0]*motionWidth+0.5), int(p[1]*motionHeight+0.5))
+		}
+		for _, r := range polygonRects(pts) {
+			r = r.Intersect(image.Rect(0, 0, motionWidth, motionHeight))
+			for y := r.Min.Y; y < r.Max.Y; y++ {
+				for x := r.Min.X; x < r.Max.X; x++ {
+					mask[y*motionWidth+x] = true
+				}
+			}
+		}
+	}
+	return mask
+}
+
+// zonesHandler returns the motion zones (GET) and replaces them
+// (PUT with a json list of zones). An empty list detects motion
+// in the whole frame. The zones are saved to file if it isn't empty.
+type zonesHandler struct {
+	md   *motionDetector
+	file string
+
+	mu    sync.Mutex
+	zones []motionZone
+}
+
+// readMotionZones reads zones from file, which may not exist yet.
+func readMotionZones(file string) ([]motionZone, error) {
+	b, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var zones []motionZone
+	if err := json.Unmarshal(b, &zones); err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	for _, z := range zones {
+		if err := z.validate(); err != nil {
+			return nil, fmt.Errorf("%s: %v", file, err)
+		}
+	}
+	return zones, nil
+}
+
+// save writes the zones to a temporary file which replaces the file.
+func (h *zonesHandler) save(zones []motionZone) error {
+	b, err := json.MarshalIndent(zones, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(filepath.Dir(h.file), "."+filepath.Base(h.file)+".tmp")
+	if err := os.WriteFile(tmp, append(b, '\n'), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.file)
+}
+
+func (h *zonesHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var zones []motionZone
+		if err := json.NewDecoder(r.Body).Decode(&zones); err != nil {
+			http.Error(w, "invalid json: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		for _, z := range zones {
+			if err := z.validate(); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		if h.file != "" {
+			if err := h.save(zones); err != nil {
+				logger.Error("saving motion zones failed", "file", h.file, "err", err)
+				http.Error(w, "saving zones failed", http.StatusInternalServerError)
+				return
+			}
+		}
+		h.zones = zones
+		h.md.setZones(zones)
+		logger.Info("motion zones changed", "zones", len(zones))
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	zones := h.zones
+	if zones == nil {
+		zones = []motionZone{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(zones)
+}
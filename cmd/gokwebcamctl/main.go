@@ -0,0 +1,242 @@
+// gokwebcamctl controls a running gokwebcam over its admin socket,
+// which is enabled with the -admin flag of gokwebcam.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const usage = `usage: gokwebcamctl [-s socket] command [args]
+
+commands:
+  status            show the state of the daemon
+  clients           list the connected clients
+  kick id           disconnect a client
+  snapshot [file]   save the next frame as jpeg, to stdout with -
+  quality [value]   show or set the jpeg quality, 0 is the default quality
+`
+
+// status is the part of the /status response shown by gokwebcamctl.
+type status struct {
+	Uptime         float64            `json:"uptime"`
+	Format         string             `json:"format"`
+	Width          uint32             `json:"width"`
+	Height         uint32             `json:"height"`
+	FPS            float64            `json:"fps"`
+	FramesCaptured uint64             `json:"frames_captured"`
+	FramesDropped  uint64             `json:"frames_dropped"`
+	BytesServed    uint64             `json:"bytes_served"`
+	ClientCounts   map[string]int     `json:"client_counts"`
+	EncodeDuration map[string]float64 `json:"encode_duration"`
+}
+
+type client struct {
+	ID        uint64    `json:"id"`
+	Endpoint  string    `json:"endpoint"`
+	Remote    string    `json:"remote"`
+	Connected time.Time `json:"connected"`
+	Latency   *struct {
+		Total float64 `json:"capture_to_send"`
+	} `json:"latency"` // with -latency
+}
+
+type quality struct {
+	Quality int `json:"quality"`
+}
+
+func main() {
+	socket := flag.String("s", "/run/gokwebcam-admin.sock", "admin socket of gokwebcam")
+	flag.Usage = func() {
+		fmt.Fprint(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	c := &ctl{
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var d net.Dialer
+					return d.DialContext(ctx, "unix", *socket)
+				},
+			},
+			Timeout: 30 * time.Second,
+		},
+	}
+
+	var err error
+	switch cmd, args := args[0], args[1:]; {
+	case cmd == "status" && len(args) == 0:
+		err = c.status()
+	case cmd == "clients" && len(args) == 0:
+		err = c.clients()
+	case cmd == "kick" && len(args) == 1:
+		err = c.kick(args[0])
+	case cmd == "snapshot" && len(args) <= 1:
+		file := "snapshot.jpg"
+		if len(args) == 1 {
+			file = args[0]
+		}
+		err = c.snapshot(file)
+	case cmd == "quality" && len(args) <= 1:
+		err = c.quality(args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "gokwebcamctl:", err)
+		os.Exit(1)
+	}
+}
+
+// ctl sends requests to the admin socket.
+type ctl struct {
+	client *http.Client
+}
+
+// do sends a request and decodes the json response into v if it isn't nil.
+func (c *ctl) do(method, path string, form url.Values, v interface{}) error {
+	var body io.Reader
+	if form != nil {
+		body = strings.NewReader(form.Encode())
+	}
+	// the host is ignored by the unix socket dialer
+	req, err := http.NewRequest(method, "http://gokwebcam"+path, body)
+	if err != nil {
+		return err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, 1024))
+		return errors.New(strings.TrimSpace(string(msg)))
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+func (c *ctl) status() error {
+	var s status
+	if err := c.do("GET", "/status", nil, &s); err != nil {
+		return err
+	}
+
+	uptime := time.Duration(s.Uptime) * time.Second
+	fmt.Printf("uptime:   %s\n", uptime)
+	fmt.Printf("format:   %s %dx%d\n", s.Format, s.Width, s.Height)
+	fmt.Printf("fps:      %.1f\n", s.FPS)
+	fmt.Printf("frames:   %d captured, %d dropped\n", s.FramesCaptured, s.FramesDropped)
+	fmt.Printf("encoding: %.1fms p50, %.1fms p99\n", s.EncodeDuration["p50"]*1000, s.EncodeDuration["p99"]*1000)
+	fmt.Printf("served:   %d bytes\n", s.BytesServed)
+
+	var clients []string
+	for endpoint, n := range s.ClientCounts {
+		clients = append(clients, endpoint+" "+strconv.Itoa(n))
+	}
+	sort.Strings(clients)
+	fmt.Printf("clients:  %s\n", strings.Join(clients, ", "))
+	return nil
+}
+
+func (c *ctl) clients() error {
+	var list []client
+	if err := c.do("GET", "/clients", nil, &list); err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tENDPOINT\tREMOTE\tCONNECTED\tLATENCY")
+	for _, cl := range list {
+		since := time.Since(cl.Connected).Round(time.Second)
+		latency := "-"
+		if cl.Latency != nil {
+			latency = fmt.Sprintf("%.1fms", cl.Latency.Total*1000)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s ago\t%s\n", cl.ID, cl.Endpoint, cl.Remote, since, latency)
+	}
+	return tw.Flush()
+}
+
+func (c *ctl) kick(id string) error {
+	if _, err := strconv.ParseUint(id, 10, 64); err != nil {
+		return fmt.Errorf("invalid client id %q", id)
+	}
+	return c.do("DELETE", "/clients/"+id, nil, nil)
+}
+
+func (c *ctl) snapshot(file string) error {
+	res, err := c.client.Get("http://gokwebcam/snapshot")
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("snapshot failed: %s", res.Status)
+	}
+
+	if file == "-" {
+		_, err = io.Copy(os.Stdout, res.Body)
+		return err
+	}
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, res.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (c *ctl) quality(args []string) error {
+	var q quality
+	if len(args) == 0 {
+		if err := c.do("GET", "/quality", nil, &q); err != nil {
+			return err
+		}
+	} else {
+		if err := c.do("POST", "/quality", url.Values{"value": args}, &q); err != nil {
+			return err
+		}
+	}
+
+	if q.Quality == 0 {
+		fmt.Println("default")
+	} else {
+		fmt.Println(q.Quality)
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package webcam
+
+import (
+	"encoding/binary"
+	"image"
+	"runtime"
+	"sync"
+)
+
+// The converters take the number of bytes per row of the frame as
+// stride, which is larger than the row if the driver pads rows,
+// or 0 if rows are not padded. The stride of planar formats is
+// the one of the luma plane, as reported in bytesperline.
+
+// YUYVToYCbCr unpacks a YUYV 4:2:2 frame into dst.
+// The rows are split into stripes which are converted in parallel.
+func YUYVToYCbCr(dst *image.YCbCr, src []byte, stride int) {
+	w := dst.Rect.Dx()
+	h := dst.Rect.Dy()
+	if stride == 0 {
+		stride = w * 2
+	}
+
+	// ignore incomplete rows of short frames
+	if rows := completeRows(len(src), stride, w*2); rows < h {
+		h = rows
+	}
+
+	n := runtime.GOMAXPROCS(0)
+	if n > h {
+		n = h
+	}
+	if n <= 1 {
+		yuyvRowsToYCbCr(dst, src, stride, 0, h)
+		return
+	}
+
+	stripe := (h + n - 1) / n
+	var wg sync.WaitGroup
+	for y := 0; y < h; y += stripe {
+		end := y + stripe
+		if end > h {
+			end = h
+		}
+
+		wg.Add(1)
+		go func(y0, y1 int) {
+			defer wg.Done()
+			yuyvRowsToYCbCr(dst, src, stride, y0, y1)
+		}(y, end)
+	}
+	wg.Wait()
+}
+
+// yuyvRowsToYCbCr unpacks the rows [y0, y1) of a YUYV frame into dst.
+func yuyvRowsToYCbCr(dst *image.YCbCr, src []byte, stride, y0, y1 int) {
+	w := dst.Rect.Dx()
+
+	for y := y0; y < y1; y++ {
+		row := src[y*stride : y*stride+w*2]
+		yrow := dst.Y[y*dst.YStride : y*dst.YStride+w]
+		cbrow := dst.Cb[y*dst.CStride : y*dst.CStride+w/2]
+		crrow := dst.Cr[y*dst.CStride : y*dst.CStride+w/2]
+
+		// read two macro pixels (Y0 Cb Y1 Cr) at once
+		x, i, j := 0, 0, 0
+		for ; x+8 <= len(row); x, i, j = x+8, i+4, j+2 {
+			v := binary.LittleEndian.Uint64(row[x:])
+			yrow[i] = byte(v)
+			cbrow[j] = byte(v >> 8)
+			yrow[i+1] = byte(v >> 16)
+			crrow[j] = byte(v >> 24)
+			yrow[i+2] = byte(v >> 32)
+			cbrow[j+1] = byte(v >> 40)
+			yrow[i+3] = byte(v >> 48)
+			crrow[j+1] = byte(v >> 56)
+		}
+
+		for ; x+4 <= len(row); x, i, j = x+4, i+2, j+1 {
+			yrow[i] = row[x]
+			cbrow[j] = row[x+1]
+			yrow[i+1] = row[x+2]
+			crrow[j] = row[x+3]
+		}
+	}
+}
+
+// NV12ToYCbCr unpacks a NV12 frame, which consists of a Y plane
+// followed by a plane of interleaved Cb and Cr samples, into dst.
+// The subsample ratio of dst must be 4:2:0.
+func NV12ToYCbCr(dst *image.YCbCr, frame []byte, stride int) {
+	w := dst.Rect.Dx()
+	h := dst.Rect.Dy()
+	cw := (w + 1) / 2
+	ch := (h + 1) / 2
+
+	// both planes have the same stride
+	ys, cs := w, cw*2
+	if stride > 0 {
+		ys, cs = stride, stride
+	}
+	if len(frame) < ys*h+cs*ch {
+		return
+	}
+
+	copyPlane(dst.Y, dst.YStride, frame, ys, w, h)
+
+	uv := frame[ys*h:]
+	for y := 0; y < ch; y++ {
+		row := uv[y*cs : y*cs+cw*2]
+		cb := dst.Cb[y*dst.CStride : y*dst.CStride+cw]
+		cr := dst.Cr[y*dst.CStride : y*dst.CStride+cw]
+		for x := range cb {
+			cb[x] = row[x*2]
+			cr[x] = row[x*2+1]
+		}
+	}
+}
+
+// YUV420ToYCbCr unpacks a planar YUV 4:2:0 frame into dst.
+// The Cb plane precedes the Cr plane for YU12 (I420) frames,
+// and follows it for YV12 frames, in which case swapped must be true.
+// The subsample ratio of dst must be 4:2:0.
+func YUV420ToYCbCr(dst *image.YCbCr, frame []byte, stride int, swapped bool) {
+	w := dst.Rect.Dx()
+	h := dst.Rect.Dy()
+	cw := (w + 1) / 2
+	ch := (h + 1) / 2
+
+	// the chroma planes have half the stride of the luma plane
+	ys, cs := w, cw
+	if stride > 0 {
+		ys, cs = stride, (stride+1)/2
+	}
+	if len(frame) < ys*h+2*cs*ch {
+		return
+	}
+
+	cb := frame[ys*h : ys*h+cs*ch]
+	cr := frame[ys*h+cs*ch : ys*h+2*cs*ch]
+	if swapped {
+		cb, cr = cr, cb
+	}
+
+	copyPlane(dst.Y, dst.YStride, frame, ys, w, h)
+	copyPlane(dst.Cb, dst.CStride, cb, cs, cw, ch)
+	copyPlane(dst.Cr, dst.CStride, cr, cs, cw, ch)
+}
+
+// GreyToGray copies an 8-bit greyscale frame into dst.
+func GreyToGray(dst *image.Gray, frame []byte, stride int) {
+	w := dst.Rect.Dx()
+	h := dst.Rect.Dy()
+	if stride == 0 {
+		stride = w
+	}
+	if rows := completeRows(len(frame), stride, w); rows < h {
+		h = rows
+	}
+
+	copyPlane(dst.Pix, dst.Stride, frame, stride, w, h)
+}
+
+// completeRows returns the number of rows of n bytes which are
+// complete in a frame of size bytes with stride bytes per row.
+func completeRows(size, stride, n int) int {
+	if size < n {
+		return 0
+	}
+	return (size-n)/stride + 1
+}
+
+// packRows appends the h rows of n bytes of a frame
+// with stride bytes per row to dst, without padding.
+func packRows(dst, frame []byte, stride, n, h int) []byte {
+	if rows := completeRows(len(frame), stride, n); rows < h {
+		h = rows
+	}
+	for y := 0; y < h; y++ {
+		dst = append(dst, frame[y*stride:y*stride+n]...)
+	}
+	return dst
+}
+
+// copyPlane copies h rows of w bytes from src to dst.
+func copyPlane(dst []byte, dstStride int, src []byte, srcStride int, w, h int) {
+	if dstStride == srcStride && dstStride == w {
+		copy(dst, src[:w*h])
+		return
+	}
+
+	for y := 0; y < h; y++ {
+		copy(dst[y*dstStride:y*dstStride+w], src[y*srcStride:y*srcStride+w])
+	}
+}
+
+// RGBToRGBA converts a packed 24-bit RGB frame into dst.
+// The byte order of each pixel is B, G, R instead if bgr is true.
+func RGBToRGBA(dst *image.RGBA, frame []byte, stride int, bgr bool) {
+	w := dst.Rect.Dx()
+	h := dst.Rect.Dy()
+	if stride == 0 {
+		stride = w * 3
+	}
+	if rows := completeRows(len(frame), stride, w*3); rows < h {
+		h = rows
+	}
+
+	ri, bi := 0, 2
+	if bgr {
+		ri, bi = 2, 0
+	}
+
+	for y := 0; y < h; y++ {
+		src := frame[y*stride : y*stride+w*3]
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+w*4]
+		for x := 0; x < w; x++ {
+			s := src[x*3 : x*3+3]
+			p := row[x*4 : x*4+4]
+			p[0] = s[ri]
+			p[1] = s[1]
+			p[2] = s[bi]
+			p[3] = 0xff
+		}
+	}
+}
+
+// RGB565ToRGBA converts a packed 16-bit RGB 5:6:5 little endian frame into dst.
+func RGB565ToRGBA(dst *image.RGBA, frame []byte, stride int) {
+	w := dst.Rect.Dx()
+	h := dst.Rect.Dy()
+	if stride == 0 {
+		stride = w * 2
+	}
+	if rows := completeRows(len(frame), stride, w*2); rows < h {
+		h = rows
+	}
+
+	for y := 0; y < h; y++ {
+		src := frame[y*stride : y*stride+w*2]
+		row := dst.Pix[y*dst.Stride : y*dst.Stride+w*4]
+		for x := 0; x < w; x++ {
+			v := binary.LittleEndian.Uint16(src[x*2:])
+			r := byte(v >> 11)
+			g := byte(v>>5) & 0x3f
+			b := byte(v) & 0x1f
+
+			// replicate the high bits to scale to 8 bits
+			p := row[x*4 : x*4+4]
+			p[0] = r<<3 | r>>2
+			p[1] = g<<2 | g>>4
+			p[2] = b<<3 | b>>2
+			p[3] = 0xff
+		}
+	}
+}
@@ -0,0 +1,279 @@
+package webcam
+
+import (
+	"bytes"
+	"flag"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden images in testdata")
+
+// testPatches are the colors of the reference image: the SMPTE bars in
+// the top row, and black, white, the primaries, a skin tone and mid grey
+// in the bottom row.
+var testPatches = [][]color.RGBA{
+	{
+		{192, 192, 192, 255},
+		{192, 192, 0, 255},
+		{0, 192, 192, 255},
+		{0, 192, 0, 255},
+		{192, 0, 192, 255},
+		{192, 0, 0, 255},
+		{0, 0, 192, 255},
+	},
+	{
+		{0, 0, 0, 255},
+		{255, 255, 255, 255},
+		{255, 0, 0, 255},
+		{0, 255, 0, 255},
+		{0, 0, 255, 255},
+		{224, 172, 105, 255},
+		{128, 128, 128, 255},
+	},
+}
+
+// testPatchSize is the size of a patch of the reference image in pixels.
+const testPatchSize = 8
+
+// testReference returns the reference image of testPatches.
+func testReference() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, len(testPatches[0])*testPatchSize, len(testPatches)*testPatchSize))
+	for y, row := range testPatches {
+		for x, c := range row {
+			draw.Draw(img, testPatch(x, y), &image.Uniform{c}, image.Point{}, draw.Src)
+		}
+	}
+	return img
+}
+
+// testPatch returns the rectangle of the patch in column x and row y.
+func testPatch(x, y int) image.Rectangle {
+	return image.Rect(x*testPatchSize, y*testPatchSize, (x+1)*testPatchSize, (y+1)*testPatchSize)
+}
+
+// packYUYV converts img to a YUYV 4:2:2 frame with stride bytes per row.
+// The chroma of every pixel pair is taken from its left pixel.
+func packYUYV(img *image.RGBA, stride int) []byte {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	frame := make([]byte, stride*h)
+	for y := 0; y < h; y++ {
+		row := frame[y*stride:]
+		for x := 0; x < w; x += 2 {
+			p0, p1 := img.RGBAAt(x, y), img.RGBAAt(x+1, y)
+			y0, u, v := color.RGBToYCbCr(p0.R, p0.G, p0.B)
+			y1, _, _ := color.RGBToYCbCr(p1.R, p1.G, p1.B)
+			row[2*x], row[2*x+1], row[2*x+2], row[2*x+3] = y0, u, y1, v
+		}
+	}
+	return frame
+}
+
+// packNV12 converts img to a NV12 frame with stride bytes per row of
+// both planes. The chroma of every 2x2 block is taken from its top left
+// pixel.
+func packNV12(img *image.RGBA, stride int) []byte {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	frame := make([]byte, stride*h+stride*((h+1)/2))
+	uv := frame[stride*h:]
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.RGBAAt(x, y)
+			yy, u, v := color.RGBToYCbCr(p.R, p.G, p.B)
+			frame[y*stride+x] = yy
+			if x%2 == 0 && y%2 == 0 {
+				uv[(y/2)*stride+x], uv[(y/2)*stride+x+1] = u, v
+			}
+		}
+	}
+	return frame
+}
+
+// packRGB24 converts img to a packed 24-bit RGB frame
+// with stride bytes per row.
+func packRGB24(img *image.RGBA, stride int) []byte {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	frame := make([]byte, stride*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			p := img.RGBAAt(x, y)
+			copy(frame[y*stride+3*x:], []byte{p.R, p.G, p.B})
+		}
+	}
+	return frame
+}
+
+// testFormats are the formats of the golden images, with a function
+// which packs the reference image into a frame of the format and the
+// bytes per pixel of the frame.
+var testFormats = []struct {
+	name   string
+	format PixelFormat
+	bpp    int
+	pack   func(img *image.RGBA, stride int) []byte
+}{
+	{"yuyv", V4L2_PIX_FMT_YUYV, 2, packYUYV},
+	{"nv12", V4L2_PIX_FMT_NV12, 1, packNV12},
+	{"rgb24", V4L2_PIX_FMT_RGB24, 3, packRGB24},
+}
+
+// comparePatches returns the largest error of the mean color of a patch
+// of img. The borders of the patches are ignored, because chroma
+// subsampling blurs the edges between them.
+func comparePatches(img image.Image) float64 {
+	var maxErr float64
+	for y, row := range testPatches {
+		for x, c := range row {
+			r := testPatch(x, y).Inset(testPatchSize / 4)
+			var sum [3]float64
+			for py := r.Min.Y; py < r.Max.Y; py++ {
+				for px := r.Min.X; px < r.Max.X; px++ {
+					pr, pg, pb, _ := img.At(px, py).RGBA()
+					sum[0] += float64(pr >> 8)
+					sum[1] += float64(pg >> 8)
+					sum[2] += float64(pb >> 8)
+				}
+			}
+			pixels := float64(r.Dx() * r.Dy())
+			for i, want := range [3]uint8{c.R, c.G, c.B} {
+				maxErr = math.Max(maxErr, math.Abs(sum[i]/pixels-float64(want)))
+			}
+		}
+	}
+	return maxErr
+}
+
+// toRGBA returns img as RGBA image.
+func toRGBA(img image.Image) *image.RGBA {
+	dst := image.NewRGBA(img.Bounds())
+	draw.Draw(dst, dst.Rect, img, img.Bounds().Min, draw.Src)
+	return dst
+}
+
+// TestConvertGolden converts the reference image in every format and
+// compares the result with the golden image in testdata, which is
+// written with -update. Frames with padded rows must convert to the
+// same image.
+func TestConvertGolden(t *testing.T) {
+	ref := testReference()
+	w, h := ref.Rect.Dx(), ref.Rect.Dy()
+
+	for _, f := range testFormats {
+		t.Run(f.name, func(t *testing.T) {
+			golden := filepath.Join("testdata", "convert_"+f.name+".png")
+			for _, stride := range []int{w * f.bpp, w*f.bpp + 64} {
+				conv, err := NewConverter(f.format, w, h, stride)
+				if err != nil {
+					t.Fatal(err)
+				}
+				img := toRGBA(conv.Convert(f.pack(ref, stride)))
+				if maxErr := comparePatches(img); maxErr > 2 {
+					t.Errorf("stride %d: color error %.1f", stride, maxErr)
+				}
+
+				if *update && stride == w*f.bpp {
+					var b bytes.Buffer
+					if err := png.Encode(&b, img); err != nil {
+						t.Fatal(err)
+					}
+					if err := os.WriteFile(golden, b.Bytes(), 0644); err != nil {
+						t.Fatal(err)
+					}
+				}
+
+				want := readGolden(t, golden)
+				if !bytes.Equal(img.Pix, want.Pix) {
+					t.Errorf("stride %d: image differs from %s", stride, golden)
+				}
+			}
+		})
+	}
+}
+
+// readGolden returns the golden image of file as RGBA image.
+func readGolden(t *testing.T, file string) *image.RGBA {
+	t.Helper()
+	r, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	img, err := png.Decode(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return toRGBA(img)
+}
+
+// benchmarkSizes are the frame sizes of the benchmarks.
+var benchmarkSizes = []struct {
+	name string
+	w, h int
+}{
+	{"640x480", 640, 480},
+	{"1920x1080", 1920, 1080},
+}
+
+func BenchmarkYUYVToYCbCr(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(size.name, func(b *testing.B) {
+			dst := image.NewYCbCr(image.Rect(0, 0, size.w, size.h), image.YCbCrSubsampleRatio422)
+			src := make([]byte, size.w*size.h*2)
+			b.SetBytes(int64(len(src)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				YUYVToYCbCr(dst, src, 0)
+			}
+		})
+	}
+}
+
+func BenchmarkYUYVToYCbCrPadded(b *testing.B) {
+	w, h := 1920, 1080
+	stride := w*2 + 64
+	dst := image.NewYCbCr(image.Rect(0, 0, w, h), image.YCbCrSubsampleRatio422)
+	src := make([]byte, stride*h)
+	b.SetBytes(int64(len(src)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		YUYVToYCbCr(dst, src, stride)
+	}
+}
+
+func BenchmarkNV12ToYCbCr(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(size.name, func(b *testing.B) {
+			dst := image.NewYCbCr(image.Rect(0, 0, size.w, size.h), image.YCbCrSubsampleRatio420)
+			src := make([]byte, size.w*size.h*3/2)
+			b.SetBytes(int64(len(src)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				NV12ToYCbCr(dst, src, 0)
+			}
+		})
+	}
+}
+
+func BenchmarkRGBToRGBA(b *testing.B) {
+	for _, size := range benchmarkSizes {
+		b.Run(size.name, func(b *testing.B) {
+			dst := image.NewRGBA(image.Rect(0, 0, size.w, size.h))
+			src := make([]byte, size.w*size.h*3)
+			b.SetBytes(int64(len(src)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				RGBToRGBA(dst, src, 0, false)
+			}
+		})
+	}
+}
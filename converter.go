@@ -0,0 +1,99 @@
+package webcam
+
+import (
+	"fmt"
+	"image"
+)
+
+// bayerFormats maps raw bayer formats to their pattern and sample depth.
+var bayerFormats = map[PixelFormat]struct {
+	pattern BayerPattern
+	depth   int
+}{
+	V4L2_PIX_FMT_SBGGR8:  {BayerBGGR, 8},
+	V4L2_PIX_FMT_SGBRG8:  {BayerGBRG, 8},
+	V4L2_PIX_FMT_SGRBG8:  {BayerGRBG, 8},
+	V4L2_PIX_FMT_SRGGB8:  {BayerRGGB, 8},
+	V4L2_PIX_FMT_SBGGR10: {BayerBGGR, 10},
+	V4L2_PIX_FMT_SGBRG10: {BayerGBRG, 10},
+	V4L2_PIX_FMT_SGRBG10: {BayerGRBG, 10},
+	V4L2_PIX_FMT_SRGGB10: {BayerRGGB, 10},
+}
+
+// Converter converts raw frames to images.
+// The image is reused between frames.
+type Converter struct {
+	format PixelFormat
+	stride int
+	img    image.Image
+}
+
+// NewConverter returns a converter for frames of format and size
+// with stride bytes per row, or 0 if rows are not padded.
+// An error is returned if the format can not be converted.
+func NewConverter(format PixelFormat, w, h, stride int) (*Converter, error) {
+	rect := image.Rect(0, 0, w, h)
+
+	var img image.Image
+	switch format {
+	case V4L2_PIX_FMT_YUYV:
+		img = image.NewYCbCr(rect, image.YCbCrSubsampleRatio422)
+	case V4L2_PIX_FMT_NV12, V4L2_PIX_FMT_YUV420, V4L2_PIX_FMT_YVU420:
+		img = image.NewYCbCr(rect, image.YCbCrSubsampleRatio420)
+	case V4L2_PIX_FMT_GREY:
+		img = image.NewGray(rect)
+	case V4L2_PIX_FMT_RGB24, V4L2_PIX_FMT_BGR24, V4L2_PIX_FMT_RGB565:
+		img = image.NewRGBA(rect)
+	default:
+		if _, ok := bayerFormats[format]; ok {
+			img = image.NewRGBA(rect)
+			break
+		}
+		return nil, fmt.Errorf("format %08x can not be converted", uint32(format))
+	}
+
+	return &Converter{format: format, stride: stride, img: img}, nil
+}
+
+// Format returns the format of the converted frames.
+func (c *Converter) Format() PixelFormat {
+	return c.format
+}
+
+// Size returns the size of the converted frames.
+func (c *Converter) Size() image.Point {
+	return c.img.Bounds().Size()
+}
+
+// Stride returns the bytes per row of the converted frames.
+func (c *Converter) Stride() int {
+	return c.stride
+}
+
+// Convert returns the frame as image. The image is only valid
+// until the next call to Convert.
+func (c *Converter) Convert(frame []byte) image.Image {
+	switch c.format {
+	case V4L2_PIX_FMT_YUYV:
+		YUYVToYCbCr(c.img.(*image.YCbCr), frame, c.stride)
+	case V4L2_PIX_FMT_NV12:
+		NV12ToYCbCr(c.img.(*image.YCbCr), frame, c.stride)
+	case V4L2_PIX_FMT_YUV420:
+		YUV420ToYCbCr(c.img.(*image.YCbCr), frame, c.stride, false)
+	case V4L2_PIX_FMT_YVU420:
+		YUV420ToYCbCr(c.img.(*image.YCbCr), frame, c.stride, true)
+	case V4L2_PIX_FMT_GREY:
+		GreyToGray(c.img.(*image.Gray), frame, c.stride)
+	case V4L2_PIX_FMT_RGB24:
+		RGBToRGBA(c.img.(*image.RGBA), frame, c.stride, false)
+	case V4L2_PIX_FMT_BGR24:
+		RGBToRGBA(c.img.(*image.RGBA), frame, c.stride, true)
+	case V4L2_PIX_FMT_RGB565:
+		RGB565ToRGBA(c.img.(*image.RGBA), frame, c.stride)
+	default:
+		bayer := bayerFormats[c.format]
+		DemosaicBayer(c.img.(*image.RGBA), frame, c.stride, bayer.pattern, bayer.depth)
+	}
+
+	return c.img
+}
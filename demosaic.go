@@ -0,0 +1,105 @@
+package webcam
+
+import "image"
+
+// BayerPattern describes the order of the color filters in the
+// top left 2x2 block of a raw bayer frame.
+type BayerPattern string
+
+const (
+	BayerBGGR BayerPattern = "BGGR"
+	BayerGBRG BayerPattern = "GBRG"
+	BayerGRBG BayerPattern = "GRBG"
+	BayerRGGB BayerPattern = "RGGB"
+)
+
+// DemosaicBayer converts a raw bayer frame into dst by bilinear interpolation
+// of the missing colors. Samples with a depth of 8 bits take one byte,
+// samples with a larger depth take 16 bit little endian words and are
+// scaled down to 8 bits. stride is the number of bytes per row of the
+// frame, or 0 if rows are not padded.
+func DemosaicBayer(dst *image.RGBA, frame []byte, stride int, pattern BayerPattern, depth int) {
+	w := dst.Rect.Dx()
+	h := dst.Rect.Dy()
+	if len(pattern) != 4 || w < 2 || h < 2 {
+		return
+	}
+
+	bpp := 1
+	if depth > 8 {
+		bpp = 2
+	}
+	if stride == 0 {
+		stride = w * bpp
+	}
+	if len(frame) < (h-1)*stride+w*bpp {
+		return
+	}
+
+	// sample returns the value at x, y mirrored at the edges
+	// to keep the color of the filter.
+	sample := func(x, y int) int {
+		if x < 0 {
+			x = 1
+		} else if x >= w {
+			x = w - 2
+		}
+		if y < 0 {
+			y = 1
+		} else if y >= h {
+			y = h - 2
+		}
+
+		i := y*stride + x*bpp
+		if bpp == 1 {
+			return int(frame[i])
+		}
+		return (int(frame[i]) | int(frame[i+1])<<8) >> uint(depth-8)
+	}
+
+	for y := 0; y < h; y++ {
+		row := dst.Pix[y*dst.Stride:]
+		for x := 0; x < w; x++ {
+			c := pattern[(y&1)*2+(x&1)]
+			v := sample(x, y)
+
+			var r, g, b int
+			switch c {
+			case 'G':
+				horizontal := (sample(x-1, y) + sample(x+1, y)) / 2
+				vertical := (sample(x, y-1) + sample(x, y+1)) / 2
+				g = v
+				if pattern[(y&1)*2+((x+1)&1)] == 'R' {
+					r, b = horizontal, vertical
+				} else {
+					r, b = vertical, horizontal
+				}
+			default:
+				cross := (sample(x-1, y) + sample(x+1, y) + sample(x, y-1) + sample(x, y+1)) / 4
+				diagonal := (sample(x-1, y-1) + sample(x+1, y-1) + sample(x-1, y+1) + sample(x+1, y+1)) / 4
+				g = cross
+				if c == 'R' {
+					r, b = v, diagonal
+				} else {
+					r, b = diagonal, v
+				}
+			}
+
+			p := row[x*4 : x*4+4]
+			p[0] = clamp(r)
+			p[1] = clamp(g)
+			p[2] = clamp(b)
+			p[3] = 0xff
+		}
+	}
+}
+
+func clamp(v int) uint8 {
+	if v < 0 {
+		return 0
+	}
+	if v > 255 {
+		return 255
+	}
+	return uint8(v)
+}
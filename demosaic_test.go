@@ -0,0 +1,111 @@
+package webcam
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// mosaic returns a w by h bayer frame of pattern with stride bytes per
+// row, whose samples are the channel of c of their filter color.
+func mosaic(pattern BayerPattern, c color.RGBA, w, h, stride, depth int) []byte {
+	bpp := 1
+	if depth > 8 {
+		bpp = 2
+	}
+	frame := make([]byte, stride*h)
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var v int
+			switch pattern[(y&1)*2+(x&1)] {
+			case 'R':
+				v = int(c.R)
+			case 'G':
+				v = int(c.G)
+			case 'B':
+				v = int(c.B)
+			}
+			i := y*stride + x*bpp
+			if bpp == 1 {
+				frame[i] = uint8(v)
+				continue
+			}
+			v <<= uint(depth - 8)
+			frame[i], frame[i+1] = uint8(v), uint8(v>>8)
+		}
+	}
+	return frame
+}
+
+func TestDemosaicBayerUniform(t *testing.T) {
+	c := color.RGBA{200, 100, 50, 255}
+	tests := []struct {
+		pattern BayerPattern
+		depth   int
+		padding int
+	}{
+		{BayerRGGB, 8, 0},
+		{BayerBGGR, 8, 0},
+		{BayerGRBG, 8, 0},
+		{BayerGBRG, 8, 0},
+		{BayerRGGB, 10, 0},
+		{BayerBGGR, 10, 0},
+		{BayerGRBG, 10, 0},
+		{BayerGBRG, 10, 0},
+		{BayerRGGB, 8, 4},
+		{BayerGBRG, 10, 8},
+	}
+	for _, test := range tests {
+		w, h := 6, 4
+		bpp := 1
+		if test.depth > 8 {
+			bpp = 2
+		}
+		stride := w*bpp + test.padding
+		dst := image.NewRGBA(image.Rect(0, 0, w, h))
+		DemosaicBayer(dst, mosaic(test.pattern, c, w, h, stride, test.depth), stride, test.pattern, test.depth)
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				if got := dst.RGBAAt(x, y); got != c {
+					t.Fatalf("%s %d-bit stride %d: pixel %d,%d is %v, want %v", test.pattern, test.depth, stride, x, y, got, c)
+				}
+			}
+		}
+	}
+}
+
+func TestDemosaicBayer(t *testing.T) {
+	// the samples of a 2x2 frame are 10, 20, 30 and 40 in the order of
+	// the pattern, the missing colors are interpolated from the samples
+	// mirrored at the edges
+	tests := []struct {
+		pattern BayerPattern
+		want    [4]color.RGBA
+	}{
+		{BayerRGGB, [4]color.RGBA{
+			{10, 25, 40, 255}, {10, 20, 40, 255},
+			{10, 30, 40, 255}, {10, 25, 40, 255},
+		}},
+		{BayerBGGR, [4]color.RGBA{
+			{40, 25, 10, 255}, {40, 20, 10, 255},
+			{40, 30, 10, 255}, {40, 25, 10, 255},
+		}},
+		{BayerGRBG, [4]color.RGBA{
+			{20, 10, 30, 255}, {20, 25, 30, 255},
+			{20, 25, 30, 255}, {20, 40, 30, 255},
+		}},
+		{BayerGBRG, [4]color.RGBA{
+			{30, 10, 20, 255}, {30, 25, 20, 255},
+			{30, 25, 20, 255}, {30, 40, 20, 255},
+		}},
+	}
+	for _, test := range tests {
+		dst := image.NewRGBA(image.Rect(0, 0, 2, 2))
+		DemosaicBayer(dst, []byte{10, 20, 30, 40}, 0, test.pattern, 8)
+		for i, want := range test.want {
+			if got := dst.RGBAAt(i%2, i/2); got != want {
+				t.Errorf("%s: pixel %d,%d is %v, want %v", test.pattern, i%2, i/2, got, want)
+			}
+		}
+	}
+}
@@ -0,0 +1,54 @@
+package webcam
+
+import (
+	"image"
+	"image/jpeg"
+	"io"
+)
+
+// Encoder compresses frames as jpeg.
+type Encoder interface {
+	// EncodeYUYV encodes a raw frame in the YUYV 4:2:2 format
+	// whose rows are not padded.
+	EncodeYUYV(w io.Writer, frame []byte, width, height int) error
+
+	// EncodeFrame encodes an image.
+	EncodeFrame(w io.Writer, img image.Image) error
+}
+
+// JPEGEncoder encodes frames with the image/jpeg package.
+type JPEGEncoder struct {
+	// Quality ranges from 1 to 100, 0 means the default quality.
+	Quality int
+
+	img *image.YCbCr
+}
+
+// NewJPEGEncoder returns an encoder with the given quality.
+func NewJPEGEncoder(quality int) *JPEGEncoder {
+	return &JPEGEncoder{Quality: quality}
+}
+
+// SetQuality sets the quality of subsequently encoded frames.
+func (e *JPEGEncoder) SetQuality(quality int) error {
+	e.Quality = quality
+	return nil
+}
+
+func (e *JPEGEncoder) EncodeYUYV(w io.Writer, frame []byte, width, height int) error {
+	if e.img == nil || e.img.Rect.Dx() != width || e.img.Rect.Dy() != height {
+		e.img = image.NewYCbCr(image.Rect(0, 0, width, height), image.YCbCrSubsampleRatio422)
+	}
+
+	YUYVToYCbCr(e.img, frame, 0)
+	return e.EncodeFrame(w, e.img)
+}
+
+func (e *JPEGEncoder) EncodeFrame(w io.Writer, img image.Image) error {
+	var opts *jpeg.Options
+	if e.Quality > 0 {
+		opts = &jpeg.Options{Quality: e.Quality}
+	}
+
+	return jpeg.Encode(w, img, opts)
+}
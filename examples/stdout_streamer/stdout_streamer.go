@@ -1,4 +1,4 @@
-// Example program that uses blakjack/webcam library
+// Example program that uses brutella/webcam library
 // for working with V4L2 devices.
 // The application reads frames from device and writes them to stdout
 // If your device supports motion formats (e.g. H264 or MJPEG) you can
@@ -6,7 +6,8 @@
 // Example usage: go run stdout_streamer.go | vlc -
 package main
 
-import "github.com/blackjack/webcam"
+import "context"
+import "github.com/brutella/webcam"
 import "os"
 import "fmt"
 import "sort"
@@ -89,26 +90,20 @@ func main() {
 		panic(err.Error())
 	}
 
-	timeout := uint32(5) //5 seconds
-	for {
-		err = cam.WaitForFrame(timeout)
-
-		switch err.(type) {
+	for frame := range cam.Frames(context.Background()) {
+		switch frame.Err.(type) {
 		case nil:
 		case *webcam.Timeout:
-			fmt.Fprint(os.Stderr, err.Error())
+			fmt.Fprint(os.Stderr, frame.Err.Error())
 			continue
 		default:
-			panic(err.Error())
+			panic(frame.Err.Error())
 		}
 
-		frame, err := cam.ReadFrame()
-		if len(frame) != 0 {
-			print(".")
-			os.Stdout.Write(frame)
-			os.Stdout.Sync()
-		} else if err != nil {
-			panic(err.Error())
-		}
+		print(".")
+		os.Stdout.Write(frame.Data)
+		os.Stdout.Sync()
+		// give the buffer back to the driver
+		frame.Release()
 	}
 }
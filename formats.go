@@ -9,6 +9,30 @@ import "fmt"
 // of supported image formats
 type PixelFormat uint32
 
+// Pixel formats which can be converted to images with a Converter.
+const (
+	V4L2_PIX_FMT_PJPG   = 0x47504A50
+	V4L2_PIX_FMT_MJPG   = 0x47504A4D
+	V4L2_PIX_FMT_YUYV   = 0x56595559
+	V4L2_PIX_FMT_JPEG   = 0x4745504A
+	V4L2_PIX_FMT_NV12   = 0x3231564E
+	V4L2_PIX_FMT_YUV420 = 0x32315559 // YU12
+	V4L2_PIX_FMT_YVU420 = 0x32315659 // YV12
+	V4L2_PIX_FMT_GREY   = 0x59455247
+	V4L2_PIX_FMT_RGB24  = 0x33424752 // RGB3
+	V4L2_PIX_FMT_BGR24  = 0x33524742 // BGR3
+	V4L2_PIX_FMT_RGB565 = 0x50424752 // RGBP
+
+	V4L2_PIX_FMT_SBGGR8  = 0x31384142 // BA81
+	V4L2_PIX_FMT_SGBRG8  = 0x47524247
+	V4L2_PIX_FMT_SGRBG8  = 0x47425247
+	V4L2_PIX_FMT_SRGGB8  = 0x42474752
+	V4L2_PIX_FMT_SBGGR10 = 0x30314742
+	V4L2_PIX_FMT_SGBRG10 = 0x30314247
+	V4L2_PIX_FMT_SGRBG10 = 0x30314142 // BA10
+	V4L2_PIX_FMT_SRGGB10 = 0x30314752
+)
+
 // Struct that describes frame size supported by a webcam
 // For fixed sizes min and max values will be the same and
 // step value will be equal to '0'
@@ -0,0 +1,180 @@
+package webcam
+
+import (
+	"context"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Frame is a frame read by Frames.
+// If reading failed, Err is set and Data is empty.
+//
+// Data references the memory mapped buffer of the driver.
+// It must be given back by calling Release once it is not used anymore,
+// otherwise the driver runs out of buffers and stops capturing.
+// In BufferModeRead, Data is a copy of the frame, because the single
+// buffer is overwritten by the next read.
+type Frame struct {
+	Data []byte
+	Err  error
+
+	Timestamp time.Time // time the frame was captured by the driver
+	Sequence  uint32    // sequence number counted by the driver
+	Format    PixelFormat
+	Width     uint32
+	Height    uint32
+	Stride    uint32 // bytes per line, 0 for compressed formats
+	FD        int    // dma-buf file descriptor of the buffer in BufferModeDMABUF, otherwise -1
+	Flags     uint32 // V4L2_BUF_FLAG_* flags of the buffer
+
+	release func() error
+}
+
+// Corrupted returns true if the driver flagged the frame as erroneous,
+// e.g. because of a transmission error, or if a raw frame is truncated.
+// Such frames contain garbage and should not be shown.
+func (f *Frame) Corrupted() bool {
+	if f.Flags&V4L2_BUF_FLAG_ERROR != 0 {
+		return true
+	}
+	return f.Stride != 0 && uint32(len(f.Data)) < f.Stride*f.Height
+}
+
+// Release gives the buffer of the frame back to the driver.
+// Data must not be used afterwards.
+func (f *Frame) Release() error {
+	release := f.release
+	f.release = nil
+	f.Data = nil
+	if release == nil {
+		return nil
+	}
+	return release()
+}
+
+// How often Frames checks for cancellation while waiting for a frame
+const framesPollInterval = 1 // seconds
+
+// Frames reads frames in a separate goroutine and sends them to the
+// returned channel until ctx is done or waiting for a frame fails.
+// The channel is closed afterwards; streaming must be stopped by the
+// caller only after that.
+//
+// If no frame arrives within the frame timeout (see SetFrameTimeout),
+// a Frame with a *Timeout error is sent and reading continues.
+// Errors reading a single frame are sent and reading continues as well.
+// Any other error is sent as the last Frame before the channel is closed.
+func (w *Webcam) Frames(ctx context.Context) <-chan Frame {
+	frames := make(chan Frame)
+
+	go func() {
+		defer close(frames)
+
+		send := func(f Frame) bool {
+			select {
+			case frames <- f:
+				return true
+			case <-ctx.Done():
+				f.Release()
+				return false
+			}
+		}
+
+		pix, err := getImageFormat(w.fd)
+		if err != nil {
+			send(Frame{Err: err})
+			return
+		}
+
+		last := time.Now()
+		for ctx.Err() == nil {
+			err := w.WaitForFrame(framesPollInterval)
+			switch err.(type) {
+			case nil:
+			case *Timeout:
+				if time.Since(last) < w.frameTimeout {
+					continue
+				}
+				last = time.Now()
+				if !send(Frame{Err: err}) {
+					return
+				}
+				continue
+			default:
+				send(Frame{Err: err})
+				return
+			}
+
+			buffer, err := w.dequeue()
+			if err != nil {
+				if !send(Frame{Err: err}) {
+					return
+				}
+				continue
+			}
+			last = time.Now()
+
+			index := buffer.index
+			if buffer.bytesused == 0 {
+				w.ReleaseFrame(index)
+				continue
+			}
+
+			fd := -1
+			if int(index) < len(w.dmabufs) {
+				fd = w.dmabufs[index]
+			}
+
+			data := w.buffers[index][:buffer.bytesused]
+			if w.mode == BufferModeRead {
+				data = append([]byte(nil), data...)
+			}
+
+			f := Frame{
+				Data:      data,
+				Timestamp: bufferTime(buffer),
+				Sequence:  buffer.sequence,
+				Format:    PixelFormat(pix.Pixelformat),
+				Width:     pix.Width,
+				Height:    pix.Height,
+				Stride:    pix.Bytesperline,
+				FD:        fd,
+				Flags:     buffer.flags,
+				release: func() error {
+					return w.ReleaseFrame(index)
+				},
+			}
+			if !send(f) {
+				return
+			}
+		}
+	}()
+
+	return frames
+}
+
+// bufferTime returns the timestamp of buffer as wall clock time.
+func bufferTime(buffer *v4l2_buffer) time.Time {
+	t := time.Unix(buffer.timestamp.Unix())
+	if buffer.flags&V4L2_BUF_FLAG_TIMESTAMP_MASK != V4L2_BUF_FLAG_TIMESTAMP_MONOTONIC {
+		return t
+	}
+
+	return monotonicTime(time.Duration(t.UnixNano()))
+}
+
+// monotonicTime converts a time of CLOCK_MONOTONIC to wall clock time.
+func monotonicTime(d time.Duration) time.Time {
+	var ts unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts); err != nil {
+		return time.Now()
+	}
+	return time.Now().Add(d - time.Duration(ts.Nano()))
+}
+
+// SetFrameTimeout sets the time after which Frames reports a *Timeout
+// if no frame arrived. The default is 5 seconds.
+func (w *Webcam) SetFrameTimeout(timeout time.Duration) {
+	w.frameTimeout = timeout
+}
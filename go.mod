@@ -4,6 +4,23 @@ go 1.20
 
 require (
 	github.com/blackjack/webcam v0.0.0-20230509180125-87693b3f29dc
+	github.com/brutella/hap v0.0.35
+	github.com/pkg/sftp v1.13.7
+	golang.org/x/crypto v0.24.0
 	golang.org/x/image v0.7.0
-	golang.org/x/sys v0.8.0
+	golang.org/x/sys v0.21.0
+)
+
+require (
+	github.com/brutella/dnssd v1.2.14 // indirect
+	github.com/go-chi/chi v1.5.4 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/miekg/dns v1.1.61 // indirect
+	github.com/tadglines/go-pkgs v0.0.0-20210623144937-b983b20f54f9 // indirect
+	github.com/vishvananda/netlink v1.2.1-beta.2 // indirect
+	github.com/vishvananda/netns v0.0.0-20200728191858-db3c7e526aae // indirect
+	github.com/xiam/to v0.0.0-20200126224905-d60d31e03561 // indirect
+	golang.org/x/net v0.26.0 // indirect
+	golang.org/x/text v0.16.0 // indirect
+	gopkg.in/Regis24GmbH/go-diacritics.v2 v2.0.3 // indirect
 )
@@ -0,0 +1,172 @@
+package webcam
+
+import (
+	"errors"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// M2M is a memory-to-memory device, e.g. a hardware jpeg encoder.
+// Frames written to the output queue of the device are processed
+// and the result is read from the capture queue.
+// Only single-planar devices are supported.
+type M2M struct {
+	fd        uintptr
+	in        []byte
+	out       []byte
+	streaming bool
+}
+
+// OpenM2M opens a memory-to-memory device with a given path.
+func OpenM2M(path string) (*M2M, error) {
+	handle, err := unix.Open(path, unix.O_RDWR|unix.O_NONBLOCK, 0666)
+	if err != nil {
+		return nil, err
+	}
+	fd := uintptr(handle)
+
+	caps, err := getCapabilities(fd)
+	if err != nil {
+		unix.Close(handle)
+		return nil, err
+	}
+
+	m2m := caps&V4L2_CAP_VIDEO_M2M != 0 ||
+		caps&(V4L2_CAP_VIDEO_CAPTURE|V4L2_CAP_VIDEO_OUTPUT) == V4L2_CAP_VIDEO_CAPTURE|V4L2_CAP_VIDEO_OUTPUT
+	if !m2m {
+		unix.Close(handle)
+		return nil, errors.New("Not a single-planar memory-to-memory device")
+	}
+
+	if caps&V4L2_CAP_STREAMING == 0 {
+		unix.Close(handle)
+		return nil, errors.New("Device does not support the streaming I/O method")
+	}
+
+	return &M2M{fd: fd}, nil
+}
+
+// SetFormat sets the format of the frames which are processed (in)
+// and the format of the result (out).
+func (m *M2M) SetFormat(in, out PixelFormat, width, height uint32) error {
+	code, w, h := uint32(in), width, height
+	if err := setFormat(m.fd, V4L2_BUF_TYPE_VIDEO_OUTPUT, &code, &w, &h); err != nil {
+		return err
+	}
+	if code != uint32(in) || w != width || h != height {
+		return errors.New("Input format is not supported by the device")
+	}
+
+	code, w, h = uint32(out), width, height
+	if err := setFormat(m.fd, V4L2_BUF_TYPE_VIDEO_CAPTURE, &code, &w, &h); err != nil {
+		return err
+	}
+	if code != uint32(out) {
+		return errors.New("Output format is not supported by the device")
+	}
+
+	return nil
+}
+
+// SetControl sets a control, e.g. V4L2_CID_JPEG_COMPRESSION_QUALITY.
+func (m *M2M) SetControl(id ControlID, value int32) error {
+	return setControl(m.fd, uint32(id), value)
+}
+
+// StartStreaming allocates one buffer per queue and starts processing.
+func (m *M2M) StartStreaming() error {
+	if m.streaming {
+		return errors.New("Already streaming")
+	}
+
+	var err error
+	for _, bufType := range []uint32{V4L2_BUF_TYPE_VIDEO_OUTPUT, V4L2_BUF_TYPE_VIDEO_CAPTURE} {
+		count := uint32(1)
+		if err = requestBuffers(m.fd, bufType, &count); err != nil {
+			return errors.New("Failed to map request buffers: " + string(err.Error()))
+		}
+
+		var length uint32
+		buffer, err := queryBuffer(m.fd, bufType, 0, &length)
+		if err != nil {
+			return errors.New("Failed to map memory: " + string(err.Error()))
+		}
+
+		if bufType == V4L2_BUF_TYPE_VIDEO_OUTPUT {
+			m.in = buffer
+		} else {
+			m.out = buffer
+		}
+	}
+
+	if err = streamOn(m.fd, V4L2_BUF_TYPE_VIDEO_OUTPUT); err != nil {
+		return errors.New("Failed to start streaming: " + string(err.Error()))
+	}
+	if err = streamOn(m.fd, V4L2_BUF_TYPE_VIDEO_CAPTURE); err != nil {
+		return errors.New("Failed to start streaming: " + string(err.Error()))
+	}
+	m.streaming = true
+
+	return nil
+}
+
+// Process passes a frame to the device and waits for the result.
+// The returned slice is only valid until the next call to Process.
+func (m *M2M) Process(frame []byte, timeout uint32) ([]byte, error) {
+	if !m.streaming {
+		return nil, errors.New("Not streaming")
+	}
+
+	if len(frame) > len(m.in) {
+		return nil, errors.New("Frame exceeds buffer size")
+	}
+	copy(m.in, frame)
+
+	if err := enqueueBuffer(m.fd, V4L2_BUF_TYPE_VIDEO_CAPTURE, 0, 0); err != nil {
+		return nil, err
+	}
+	if err := enqueueBuffer(m.fd, V4L2_BUF_TYPE_VIDEO_OUTPUT, 0, uint32(len(frame))); err != nil {
+		return nil, err
+	}
+
+	count, err := waitForFrame(m.fd, timeout)
+	if err != nil {
+		return nil, err
+	} else if count == 0 {
+		return nil, new(Timeout)
+	}
+
+	var index, length uint32
+	if err := dequeueBuffer(m.fd, V4L2_BUF_TYPE_VIDEO_CAPTURE, &index, &length); err != nil {
+		return nil, err
+	}
+
+	// the output buffer is released by the driver shortly after
+	// the result is available
+	for i := 0; ; i++ {
+		err = dequeueBuffer(m.fd, V4L2_BUF_TYPE_VIDEO_OUTPUT, &index, new(uint32))
+		if err != unix.EAGAIN || i == 100 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return m.out[:length], nil
+}
+
+// Close stops processing and closes the device.
+func (m *M2M) Close() error {
+	if m.streaming {
+		m.streaming = false
+		streamOff(m.fd, V4L2_BUF_TYPE_VIDEO_OUTPUT)
+		streamOff(m.fd, V4L2_BUF_TYPE_VIDEO_CAPTURE)
+		mmapReleaseBuffer(m.in)
+		mmapReleaseBuffer(m.out)
+	}
+
+	return unix.Close(int(m.fd))
+}
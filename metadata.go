@@ -0,0 +1,239 @@
+package webcam
+
+import (
+	"encoding/binary"
+	"errors"
+	"time"
+	"unsafe"
+
+	"github.com/blackjack/webcam/ioctl"
+	"golang.org/x/sys/unix"
+)
+
+// V4L2_META_FMT_UVC is the format of the metadata
+// nodes which the uvcvideo driver creates for cameras.
+const V4L2_META_FMT_UVC uint32 = 0x48435655 // UVCH
+
+// Flags of the UVC payload header
+const (
+	UVC_STREAM_EOF uint8 = 0x02 // end of frame
+	UVC_STREAM_PTS uint8 = 0x04 // presentation time stamp is present
+	UVC_STREAM_SCR uint8 = 0x08 // source clock reference is present
+	UVC_STREAM_ERR uint8 = 0x40 // payload error
+)
+
+// metadataBufferCount is the number of buffers of a metadata device.
+const metadataBufferCount = 4
+
+// MetadataDevice is a V4L2 metadata capture device. The uvcvideo
+// driver creates one for every camera, usually the video node which
+// follows the video node of the camera, e.g. /dev/video1 for /dev/video0.
+// It delivers the payload headers of the USB packets of every frame.
+type MetadataDevice struct {
+	fd        uintptr
+	buffers   [][]byte
+	streaming bool
+}
+
+// OpenMetadata opens a metadata device with a given path.
+func OpenMetadata(path string) (*MetadataDevice, error) {
+	handle, err := unix.Open(path, unix.O_RDWR|unix.O_NONBLOCK, 0666)
+	if err != nil {
+		return nil, err
+	}
+	fd := uintptr(handle)
+
+	caps, err := getCapabilities(fd)
+	if err != nil {
+		unix.Close(handle)
+		return nil, err
+	}
+	if caps&V4L2_CAP_META_CAPTURE == 0 {
+		unix.Close(handle)
+		return nil, errors.New("Not a metadata capture device")
+	}
+	if caps&V4L2_CAP_STREAMING == 0 {
+		unix.Close(handle)
+		return nil, errors.New("Device does not support the streaming I/O method")
+	}
+
+	return &MetadataDevice{fd: fd}, nil
+}
+
+// StartStreaming selects the UVC metadata format, allocates the
+// buffers and starts streaming. Metadata is only delivered while
+// the camera is streaming.
+func (m *MetadataDevice) StartStreaming() error {
+	if m.streaming {
+		return errors.New("Already streaming")
+	}
+
+	format := &v4l2_format{_type: V4L2_BUF_TYPE_META_CAPTURE}
+	NativeByteOrder.PutUint32(format.union.data[:4], V4L2_META_FMT_UVC)
+	if err := ioctl.Ioctl(m.fd, VIDIOC_S_FMT, uintptr(unsafe.Pointer(format))); err != nil {
+		return errors.New("Failed to set metadata format: " + err.Error())
+	}
+	if NativeByteOrder.Uint32(format.union.data[:4]) != V4L2_META_FMT_UVC {
+		return errors.New("UVC metadata is not supported by the device")
+	}
+
+	count := uint32(metadataBufferCount)
+	if err := requestBuffers(m.fd, V4L2_BUF_TYPE_META_CAPTURE, &count); err != nil {
+		return errors.New("Failed to map request buffers: " + err.Error())
+	}
+	m.buffers = make([][]byte, count)
+	for i := range m.buffers {
+		var length uint32
+		buffer, err := queryBuffer(m.fd, V4L2_BUF_TYPE_META_CAPTURE, uint32(i), &length)
+		if err != nil {
+			return errors.New("Failed to map memory: " + err.Error())
+		}
+		m.buffers[i] = buffer
+		if err := enqueueBuffer(m.fd, V4L2_BUF_TYPE_META_CAPTURE, uint32(i), 0); err != nil {
+			return errors.New("Failed to enqueue buffer: " + err.Error())
+		}
+	}
+
+	if err := streamOn(m.fd, V4L2_BUF_TYPE_META_CAPTURE); err != nil {
+		return errors.New("Failed to start streaming: " + err.Error())
+	}
+	m.streaming = true
+
+	return nil
+}
+
+// ReadMetadata waits up to timeout seconds for the metadata of the next
+// frame. It returns a *Timeout error if no metadata is available, which
+// allows to read the available metadata without waiting with a timeout of 0.
+func (m *MetadataDevice) ReadMetadata(timeout uint32) (*UVCMetadata, error) {
+	if !m.streaming {
+		return nil, errors.New("Not streaming")
+	}
+
+	count, err := waitForFrame(m.fd, timeout)
+	if err != nil {
+		return nil, err
+	} else if count == 0 {
+		return nil, new(Timeout)
+	}
+
+	buffer, err := dequeue(m.fd, V4L2_BUF_TYPE_META_CAPTURE, V4L2_MEMORY_MMAP)
+	if err == unix.EAGAIN {
+		return nil, new(Timeout)
+	} else if err != nil {
+		return nil, err
+	}
+
+	md := &UVCMetadata{
+		Sequence:  buffer.sequence,
+		Timestamp: bufferTime(buffer),
+		Headers:   ParseUVCMetadata(m.buffers[buffer.index][:buffer.bytesused]),
+	}
+	if err := enqueueBuffer(m.fd, V4L2_BUF_TYPE_META_CAPTURE, buffer.index, 0); err != nil {
+		return nil, err
+	}
+
+	return md, nil
+}
+
+// Close stops streaming and closes the device.
+func (m *MetadataDevice) Close() error {
+	if m.streaming {
+		m.streaming = false
+		streamOff(m.fd, V4L2_BUF_TYPE_META_CAPTURE)
+		for _, buffer := range m.buffers {
+			mmapReleaseBuffer(buffer)
+		}
+	}
+
+	return unix.Close(int(m.fd))
+}
+
+// UVCMetadata is the metadata of a frame captured by a UVC camera.
+type UVCMetadata struct {
+	Sequence  uint32    // sequence number of the frame, see Frame.Sequence
+	Timestamp time.Time // timestamp of the frame
+	Headers   []UVCPayloadHeader
+}
+
+// Received returns the time the first and the last payload header of
+// the frame were received, or zero times if there are no headers.
+// The difference is the time the frame took to be transferred.
+func (md *UVCMetadata) Received() (first, last time.Time) {
+	if len(md.Headers) == 0 {
+		return
+	}
+	first = monotonicTime(md.Headers[0].Received)
+	return first, first.Add(md.Headers[len(md.Headers)-1].Received - md.Headers[0].Received)
+}
+
+// CaptureTime returns the time the capture of the frame started. The time
+// the first packet with time stamps was received is dated back by the time
+// between the presentation time stamp and the source clock of the packet,
+// which requires the frequency of the device clock in Hz. It returns false
+// if the frame has no time stamps.
+func (md *UVCMetadata) CaptureTime(clockFrequency uint32) (time.Time, bool) {
+	if clockFrequency == 0 {
+		return time.Time{}, false
+	}
+	for _, h := range md.Headers {
+		if h.Flags&UVC_STREAM_PTS == 0 || h.Flags&UVC_STREAM_SCR == 0 {
+			continue
+		}
+		// the device clock wraps around
+		ticks := time.Duration(h.STC - h.PTS)
+		return monotonicTime(h.Received - ticks*time.Second/time.Duration(clockFrequency)), true
+	}
+	return time.Time{}, false
+}
+
+// UVCPayloadHeader is the header of a USB packet of a frame.
+// The device clock runs at the frequency of the
+// dwClockFrequency field of the video probe control.
+type UVCPayloadHeader struct {
+	Received time.Duration // CLOCK_MONOTONIC time the packet was received
+	SOF      uint16        // USB frame number the packet was received in
+	Flags    uint8         // UVC_STREAM_* flags
+
+	PTS uint32 // device clock at the start of the capture if Flags has UVC_STREAM_PTS
+
+	// device clock and its USB frame number when the
+	// packet was sent if Flags has UVC_STREAM_SCR
+	STC       uint32
+	DeviceSOF uint16
+}
+
+// ParseUVCMetadata parses a buffer of a metadata device in the
+// V4L2_META_FMT_UVC format. Incomplete headers are ignored.
+func ParseUVCMetadata(b []byte) []UVCPayloadHeader {
+	var headers []UVCPayloadHeader
+	// every block starts with the system time and the usb frame number,
+	// followed by the payload header, whose length includes the length
+	// and flags fields
+	for len(b) >= 12 {
+		length := int(b[10])
+		if length < 2 || len(b) < 10+length {
+			break
+		}
+		h := UVCPayloadHeader{
+			Received: time.Duration(NativeByteOrder.Uint64(b[0:8])),
+			SOF:      NativeByteOrder.Uint16(b[8:10]),
+			Flags:    b[11],
+		}
+
+		// the fields of the payload header are little endian
+		p := b[12 : 10+length]
+		if h.Flags&UVC_STREAM_PTS != 0 && len(p) >= 4 {
+			h.PTS = binary.LittleEndian.Uint32(p)
+			p = p[4:]
+		}
+		if h.Flags&UVC_STREAM_SCR != 0 && len(p) >= 6 {
+			h.STC = binary.LittleEndian.Uint32(p)
+			h.DeviceSOF = binary.LittleEndian.Uint16(p[4:]) & 0x7ff
+		}
+
+		headers = append(headers, h)
+		b = b[10+length:]
+	}
+	return headers
+}
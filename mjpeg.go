@@ -0,0 +1,125 @@
+package webcam
+
+import (
+	"bytes"
+	"errors"
+)
+
+// JPEG markers
+const (
+	markerSOI = 0xd8
+	markerEOI = 0xd9
+	markerSOS = 0xda
+	markerDHT = 0xc4
+)
+
+var (
+	ErrMissingSOI = errors.New("mjpeg frame does not start with SOI marker")
+	ErrMissingEOI = errors.New("mjpeg frame does not end with EOI marker")
+)
+
+// ValidateMJPEG checks that frame starts with a SOI and ends with an
+// EOI marker. Zero padding after the EOI marker is ignored.
+// Frames without these markers are truncated and render as broken images.
+func ValidateMJPEG(frame []byte) error {
+	if len(frame) < 4 || frame[0] != 0xff || frame[1] != markerSOI {
+		return ErrMissingSOI
+	}
+
+	frame = bytes.TrimRight(frame, "\x00")
+	if n := len(frame); n < 4 || frame[n-2] != 0xff || frame[n-1] != markerEOI {
+		return ErrMissingEOI
+	}
+
+	return nil
+}
+
+// AppendMJPEG appends frame to dst and inserts the default Huffman
+// tables of the JPEG standard before the start of scan, if the frame
+// has no DHT segment. Many UVC cameras omit them as allowed by the
+// MJPEG format, but browsers and most decoders require them.
+func AppendMJPEG(dst, frame []byte) []byte {
+	sos := -1
+
+	// walk the marker segments up to the start of scan
+	for i := 2; i+4 <= len(frame); {
+		if frame[i] != 0xff {
+			break
+		}
+		marker := frame[i+1]
+		if marker == 0xff {
+			// fill byte
+			i++
+			continue
+		}
+		if marker == markerDHT {
+			return append(dst, frame...)
+		}
+		if marker == markerSOS {
+			sos = i
+			break
+		}
+		i += 2 + int(frame[i+2])<<8 | int(frame[i+3])
+	}
+
+	if sos < 0 {
+		return append(dst, frame...)
+	}
+
+	dst = append(dst, frame[:sos]...)
+	dst = append(dst, defaultDHT...)
+	return append(dst, frame[sos:]...)
+}
+
+// defaultDHT is a DHT segment with the Huffman tables
+// of section K.3 of the JPEG standard.
+var defaultDHT = func() []byte {
+	tables := []struct {
+		class byte
+		bits  [16]byte
+		vals  []byte
+	}{
+		{0x00, [16]byte{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0}, []byte{
+			0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b,
+		}},
+		{0x10, [16]byte{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 0x7d}, []byte{
+			0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12, 0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+			0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08, 0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+			0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16, 0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+			0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+			0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+			0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+			0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+			0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+			0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+			0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		}},
+		{0x01, [16]byte{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0}, []byte{
+			0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0a, 0x0b,
+		}},
+		{0x11, [16]byte{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 0x77}, []byte{
+			0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21, 0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+			0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91, 0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+			0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34, 0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+			0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38, 0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+			0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+			0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+			0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+			0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+			0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+			0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+			0xf9, 0xfa,
+		}},
+	}
+
+	var data []byte
+	for _, t := range tables {
+		data = append(data, t.class)
+		data = append(data, t.bits[:]...)
+		data = append(data, t.vals...)
+	}
+
+	n := len(data) + 2
+	return append([]byte{0xff, markerDHT, byte(n >> 8), byte(n)}, data...)
+}()
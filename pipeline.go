@@ -0,0 +1,153 @@
+package webcam
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// Filter processes frames before they are encoded,
+// e.g. to rotate them, draw an overlay or scan barcodes.
+type Filter interface {
+	// Apply processes img, which was captured at t, and returns the
+	// result, which is either img modified in place or a new image.
+	// img is only valid until Apply returns.
+	Apply(img image.Image, t time.Time) image.Image
+}
+
+// FilterFunc is a function used as Filter.
+type FilterFunc func(img image.Image, t time.Time) image.Image
+
+func (f FilterFunc) Apply(img image.Image, t time.Time) image.Image {
+	return f(img, t)
+}
+
+// OptionalFilter is a Filter which reports when it doesn't change
+// frames. The Pipeline skips disabled filters, and jpeg frames are
+// not decoded if all filters are disabled.
+type OptionalFilter interface {
+	Filter
+
+	// Enabled returns false if the filter currently doesn't change frames.
+	Enabled() bool
+}
+
+func filterEnabled(f Filter) bool {
+	if of, ok := f.(OptionalFilter); ok {
+		return of.Enabled()
+	}
+	return true
+}
+
+// Pipeline converts raw frames to images, passes them through
+// the filters in order and encodes them as jpeg.
+//
+//	convert → filter → … → filter → encode
+//
+// A pipeline is not safe for concurrent use.
+type Pipeline struct {
+	Encoder Encoder
+	Filters []Filter
+
+	conv   *Converter
+	packed []byte // yuyv frame without padding
+}
+
+// NewPipeline returns a pipeline which encodes frames
+// with enc after applying filters.
+func NewPipeline(enc Encoder, filters ...Filter) *Pipeline {
+	return &Pipeline{Encoder: enc, Filters: filters}
+}
+
+// Filtering returns true if any filter is enabled.
+func (p *Pipeline) Filtering() bool {
+	for _, f := range p.Filters {
+		if filterEnabled(f) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filter applies the enabled filters to img.
+func (p *Pipeline) Filter(img image.Image, t time.Time) image.Image {
+	for _, f := range p.Filters {
+		if filterEnabled(f) {
+			img = f.Apply(img, t)
+		}
+	}
+	return img
+}
+
+// Encode writes the frame of format and size with stride bytes per row,
+// or 0 if rows are not padded, which was captured at t, as jpeg to w.
+// Jpeg frames are written as they are, unless filters are enabled,
+// in which case they are decoded first. YUYV frames are encoded
+// directly if no filter is enabled.
+func (p *Pipeline) Encode(w io.Writer, frame []byte, format PixelFormat, width, height, stride int, t time.Time) error {
+	filtering := p.Filtering()
+
+	switch format {
+	case V4L2_PIX_FMT_MJPG, V4L2_PIX_FMT_PJPG, V4L2_PIX_FMT_JPEG:
+		frame = AppendMJPEG(nil, frame)
+		if !filtering {
+			_, err := w.Write(frame)
+			return err
+		}
+		img, err := jpeg.Decode(bytes.NewReader(frame))
+		if err != nil {
+			return err
+		}
+		return p.EncodeImage(w, img, t)
+	case V4L2_PIX_FMT_YUYV:
+		if !filtering {
+			if stride > 0 && stride != width*2 {
+				p.packed = packRows(p.packed[:0], frame, stride, width*2, height)
+				frame = p.packed
+			}
+			return p.Encoder.EncodeYUYV(w, frame, width, height)
+		}
+	}
+
+	if p.conv == nil || p.conv.Format() != format || p.conv.Size() != image.Pt(width, height) || p.conv.Stride() != stride {
+		conv, err := NewConverter(format, width, height, stride)
+		if err != nil {
+			return err
+		}
+		p.conv = conv
+	}
+	return p.EncodeImage(w, p.conv.Convert(frame), t)
+}
+
+// EncodeImage applies the filters to img, which was
+// captured at t, and writes it as jpeg to w.
+func (p *Pipeline) EncodeImage(w io.Writer, img image.Image, t time.Time) error {
+	return p.Encoder.EncodeFrame(w, p.Filter(img, t))
+}
+
+// ScaleFilter scales frames to Width x Height with bilinear
+// interpolation. The scaled image is reused between frames.
+type ScaleFilter struct {
+	Width, Height int
+
+	dst *image.RGBA
+}
+
+func (s *ScaleFilter) Enabled() bool {
+	return s.Width > 0 && s.Height > 0
+}
+
+func (s *ScaleFilter) Apply(img image.Image, t time.Time) image.Image {
+	if img.Bounds().Size() == image.Pt(s.Width, s.Height) {
+		return img
+	}
+	if s.dst == nil || s.dst.Rect.Dx() != s.Width || s.dst.Rect.Dy() != s.Height {
+		s.dst = image.NewRGBA(image.Rect(0, 0, s.Width, s.Height))
+	}
+	draw.ApproxBiLinear.Scale(s.dst, s.dst.Rect, img, img.Bounds(), draw.Src, nil)
+	return s.dst
+}
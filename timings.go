@@ -0,0 +1,223 @@
+package webcam
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/blackjack/webcam/ioctl"
+	"golang.org/x/sys/unix"
+)
+
+// Status flags of an input
+const (
+	V4L2_IN_ST_NO_POWER  uint32 = 0x00000001
+	V4L2_IN_ST_NO_SIGNAL uint32 = 0x00000002
+	V4L2_IN_ST_NO_COLOR  uint32 = 0x00000004
+	V4L2_IN_ST_NO_H_LOCK uint32 = 0x00000100
+)
+
+// Capabilities of an input
+const (
+	V4L2_IN_CAP_DV_TIMINGS uint32 = 0x00000002
+	V4L2_IN_CAP_STD        uint32 = 0x00000004
+)
+
+const (
+	V4L2_DV_BT_656_1120 uint32 = 0 // type of BT.656/BT.1120 timings
+	V4L2_DV_INTERLACED  uint32 = 1
+)
+
+// Errors of QueryDVTimings and QueryStandard
+var (
+	ErrNoSignal         = errors.New("No signal")
+	ErrUnstableSignal   = errors.New("Signal is unstable")
+	ErrSignalOutOfRange = errors.New("Signal is out of range")
+)
+
+var (
+	VIDIOC_G_STD            = ioctl.IoR(uintptr('V'), 23, 8)
+	VIDIOC_S_STD            = ioctl.IoW(uintptr('V'), 24, 8)
+	VIDIOC_ENUMINPUT        = ioctl.IoRW(uintptr('V'), 26, unsafe.Sizeof(v4l2_input{}))
+	VIDIOC_QUERYSTD         = ioctl.IoR(uintptr('V'), 63, 8)
+	VIDIOC_S_DV_TIMINGS     = ioctl.IoRW(uintptr('V'), 87, unsafe.Sizeof(v4l2_dv_timings{}))
+	VIDIOC_G_DV_TIMINGS     = ioctl.IoRW(uintptr('V'), 88, unsafe.Sizeof(v4l2_dv_timings{}))
+	VIDIOC_QUERY_DV_TIMINGS = ioctl.IoR(uintptr('V'), 99, unsafe.Sizeof(v4l2_dv_timings{}))
+)
+
+type v4l2_input struct {
+	index        uint32
+	name         [32]uint8
+	_type        uint32
+	audioset     uint32
+	tuner        uint32
+	std          uint64
+	status       uint32
+	capabilities uint32
+	reserved     [3]uint32
+}
+
+// v4l2_dv_timings is packed, the fields of the
+// struct v4l2_bt_timings are read from bt
+type v4l2_dv_timings struct {
+	_type uint32
+	bt    [128]uint8
+}
+
+// Input describes the current input of a device.
+type Input struct {
+	Index        uint32
+	Name         string
+	Status       uint32 // V4L2_IN_ST_* flags
+	Capabilities uint32 // V4L2_IN_CAP_* flags
+}
+
+// HasSignal returns false if the input reports that
+// there is no power, no signal or no horizontal sync.
+func (in Input) HasSignal() bool {
+	return in.Status&(V4L2_IN_ST_NO_POWER|V4L2_IN_ST_NO_SIGNAL|V4L2_IN_ST_NO_H_LOCK) == 0
+}
+
+// DVTimings are the digital video timings of an input, e.g. of the
+// HDMI input of a capture card. They are queried from the signal with
+// QueryDVTimings and set with SetDVTimings.
+type DVTimings struct {
+	Width, Height  uint32
+	Interlaced     bool
+	PixelClock     uint64 // in Hz
+	HTotal, VTotal uint32 // frame size including blanking
+
+	raw v4l2_dv_timings
+}
+
+func newDVTimings(raw v4l2_dv_timings) DVTimings {
+	b := raw.bt[:]
+	u32 := func(offset int) uint32 { return NativeByteOrder.Uint32(b[offset:]) }
+
+	t := DVTimings{
+		Width:      u32(0),
+		Height:     u32(4),
+		Interlaced: u32(8) == V4L2_DV_INTERLACED,
+		PixelClock: NativeByteOrder.Uint64(b[16:]),
+		raw:        raw,
+	}
+	// front porch, sync and back porch
+	t.HTotal = t.Width + u32(24) + u32(28) + u32(32)
+	t.VTotal = t.Height + u32(36) + u32(40) + u32(44)
+	if t.Interlaced {
+		// blanking of the second field
+		t.VTotal += u32(48) + u32(52) + u32(56)
+	}
+	return t
+}
+
+// Framerate returns the number of frames per second,
+// or fields per second of interlaced timings.
+func (t DVTimings) Framerate() float32 {
+	if t.HTotal == 0 || t.VTotal == 0 {
+		return 0
+	}
+	rate := float32(t.PixelClock) / float32(t.HTotal) / float32(t.VTotal)
+	if t.Interlaced {
+		rate *= 2
+	}
+	return rate
+}
+
+// Equal returns true if the timings describe the same signal.
+func (t DVTimings) Equal(o DVTimings) bool {
+	return t.raw == o.raw
+}
+
+func (t DVTimings) String() string {
+	scan := "p"
+	if t.Interlaced {
+		scan = "i"
+	}
+	return fmt.Sprintf("%dx%d%s%.2f", t.Width, t.Height, scan, t.Framerate())
+}
+
+// QueryInput returns the current input and its status.
+func (w *Webcam) QueryInput() (Input, error) {
+	index, err := getInput(w.fd)
+	if err != nil {
+		return Input{}, err
+	}
+	in := &v4l2_input{index: uint32(index)}
+	if err := ioctl.Ioctl(w.fd, VIDIOC_ENUMINPUT, uintptr(unsafe.Pointer(in))); err != nil {
+		return Input{}, err
+	}
+	return Input{
+		Index:        in.index,
+		Name:         CToGoString(in.name[:]),
+		Status:       in.status,
+		Capabilities: in.capabilities,
+	}, nil
+}
+
+// QueryDVTimings detects the timings of the signal of the current input.
+// It returns ErrNoSignal, ErrUnstableSignal or ErrSignalOutOfRange if
+// the timings can't be detected. Streaming has to be stopped to change
+// the timings with SetDVTimings.
+func (w *Webcam) QueryDVTimings() (DVTimings, error) {
+	var raw v4l2_dv_timings
+	if err := ioctl.Ioctl(w.fd, VIDIOC_QUERY_DV_TIMINGS, uintptr(unsafe.Pointer(&raw))); err != nil {
+		return DVTimings{}, signalError(err)
+	}
+	return newDVTimings(raw), nil
+}
+
+// GetDVTimings returns the timings the current input is configured for.
+func (w *Webcam) GetDVTimings() (DVTimings, error) {
+	var raw v4l2_dv_timings
+	if err := ioctl.Ioctl(w.fd, VIDIOC_G_DV_TIMINGS, uintptr(unsafe.Pointer(&raw))); err != nil {
+		return DVTimings{}, err
+	}
+	return newDVTimings(raw), nil
+}
+
+// SetDVTimings configures the current input for timings, which
+// changes the frame size. It fails with EBUSY while streaming.
+func (w *Webcam) SetDVTimings(t DVTimings) error {
+	raw := t.raw
+	return ioctl.Ioctl(w.fd, VIDIOC_S_DV_TIMINGS, uintptr(unsafe.Pointer(&raw)))
+}
+
+// QueryStandard detects the analog video standards (V4L2_STD_* flags)
+// of the signal of the current input. It returns ErrNoSignal if the
+// standard can't be detected.
+func (w *Webcam) QueryStandard() (uint64, error) {
+	var std uint64
+	if err := ioctl.Ioctl(w.fd, VIDIOC_QUERYSTD, uintptr(unsafe.Pointer(&std))); err != nil {
+		return 0, signalError(err)
+	}
+	if std == 0 {
+		return 0, ErrNoSignal
+	}
+	return std, nil
+}
+
+// GetStandard returns the video standards the current input is configured for.
+func (w *Webcam) GetStandard() (uint64, error) {
+	var std uint64
+	err := ioctl.Ioctl(w.fd, VIDIOC_G_STD, uintptr(unsafe.Pointer(&std)))
+	return std, err
+}
+
+// SetStandard configures the current input for the video standards std.
+func (w *Webcam) SetStandard(std uint64) error {
+	return ioctl.Ioctl(w.fd, VIDIOC_S_STD, uintptr(unsafe.Pointer(&std)))
+}
+
+// signalError maps the errors of drivers which can't detect a signal.
+func signalError(err error) error {
+	switch err {
+	case unix.ENOLINK:
+		return ErrNoSignal
+	case unix.ENOLCK:
+		return ErrUnstableSignal
+	case unix.ERANGE:
+		return ErrSignalOutOfRange
+	}
+	return err
+}
@@ -0,0 +1,135 @@
+//go:build turbojpeg
+
+package webcam
+
+// #cgo LDFLAGS: -lturbojpeg
+// #include <stdlib.h>
+// #include <turbojpeg.h>
+import "C"
+
+import (
+	"errors"
+	"image"
+	"image/draw"
+	"io"
+	"unsafe"
+)
+
+// TurboJPEGEncoder encodes frames with libjpeg-turbo.
+// It is only available when building with the `turbojpeg` build tag.
+type TurboJPEGEncoder struct {
+	// Quality ranges from 1 to 100.
+	Quality int
+
+	// Progressive encodes progressive jpegs, which are rendered
+	// incrementally while they are loaded, but encode slower.
+	Progressive bool
+
+	handle C.tjhandle
+	planes []byte
+	rgba   *image.RGBA
+}
+
+// NewTurboJPEGEncoder returns an encoder with the given quality.
+// The encoder must be closed when it is no longer used.
+func NewTurboJPEGEncoder(quality int) (*TurboJPEGEncoder, error) {
+	handle := C.tjInitCompress()
+	if handle == nil {
+		return nil, errors.New("Failed to initialize libjpeg-turbo")
+	}
+
+	if quality <= 0 {
+		quality = 75
+	}
+
+	return &TurboJPEGEncoder{Quality: quality, handle: handle}, nil
+}
+
+// SetQuality sets the quality of subsequently encoded frames.
+func (e *TurboJPEGEncoder) SetQuality(quality int) error {
+	if quality <= 0 {
+		quality = 75
+	}
+	e.Quality = quality
+	return nil
+}
+
+func (e *TurboJPEGEncoder) EncodeYUYV(w io.Writer, frame []byte, width, height int) error {
+	// unpack the frame into consecutive Y, Cb and Cr planes
+	cw := (width + 1) / 2
+	if size := width*height + 2*cw*height; len(e.planes) != size {
+		e.planes = make([]byte, size)
+	}
+	img := &image.YCbCr{
+		Y:              e.planes[:width*height],
+		Cb:             e.planes[width*height : width*height+cw*height],
+		Cr:             e.planes[width*height+cw*height:],
+		YStride:        width,
+		CStride:        cw,
+		SubsampleRatio: image.YCbCrSubsampleRatio422,
+		Rect:           image.Rect(0, 0, width, height),
+	}
+	YUYVToYCbCr(img, frame, 0)
+
+	var buf *C.uchar
+	var size C.ulong
+	ret := C.tjCompressFromYUV(e.handle, (*C.uchar)(unsafe.Pointer(&e.planes[0])), C.int(width), 1, C.int(height),
+		C.TJSAMP_422, &buf, &size, C.int(e.Quality), e.flags())
+
+	return e.write(w, ret, buf, size)
+}
+
+func (e *TurboJPEGEncoder) EncodeFrame(w io.Writer, img image.Image) error {
+	rgba, ok := img.(*image.RGBA)
+	if !ok {
+		b := img.Bounds()
+		if e.rgba == nil || e.rgba.Rect != b {
+			e.rgba = image.NewRGBA(b)
+		}
+		draw.Draw(e.rgba, b, img, b.Min, draw.Src)
+		rgba = e.rgba
+	}
+
+	b := rgba.Bounds()
+	if b.Empty() {
+		return errors.New("Empty image")
+	}
+
+	var buf *C.uchar
+	var size C.ulong
+	ret := C.tjCompress2(e.handle, (*C.uchar)(unsafe.Pointer(&rgba.Pix[rgba.PixOffset(b.Min.X, b.Min.Y)])),
+		C.int(b.Dx()), C.int(rgba.Stride), C.int(b.Dy()), C.TJPF_RGBA,
+		&buf, &size, C.TJSAMP_420, C.int(e.Quality), e.flags())
+
+	return e.write(w, ret, buf, size)
+}
+
+// flags returns the flags of the compression functions.
+func (e *TurboJPEGEncoder) flags() C.int {
+	if e.Progressive {
+		return C.TJFLAG_FASTDCT | C.TJFLAG_PROGRESSIVE
+	}
+	return C.TJFLAG_FASTDCT
+}
+
+// write writes the compressed image to w and frees the buffer.
+func (e *TurboJPEGEncoder) write(w io.Writer, ret C.int, buf *C.uchar, size C.ulong) error {
+	if buf != nil {
+		defer C.tjFree(buf)
+	}
+
+	if ret != 0 {
+		return errors.New(C.GoString(C.tjGetErrorStr2(e.handle)))
+	}
+
+	_, err := w.Write(unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(size)))
+	return err
+}
+
+// Close releases the resources of the encoder.
+func (e *TurboJPEGEncoder) Close() error {
+	if C.tjDestroy(e.handle) != 0 {
+		return errors.New(C.GoString(C.tjGetErrorStr2(e.handle)))
+	}
+	return nil
+}
@@ -35,10 +35,19 @@ type control struct {
 
 const (
 	V4L2_CAP_VIDEO_CAPTURE      uint32 = 0x00000001
+	V4L2_CAP_VIDEO_OUTPUT       uint32 = 0x00000002
+	V4L2_CAP_VIDEO_M2M          uint32 = 0x00008000
+	V4L2_CAP_META_CAPTURE       uint32 = 0x00800000
+	V4L2_CAP_READWRITE          uint32 = 0x01000000
 	V4L2_CAP_STREAMING          uint32 = 0x04000000
 	V4L2_BUF_TYPE_VIDEO_CAPTURE uint32 = 1
+	V4L2_BUF_TYPE_VIDEO_OUTPUT  uint32 = 2
+	V4L2_BUF_TYPE_META_CAPTURE  uint32 = 13
 	V4L2_MEMORY_MMAP            uint32 = 1
+	V4L2_MEMORY_USERPTR         uint32 = 2
+	V4L2_MEMORY_DMABUF          uint32 = 4
 	V4L2_FIELD_ANY              uint32 = 0
+	V4L2_FIELD_NONE             uint32 = 1
 )
 
 const (
@@ -54,9 +63,39 @@ const (
 )
 
 const (
-	V4L2_CID_BASE               uint32 = 0x00980900
-	V4L2_CID_AUTO_WHITE_BALANCE uint32 = V4L2_CID_BASE + 12
-	V4L2_CID_PRIVATE_BASE       uint32 = 0x08000000
+	V4L2_SEL_TGT_CROP         uint32 = 0x0000
+	V4L2_SEL_TGT_CROP_DEFAULT uint32 = 0x0001
+	V4L2_SEL_TGT_CROP_BOUNDS  uint32 = 0x0002
+)
+
+const (
+	V4L2_CID_BASE                      uint32 = 0x00980900
+	V4L2_CID_BRIGHTNESS                uint32 = V4L2_CID_BASE + 0
+	V4L2_CID_CONTRAST                  uint32 = V4L2_CID_BASE + 1
+	V4L2_CID_SATURATION                uint32 = V4L2_CID_BASE + 2
+	V4L2_CID_HUE                       uint32 = V4L2_CID_BASE + 3
+	V4L2_CID_AUTO_WHITE_BALANCE        uint32 = V4L2_CID_BASE + 12
+	V4L2_CID_GAIN                      uint32 = V4L2_CID_BASE + 19
+	V4L2_CID_HFLIP                     uint32 = V4L2_CID_BASE + 20
+	V4L2_CID_VFLIP                     uint32 = V4L2_CID_BASE + 21
+	V4L2_CID_POWER_LINE_FREQUENCY      uint32 = V4L2_CID_BASE + 24
+	V4L2_CID_WHITE_BALANCE_TEMPERATURE uint32 = V4L2_CID_BASE + 26
+	V4L2_CID_SHARPNESS                 uint32 = V4L2_CID_BASE + 27
+	V4L2_CID_BACKLIGHT_COMPENSATION    uint32 = V4L2_CID_BASE + 28
+	V4L2_CID_PRIVATE_BASE              uint32 = 0x08000000
+
+	V4L2_CID_CAMERA_CLASS_BASE      uint32 = 0x009a0900
+	V4L2_CID_EXPOSURE_AUTO          uint32 = V4L2_CID_CAMERA_CLASS_BASE + 1
+	V4L2_CID_EXPOSURE_ABSOLUTE      uint32 = V4L2_CID_CAMERA_CLASS_BASE + 2
+	V4L2_CID_EXPOSURE_AUTO_PRIORITY uint32 = V4L2_CID_CAMERA_CLASS_BASE + 3
+	V4L2_CID_FOCUS_ABSOLUTE         uint32 = V4L2_CID_CAMERA_CLASS_BASE + 10
+	V4L2_CID_FOCUS_RELATIVE         uint32 = V4L2_CID_CAMERA_CLASS_BASE + 11
+	V4L2_CID_FOCUS_AUTO             uint32 = V4L2_CID_CAMERA_CLASS_BASE + 12
+	V4L2_CID_AUTO_FOCUS_START       uint32 = V4L2_CID_CAMERA_CLASS_BASE + 28
+	V4L2_CID_AUTO_FOCUS_STOP        uint32 = V4L2_CID_CAMERA_CLASS_BASE + 29
+
+	V4L2_CID_JPEG_CLASS_BASE          uint32 = 0x009d0900
+	V4L2_CID_JPEG_COMPRESSION_QUALITY uint32 = V4L2_CID_JPEG_CLASS_BASE + 3
 )
 
 const (
@@ -81,13 +120,21 @@ const (
 	V4L2_CTRL_FLAG_NEXT_CTRL uint32 = 0x80000000
 )
 
+const (
+	V4L2_BUF_FLAG_ERROR               uint32 = 0x00000040
+	V4L2_BUF_FLAG_TIMESTAMP_MASK      uint32 = 0x0000e000
+	V4L2_BUF_FLAG_TIMESTAMP_MONOTONIC uint32 = 0x00002000
+)
+
 var (
 	VIDIOC_QUERYCAP  = ioctl.IoR(uintptr('V'), 0, unsafe.Sizeof(v4l2_capability{}))
 	VIDIOC_ENUM_FMT  = ioctl.IoRW(uintptr('V'), 2, unsafe.Sizeof(v4l2_fmtdesc{}))
+	VIDIOC_G_FMT     = ioctl.IoRW(uintptr('V'), 4, unsafe.Sizeof(v4l2_format{}))
 	VIDIOC_S_FMT     = ioctl.IoRW(uintptr('V'), 5, unsafe.Sizeof(v4l2_format{}))
 	VIDIOC_REQBUFS   = ioctl.IoRW(uintptr('V'), 8, unsafe.Sizeof(v4l2_requestbuffers{}))
 	VIDIOC_QUERYBUF  = ioctl.IoRW(uintptr('V'), 9, unsafe.Sizeof(v4l2_buffer{}))
 	VIDIOC_QBUF      = ioctl.IoRW(uintptr('V'), 15, unsafe.Sizeof(v4l2_buffer{}))
+	VIDIOC_EXPBUF    = ioctl.IoRW(uintptr('V'), 16, unsafe.Sizeof(v4l2_exportbuffer{}))
 	VIDIOC_DQBUF     = ioctl.IoRW(uintptr('V'), 17, unsafe.Sizeof(v4l2_buffer{}))
 	VIDIOC_G_PARM    = ioctl.IoRW(uintptr('V'), 21, unsafe.Sizeof(v4l2_streamparm{}))
 	VIDIOC_S_PARM    = ioctl.IoRW(uintptr('V'), 22, unsafe.Sizeof(v4l2_streamparm{}))
@@ -101,6 +148,8 @@ var (
 	VIDIOC_S_INPUT             = ioctl.IoRW(uintptr('V'), 39, 4)
 	VIDIOC_ENUM_FRAMESIZES     = ioctl.IoRW(uintptr('V'), 74, unsafe.Sizeof(v4l2_frmsizeenum{}))
 	VIDIOC_ENUM_FRAMEINTERVALS = ioctl.IoRW(uintptr('V'), 75, unsafe.Sizeof(v4l2_frmivalenum{}))
+	VIDIOC_G_SELECTION         = ioctl.IoRW(uintptr('V'), 94, unsafe.Sizeof(v4l2_selection{}))
+	VIDIOC_S_SELECTION         = ioctl.IoRW(uintptr('V'), 95, unsafe.Sizeof(v4l2_selection{}))
 	__p                        = unsafe.Pointer(uintptr(0))
 	NativeByteOrder            = getNativeByteOrder()
 )
@@ -215,6 +264,15 @@ type v4l2_buffer struct {
 	reserved  uint32
 }
 
+type v4l2_exportbuffer struct {
+	_type    uint32
+	index    uint32
+	plane    uint32
+	flags    uint32
+	fd       int32
+	reserved [11]uint32
+}
+
 type v4l2_timecode struct {
 	_type    uint32
 	flags    uint32
@@ -242,6 +300,21 @@ type v4l2_control struct {
 	value int32
 }
 
+type v4l2_rect struct {
+	left   int32
+	top    int32
+	width  uint32
+	height uint32
+}
+
+type v4l2_selection struct {
+	_type    uint32
+	target   uint32
+	flags    uint32
+	r        v4l2_rect
+	reserved [9]uint32
+}
+
 type v4l2_fract struct {
 	Numerator   uint32
 	Denominator uint32
@@ -264,20 +337,27 @@ type v4l2_streamparm struct {
 
 func checkCapabilities(fd uintptr) (supportsVideoCapture bool, supportsVideoStreaming bool, err error) {
 
-	caps := &v4l2_capability{}
-
-	err = ioctl.Ioctl(fd, VIDIOC_QUERYCAP, uintptr(unsafe.Pointer(caps)))
+	caps, err := getCapabilities(fd)
 
 	if err != nil {
 		return
 	}
 
-	supportsVideoCapture = (caps.capabilities & V4L2_CAP_VIDEO_CAPTURE) != 0
-	supportsVideoStreaming = (caps.capabilities & V4L2_CAP_STREAMING) != 0
+	supportsVideoCapture = (caps & V4L2_CAP_VIDEO_CAPTURE) != 0
+	supportsVideoStreaming = (caps & V4L2_CAP_STREAMING) != 0
 	return
 
 }
 
+func getCapabilities(fd uintptr) (uint32, error) {
+	caps := &v4l2_capability{}
+	if err := ioctl.Ioctl(fd, VIDIOC_QUERYCAP, uintptr(unsafe.Pointer(caps))); err != nil {
+		return 0, err
+	}
+
+	return caps.capabilities, nil
+}
+
 func getPixelFormat(fd uintptr, index uint32) (code uint32, description string, err error) {
 
 	fmtdesc := &v4l2_fmtdesc{}
@@ -326,9 +406,8 @@ func getFrameSize(fd uintptr, index uint32, code uint32) (frameSize FrameSize, e
 		frameSize.MaxHeight = discrete.Height
 		frameSize.StepHeight = 0
 
-	case V4L2_FRMSIZE_TYPE_CONTINUOUS:
-
-	case V4L2_FRMSIZE_TYPE_STEPWISE:
+	// continuous sizes are reported as stepwise sizes with a step of 1
+	case V4L2_FRMSIZE_TYPE_CONTINUOUS, V4L2_FRMSIZE_TYPE_STEPWISE:
 		stepwise := &v4l2_frmsize_stepwise{}
 		err = binary.Read(bytes.NewBuffer(frmsizeenum.union[:]), NativeByteOrder, stepwise)
 
@@ -414,10 +493,31 @@ func getBusInfo(fd uintptr) (string, error) {
 	return CToGoString(caps.bus_info[:]), nil
 }
 
+// getImageFormat returns the current format of captured images.
+func getImageFormat(fd uintptr) (*v4l2_pix_format, error) {
+	format := &v4l2_format{
+		_type: V4L2_BUF_TYPE_VIDEO_CAPTURE,
+	}
+
+	if err := ioctl.Ioctl(fd, VIDIOC_G_FMT, uintptr(unsafe.Pointer(format))); err != nil {
+		return nil, err
+	}
+
+	pix := &v4l2_pix_format{}
+	if err := binary.Read(bytes.NewBuffer(format.union.data[:]), NativeByteOrder, pix); err != nil {
+		return nil, err
+	}
+	return pix, nil
+}
+
 func setImageFormat(fd uintptr, formatcode *uint32, width *uint32, height *uint32) (err error) {
+	return setFormat(fd, V4L2_BUF_TYPE_VIDEO_CAPTURE, formatcode, width, height)
+}
+
+func setFormat(fd uintptr, bufType uint32, formatcode *uint32, width *uint32, height *uint32) (err error) {
 
 	format := &v4l2_format{
-		_type: V4L2_BUF_TYPE_VIDEO_CAPTURE,
+		_type: bufType,
 	}
 
 	pix := v4l2_pix_format{
@@ -458,11 +558,23 @@ func setImageFormat(fd uintptr, formatcode *uint32, width *uint32, height *uint3
 }
 
 func mmapRequestBuffers(fd uintptr, buf_count *uint32) (err error) {
+	return requestBuffers(fd, V4L2_BUF_TYPE_VIDEO_CAPTURE, buf_count)
+}
+
+func userptrRequestBuffers(fd uintptr, buf_count *uint32) (err error) {
+	return requestBuffersMemory(fd, V4L2_BUF_TYPE_VIDEO_CAPTURE, V4L2_MEMORY_USERPTR, buf_count)
+}
+
+func requestBuffers(fd uintptr, bufType uint32, buf_count *uint32) (err error) {
+	return requestBuffersMemory(fd, bufType, V4L2_MEMORY_MMAP, buf_count)
+}
+
+func requestBuffersMemory(fd uintptr, bufType uint32, memory uint32, buf_count *uint32) (err error) {
 
 	req := &v4l2_requestbuffers{}
 	req.count = *buf_count
-	req._type = V4L2_BUF_TYPE_VIDEO_CAPTURE
-	req.memory = V4L2_MEMORY_MMAP
+	req._type = bufType
+	req.memory = memory
 
 	err = ioctl.Ioctl(fd, VIDIOC_REQBUFS, uintptr(unsafe.Pointer(req)))
 
@@ -477,10 +589,14 @@ func mmapRequestBuffers(fd uintptr, buf_count *uint32) (err error) {
 }
 
 func mmapQueryBuffer(fd uintptr, index uint32, length *uint32) (buffer []byte, err error) {
+	return queryBuffer(fd, V4L2_BUF_TYPE_VIDEO_CAPTURE, index, length)
+}
+
+func queryBuffer(fd uintptr, bufType uint32, index uint32, length *uint32) (buffer []byte, err error) {
 
 	req := &v4l2_buffer{}
 
-	req._type = V4L2_BUF_TYPE_VIDEO_CAPTURE
+	req._type = bufType
 	req.memory = V4L2_MEMORY_MMAP
 	req.index = index
 
@@ -504,13 +620,12 @@ func mmapQueryBuffer(fd uintptr, index uint32, length *uint32) (buffer []byte, e
 }
 
 func mmapDequeueBuffer(fd uintptr, index *uint32, length *uint32) (err error) {
+	return dequeueBuffer(fd, V4L2_BUF_TYPE_VIDEO_CAPTURE, index, length)
+}
 
-	buffer := &v4l2_buffer{}
-
-	buffer._type = V4L2_BUF_TYPE_VIDEO_CAPTURE
-	buffer.memory = V4L2_MEMORY_MMAP
+func dequeueBuffer(fd uintptr, bufType uint32, index *uint32, length *uint32) (err error) {
 
-	err = ioctl.Ioctl(fd, VIDIOC_DQBUF, uintptr(unsafe.Pointer(buffer)))
+	buffer, err := dequeue(fd, bufType, V4L2_MEMORY_MMAP)
 
 	if err != nil {
 		return
@@ -523,35 +638,92 @@ func mmapDequeueBuffer(fd uintptr, index *uint32, length *uint32) (err error) {
 
 }
 
+// dequeue dequeues a buffer and returns it with all its metadata.
+func dequeue(fd uintptr, bufType uint32, memory uint32) (*v4l2_buffer, error) {
+	buffer := &v4l2_buffer{
+		_type:  bufType,
+		memory: memory,
+	}
+	err := ioctl.Ioctl(fd, VIDIOC_DQBUF, uintptr(unsafe.Pointer(buffer)))
+	return buffer, err
+}
+
 func mmapEnqueueBuffer(fd uintptr, index uint32) (err error) {
+	return enqueueBuffer(fd, V4L2_BUF_TYPE_VIDEO_CAPTURE, index, 0)
+}
+
+// enqueueBuffer queues a buffer. The number of bytes used
+// is only relevant for output buffers.
+func enqueueBuffer(fd uintptr, bufType uint32, index uint32, bytesused uint32) (err error) {
 
 	buffer := &v4l2_buffer{}
 
-	buffer._type = V4L2_BUF_TYPE_VIDEO_CAPTURE
+	buffer._type = bufType
 	buffer.memory = V4L2_MEMORY_MMAP
 	buffer.index = index
+	if bufType == V4L2_BUF_TYPE_VIDEO_OUTPUT {
+		buffer.bytesused = bytesused
+		buffer.field = V4L2_FIELD_NONE
+	}
 
 	err = ioctl.Ioctl(fd, VIDIOC_QBUF, uintptr(unsafe.Pointer(buffer)))
 	return
 
 }
 
+// userptrEnqueueBuffer queues buf, which was allocated by the process.
+func userptrEnqueueBuffer(fd uintptr, index uint32, buf []byte) (err error) {
+
+	buffer := &v4l2_buffer{}
+
+	buffer._type = V4L2_BUF_TYPE_VIDEO_CAPTURE
+	buffer.memory = V4L2_MEMORY_USERPTR
+	buffer.index = index
+	buffer.length = uint32(len(buf))
+	*(*uintptr)(unsafe.Pointer(&buffer.union)) = uintptr(unsafe.Pointer(&buf[0]))
+
+	err = ioctl.Ioctl(fd, VIDIOC_QBUF, uintptr(unsafe.Pointer(buffer)))
+	return
+
+}
+
+// exportBuffer exports a memory mapped buffer as dma-buf file descriptor.
+func exportBuffer(fd uintptr, index uint32) (int, error) {
+	exp := &v4l2_exportbuffer{
+		_type: V4L2_BUF_TYPE_VIDEO_CAPTURE,
+		index: index,
+		flags: unix.O_CLOEXEC | unix.O_RDWR,
+	}
+	if err := ioctl.Ioctl(fd, VIDIOC_EXPBUF, uintptr(unsafe.Pointer(exp))); err != nil {
+		return -1, err
+	}
+	return int(exp.fd), nil
+}
+
 func mmapReleaseBuffer(buffer []byte) (err error) {
 	err = unix.Munmap(buffer)
 	return
 }
 
 func startStreaming(fd uintptr) (err error) {
+	return streamOn(fd, V4L2_BUF_TYPE_VIDEO_CAPTURE)
+}
+
+func streamOn(fd uintptr, bufType uint32) (err error) {
 
-	var uintPointer uint32 = V4L2_BUF_TYPE_VIDEO_CAPTURE
+	var uintPointer uint32 = bufType
 	err = ioctl.Ioctl(fd, VIDIOC_STREAMON, uintptr(unsafe.Pointer(&uintPointer)))
 	return
 
 }
 
 func stopStreaming(fd uintptr) (err error) {
+	return streamOff(fd, V4L2_BUF_TYPE_VIDEO_CAPTURE)
+}
+
+func streamOff(fd uintptr, bufType uint32) (err error) {
 
-	var uintPointer uint32 = V4L2_BUF_TYPE_VIDEO_CAPTURE
+	var uintPointer uint32 = bufType
 	err = ioctl.Ioctl(fd, VIDIOC_STREAMOFF, uintptr(unsafe.Pointer(&uintPointer)))
 	return
 
@@ -592,6 +764,26 @@ func setControl(fd uintptr, id uint32, val int32) error {
 	return ioctl.Ioctl(fd, VIDIOC_S_CTRL, uintptr(unsafe.Pointer(ctrl)))
 }
 
+func getSelection(fd uintptr, target uint32) (left, top int32, width, height uint32, err error) {
+	sel := &v4l2_selection{}
+	sel._type = V4L2_BUF_TYPE_VIDEO_CAPTURE
+	sel.target = target
+	err = ioctl.Ioctl(fd, VIDIOC_G_SELECTION, uintptr(unsafe.Pointer(sel)))
+	return sel.r.left, sel.r.top, sel.r.width, sel.r.height, err
+}
+
+func setSelection(fd uintptr, target uint32, left, top *int32, width, height *uint32) error {
+	sel := &v4l2_selection{}
+	sel._type = V4L2_BUF_TYPE_VIDEO_CAPTURE
+	sel.target = target
+	sel.r = v4l2_rect{left: *left, top: *top, width: *width, height: *height}
+	if err := ioctl.Ioctl(fd, VIDIOC_S_SELECTION, uintptr(unsafe.Pointer(sel))); err != nil {
+		return err
+	}
+	*left, *top, *width, *height = sel.r.left, sel.r.top, sel.r.width, sel.r.height
+	return nil
+}
+
 func getInput(fd uintptr) (index int32, err error) {
 	err = ioctl.Ioctl(fd, VIDIOC_G_INPUT, uintptr(unsafe.Pointer(&index)))
 	return
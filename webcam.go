@@ -5,7 +5,9 @@ package webcam
 
 import (
 	"errors"
+	"image"
 	"reflect"
+	"time"
 	"unsafe"
 
 	"golang.org/x/sys/unix"
@@ -13,10 +15,38 @@ import (
 
 // Webcam object
 type Webcam struct {
-	fd        uintptr
-	bufcount  uint32
-	buffers   [][]byte
-	streaming bool
+	fd           uintptr
+	bufcount     uint32
+	buffers      [][]byte
+	dmabufs      []int
+	mode         BufferMode
+	sequence     uint32 // frames read in BufferModeRead
+	streaming    bool
+	frameTimeout time.Duration
+}
+
+// BufferMode is the I/O method used to exchange frame buffers with the driver.
+type BufferMode int
+
+const (
+	// Buffers are allocated by the driver and memory mapped (default)
+	BufferModeMMAP BufferMode = iota
+	// Buffers are allocated by the process and filled by the driver
+	BufferModeUserPtr
+	// Buffers are memory mapped and additionally exported as dma-buf
+	// file descriptors, which can be passed to hardware encoders or
+	// GPU pipelines without copying the frame
+	BufferModeDMABUF
+	// Frames are copied into a single buffer with read(),
+	// used for devices which don't support streaming I/O
+	BufferModeRead
+)
+
+func (m BufferMode) memory() uint32 {
+	if m == BufferModeUserPtr {
+		return V4L2_MEMORY_USERPTR
+	}
+	return V4L2_MEMORY_MMAP
 }
 
 type ControlID uint32
@@ -41,23 +71,29 @@ func Open(path string) (*Webcam, error) {
 		return nil, err
 	}
 
-	supportsVideoCapture, supportsVideoStreaming, err := checkCapabilities(fd)
+	caps, err := getCapabilities(fd)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if !supportsVideoCapture {
+	if caps&V4L2_CAP_VIDEO_CAPTURE == 0 {
 		return nil, errors.New("Not a video capture device")
 	}
 
-	if !supportsVideoStreaming {
-		return nil, errors.New("Device does not support the streaming I/O method")
-	}
-
 	w := new(Webcam)
 	w.fd = fd
 	w.bufcount = 256
+	w.frameTimeout = 5 * time.Second
+
+	if caps&V4L2_CAP_STREAMING == 0 {
+		if caps&V4L2_CAP_READWRITE == 0 {
+			return nil, errors.New("Device does not support the streaming or read I/O method")
+		}
+		// fall back to read() for devices without streaming I/O
+		w.mode = BufferModeRead
+	}
+
 	return w, nil
 }
 
@@ -202,6 +238,37 @@ func (w *Webcam) SetControl(id ControlID, value int32) error {
 	return setControl(w.fd, uint32(id), value)
 }
 
+// Get the crop rectangle of the device.
+func (w *Webcam) GetCrop() (image.Rectangle, error) {
+	return w.getSelection(V4L2_SEL_TGT_CROP)
+}
+
+// Get the default crop rectangle of the device, which
+// usually covers the whole picture.
+func (w *Webcam) GetDefaultCrop() (image.Rectangle, error) {
+	return w.getSelection(V4L2_SEL_TGT_CROP_DEFAULT)
+}
+
+// Set the crop rectangle of the device. The device may adjust
+// the rectangle, the resulting rectangle is returned.
+// Devices with a scaler scale the cropped picture to the frame size.
+func (w *Webcam) SetCrop(r image.Rectangle) (image.Rectangle, error) {
+	left, top := int32(r.Min.X), int32(r.Min.Y)
+	width, height := uint32(r.Dx()), uint32(r.Dy())
+	if err := setSelection(w.fd, V4L2_SEL_TGT_CROP, &left, &top, &width, &height); err != nil {
+		return image.Rectangle{}, err
+	}
+	return image.Rect(int(left), int(top), int(left)+int(width), int(top)+int(height)), nil
+}
+
+func (w *Webcam) getSelection(target uint32) (image.Rectangle, error) {
+	left, top, width, height, err := getSelection(w.fd, target)
+	if err != nil {
+		return image.Rectangle{}, err
+	}
+	return image.Rect(int(left), int(top), int(left)+int(width), int(top)+int(height)), nil
+}
+
 // Get the framerate.
 func (w *Webcam) GetFramerate() (float32, error) {
 	return getFramerate(w.fd)
@@ -212,12 +279,47 @@ func (w *Webcam) SetFramerate(fps float32) error {
 	return setFramerate(w.fd, 1000, uint32(1000*(fps)))
 }
 
+// Set the I/O method used for frame buffers.
+// Not allowed if streaming is already on.
+// Devices without streaming I/O always use BufferModeRead.
+func (w *Webcam) SetBufferMode(mode BufferMode) error {
+	if w.streaming {
+		return errors.New("Cannot set buffer mode when streaming")
+	}
+	if w.mode == BufferModeRead && mode != BufferModeRead {
+		return errors.New("Device does not support the streaming I/O method")
+	}
+	w.mode = mode
+	return nil
+}
+
+// Returns the I/O method used for frame buffers
+func (w *Webcam) GetBufferMode() BufferMode {
+	return w.mode
+}
+
+// Returns the dma-buf file descriptor of the buffer with the given index.
+// Only available in BufferModeDMABUF while streaming.
+func (w *Webcam) GetBufferFD(index uint32) (int, error) {
+	if int(index) >= len(w.dmabufs) {
+		return -1, errors.New("Buffer not exported")
+	}
+	return w.dmabufs[index], nil
+}
+
 // Start streaming process
 func (w *Webcam) StartStreaming() error {
 	if w.streaming {
 		return errors.New("Already streaming")
 	}
 
+	switch w.mode {
+	case BufferModeUserPtr:
+		return w.startUserPtrStreaming()
+	case BufferModeRead:
+		return w.startReading()
+	}
+
 	err := mmapRequestBuffers(w.fd, &w.bufcount)
 
 	if err != nil {
@@ -235,11 +337,69 @@ func (w *Webcam) StartStreaming() error {
 		}
 
 		w.buffers[index] = buffer
+
+		if w.mode == BufferModeDMABUF {
+			fd, err := exportBuffer(w.fd, uint32(index))
+
+			if err != nil {
+				return errors.New("Failed to export buffer: " + string(err.Error()))
+			}
+
+			w.dmabufs = append(w.dmabufs, fd)
+		}
+	}
+
+	return w.enqueueAndStart()
+}
+
+// startUserPtrStreaming allocates the buffers and starts streaming
+// in BufferModeUserPtr.
+func (w *Webcam) startUserPtrStreaming() error {
+	err := userptrRequestBuffers(w.fd, &w.bufcount)
+
+	if err != nil {
+		return errors.New("Failed to request user pointer buffers: " + string(err.Error()))
+	}
+
+	pix, err := getImageFormat(w.fd)
+
+	if err != nil {
+		return errors.New("Failed to get image format: " + string(err.Error()))
+	}
+
+	w.buffers = make([][]byte, w.bufcount, w.bufcount)
+	for index, _ := range w.buffers {
+		// anonymous mappings are page aligned as required by some drivers
+		buffer, err := unix.Mmap(-1, 0, int(pix.Sizeimage), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS)
+
+		if err != nil {
+			return errors.New("Failed to allocate buffer: " + string(err.Error()))
+		}
+
+		w.buffers[index] = buffer
 	}
 
+	return w.enqueueAndStart()
+}
+
+// startReading allocates the buffer for BufferModeRead.
+func (w *Webcam) startReading() error {
+	pix, err := getImageFormat(w.fd)
+
+	if err != nil {
+		return errors.New("Failed to get image format: " + string(err.Error()))
+	}
+
+	w.buffers = [][]byte{make([]byte, pix.Sizeimage)}
+	w.streaming = true
+
+	return nil
+}
+
+func (w *Webcam) enqueueAndStart() error {
 	for index, _ := range w.buffers {
 
-		err := mmapEnqueueBuffer(w.fd, uint32(index))
+		err := w.ReleaseFrame(uint32(index))
 
 		if err != nil {
 			return errors.New("Failed to enqueue buffer: " + string(err.Error()))
@@ -247,7 +407,7 @@ func (w *Webcam) StartStreaming() error {
 
 	}
 
-	err = startStreaming(w.fd)
+	err := startStreaming(w.fd)
 
 	if err != nil {
 		return errors.New("Failed to start streaming: " + string(err.Error()))
@@ -273,21 +433,46 @@ func (w *Webcam) ReadFrame() ([]byte, error) {
 // If frame cannot be read at the moment
 // function will return empty slice
 func (w *Webcam) GetFrame() ([]byte, uint32, error) {
-	var index uint32
-	var length uint32
-
-	err := mmapDequeueBuffer(w.fd, &index, &length)
+	buffer, err := w.dequeue()
 
 	if err != nil {
 		return nil, 0, err
 	}
 
-	return w.buffers[int(index)][:length], index, nil
+	return w.buffers[int(buffer.index)][:buffer.bytesused], buffer.index, nil
+
+}
+
+// dequeue returns the next filled buffer.
+// In BufferModeRead the frame is read into the single buffer
+// and the metadata is filled in.
+func (w *Webcam) dequeue() (*v4l2_buffer, error) {
+	if w.mode != BufferModeRead {
+		return dequeue(w.fd, V4L2_BUF_TYPE_VIDEO_CAPTURE, w.mode.memory())
+	}
+
+	n, err := unix.Read(int(w.fd), w.buffers[0])
 
+	if err != nil {
+		return nil, err
+	}
+
+	w.sequence++
+	return &v4l2_buffer{
+		bytesused: uint32(n),
+		sequence:  w.sequence - 1,
+		timestamp: unix.NsecToTimeval(time.Now().UnixNano()),
+	}, nil
 }
 
 // Release the frame buffer that was obtained via GetFrame
 func (w *Webcam) ReleaseFrame(index uint32) error {
+	switch w.mode {
+	case BufferModeUserPtr:
+		return userptrEnqueueBuffer(w.fd, index, w.buffers[index])
+	case BufferModeRead:
+		return nil
+	}
 	return mmapEnqueueBuffer(w.fd, index)
 }
 
@@ -310,14 +495,35 @@ func (w *Webcam) StopStreaming() error {
 		return errors.New("Request to stop streaming when not streaming")
 	}
 	w.streaming = false
+
+	if w.mode == BufferModeRead {
+		w.buffers = nil
+		return nil
+	}
+
+	// user pointer buffers must not be freed while the driver uses them
+	err := stopStreaming(w.fd)
+
+	for _, fd := range w.dmabufs {
+		unix.Close(fd)
+	}
+	w.dmabufs = nil
+
 	for _, buffer := range w.buffers {
-		err := mmapReleaseBuffer(buffer)
-		if err != nil {
+		if err := mmapReleaseBuffer(buffer); err != nil {
 			return err
 		}
 	}
+	w.buffers = nil
 
-	return stopStreaming(w.fd)
+	// free the buffers of the driver, otherwise
+	// the image format can't be changed anymore
+	var count uint32
+	if rerr := requestBuffersMemory(w.fd, V4L2_BUF_TYPE_VIDEO_CAPTURE, w.mode.memory(), &count); err == nil {
+		err = rerr
+	}
+
+	return err
 }
 
 // Close the device